@@ -0,0 +1,158 @@
+package benchmark
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// 模擬一般聊天室的消息
+func benchmarkMessage() storage.ChatMessage {
+	return storage.ChatMessage{
+		RoomID:    "3f1c2a9e-5b7d-4c1e-9a2f-8d6b4e0c1a7f",
+		SenderID:  "b2e4c6a8-1d3f-4a5b-8c7d-9e0f1a2b3c4d",
+		Sender:    "benchmark_user",
+		Content:   "今天下午三點的會議改到四點，大家記得更新行事曆 👍",
+		Timestamp: time.Now(),
+	}
+}
+
+// 測試各種編碼序列化 ChatMessage 的性能與大小
+func BenchmarkCodecMarshalMessage(b *testing.B) {
+	msg := benchmarkMessage()
+
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack, codec.Protobuf} {
+		b.Run(c.Name(), func(b *testing.B) {
+			var size int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, err := c.Marshal(msg)
+				if err != nil {
+					b.Fatalf("序列化失敗: %v", err)
+				}
+				size = len(data)
+			}
+			b.ReportMetric(float64(size), "bytes/msg")
+		})
+	}
+}
+
+// 測試各種編碼反序列化 ChatMessage 的性能
+func BenchmarkCodecUnmarshalMessage(b *testing.B) {
+	msg := benchmarkMessage()
+
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack, codec.Protobuf} {
+		data, err := c.Marshal(msg)
+		if err != nil {
+			b.Fatalf("序列化失敗: %v", err)
+		}
+
+		b.Run(c.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var out storage.ChatMessage
+				if err := c.Unmarshal(data, &out); err != nil {
+					b.Fatalf("反序列化失敗: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// 測試 EventBus 發布到 NATS 的事件 payload 編碼
+func BenchmarkCodecMarshalEvent(b *testing.B) {
+	msg := benchmarkMessage()
+	event := types.NewEnvelope(types.EventTypeNewMessage, msg.RoomID, msg.SenderID, msg)
+
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack} {
+		b.Run(c.Name(), func(b *testing.B) {
+			var size int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, err := c.Marshal(event)
+				if err != nil {
+					b.Fatalf("序列化失敗: %v", err)
+				}
+				size = len(data)
+			}
+			b.ReportMetric(float64(size), "bytes/event")
+		})
+	}
+}
+
+// 測試 permessage-deflate 對 WebSocket 寫入的影響 (本機 httptest 伺服器，不需要啟動 SettleChat)
+func BenchmarkWebSocketCompression(b *testing.B) {
+	// 較長的消息比較能看出壓縮的效果
+	msg := benchmarkMessage()
+	msg.Content = strings.Repeat(msg.Content, 8)
+
+	for _, compress := range []bool{false, true} {
+		for _, c := range []codec.Codec{codec.JSON, codec.MsgPack} {
+			b.Run(fmt.Sprintf("%s/compression=%v", c.Name(), compress), func(b *testing.B) {
+				benchmarkWebSocketWrite(b, c, compress, msg)
+			})
+		}
+	}
+}
+
+func benchmarkWebSocketWrite(b *testing.B, c codec.Codec, compress bool, msg storage.ChatMessage) {
+	upgrader := websocket.Upgrader{EnableCompression: compress}
+	received := make(chan int, 1)
+
+	// 伺服器端只讀取消息並統計收到的位元組數
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		total := 0
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				received <- total
+				return
+			}
+			total += len(data)
+		}
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{EnableCompression: compress}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		b.Fatalf("連接失敗: %v", err)
+	}
+
+	frameType := websocket.TextMessage
+	if c.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		data, err := c.Marshal(msg)
+		if err != nil {
+			b.Fatalf("序列化失敗: %v", err)
+		}
+		if err := conn.WriteMessage(frameType, data); err != nil {
+			b.Fatalf("寫入失敗: %v", err)
+		}
+	}
+
+	b.StopTimer()
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+	<-received
+}
@@ -2,9 +2,11 @@ package benchmark
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/ianwu0915/SettleChat/internal/storage" // 調整為你的包路徑
 )
 
@@ -80,4 +82,127 @@ func BenchmarkGetRecentMessages(b *testing.B) {
 			b.Fatalf("獲取消息失敗: %v", err)
 		}
 	}
-}
\ No newline at end of file
+}
+
+// benchmarkPending 返回一條聊天消息與它的廣播事件，每次呼叫的事件 ID 都不同
+func benchmarkPending(roomID string) storage.PendingMessage {
+	return storage.PendingMessage{
+		Message: storage.ChatMessage{
+			RoomID:    roomID,
+			SenderID:  "benchmark_sender",
+			Sender:    "Benchmark User",
+			Content:   "This is a benchmark test message",
+			Timestamp: time.Now(),
+		},
+		Event: storage.FixedEvent(storage.OutboxMessage{
+			EventID: uuid.NewString(),
+			Subject: "settlechat.message.broadcast." + roomID,
+			Data:    []byte(`{"content":"This is a benchmark test message"}`),
+		}),
+	}
+}
+
+// reportThroughput 以每秒寫入的消息數報告吞吐量
+func reportThroughput(b *testing.B, messages int) {
+	b.ReportMetric(float64(messages)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+// 每條消息各自一個交易 (沒有 MessageWriter 時 ChatMessageHandler 的寫法)
+func BenchmarkSaveMessageWithOutbox(b *testing.B) {
+	store := setupTestStore()
+	defer store.Close()
+
+	ctx := context.Background()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pending := benchmarkPending("benchmark_room")
+			if _, err := store.SaveMessageWithOutbox(ctx, pending.Message, pending.Event); err != nil {
+				b.Fatalf("保存消息失敗: %v", err)
+			}
+		}
+	})
+	reportThroughput(b, b.N)
+}
+
+// 一個交易寫入一批消息 (outbox 以 unnest、消息以 COPY 寫入)
+func BenchmarkSaveMessagesWithOutbox(b *testing.B) {
+	store := setupTestStore()
+	defer store.Close()
+
+	ctx := context.Background()
+	for _, size := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			batch := make([]storage.PendingMessage, size)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := range batch {
+					batch[j] = benchmarkPending(fmt.Sprintf("benchmark_room_%d", j%10))
+				}
+				b.StartTimer()
+
+				if _, err := store.SaveMessagesWithOutbox(ctx, batch); err != nil {
+					b.Fatalf("批次保存消息失敗: %v", err)
+				}
+			}
+			reportThroughput(b, b.N*size)
+		})
+	}
+}
+
+// 經由 MessageWriter 等待確認 (ChatMessageHandler 的寫法)，每個房間一次只有一條消息在等待確認
+// 多個房間同時送出消息時每個 goroutine 代表一個房間；one-room 是單一房間連續送出消息
+func BenchmarkMessageWriter(b *testing.B) {
+	store := setupTestStore()
+	defer store.Close()
+
+	ctx := context.Background()
+	for _, config := range []storage.WriterConfig{
+		{MaxBatch: 100, FlushInterval: 0},
+		{MaxBatch: 100, FlushInterval: 5 * time.Millisecond},
+		{MaxBatch: 500, FlushInterval: 10 * time.Millisecond},
+	} {
+		b.Run(fmt.Sprintf("batch=%d/interval=%s", config.MaxBatch, config.FlushInterval), func(b *testing.B) {
+			writer := storage.NewMessageWriter(store, config)
+			defer writer.Close()
+
+			// 每個 CPU 64 個房間
+			b.SetParallelism(64)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				roomID := "benchmark_room_" + uuid.NewString()
+				for pb.Next() {
+					pending := benchmarkPending(roomID)
+					if _, err := writer.SaveMessageWithOutbox(ctx, pending.Message, pending.Event); err != nil {
+						b.Fatalf("保存消息失敗: %v", err)
+					}
+				}
+			})
+			reportThroughput(b, b.N)
+			b.ReportMetric(writer.Stats().AvgBatch, "msgs/batch")
+		})
+
+		// 只有一個忙碌的房間：dispatcher 依序處理，上一條確認後才送出下一條，
+		// 吞吐量受限於每條消息等待寫入的時間 (FlushInterval 大於 0 時每條至少等待一個 interval)
+		b.Run(fmt.Sprintf("batch=%d/interval=%s/one-room", config.MaxBatch, config.FlushInterval), func(b *testing.B) {
+			writer := storage.NewMessageWriter(store, config)
+			defer writer.Close()
+
+			roomID := "benchmark_room_" + uuid.NewString()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				pending := benchmarkPending(roomID)
+				if _, err := writer.SaveMessageWithOutbox(ctx, pending.Message, pending.Event); err != nil {
+					b.Fatalf("保存消息失敗: %v", err)
+				}
+			}
+			reportThroughput(b, b.N)
+			b.ReportMetric(writer.Stats().AvgBatch, "msgs/batch")
+		})
+	}
+}
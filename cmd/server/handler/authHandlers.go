@@ -10,10 +10,10 @@ import (
 )
 
 type AuthHandler struct {
-	DB *storage.PostgresStore
+	DB storage.UserStore
 }
 
-func NewAuthHandler(store *storage.PostgresStore) *AuthHandler {
+func NewAuthHandler(store storage.UserStore) *AuthHandler {
 	return &AuthHandler{DB: store}
 }
 
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+const defaultDeadLetterLimit = 50
+
+// DeadLetterHandler 管理重試後仍然失敗的事件
+type DeadLetterHandler struct {
+	store     storage.DeadLetterStore
+	transport types.Transport
+}
+
+func NewDeadLetterHandler(store storage.DeadLetterStore, transport types.Transport) *DeadLetterHandler {
+	return &DeadLetterHandler{store: store, transport: transport}
+}
+
+// deadLetterView 在 payload 是 JSON 時直接內嵌，方便檢查
+type deadLetterView struct {
+	storage.DeadLetter
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func newDeadLetterView(letter storage.DeadLetter) deadLetterView {
+	view := deadLetterView{DeadLetter: letter}
+	if json.Valid(letter.Data) {
+		view.Payload = letter.Data
+		view.Data = nil
+	}
+	return view
+}
+
+// DeadLetters 處理 /admin/deadletters:
+// GET    ?id= 查詢一筆死信；沒有 id 時列出死信，可用 ?handler= 與 ?limit= 篩選
+// DELETE ?id= 丟棄一筆死信
+func (h *DeadLetterHandler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Has("id") {
+			h.get(w, r)
+			return
+		}
+		h.list(w, r)
+	case http.MethodDelete:
+		h.discard(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *DeadLetterHandler) list(w http.ResponseWriter, r *http.Request) {
+	limit := defaultDeadLetterLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	letters, err := h.store.ListDeadLetters(r.Context(), r.URL.Query().Get("handler"), limit)
+	if err != nil {
+		log.Printf("Failed to list dead letters: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	views := make([]deadLetterView, 0, len(letters))
+	for _, letter := range letters {
+		views = append(views, newDeadLetterView(letter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func (h *DeadLetterHandler) get(w http.ResponseWriter, r *http.Request) {
+	letter, ok := h.lookup(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newDeadLetterView(*letter))
+}
+
+func (h *DeadLetterHandler) discard(w http.ResponseWriter, r *http.Request) {
+	id, ok := deadLetterID(w, r)
+	if !ok {
+		return
+	}
+	if err := h.store.DeleteDeadLetter(r.Context(), id); err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	log.Printf("Discarded dead letter %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Replay 處理 POST /admin/deadletters/replay?id=
+// 把死信以原本的主題與標頭重新發布，成功後刪除；再次失敗時 Subscriber 會寫入新的死信
+// 去重 ID 換成新的 ID (與 eventlog.Replay 相同)，否則 JetStream 在去重窗口內會把它當成重複的事件丟棄，
+// 事件在死信刪除後就遺失了
+func (h *DeadLetterHandler) Replay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	letter, ok := h.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	msg := types.NewMessage(letter.Subject, letter.Data)
+	for key, values := range letter.Header {
+		msg.Header[key] = values
+	}
+	if id := msg.Header.Get(types.HeaderMsgID); id != "" {
+		msg.Header.Set(types.HeaderMsgID, fmt.Sprintf("%s.replay-%d", id, time.Now().UnixNano()))
+	}
+	if err := h.transport.Publish(msg); err != nil {
+		log.Printf("Failed to replay dead letter %d: %v", letter.ID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if err := h.store.DeleteDeadLetter(r.Context(), letter.ID); err != nil {
+		log.Printf("Replayed dead letter %d but failed to delete it: %v", letter.ID, err)
+	}
+	log.Printf("Replayed dead letter %d to %s", letter.ID, letter.Subject)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *DeadLetterHandler) lookup(w http.ResponseWriter, r *http.Request) (*storage.DeadLetter, bool) {
+	id, ok := deadLetterID(w, r)
+	if !ok {
+		return nil, false
+	}
+	letter, err := h.store.GetDeadLetter(r.Context(), id)
+	if err != nil {
+		writeDeadLetterError(w, err)
+		return nil, false
+	}
+	return letter, true
+}
+
+func deadLetterID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func writeDeadLetterError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("Dead letter operation failed: %v", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	memstore "github.com/ianwu0915/SettleChat/internal/storage/memory"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// TestReplayRewritesMsgID 重播的死信換上新的去重 ID，不會被 JetStream 當成重複的事件丟棄
+func TestReplayRewritesMsgID(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.NewStore()
+	transport := memory.NewTransport()
+	defer transport.Close()
+
+	published := make(chan *types.Message, 1)
+	transport.Subscribe("room.r1.message", func(msg *types.Message) { published <- msg })
+
+	if err := store.SaveDeadLetter(ctx, storage.DeadLetter{
+		HandlerKey: "chat_message",
+		Subject:    "room.r1.message",
+		Header:     map[string][]string{types.HeaderMsgID: {"event-1"}, "Content-Type": {"application/json"}},
+		Data:       []byte(`{}`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	letters, _ := store.ListDeadLetters(ctx, "", 10)
+	id := letters[0].ID
+
+	h := NewDeadLetterHandler(store, transport)
+	w := httptest.NewRecorder()
+	h.Replay(w, httptest.NewRequest(http.MethodPost, "/admin/deadletters/replay?id="+strconv.FormatInt(id, 10), nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("replay = %d %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case msg := <-published:
+		if got := msg.Header.Get(types.HeaderMsgID); got == "event-1" || !strings.HasPrefix(got, "event-1.replay-") {
+			t.Errorf("replayed %s = %q, want a new ID derived from event-1", types.HeaderMsgID, got)
+		}
+		if msg.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("header not kept: %v", msg.Header)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead letter not published")
+	}
+	if _, err := store.GetDeadLetter(ctx, id); err == nil {
+		t.Error("dead letter kept after replay")
+	}
+}
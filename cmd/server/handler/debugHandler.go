@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ianwu0915/SettleChat/internal/chat"
+	"github.com/ianwu0915/SettleChat/internal/event_handlers"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+type DebugHandler struct {
+	hub     *chat.Hub
+	metrics *event_handlers.HandlerMetrics
+	writer  *storage.MessageWriter
+}
+
+func NewDebugHandler(hub *chat.Hub, metrics *event_handlers.HandlerMetrics) *DebugHandler {
+	return &DebugHandler{hub: hub, metrics: metrics}
+}
+
+// SetMessageWriter 設置 GET /debug/writer 返回統計的 MessageWriter
+func (h *DebugHandler) SetMessageWriter(w *storage.MessageWriter) {
+	h.writer = w
+}
+
+// HubSnapshot 處理 GET /debug/hub，返回本實例持有的房間與客戶端數量
+func (h *DebugHandler) HubSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.hub.Snapshot())
+}
+
+// HandlerMetrics 處理 GET /debug/handlers，返回每個事件 handler 的處理次數、錯誤與延遲
+func (h *DebugHandler) HandlerMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.metrics.Snapshot())
+}
+
+// DispatcherStats 處理 GET /debug/dispatcher，返回事件 worker pool 的佇列長度與背壓指標
+func (h *DebugHandler) DispatcherStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.hub.Subscriber == nil {
+		http.Error(w, "subscriber not started", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.hub.Subscriber.DispatcherStats())
+}
+
+// WriterStats 處理 GET /debug/writer，返回聊天消息批次寫入的批數、條數與失敗數
+func (h *DebugHandler) WriterStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.writer == nil {
+		http.Error(w, "message writer not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.writer.Stats())
+}
+
+// eventSchema 是 GET /debug/events 返回的一個事件版本
+type eventSchema struct {
+	Type        string              `json:"type"`
+	Version     int                 `json:"version"`
+	Current     bool                `json:"current"`
+	Description string              `json:"description"`
+	Fields      []types.SchemaField `json:"fields"`
+}
+
+// EventSchemas 處理 GET /debug/events，列出所有事件類型與各版本的 payload 欄位
+func (h *DebugHandler) EventSchemas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	schemas := []eventSchema{}
+	for _, schema := range types.Events.Schemas() {
+		current, _ := types.Events.CurrentVersion(schema.Type)
+		schemas = append(schemas, eventSchema{
+			Type:        schema.Type,
+			Version:     schema.Version,
+			Current:     schema.Version == current,
+			Description: schema.Description,
+			Fields:      schema.Fields(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schemas)
+}
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/ianwu0915/SettleChat/internal/chat"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// HTTPTransportHandler 提供給無法使用 WebSocket 的客戶端（例如企業代理會切斷 WebSocket）:
+// SSE 串流 + HTTP POST 發送，最後手段是 long-polling
+type HTTPTransportHandler struct {
+	hub      *chat.Hub
+	sessions map[string]chat.HTTPConn
+	mu       sync.RWMutex
+}
+
+func NewHTTPTransportHandler(hub *chat.Hub) *HTTPTransportHandler {
+	return &HTTPTransportHandler{
+		hub:      hub,
+		sessions: make(map[string]chat.HTTPConn),
+	}
+}
+
+// SSE 處理 GET /sse?room=&user_id=&username=
+// 第一個事件是 `event: session`，帶有之後 POST /send 要用的 session_id
+func (h *HTTPTransportHandler) SSE(w http.ResponseWriter, r *http.Request) {
+	roomID, userID, username, ok := clientParams(w, r)
+	if !ok {
+		return
+	}
+	since, ok := replaySince(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := chat.NewSSEConn(w)
+	if err != nil {
+		log.Printf("Failed to start SSE stream: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.addSession(conn)
+
+	// 客戶端斷開時關閉連線，ReadPump 會因此結束並把客戶端從 Hub 移除
+	go func() {
+		select {
+		case <-r.Context().Done():
+			conn.Close()
+		case <-conn.Done():
+		}
+	}()
+
+	client := chat.NewClient(h.hub, userID, username, conn, roomID, h.hub.EventBus)
+	client.ReplaySince = since
+	h.hub.Register <- client
+
+	go client.ReadPump()
+	// SSE 只能在這個 handler 返回前寫入，所以 WritePump 在這裡執行
+	client.WritePump()
+}
+
+// PollConnect 處理 GET /poll/connect?room=&user_id=&username=，建立 long-polling session
+func (h *HTTPTransportHandler) PollConnect(w http.ResponseWriter, r *http.Request) {
+	roomID, userID, username, ok := clientParams(w, r)
+	if !ok {
+		return
+	}
+	since, ok := replaySince(w, r)
+	if !ok {
+		return
+	}
+
+	conn := chat.NewLongPollConn()
+	h.addSession(conn)
+
+	client := chat.NewClient(h.hub, userID, username, conn, roomID, h.hub.EventBus)
+	client.ReplaySince = since
+	h.hub.Register <- client
+
+	go client.WritePump()
+	go client.ReadPump()
+
+	json.NewEncoder(w).Encode(map[string]string{"session_id": conn.SessionID()})
+}
+
+// Poll 處理 GET /poll?session=，返回等待中的消息陣列
+func (h *HTTPTransportHandler) Poll(w http.ResponseWriter, r *http.Request) {
+	conn, ok := h.getSession(w, r)
+	if !ok {
+		return
+	}
+
+	pollConn, ok := conn.(*chat.LongPollConn)
+	if !ok {
+		http.Error(w, "session is not a long-polling session", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := pollConn.Poll(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	json.NewEncoder(w).Encode(messages)
+}
+
+// Send 處理 POST /send?session=，消息格式與 WebSocket 相同
+func (h *HTTPTransportHandler) Send(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conn, ok := h.getSession(w, r)
+	if !ok {
+		return
+	}
+
+	var msg storage.ChatMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := conn.Deliver(msg); err != nil {
+		switch {
+		case errors.Is(err, chat.ErrInboundFull):
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		default:
+			http.Error(w, err.Error(), http.StatusGone)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// addSession 記錄 session，並在連線關閉時自動移除
+func (h *HTTPTransportHandler) addSession(conn chat.HTTPConn) {
+	h.mu.Lock()
+	h.sessions[conn.SessionID()] = conn
+	h.mu.Unlock()
+
+	go func() {
+		<-conn.Done()
+		h.mu.Lock()
+		delete(h.sessions, conn.SessionID())
+		h.mu.Unlock()
+	}()
+}
+
+func (h *HTTPTransportHandler) getSession(w http.ResponseWriter, r *http.Request) (chat.HTTPConn, bool) {
+	sessionID := r.URL.Query().Get("session")
+	if sessionID == "" {
+		http.Error(w, "missing session", http.StatusBadRequest)
+		return nil, false
+	}
+
+	h.mu.RLock()
+	conn, ok := h.sessions[sessionID]
+	h.mu.RUnlock()
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, false
+	}
+	return conn, true
+}
@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/chat"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+func newTestTransport(t *testing.T) (*HTTPTransportHandler, *httptest.Server) {
+	t.Helper()
+	hub := chat.NewHub(nil, nil, nil, nil, nil)
+	go hub.Run()
+
+	h := NewHTTPTransportHandler(hub)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sse", h.SSE)
+	mux.HandleFunc("/poll/connect", h.PollConnect)
+	mux.HandleFunc("/poll", h.Poll)
+	mux.HandleFunc("/send", h.Send)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return h, server
+}
+
+func send(t *testing.T, server *httptest.Server, sessionID, content string) int {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/send?session="+sessionID, "application/json", strings.NewReader(`{"content":"`+content+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitForSessionGone 等待連線關閉後 session 被移除
+func waitForSessionGone(t *testing.T, h *HTTPTransportHandler, sessionID string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.RLock()
+		_, ok := h.sessions[sessionID]
+		h.mu.RUnlock()
+		if !ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("session %s still registered", sessionID)
+}
+
+func TestSendUnknownSession(t *testing.T) {
+	_, server := newTestTransport(t)
+
+	if code := send(t, server, "", "hi"); code != http.StatusBadRequest {
+		t.Errorf("send without session = %d, want 400", code)
+	}
+	if code := send(t, server, "no-such-session", "hi"); code != http.StatusNotFound {
+		t.Errorf("send to unknown session = %d, want 404", code)
+	}
+
+	resp, err := http.Get(server.URL + "/send?session=no-such-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /send = %d, want 405", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/poll?session=no-such-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("poll unknown session = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestSendInboundFull(t *testing.T) {
+	h, server := newTestTransport(t)
+
+	// 沒有 ReadPump 取走消息，送滿之後返回 429
+	conn := chat.NewLongPollConn()
+	h.addSession(conn)
+
+	code := http.StatusAccepted
+	sent := 0
+	for ; code == http.StatusAccepted && sent < 100; sent++ {
+		code = send(t, server, conn.SessionID(), "hi")
+	}
+	if code != http.StatusTooManyRequests || sent <= 1 {
+		t.Fatalf("send %d got %d, want 429 once the inbound queue is full", sent, code)
+	}
+
+	conn.Close()
+	waitForSessionGone(t, h, conn.SessionID())
+	if code := send(t, server, conn.SessionID(), "hi"); code != http.StatusNotFound {
+		t.Errorf("send after close = %d, want 404", code)
+	}
+}
+
+func TestLongPollSession(t *testing.T) {
+	h, server := newTestTransport(t)
+
+	resp, err := http.Get(server.URL + "/poll/connect?room=room-1&user_id=u1&username=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var connected struct {
+		SessionID string `json:"session_id"`
+	}
+	json.NewDecoder(resp.Body).Decode(&connected)
+	resp.Body.Close()
+	if connected.SessionID == "" {
+		t.Fatal("no session_id in connect response")
+	}
+	h.mu.RLock()
+	conn := h.sessions[connected.SessionID].(*chat.LongPollConn)
+	h.mu.RUnlock()
+
+	// 沒有消息時 poll 在請求的 context 結束時返回 []
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/poll?session="+connected.SessionID, nil)
+	w := httptest.NewRecorder()
+	h.Poll(w, req)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("poll without messages = %d %q, want []", w.Code, w.Body.String())
+	}
+
+	conn.WriteMessage(storage.ChatMessage{Content: "hello"})
+	resp, err = http.Get(server.URL + "/poll?session=" + connected.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []storage.ChatMessage
+	json.NewDecoder(resp.Body).Decode(&messages)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(messages) != 1 || messages[0].Content != "hello" {
+		t.Fatalf("poll = %d %+v, want hello", resp.StatusCode, messages)
+	}
+
+	// 連線在 poll 等待中被關閉，返回 410 並移除 session
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+	}()
+	resp, err = http.Get(server.URL + "/poll?session=" + connected.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("poll on closed session = %d, want 410", resp.StatusCode)
+	}
+	waitForSessionGone(t, h, connected.SessionID)
+}
+
+func TestSSEStream(t *testing.T) {
+	h, server := newTestTransport(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/sse?room=room-1&user_id=u1&username=alice", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	readFrame := func() string {
+		t.Helper()
+		var frame strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read frame: %v (got %q)", err, frame.String())
+			}
+			if line == "\n" {
+				return frame.String()
+			}
+			frame.WriteString(line)
+		}
+	}
+
+	frame := readFrame()
+	event, data, _ := strings.Cut(frame, "\n")
+	if event != "event: session" || !strings.HasPrefix(data, "data: ") {
+		t.Fatalf("first frame = %q, want session event", frame)
+	}
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(data, "data: "))), &session); err != nil || session.SessionID == "" {
+		t.Fatalf("session frame = %q: %v", frame, err)
+	}
+
+	// SSE session 不能用來 long-poll
+	pollResp, err := http.Get(server.URL + "/poll?session=" + session.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pollResp.Body.Close()
+	if pollResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("poll on SSE session = %d, want 400", pollResp.StatusCode)
+	}
+
+	// 送給客戶端的消息成為一個 data 事件
+	deadline := time.Now().Add(time.Second)
+	for !h.hub.NotifyUser("room-1", "u1", storage.ChatMessage{Content: "hello"}) {
+		if time.Now().After(deadline) {
+			t.Fatal("client never joined room-1")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	frame = readFrame()
+	var msg storage.ChatMessage
+	if !strings.HasPrefix(frame, "data: ") || json.Unmarshal([]byte(strings.TrimPrefix(frame, "data: ")), &msg) != nil || msg.Content != "hello" {
+		t.Fatalf("message frame = %q, want hello", frame)
+	}
+
+	if code := send(t, server, session.SessionID, "hi"); code != http.StatusAccepted {
+		t.Errorf("send on SSE session = %d, want 202", code)
+	}
+
+	// 客戶端斷開後 session 被移除
+	cancel()
+	io.Copy(io.Discard, resp.Body)
+	waitForSessionGone(t, h, session.SessionID)
+}
+
+// TestShutdownEndsStreams Shutdown 時關閉 Hub，SSE 串流立即結束，Shutdown 不必等到逾時
+func TestShutdownEndsStreams(t *testing.T) {
+	h, server := newTestTransport(t)
+	server.Config.RegisterOnShutdown(h.hub.Close)
+
+	resp, err := http.Get(server.URL + "/sse?room=room-1&user_id=u1&username=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := h.hub.FindClient("room-1", "u1"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client never joined room-1")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := server.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown = %v after %v, want the stream to end", err, time.Since(start))
+	}
+	io.Copy(io.Discard, resp.Body)
+	h.mu.RLock()
+	sessions := len(h.sessions)
+	h.mu.RUnlock()
+	if sessions != 0 {
+		t.Errorf("%d sessions left after shutdown", sessions)
+	}
+}
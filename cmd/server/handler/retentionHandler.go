@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// RetentionStore 房間資訊與保留規則
+type RetentionStore interface {
+	GetRoom(ctx context.Context, roomID string) (*storage.Room, error)
+	GetRetentionPolicy(ctx context.Context, roomID string) (*storage.RetentionPolicy, error)
+	SetRetentionPolicy(ctx context.Context, policy storage.RetentionPolicy) (*storage.RetentionPolicy, error)
+	SetLegalHold(ctx context.Context, roomID string, hold bool) (*storage.RetentionPolicy, error)
+}
+
+// RetentionHandler 查詢與設定房間的消息保留規則
+type RetentionHandler struct {
+	store RetentionStore
+}
+
+func NewRetentionHandler(store RetentionStore) *RetentionHandler {
+	return &RetentionHandler{store: store}
+}
+
+type retentionRequest struct {
+	UserID   string `json:"user_id"`
+	Mode     string `json:"mode"`
+	Days     int    `json:"days"`
+	KeepLast int    `json:"keep_last"`
+}
+
+type legalHoldRequest struct {
+	RoomID    string `json:"room_id"`
+	LegalHold bool   `json:"legal_hold"`
+}
+
+// Retention 處理 /rooms/retention?room_id=:
+// GET 查詢房間的保留規則
+// PUT 設定保留規則 (body: user_id, mode, days, keep_last)，只有房間的創建者可以設定，不改變法律保全
+func (h *RetentionHandler) Retention(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		http.Error(w, "missing room_id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		policy, err := h.store.GetRetentionPolicy(r.Context(), roomID)
+		writePolicy(w, roomID, policy, err)
+	case http.MethodPut:
+		var req retentionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		room, err := h.store.GetRoom(r.Context(), roomID)
+		if err != nil {
+			writePolicy(w, roomID, nil, err)
+			return
+		}
+		if req.UserID == "" || req.UserID != room.CreatedBy {
+			http.Error(w, "only the room creator can change its retention", http.StatusForbidden)
+			return
+		}
+
+		policy := storage.RetentionPolicy{RoomID: roomID, Mode: req.Mode, Days: req.Days, KeepLast: req.KeepLast}
+		if err := policy.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		saved, err := h.store.SetRetentionPolicy(r.Context(), policy)
+		if err == nil {
+			log.Printf("Retention of room %s set to %s by %s", roomID, saved.Mode, req.UserID)
+		}
+		writePolicy(w, roomID, saved, err)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// LegalHold 處理 POST /admin/rooms/legalhold (body: room_id, legal_hold)，法律保全中的房間不刪除任何消息
+func (h *RetentionHandler) LegalHold(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req legalHoldRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RoomID == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	policy, err := h.store.SetLegalHold(r.Context(), req.RoomID, req.LegalHold)
+	if err == nil {
+		log.Printf("Legal hold of room %s set to %t", req.RoomID, req.LegalHold)
+	}
+	writePolicy(w, req.RoomID, policy, err)
+}
+
+// writePolicy 返回保留規則，房間不存在時返回 404
+func writePolicy(w http.ResponseWriter, roomID string, policy *storage.RetentionPolicy, err error) {
+	if errors.Is(err, storage.ErrRoomNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to access retention of room %s: %v", roomID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
@@ -1,23 +1,28 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	messaging "github.com/ianwu0915/SettleChat/internal/messaging"
 	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
 	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
 )
 
 type RoomHandler struct {
-	DB        *storage.PostgresStore
+	DB        storage.Store
 	publisher *nats.NATSPublisher
 	env       string
 	EventBus  *messaging.EventBus
 }
 
-func NewRoomHandler(store *storage.PostgresStore, publisher *nats.NATSPublisher, env string, eventBus *messaging.EventBus) *RoomHandler {
+func NewRoomHandler(store storage.Store, publisher *nats.NATSPublisher, env string, eventBus *messaging.EventBus) *RoomHandler {
 	return &RoomHandler{
 		DB:        store,
 		publisher: publisher,
@@ -44,8 +49,8 @@ type leaveRoomRequest struct {
 
 // CreateRoom 創建房間:
 // 1. 獲取用戶信息
-// 2. 創建房間
-// 3. 發布用戶加入事件
+// 2. 創建房間，並在同一個交易中寫入用戶加入事件
+// 3. OutboxRelay 發布用戶加入事件
 func (h *RoomHandler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	var req createRoomRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -61,19 +66,22 @@ func (h *RoomHandler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 創建房間
-	rid, err := h.DB.CreateRoom(r.Context(), req.RoomName, req.UserID)
+	// 創建房間，用戶加入事件與房間在同一個交易寫入 outbox，由 OutboxRelay 發布
+	var rid string
+	if h.EventBus != nil {
+		rid, err = h.DB.CreateRoomWithOutbox(r.Context(), req.RoomName, req.UserID, func(roomID string) (storage.OutboxMessage, error) {
+			payload := types.UserJoinedMessage{RoomID: roomID, UserID: req.UserID, Username: user.UserName, JoinedAt: time.Now()}
+			return h.EventBus.OutboxMessage(r.Context(), types.NewEnvelope(types.EventTypeUserJoined, roomID, req.UserID, payload))
+		})
+	} else {
+		rid, err = h.DB.CreateRoom(r.Context(), req.RoomName, req.UserID)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
 	if h.EventBus != nil {
-		if err := h.EventBus.PublishUserJoinedEvent(rid, req.UserID, user.UserName); err != nil {
-			log.Printf("Failed to publish New UserJoin event: %v", err)
-		} else {
-			log.Printf("Published New UserJoin event for %s in room %s", user.UserName, rid)
-		}
+		log.Printf("Queued New UserJoin event for %s in room %s", user.UserName, rid)
 	}
 
 	// Return {"room_id:" "lkahld "}
@@ -146,3 +154,104 @@ func (h *RoomHandler) GetUserRooms(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(rooms)
 }
+
+// RoomMembers 以 request-reply 查詢房間成員與在線狀態 (GET ?room_id=)
+func (h *RoomHandler) RoomMembers(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		http.Error(w, "missing room_id", http.StatusBadRequest)
+		return
+	}
+
+	members, err := h.EventBus.RequestRoomMembers(r.Context(), roomID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// RoomHistory 以 request-reply 查詢早於 before 的歷史消息，用於向上捲動 (GET ?room_id=&before=&before_id=&limit=)
+// before 是 RFC 3339 時間，before_id 是消息 ID，通常是客戶端目前最舊一條消息的時間與 ID；
+// 帶上 before_id 時同一時間的其他消息不會被略過。已經封存的月份也會返回
+func (h *RoomHandler) RoomHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	roomID := query.Get("room_id")
+	if roomID == "" {
+		http.Error(w, "missing room_id", http.StatusBadRequest)
+		return
+	}
+	before := storage.MessageCursor{Timestamp: time.Now()}
+	if s := query.Get("before"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			http.Error(w, "invalid before, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+		before.Timestamp = t
+	}
+	if s := query.Get("before_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, "invalid before_id", http.StatusBadRequest)
+			return
+		}
+		before.ID = id
+	}
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	messages, err := h.EventBus.RequestHistoryBefore(r.Context(), roomID, query.Get("user_id"), before, limit)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	if messages == nil {
+		messages = []storage.ChatMessage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// RoomState 以 request-reply 查詢房間資訊、成員數與最後一條消息的時間 (GET ?room_id=)
+func (h *RoomHandler) RoomState(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		http.Error(w, "missing room_id", http.StatusBadRequest)
+		return
+	}
+
+	state, err := h.EventBus.RequestRoomState(r.Context(), roomID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// writeQueryError 把查詢錯誤轉換成對應的 HTTP 狀態碼
+func writeQueryError(w http.ResponseWriter, err error) {
+	var queryErr *types.QueryError
+	switch {
+	case errors.As(err, &queryErr) && queryErr.Code == types.QueryErrorNotFound:
+		http.Error(w, queryErr.Message, http.StatusNotFound)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, types.ErrNoResponders):
+		log.Printf("Room query unavailable: %v", err)
+		http.Error(w, "query timed out", http.StatusGatewayTimeout)
+	default:
+		log.Printf("Room query failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// SearchStore 搜尋消息並確認用戶所屬的房間
+type SearchStore interface {
+	SearchMessages(ctx context.Context, search storage.MessageSearch) ([]storage.SearchResult, error)
+	GetUserRooms(ctx context.Context, userID string) ([]storage.Room, error)
+	IsRoomMember(ctx context.Context, roomID, userID string) (bool, error)
+}
+
+// SearchHandler 搜尋用戶所屬房間中的消息
+type SearchHandler struct {
+	store SearchStore
+}
+
+func NewSearchHandler(store SearchStore) *SearchHandler {
+	return &SearchHandler{store: store}
+}
+
+// Search 處理 GET /search?user_id=&q=，可用 room_id、sender_id、from、to (RFC 3339)、has_attachment 與 limit 篩選
+// 只返回 user_id 所屬房間的消息；指定的 room_id 不是用戶的房間時返回 403
+func (h *SearchHandler) Search(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	userID := query.Get("user_id")
+	if userID == "" {
+		http.Error(w, "missing user_id", http.StatusBadRequest)
+		return
+	}
+	search := storage.MessageSearch{Query: query.Get("q"), SenderID: query.Get("sender_id")}
+	if search.Normalize().Query == "" {
+		http.Error(w, "missing q", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	for name, t := range map[string]*time.Time{"from": &search.From, "to": &search.To} {
+		if s := query.Get(name); s != "" {
+			if *t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+				http.Error(w, "invalid "+name+", expected RFC 3339", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if s := query.Get("has_attachment"); s != "" {
+		if search.HasAttachment, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "invalid has_attachment", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		if search.Limit, err = strconv.Atoi(s); err != nil || search.Limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 搜尋範圍只包含用戶所屬的房間
+	if roomID := query.Get("room_id"); roomID != "" {
+		member, err := h.store.IsRoomMember(r.Context(), roomID, userID)
+		if err != nil {
+			log.Printf("Failed to check membership of user %s in room %s: %v", userID, roomID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !member {
+			http.Error(w, "not a member of this room", http.StatusForbidden)
+			return
+		}
+		search.RoomIDs = []string{roomID}
+	} else {
+		rooms, err := h.store.GetUserRooms(r.Context(), userID)
+		if err != nil {
+			log.Printf("Failed to get rooms of user %s: %v", userID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		search.RoomIDs = make([]string, len(rooms))
+		for i, room := range rooms {
+			search.RoomIDs[i] = room.ID
+		}
+	}
+
+	results, err := h.store.SearchMessages(r.Context(), search)
+	if err != nil {
+		log.Printf("Failed to search messages for user %s: %v", userID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ianwu0915/SettleChat/internal/chat"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+const maxStatusTextLength = 100
+
+type StatusHandler struct {
+	hub *chat.Hub
+}
+
+func NewStatusHandler(hub *chat.Hub) *StatusHandler {
+	return &StatusHandler{hub: hub}
+}
+
+type setStatusRequest struct {
+	UserID      string `json:"user_id"`
+	Status      string `json:"status"`
+	StatusText  string `json:"status_text"`
+	StatusEmoji string `json:"status_emoji"`
+	// ExpiresInMinutes 自訂狀態文字多久後過期，0 代表不過期
+	ExpiresInMinutes int `json:"expires_in_minutes"`
+}
+
+// UserStatus 處理 /user/status:
+// GET  查詢用戶的全域狀態，viewer_id 不是該用戶時返回其他用戶看到的狀態 (隱身顯示為離線)
+// POST 設定用戶的全域狀態，並發布到該用戶所在的每一個房間
+func (h *StatusHandler) UserStatus(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getStatus(w, r)
+	case http.MethodPost:
+		h.setStatus(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *StatusHandler) getStatus(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "missing user_id", http.StatusBadRequest)
+		return
+	}
+
+	status, err := h.hub.Store.GetUserStatus(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("viewer_id") != userID {
+		visible := status.Visible()
+		status = &visible
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func (h *StatusHandler) setStatus(w http.ResponseWriter, r *http.Request) {
+	var req setStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !storage.IsValidUserStatus(req.Status) {
+		http.Error(w, "status must be one of online, away, dnd, invisible", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(req.StatusText) > maxStatusTextLength {
+		http.Error(w, "status_text too long", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInMinutes < 0 {
+		http.Error(w, "expires_in_minutes must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.hub.Store.GetUserByID(r.Context(), req.UserID)
+	if err != nil {
+		log.Printf("Failed to get user info: %v", err)
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	status := storage.UserStatus{
+		UserID: user.ID,
+		Status: req.Status,
+		Text:   req.StatusText,
+		Emoji:  req.StatusEmoji,
+	}
+	if req.ExpiresInMinutes > 0 && (status.Text != "" || status.Emoji != "") {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresInMinutes) * time.Minute).UTC()
+		status.ExpiresAt = &expiresAt
+	}
+
+	if err := h.hub.SetUserStatus(r.Context(), user.UserName, status); err != nil {
+		log.Printf("Failed to set user status: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
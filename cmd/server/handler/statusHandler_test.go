@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ianwu0915/SettleChat/internal/chat"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	memstore "github.com/ianwu0915/SettleChat/internal/storage/memory"
+)
+
+func TestGetStatusHidesInvisible(t *testing.T) {
+	store := memstore.NewStore()
+	userID, err := store.Register(context.Background(), "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateUserStatus(context.Background(), storage.UserStatus{UserID: userID, Status: storage.UserStatusInvisible, Text: "hiding"}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewStatusHandler(chat.NewHub(store, nil, nil, nil, nil))
+
+	get := func(query string) storage.UserStatus {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.UserStatus(w, httptest.NewRequest(http.MethodGet, "/user/status?"+query, nil))
+		var status storage.UserStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("GET /user/status?%s = %d: %v", query, w.Code, err)
+		}
+		return status
+	}
+
+	// 其他用戶看到隱身的用戶為離線，也看不到狀態文字
+	if got := get("user_id=" + userID + "&viewer_id=someone-else"); got.Status != storage.UserStatusOffline || got.Text != "" {
+		t.Errorf("status seen by another user = %+v, want offline", got)
+	}
+	if got := get("user_id=" + userID); got.Status != storage.UserStatusOffline {
+		t.Errorf("status without viewer = %+v, want offline", got)
+	}
+	if got := get("user_id=" + userID + "&viewer_id=" + userID); got.Status != storage.UserStatusInvisible || got.Text != "hiding" {
+		t.Errorf("own status = %+v, want invisible", got)
+	}
+}
@@ -3,45 +3,83 @@ package handler
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/ianwu0915/SettleChat/internal/chat"
+	"github.com/ianwu0915/SettleChat/internal/codec"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // dev, prod -> origin whitelist
-	},
+// WebsocketConfig WebSocket 握手相關設定
+type WebsocketConfig struct {
+	// EnableCompression 啟用 permessage-deflate，只有在客戶端也支援時才會生效
+	EnableCompression bool
+
+	// CompressionLevel flate 壓縮等級 (-2 ~ 9)，0 使用預設等級
+	CompressionLevel int
+}
+
+func newUpgrader(cfg WebsocketConfig) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: cfg.EnableCompression,
+		// 客戶端用 Sec-WebSocket-Protocol 要求編碼，例如 settlechat.msgpack
+		Subprotocols: codec.Subprotocols(),
+		CheckOrigin: func(r *http.Request) bool {
+			return true // dev, prod -> origin whitelist
+		},
+	}
 }
 
 // 從路由參數取得 roomID
-// 升級 HTTP → WebSocket
+// 升級 HTTP → WebSocket，並協商幀的編碼 (JSON, MessagePack, Protobuf)
 // 建立 Client 實例（包含：userID、username、roomID、conn、send chan）
 // 把這個 client 註冊進 Hub.Register
 // 啟動這個 client 的 ReadPump() + WritePump() goroutines
-func WebsocketHandler(hub *chat.Hub) http.HandlerFunc {
+func WebsocketHandler(hub *chat.Hub, cfg WebsocketConfig) http.HandlerFunc {
+	upgrader := newUpgrader(cfg)
+
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Get all the info :roomId, userId, username from from the URL query parameters
+		// 在升級之前檢查，升級後就不能再回應 HTTP 錯誤
+		roomID, userID, username, ok := clientParams(w, r)
+		if !ok {
+			return
+		}
+
+		since, ok := replaySince(w, r)
+		if !ok {
+			return
+		}
+
+		// 無法設定子協議的客戶端可以用 ?encoding=msgpack
+		queryCodec, err := codec.Get(r.URL.Query().Get("encoding"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println("Error upgrading", err)
 			return
 		}
 
-		// Get all the info :roomId, userId, username from from the URL query parameters
-		roomID := r.URL.Query().Get("room")
-		userID := r.URL.Query().Get("user_id")
-		username := r.URL.Query().Get("username")
-
-		if roomID == "" || userID == "" || username == "" {
-			log.Println("Missing query parameters")
-			http.Error(w, "Missing room/user_id/username", http.StatusBadRequest)
-			return
+		frameCodec := queryCodec
+		if protocol := conn.Subprotocol(); protocol != "" {
+			frameCodec = codec.FromSubprotocol(protocol)
 		}
+		if cfg.EnableCompression && cfg.CompressionLevel != 0 {
+			if err := conn.SetCompressionLevel(cfg.CompressionLevel); err != nil {
+				log.Printf("Invalid compression level %d: %v", cfg.CompressionLevel, err)
+			}
+		}
+		log.Printf("WebSocket client %s using %s encoding", userID, frameCodec.Name())
 
 		// Construct Client using NewClient function
-		client := chat.NewClient(hub, userID, username, conn, roomID, hub.EventBus)
+		client := chat.NewClient(hub, userID, username, chat.NewWebSocketConn(conn, frameCodec), roomID, hub.EventBus)
+		client.ReplaySince = since
 
 		// Register the client into the room
 		hub.Register <- client
@@ -52,3 +90,32 @@ func WebsocketHandler(hub *chat.Hub) http.HandlerFunc {
 	}
 
 }
+
+// clientParams 從 URL query 取得 room、user_id、username，缺少時回應 400
+func clientParams(w http.ResponseWriter, r *http.Request) (roomID, userID, username string, ok bool) {
+	roomID = r.URL.Query().Get("room")
+	userID = r.URL.Query().Get("user_id")
+	username = r.URL.Query().Get("username")
+
+	if roomID == "" || userID == "" || username == "" {
+		log.Println("Missing query parameters")
+		http.Error(w, "Missing room/user_id/username", http.StatusBadRequest)
+		return "", "", "", false
+	}
+	return roomID, userID, username, true
+}
+
+// replaySince 取得 ?since= (RFC3339)，斷線重連的客戶端帶上最後收到消息的時間以補回錯過的消息
+func replaySince(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	value := r.URL.Query().Get("since")
+	if value == "" {
+		return time.Time{}, true
+	}
+
+	since, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		http.Error(w, "since must be an RFC3339 timestamp", http.StatusBadRequest)
+		return time.Time{}, false
+	}
+	return since, true
+}
@@ -6,16 +6,24 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/ianwu0915/SettleChat/cmd/server/handler"
 	"github.com/ianwu0915/SettleChat/internal/ai"
+	"github.com/ianwu0915/SettleChat/internal/cache"
 	"github.com/ianwu0915/SettleChat/internal/chat"
+	"github.com/ianwu0915/SettleChat/internal/codec"
 	handlers "github.com/ianwu0915/SettleChat/internal/event_handlers"
 	"github.com/ianwu0915/SettleChat/internal/messaging"
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
 	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
 	"github.com/ianwu0915/SettleChat/internal/storage"
+	memstore "github.com/ianwu0915/SettleChat/internal/storage/memory"
+	"github.com/ianwu0915/SettleChat/internal/storage/sqlite"
+	"github.com/ianwu0915/SettleChat/internal/tracing"
+	"github.com/ianwu0915/SettleChat/internal/types"
 	"github.com/joho/godotenv"
 	nat "github.com/nats-io/nats.go"
 )
@@ -31,39 +39,98 @@ func main() {
 		env = "dev"
 	}
 
-	// 2. 初始化數據庫連接
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		log.Fatal("DATABASE_URL not set")
+	// 1.1 設置 tracing：TRACE_EXPORTER=stdout 或 file (寫入 TRACE_FILE) 時輸出 span，
+	// 未設置時仍然在 NATS 標頭中傳遞 trace context；TRACE_SAMPLE_RATIO 設置新 trace 的取樣比例
+	traceConfig := tracing.Config{
+		Exporter:    os.Getenv("TRACE_EXPORTER"),
+		File:        os.Getenv("TRACE_FILE"),
+		ServiceName: "settlechat",
 	}
-	store, err := storage.NewPostgresStore(dsn)
+	if ratio := os.Getenv("TRACE_SAMPLE_RATIO"); ratio != "" {
+		sampleRatio, err := strconv.ParseFloat(ratio, 64)
+		if err != nil {
+			log.Fatalf("Invalid TRACE_SAMPLE_RATIO: %v", err)
+		}
+		traceConfig.SampleRatio = sampleRatio
+	}
+	shutdownTracing, err := tracing.Setup(traceConfig)
 	if err != nil {
-		log.Fatalf("Failed to connect to Postgres: %v", err)
+		log.Fatalf("Failed to set up tracing: %v", err)
 	}
+
+	// 2. 初始化數據庫連接：STORAGE_DRIVER 選擇 postgres (預設)、sqlite 或 memory
+	store := openStore(os.Getenv("STORAGE_DRIVER"), os.Getenv("DATABASE_URL"))
 	defer store.Close()
 
-	// 3. 初始化 NATS 連接
-	natsURL := os.Getenv("NATS_URL")
-	if natsURL == "" {
-		natsURL = nat.DefaultURL
-	}
-	natsManager := nats.NewNATSManager(natsURL, true)
-	if err := natsManager.Connect(); err != nil {
-		log.Fatalf("Failed to connect to NATS: %v", err)
+	// 2.1 聊天消息排隊後批次寫入，MESSAGE_BATCH_SIZE 與 MESSAGE_FLUSH_INTERVAL 覆蓋一批的大小與最長等待時間
+	messageWriter := newMessageWriter(store)
+
+	// 3. 創建主題格式化器：ENVIRONMENT 與選填的 TENANT 決定主題的命名空間，
+	// 共用同一個 NATS 叢集的環境與租戶之間的事件互不可見
+	nat_topic_formatter, err := nats.NewNamespacedTopicFormatter(nats.Namespace{
+		Environment: env,
+		Tenant:      os.Getenv("TENANT"),
+	})
+	if err != nil {
+		log.Fatalf("Invalid topic namespace: %v", err)
 	}
-	defer natsManager.Disconnect()
 
-	// 4. 創建主題格式化器
-	nat_topic_formatter :=nats.NewTopicFormatter("")
+	// 4. 初始化事件傳輸層：EVENT_TRANSPORT=memory 時以單機模式執行，不需要 NATS
+	var transport types.Transport
+	switch os.Getenv("EVENT_TRANSPORT") {
+	case "memory":
+		log.Println("Using in-memory event transport, running as a single node")
+		memoryTransport := memory.NewTransport()
+		defer memoryTransport.Close()
+		transport = memoryTransport
+	case "", "nats":
+		natsManager := connectNATS(nat_topic_formatter)
+		defer natsManager.Disconnect()
+		transport = nats.NewTransport(natsManager)
+	default:
+		log.Fatalf("Invalid EVENT_TRANSPORT: %q (want nats or memory)", os.Getenv("EVENT_TRANSPORT"))
+	}
 
 	// 5. 創建發布器
-	publisher := nats.NewPublisher(natsManager, env, nat_topic_formatter)
+	publisher := nats.NewPublisher(transport, env, nat_topic_formatter)
+
+	// 5.1 創建事件總線，NATS_CODEC 決定事件 payload 的編碼 (json, msgpack)
+	eventCodec, err := codec.Get(os.Getenv("NATS_CODEC"))
+	if err != nil {
+		log.Fatalf("Invalid NATS_CODEC: %v", err)
+	}
+	if eventCodec == codec.Protobuf {
+		log.Fatal("NATS_CODEC=protobuf is not supported: events have no protobuf schema")
+	}
+	eventBus := messaging.NewEventBus(transport, nat_topic_formatter).WithCodec(eventCodec)
 
-	// 5.1 創建事件總線
-	eventBus := messaging.NewEventBus(natsManager, nat_topic_formatter)
+	// 5.2 創建快取：在線狀態、限流計數與房間最近的消息，鍵以主題的命名空間區分
+	appCache := newCache(nat_topic_formatter.Namespace())
+	defer appCache.Close()
 
 	// 6. 創建 Hub
 	hub := chat.NewHub(store, publisher, nil, nat_topic_formatter, eventBus)
+	hub.Cache = appCache
+	// RATE_LIMIT_MESSAGES 與 RATE_LIMIT_AI_COMMANDS 覆蓋每個用戶的頻率上限 (例如 20/10s)
+	if rate := os.Getenv("RATE_LIMIT_MESSAGES"); rate != "" {
+		hub.MessageRate, err = cache.ParseRate(rate)
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_MESSAGES: %v", err)
+		}
+	}
+	if rate := os.Getenv("RATE_LIMIT_AI_COMMANDS"); rate != "" {
+		hub.AICommandRate, err = cache.ParseRate(rate)
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_AI_COMMANDS: %v", err)
+		}
+	}
+	// ROOM_LINGER 房間最後一個客戶端離開後保留多久 (例如 30s, 0 代表立即拆除)
+	if linger := os.Getenv("ROOM_LINGER"); linger != "" {
+		hub.RoomLinger, err = time.ParseDuration(linger)
+		if err != nil {
+			log.Fatalf("Invalid ROOM_LINGER: %v", err)
+		}
+	}
 	go hub.Run()
 
 	// mockProvider := ai.NewMockProvider("test_provider")
@@ -74,31 +141,115 @@ func main() {
 
 	// 7. 創建並初始化處理器管理器
 	handlerManager := handlers.NewHandlerManager(store, publisher, nat_topic_formatter, env, hub, aiManager)
+	handlerManager.SetCache(appCache)
+	handlerManager.SetMessageWriter(messageWriter)
 	handlerManager.Initialize()
 
 	// 8. 創建並初始化訂閱器 
-	subscriber := nats.NewSubscriber(natsManager, store, env, nat_topic_formatter)
+	subscriber := nats.NewSubscriber(transport, store, env, nat_topic_formatter)
 	handlerManager.Register(subscriber)
 
+	// 重試後仍然失敗的事件寫入 dead_letters，EVENT_MAX_ATTEMPTS 覆蓋預設的處理次數
+	subscriber.SetDeadLetterSink(store)
+	if attempts := os.Getenv("EVENT_MAX_ATTEMPTS"); attempts != "" {
+		policy := types.DefaultRetryPolicy()
+		policy.MaxAttempts, err = strconv.Atoi(attempts)
+		if err != nil {
+			log.Fatalf("Invalid EVENT_MAX_ATTEMPTS: %v", err)
+		}
+		subscriber.SetRetryPolicy("", policy)
+	}
+
+	// EVENT_WORKERS 與 EVENT_QUEUE_SIZE 覆蓋並行處理的房間數與等待處理的消息上限
+	dispatcherConfig := nats.DefaultDispatcherConfig()
+	if workers := os.Getenv("EVENT_WORKERS"); workers != "" {
+		dispatcherConfig.Workers, err = strconv.Atoi(workers)
+		if err != nil {
+			log.Fatalf("Invalid EVENT_WORKERS: %v", err)
+		}
+	}
+	if queueSize := os.Getenv("EVENT_QUEUE_SIZE"); queueSize != "" {
+		dispatcherConfig.QueueSize, err = strconv.Atoi(queueSize)
+		if err != nil {
+			log.Fatalf("Invalid EVENT_QUEUE_SIZE: %v", err)
+		}
+	}
+	subscriber.SetDispatcherConfig(dispatcherConfig)
+
+	// 投遞型事件只處理本實例有客戶端的房間，然後為每個 handler 建立萬用主題訂閱
+	subscriber.SetLocalRoomFilter(hub.HasRoom)
+	if err := subscriber.Start(); err != nil {
+		log.Fatalf("Failed to start subscriber: %v", err)
+	}
+
 	// 設置 Hub 的訂閱器
 	hub.Subscriber = subscriber
 
+	// 8.1 發布與業務資料同一個交易寫入 outbox 的事件，OUTBOX_POLL_INTERVAL 覆蓋輪詢間隔
+	relay := messaging.NewOutboxRelay(store, transport)
+	if interval := os.Getenv("OUTBOX_POLL_INTERVAL"); interval != "" {
+		relay.Interval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid OUTBOX_POLL_INTERVAL: %v", err)
+		}
+	}
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	go relay.Run(relayCtx)
+
+	// 8.2 Postgres 的 messages 按月分區，預先建立之後的分區並把冷分區封存到本地檔案，與 relay 一起停止
+	if pg, ok := store.(*storage.PostgresStore); ok {
+		go newMessageArchiver(pg).Run(relayCtx)
+	}
+
+	// 8.3 刪除過期與超出房間保留規則的消息並通知房間，RETENTION_SWEEP_INTERVAL 覆蓋清理間隔
+	sweeper := messaging.NewRetentionSweeper(store, appCache, eventBus)
+	if interval := os.Getenv("RETENTION_SWEEP_INTERVAL"); interval != "" {
+		sweeper.Interval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid RETENTION_SWEEP_INTERVAL: %v", err)
+		}
+	}
+	go sweeper.Run(relayCtx)
+
 	// 9. 創建 HTTP 處理器
 	authHandler := handler.NewAuthHandler(store)
 	roomHandler := handler.NewRoomHandler(store, publisher, env, eventBus)
+	statusHandler := handler.NewStatusHandler(hub)
+	transportHandler := handler.NewHTTPTransportHandler(hub)
+	debugHandler := handler.NewDebugHandler(hub, handlerManager.Metrics())
+	debugHandler.SetMessageWriter(messageWriter)
+	deadLetterHandler := handler.NewDeadLetterHandler(store, transport)
+	searchHandler := handler.NewSearchHandler(store)
+	retentionHandler := handler.NewRetentionHandler(store)
+
+	// 9.1 WebSocket 設定：WS_COMPRESSION 啟用 permessage-deflate
+	wsConfig := handler.WebsocketConfig{
+		EnableCompression: os.Getenv("WS_COMPRESSION") == "true",
+	}
+	if level := os.Getenv("WS_COMPRESSION_LEVEL"); level != "" {
+		wsConfig.CompressionLevel, err = strconv.Atoi(level)
+		if err != nil {
+			log.Fatalf("Invalid WS_COMPRESSION_LEVEL: %v", err)
+		}
+	}
 
 	// 10. 設置路由
 	mux := http.NewServeMux()
-	setupRoutes(mux, hub, authHandler, roomHandler)
+	// 管理 API 只接受帶有 ADMIN_TOKEN 的請求，沒有設置時停用
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Println("ADMIN_TOKEN not set, /admin/ endpoints are disabled")
+	}
+	setupRoutes(mux, hub, wsConfig, authHandler, roomHandler, statusHandler, transportHandler, debugHandler, deadLetterHandler, searchHandler, retentionHandler, adminToken)
 
 	// 11. 創建 HTTP 服務器
 	server := &http.Server{
 		Addr:    ":8080",
-		Handler: mux,
+		Handler: tracing.Middleware(mux),
 	}
 
 	// 12. 設置優雅關閉
-	go gracefulShutdown(server, hub, subscriber)
+	go gracefulShutdown(server, hub, subscriber, messageWriter, stopRelay, shutdownTracing)
 
 	// 13. 啟動服務器
 	log.Printf("Server starting on %s in %s environment", server.Addr, env)
@@ -107,21 +258,177 @@ func main() {
 	}
 }
 
+// connectNATS 連接 NATS，NATS_JETSTREAM=true 時以 JetStream 保存事件，持久型 handler 改用 durable consumer
+func connectNATS(topics *nats.TopicFormatter) *nats.NATSManager {
+	natsURL := os.Getenv("NATS_URL")
+	if natsURL == "" {
+		natsURL = nat.DefaultURL
+	}
+	// NATS_CREDS、NATS_TLS_CA 等環境變量設置認證、TLS 與連線參數
+	natsConfig, err := nats.ConnectionConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid NATS configuration: %v", err)
+	}
+	natsManager := nats.NewNATSManager(natsURL, true).WithConfig(natsConfig)
+	if err := natsManager.Connect(); err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+
+	if os.Getenv("NATS_JETSTREAM") != "true" {
+		return natsManager
+	}
+
+	jsConfig := nats.DefaultJetStreamConfig()
+	if maxAge := os.Getenv("NATS_JETSTREAM_MAX_AGE"); maxAge != "" {
+		jsConfig.MaxAge, err = time.ParseDuration(maxAge)
+		if err != nil {
+			log.Fatalf("Invalid NATS_JETSTREAM_MAX_AGE: %v", err)
+		}
+	}
+	if replicas := os.Getenv("NATS_JETSTREAM_REPLICAS"); replicas != "" {
+		jsConfig.Replicas, err = strconv.Atoi(replicas)
+		if err != nil {
+			log.Fatalf("Invalid NATS_JETSTREAM_REPLICAS: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := natsManager.EnableJetStream(ctx, topics, jsConfig); err != nil {
+		log.Fatalf("Failed to enable JetStream: %v", err)
+	}
+	return natsManager
+}
+
+// openStore 開啟儲存後端：postgres 的 DATABASE_URL 是連線字串，sqlite 的 DATABASE_URL 是資料庫檔案的路徑，
+// memory 不保存任何資料，重新啟動後資料會消失，只適合開發與測試
+func openStore(driver, dsn string) storage.Store {
+	switch driver {
+	case "", "postgres":
+		if dsn == "" {
+			log.Fatal("DATABASE_URL not set")
+		}
+		var opts []storage.PostgresOption
+		if config := os.Getenv("SEARCH_CONFIG"); config != "" {
+			opts = append(opts, storage.WithSearchConfig(config))
+		}
+		store, err := storage.NewPostgresStore(dsn, opts...)
+		if err != nil {
+			log.Fatalf("Failed to connect to Postgres: %v", err)
+		}
+		return store
+	case "sqlite":
+		if dsn == "" {
+			dsn = "settlechat.db"
+		}
+		store, err := sqlite.Open(dsn)
+		if err != nil {
+			log.Fatalf("Failed to open SQLite database: %v", err)
+		}
+		return store
+	case "memory":
+		log.Println("Using in-memory storage, all data is lost on restart")
+		return memstore.NewStore()
+	default:
+		log.Fatalf("Invalid STORAGE_DRIVER: %q (want postgres, sqlite or memory)", driver)
+		return nil
+	}
+}
+
+// newMessageWriter 創建批次寫入聊天消息的 MessageWriter
+// MESSAGE_BATCH_SIZE 一批最多幾條，MESSAGE_FLUSH_INTERVAL 一批最多等待多久 (0 代表不等待，只合併排隊中的消息)
+func newMessageWriter(store storage.MessageStore) *storage.MessageWriter {
+	config := storage.DefaultWriterConfig()
+	var err error
+	if size := os.Getenv("MESSAGE_BATCH_SIZE"); size != "" {
+		config.MaxBatch, err = strconv.Atoi(size)
+		if err != nil {
+			log.Fatalf("Invalid MESSAGE_BATCH_SIZE: %v", err)
+		}
+	}
+	if interval := os.Getenv("MESSAGE_FLUSH_INTERVAL"); interval != "" {
+		config.FlushInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid MESSAGE_FLUSH_INTERVAL: %v", err)
+		}
+	}
+	return storage.NewMessageWriter(store, config)
+}
+
+// newMessageArchiver 設定分區封存：MESSAGE_ARCHIVE_DIR 是封存檔案的目錄 (預設 ./archive，多個實例必須共用)，
+// MESSAGE_ARCHIVE_AFTER 是月份結束多久後封存 (例如 2160h，0 代表不封存)
+func newMessageArchiver(store *storage.PostgresStore) *storage.MessageArchiver {
+	store.ArchiveDir = os.Getenv("MESSAGE_ARCHIVE_DIR")
+	if store.ArchiveDir == "" {
+		store.ArchiveDir = "archive"
+	}
+	archiver := storage.NewMessageArchiver(store)
+	if after := os.Getenv("MESSAGE_ARCHIVE_AFTER"); after != "" {
+		var err error
+		archiver.After, err = time.ParseDuration(after)
+		if err != nil {
+			log.Fatalf("Invalid MESSAGE_ARCHIVE_AFTER: %v", err)
+		}
+	}
+	return archiver
+}
+
+// newCache 在設置 REDIS_URL 時連線到所有實例共用的 Redis，
+// 沒有設置或無法連線時使用只屬於本實例的 in-memory 快取 (只適合單一實例)
+func newCache(namespace string) cache.Cache {
+	opts := cache.Options{Prefix: namespace}
+
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		log.Println("REDIS_URL not set, using in-memory cache for this instance only")
+		return cache.NewMemory(opts)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	redisCache, err := cache.DialRedis(ctx, url, opts)
+	if err != nil {
+		log.Printf("Warning: failed to connect to Redis, using in-memory cache for this instance only: %v", err)
+		return cache.NewMemory(opts)
+	}
+	log.Println("Connected to Redis")
+	return redisCache
+}
+
 // setupRoutes 設置 HTTP 路由
-func setupRoutes(mux *http.ServeMux, hub *chat.Hub, auth *handler.AuthHandler, room *handler.RoomHandler) {
-	mux.HandleFunc("/ws", handler.WebsocketHandler(hub))
+func setupRoutes(mux *http.ServeMux, hub *chat.Hub, wsConfig handler.WebsocketConfig, auth *handler.AuthHandler, room *handler.RoomHandler, status *handler.StatusHandler, transport *handler.HTTPTransportHandler, debug *handler.DebugHandler, deadLetters *handler.DeadLetterHandler, search *handler.SearchHandler, retention *handler.RetentionHandler, adminToken string) {
+	mux.HandleFunc("/ws", handler.WebsocketHandler(hub, wsConfig))
+	// WebSocket 被代理擋掉時的備用傳輸
+	mux.Handle("/sse", http.HandlerFunc(transport.SSE))
+	mux.Handle("/poll/connect", http.HandlerFunc(transport.PollConnect))
+	mux.Handle("/poll", http.HandlerFunc(transport.Poll))
+	mux.Handle("/send", http.HandlerFunc(transport.Send))
 	mux.Handle("/register", http.HandlerFunc(auth.Register))
 	mux.Handle("/login", http.HandlerFunc(auth.Login))
 	mux.Handle("/user", http.HandlerFunc(auth.GetUserByID))
+	mux.Handle("/user/status", http.HandlerFunc(status.UserStatus))
 	mux.Handle("/rooms/create", http.HandlerFunc(room.CreateRoom))
 	mux.Handle("/rooms/join", http.HandlerFunc(room.JoinRoom))
 	mux.Handle("/rooms/leave", http.HandlerFunc(room.LeaveRoom))
 	mux.Handle("/rooms", http.HandlerFunc(room.GetUserRooms))
+	mux.Handle("/rooms/members", http.HandlerFunc(room.RoomMembers))
+	mux.Handle("/rooms/state", http.HandlerFunc(room.RoomState))
+	mux.Handle("/rooms/history", http.HandlerFunc(room.RoomHistory))
+	mux.Handle("/rooms/retention", http.HandlerFunc(retention.Retention))
+	mux.Handle("/search", http.HandlerFunc(search.Search))
+	mux.Handle("/debug/hub", http.HandlerFunc(debug.HubSnapshot))
+	mux.Handle("/debug/events", http.HandlerFunc(debug.EventSchemas))
+	mux.Handle("/debug/handlers", http.HandlerFunc(debug.HandlerMetrics))
+	mux.Handle("/debug/dispatcher", http.HandlerFunc(debug.DispatcherStats))
+	mux.Handle("/debug/writer", http.HandlerFunc(debug.WriterStats))
+	mux.Handle("/admin/deadletters", handler.RequireAdmin(adminToken, http.HandlerFunc(deadLetters.DeadLetters)))
+	mux.Handle("/admin/deadletters/replay", handler.RequireAdmin(adminToken, http.HandlerFunc(deadLetters.Replay)))
+	mux.Handle("/admin/rooms/legalhold", handler.RequireAdmin(adminToken, http.HandlerFunc(retention.LegalHold)))
 	mux.Handle("/", http.FileServer(http.Dir("./web")))
 }
 
 // gracefulShutdown 處理優雅關閉
-func gracefulShutdown(server *http.Server, hub *chat.Hub, subscriber *nats.Subscriber) {
+func gracefulShutdown(server *http.Server, hub *chat.Hub, subscriber *nats.Subscriber, messageWriter *storage.MessageWriter, stopRelay context.CancelFunc, shutdownTracing tracing.Shutdown) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
@@ -129,18 +436,32 @@ func gracefulShutdown(server *http.Server, hub *chat.Hub, subscriber *nats.Subsc
 	log.Println("Shutting down server...")
 
 	// 1. 停止接受新的 HTTP 請求
+	// SSE 與 long-poll 的 WritePump 在 HTTP handler 中執行，Shutdown 會等待它們返回；
+	// 所以在 Shutdown 開始時就關閉 Hub 結束這些連線，而不是等到逾時
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	server.RegisterOnShutdown(hub.Close)
 	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("HTTP server shutdown error: %v", err)
 	}
 
-	// 2. 關閉 Hub（這會關閉所有 WebSocket 連接）
+	// 2. 關閉 Hub（這會關閉所有 WebSocket 連接，Shutdown 中已經關閉時不做任何事）
 	hub.Close()
 
 	// 3. 取消 NATS 訂閱
 	subscriber.Close()
 
+	// 3.1 寫入還在排隊的聊天消息
+	messageWriter.Close()
+
+	// 4. 停止 outbox relay，還沒發布的事件由其他實例或下次啟動時發布
+	stopRelay()
+
+	// 5. 送出還在緩衝的 span
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Tracing shutdown error: %v", err)
+	}
+
 	log.Println("Server gracefully stopped")
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ianwu0915/SettleChat/internal/messaging/eventlog"
+	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	nat "github.com/nats-io/nats.go"
+)
+
+// eventsFlags 是 events 子命令共用的連線與過濾參數
+type eventsFlags struct {
+	url    string
+	env    string
+	tenant string
+	topics string
+	room   string
+	user   string
+	types  string
+}
+
+func newEventsFlagSet(name string) (*flag.FlagSet, *eventsFlags) {
+	fs := flag.NewFlagSet("settlectl events "+name, flag.ExitOnError)
+	f := &eventsFlags{}
+
+	env := os.Getenv("ENVIRONMENT")
+	if env == "" {
+		env = "dev"
+	}
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		url = nat.DefaultURL
+	}
+
+	fs.StringVar(&f.url, "nats", url, "NATS server URL")
+	fs.StringVar(&f.env, "env", env, "environment of the topic namespace")
+	fs.StringVar(&f.tenant, "tenant", os.Getenv("TENANT"), "tenant of the topic namespace")
+	fs.StringVar(&f.topics, "topic", "", "comma-separated handler keys to include, e.g. message.chat,ai.command")
+	fs.StringVar(&f.room, "room", "", "only events of this room")
+	fs.StringVar(&f.user, "user", "", "only events triggered by this user")
+	fs.StringVar(&f.types, "type", "", "comma-separated event types to include, e.g. message.new")
+	return fs, f
+}
+
+func (f *eventsFlags) filter() eventlog.Filter {
+	return eventlog.Filter{
+		Topics: splitList(f.topics),
+		RoomID: f.room,
+		UserID: f.user,
+		Types:  splitList(f.types),
+	}
+}
+
+// connect 連線到 NATS，返回命名空間的 TopicFormatter 與傳輸層
+func (f *eventsFlags) connect() (*nats.TopicFormatter, *nats.NATSTransport, func()) {
+	topics, err := nats.NewNamespacedTopicFormatter(nats.Namespace{Environment: f.env, Tenant: f.tenant})
+	if err != nil {
+		log.Fatalf("Invalid topic namespace: %v", err)
+	}
+
+	cfg, err := nats.ConnectionConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid NATS configuration: %v", err)
+	}
+	cfg.Name = "settlectl"
+	manager := nats.NewNATSManager(f.url, false).WithConfig(cfg)
+	if err := manager.Connect(); err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	return topics, nats.NewTransport(manager), manager.Disconnect
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// signalContext 在 Ctrl-C 或 SIGTERM 時結束
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func runEvents(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: settlectl events <tail|record|replay> [flags]")
+	}
+
+	switch args[0] {
+	case "tail":
+		eventsTail(args[1:])
+	case "record":
+		eventsRecord(args[1:])
+	case "replay":
+		eventsReplay(args[1:])
+	default:
+		log.Fatalf("Unknown events subcommand %q (want tail, record or replay)", args[0])
+	}
+}
+
+// eventsTail 即時印出解碼後的事件
+func eventsTail(args []string) {
+	fs, f := newEventsFlagSet("tail")
+	asJSON := fs.Bool("json", false, "print one JSON object per event instead of the pretty format")
+	fs.Parse(args)
+
+	topics, transport, disconnect := f.connect()
+	defer disconnect()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	subject := topics.GetNamespaceWildcardTopic()
+	log.Printf("Tailing %s (Ctrl-C to stop)", subject)
+	err := eventlog.Watch(ctx, transport, subject, topics, f.filter(), func(event eventlog.Event) error {
+		if *asJSON {
+			return printJSON(os.Stdout, event)
+		}
+		return printPretty(os.Stdout, event)
+	})
+	if err != nil {
+		log.Fatalf("Tail failed: %v", err)
+	}
+}
+
+// eventsRecord 把事件錄製到檔案，直到收滿 -count 個事件、經過 -duration 或 Ctrl-C
+func eventsRecord(args []string) {
+	fs, f := newEventsFlagSet("record")
+	out := fs.String("o", "", "file to record to (- for stdout)")
+	count := fs.Int("count", 0, "stop after this many events (0 = no limit)")
+	duration := fs.Duration("duration", 0, "stop after this long (0 = until Ctrl-C)")
+	fs.Parse(args)
+	if *out == "" {
+		log.Fatal("record requires -o <file>")
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *out, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	writer := eventlog.NewWriter(w)
+
+	topics, transport, disconnect := f.connect()
+	defer disconnect()
+
+	ctx, stop := signalContext()
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	ctx, done := context.WithCancel(ctx)
+	defer done()
+
+	subject := topics.GetNamespaceWildcardTopic()
+	log.Printf("Recording %s to %s (Ctrl-C to stop)", subject, *out)
+	recorded := 0
+	err := eventlog.Watch(ctx, transport, subject, topics, f.filter(), func(event eventlog.Event) error {
+		if err := writer.Write(event.Record); err != nil {
+			return err
+		}
+		recorded++
+		if *count > 0 && recorded >= *count {
+			done()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Record failed after %d events: %v", recorded, err)
+	}
+	log.Printf("Recorded %d events", recorded)
+}
+
+// eventsReplay 把錄製的事件發布到 -env/-tenant 的命名空間
+func eventsReplay(args []string) {
+	fs, f := newEventsFlagSet("replay")
+	in := fs.String("i", "", "recorded file to replay (- for stdin)")
+	speed := fs.Float64("speed", 0, "replay speed relative to the recording, 1 = original timing (0 = as fast as possible)")
+	keepIDs := fs.Bool("keep-ids", false, "keep the original deduplication IDs (duplicates within the dedup window are dropped)")
+	fs.Parse(args)
+	if *in == "" {
+		log.Fatal("replay requires -i <file>")
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		file, err := os.Open(*in)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", *in, err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	topics, transport, disconnect := f.connect()
+	defer disconnect()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	published, err := eventlog.Replay(ctx, transport, topics, eventlog.NewReader(r), eventlog.ReplayOptions{
+		Speed:   *speed,
+		KeepIDs: *keepIDs,
+		Filter:  f.filter(),
+	})
+	if err != nil {
+		log.Fatalf("Replay failed after %d events: %v", published, err)
+	}
+	log.Printf("Replayed %d events onto namespace %q", published, topics.Namespace())
+}
+
+// printPretty 以一行摘要加上縮排的 payload 印出事件
+func printPretty(w io.Writer, event eventlog.Event) error {
+	at := event.ReceivedAt.Format("15:04:05.000")
+	if event.Envelope == nil {
+		_, err := fmt.Fprintf(w, "%s %s undecodable: %v\n  %s\n\n", at, event.Subject, event.DecodeErr, rawData(event.Data))
+		return err
+	}
+
+	e := event.Envelope
+	payload, err := json.MarshalIndent(e.Payload, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s %s v%d room=%s actor=%s id=%s\n  subject: %s\n  %s\n\n",
+		at, e.Type, e.Version, e.RoomID, e.Actor, e.ID, event.Subject, payload)
+	return err
+}
+
+// printJSON 以一行 JSON 印出事件，方便以 jq 處理
+func printJSON(w io.Writer, event eventlog.Event) error {
+	out := struct {
+		ReceivedAt time.Time `json:"received_at"`
+		Subject    string    `json:"subject"`
+		Event      any       `json:"event,omitempty"`
+		Error      string    `json:"error,omitempty"`
+	}{ReceivedAt: event.ReceivedAt, Subject: event.Subject}
+	if event.Envelope != nil {
+		out.Event = event.Envelope
+	} else {
+		out.Error = event.DecodeErr.Error()
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+// rawData 返回可以印出的 payload，二進位的 payload (例如 msgpack) 以十六進位表示
+func rawData(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return fmt.Sprintf("%x", data)
+}
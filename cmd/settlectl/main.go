@@ -0,0 +1,52 @@
+// settlectl 是 SettleChat 的維運工具
+//
+//	settlectl events tail    即時觀察事件總線上的事件
+//	settlectl events record  把事件錄製到檔案
+//	settlectl events replay  把錄製的事件重新發布到事件總線
+//	settlectl migrate        套用、回滾或查看資料庫的 schema migration
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+)
+
+const usage = `Usage: settlectl <command> [arguments]
+
+Commands:
+  events tail     Print decoded events as they are published
+  events record   Record events to a file
+  events replay   Publish recorded events back onto the bus
+  migrate up      Apply pending schema migrations (-to <version>)
+  migrate down    Roll back the latest migrations (-steps <n>, default 1)
+  migrate status  List migrations and when they were applied
+
+Run "settlectl <command> <subcommand> -h" for the flags of a subcommand.
+NATS_URL, ENVIRONMENT, TENANT, DATABASE_URL and the NATS_* auth variables are read from the environment and .env.
+`
+
+func main() {
+	log.SetFlags(0)
+	// 與伺服器共用 .env，沒有 .env 時只使用環境變量
+	_ = godotenv.Load(".env")
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "events":
+		runEvents(os.Args[2:])
+	case "migrate":
+		runMigrate(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: settlectl migrate <up|down|status> [flags]")
+	}
+
+	fs := flag.NewFlagSet("settlectl migrate "+args[0], flag.ExitOnError)
+	dsn := fs.String("db", os.Getenv("DATABASE_URL"), "Postgres connection string")
+	searchConfig := fs.String("search-config", cmp.Or(os.Getenv("SEARCH_CONFIG"), storage.DefaultSearchConfig), "text search config for messages.search_vector")
+	var target int64
+	var steps int
+	switch args[0] {
+	case "up":
+		fs.Int64Var(&target, "to", 0, "migrate up to this version (0 = latest)")
+	case "down":
+		fs.IntVar(&steps, "steps", 1, "number of migrations to roll back")
+	case "status":
+	default:
+		log.Fatalf("Unknown migrate subcommand %q (want up, down or status)", args[0])
+	}
+	fs.Parse(args[1:])
+	if *dsn == "" {
+		log.Fatal("DATABASE_URL not set, pass -db")
+	}
+
+	store, err := storage.OpenPostgresStore(*dsn, storage.WithSearchConfig(*searchConfig))
+	if err != nil {
+		log.Fatalf("Failed to connect to Postgres: %v", err)
+	}
+	defer store.Close()
+
+	migrator, err := storage.NewMigrator(store.DB)
+	if err != nil {
+		log.Fatalf("Invalid migrations: %v", err)
+	}
+	migrator.SearchConfig = store.SearchConfig()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx, target)
+		if err != nil {
+			log.Fatalf("Migrate up failed: %v", err)
+		}
+		if len(applied) == 0 {
+			log.Println("Schema is up to date")
+		}
+	case "down":
+		if steps <= 0 {
+			log.Fatal("-steps must be at least 1")
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		if errors.Is(err, storage.ErrNoMigrations) {
+			log.Println("No migrations to roll back")
+			return
+		}
+		if err != nil {
+			log.Fatalf("Migrate down failed after %d migrations: %v", len(reverted), err)
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatalf("Failed to read migration status: %v", err)
+		}
+		printMigrationStatus(statuses)
+	}
+}
+
+func printMigrationStatus(statuses []storage.MigrationStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, status := range statuses {
+		applied := "pending"
+		if status.AppliedAt != nil {
+			applied = status.AppliedAt.Local().Format(time.DateTime)
+		}
+		if status.Unknown {
+			applied += " (unknown to this binary)"
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, applied)
+	}
+	w.Flush()
+}
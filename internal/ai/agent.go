@@ -17,7 +17,7 @@ type CommandHandler func(context.Context, *AIMessage) (string, error)
 type Agent struct {
 	RoomID string
 	Provider Provider
-	store *storage.PostgresStore
+	store storage.MessageStore
 	commandMap map[string]CommandHandler
 	summaryCache *SummaryCache
 	maxPromptLength int
@@ -29,18 +29,18 @@ type Agent struct {
 type SummaryCache struct {
 	LastSummaryTime time.Time
 	LastSummaryText string
-	SummarizedMsgIDs map[int]bool
+	SummarizedMsgIDs map[int64]bool
 	mu sync.Mutex
 }
 
-func NewAgent(roomID string, provider Provider, store *storage.PostgresStore, manager *Manager) *Agent {
+func NewAgent(roomID string, provider Provider, store storage.MessageStore, manager *Manager) *Agent {
 	agent := &Agent{
 		RoomID: roomID,
 		Provider: provider,
 		store: store,
 		commandMap: make(map[string]CommandHandler),
 		summaryCache: &SummaryCache{
-			SummarizedMsgIDs: make(map[int]bool),
+			SummarizedMsgIDs: make(map[int64]bool),
 		},
 		maxPromptLength: 4000,
 		manager: manager,
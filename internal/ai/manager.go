@@ -14,7 +14,7 @@ import (
 // Facade for AI services
 type Manager struct {
 	agents map[string]*Agent // Each room has one agent
-	store *storage.PostgresStore
+	store storage.MessageStore
 	provider Provider
 	eventBus *messaging.EventBus
 	mu sync.RWMutex
@@ -56,7 +56,7 @@ func DefaultManagerConfig() ManagerConfig {
 	}
 }
 
-func NewManager(store *storage.PostgresStore, provider Provider, eventBus *messaging.EventBus, options ...ManagerOption) *Manager {
+func NewManager(store storage.MessageStore, provider Provider, eventBus *messaging.EventBus, options ...ManagerOption) *Manager {
 
 	config := DefaultManagerConfig()
 
@@ -69,7 +69,7 @@ func NewManager(store *storage.PostgresStore, provider Provider, eventBus *messa
 		store: store,
 		eventBus: eventBus,
 		config: config,
-		provider: provider,
+		provider: WithTracing(provider),
 	}
 
 	// Start the cleanup goroutine
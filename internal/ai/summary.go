@@ -103,7 +103,7 @@ func (a *Agent) updateSummaryCache(messages []storage.ChatMessage, newSummary st
 
 	// 如果緩存太大，清理舊的ID
 	if len(a.summaryCache.SummarizedMsgIDs) > 1000 {
-		a.summaryCache.SummarizedMsgIDs = make(map[int]bool)
+		a.summaryCache.SummarizedMsgIDs = make(map[int64]bool)
 		for _, msg := range messages {
 			a.summaryCache.SummarizedMsgIDs[msg.ID] = true
 		}
@@ -149,7 +149,7 @@ func (a *Agent) ClearSummaryCache() {
 	defer a.summaryCache.mu.Unlock()
 
 	a.summaryCache.LastSummaryText = ""
-	a.summaryCache.SummarizedMsgIDs = make(map[int]bool)
+	a.summaryCache.SummarizedMsgIDs = make(map[int64]bool)
 	a.summaryCache.LastSummaryTime = time.Time{}
 
 	log.Println("摘要緩存已清除")
@@ -0,0 +1,49 @@
+package ai
+
+import (
+	"context"
+
+	"github.com/ianwu0915/SettleChat/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedProvider 以 span 記錄每次呼叫 AI provider 的時間與結果
+type tracedProvider struct {
+	Provider
+}
+
+// WithTracing 包裝 provider，GenerateSummary 與 ProcessPrompt 會成為呼叫者 trace 中的 client span
+func WithTracing(provider Provider) Provider {
+	if _, ok := provider.(*tracedProvider); ok || provider == nil {
+		return provider
+	}
+	return &tracedProvider{Provider: provider}
+}
+
+func (p *tracedProvider) start(ctx context.Context, operation string, messages []MessageInput) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "ai "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("ai.provider", p.GetName()),
+			attribute.String("ai.operation", operation),
+			attribute.Int("ai.messages", len(messages)),
+		),
+	)
+}
+
+func (p *tracedProvider) GenerateSummary(ctx context.Context, messages []MessageInput, previousSummary string) (string, error) {
+	ctx, span := p.start(ctx, string(TaskTypeSummary), messages)
+	summary, err := p.Provider.GenerateSummary(ctx, messages, previousSummary)
+	span.SetAttributes(attribute.Int("ai.response.length", len(summary)))
+	tracing.End(span, err)
+	return summary, err
+}
+
+func (p *tracedProvider) ProcessPrompt(ctx context.Context, prompt string, messages []MessageInput) (string, error) {
+	ctx, span := p.start(ctx, string(TaskTypePrompt), messages)
+	response, err := p.Provider.ProcessPrompt(ctx, prompt, messages)
+	span.SetAttributes(attribute.Int("ai.response.length", len(response)))
+	tracing.End(span, err)
+	return response, err
+}
@@ -0,0 +1,127 @@
+// Package cache 是多個實例共享的快取層：房間的在線用戶、用戶的限流計數與房間最近的消息
+// Redis 實現讓所有實例看到同一份資料；沒有 Redis 時使用 in-memory 實現，只適合單一實例
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+const (
+	// DefaultHistorySize 每個房間快取的最近消息數，與歷史消息查詢的上限相同
+	DefaultHistorySize = 50
+	// DefaultHistoryTTL 房間的消息快取在沒有新消息也沒有被讀取時保留的時間
+	DefaultHistoryTTL = time.Hour
+	// DefaultPresenceTTL 在線記錄沒有被刷新時保留的時間，實例崩潰時它的用戶在這之後視為離線
+	DefaultPresenceTTL = 90 * time.Second
+)
+
+// Cache 是快取層的完整介面
+type Cache interface {
+	Presence
+	RateLimiter
+	History
+	Close() error
+}
+
+// Presence 記錄每個房間的在線用戶
+type Presence interface {
+	// SetOnline 記錄用戶在房間內在線，PresenceTTL 內沒有被刷新就視為離線
+	SetOnline(ctx context.Context, roomID, userID string) error
+	SetOffline(ctx context.Context, roomID, userID string) error
+	// Refresh 延長用戶在房間內的在線記錄，不會把已經離線 (或隱身) 的用戶加回來
+	Refresh(ctx context.Context, roomID string, userIDs []string) error
+	// OnlineUsers 返回房間內在線的用戶 ID，沒有順序
+	OnlineUsers(ctx context.Context, roomID string) ([]string, error)
+}
+
+// RateLimiter 以固定窗口計數限制操作頻率
+type RateLimiter interface {
+	// Allow 把 key 在目前窗口的計數加一，超過 rate.Limit 時返回 false
+	Allow(ctx context.Context, key string, rate Rate) (bool, error)
+}
+
+// Loader 從資料庫讀取房間最近的 n 條消息，按時間由舊到新排序
+type Loader func(ctx context.Context, roomID string, n int) ([]storage.ChatMessage, error)
+
+// History 快取每個房間最近的 HistorySize 條消息
+type History interface {
+	// RecentMessages 返回房間最近的 limit 條消息 (由舊到新)
+	// 快取中沒有這個房間時以 load 讀取 HistorySize 條並寫入快取；limit 超過 HistorySize 時直接使用 load
+	RecentMessages(ctx context.Context, roomID string, limit int, load Loader) ([]storage.ChatMessage, error)
+	// AppendMessage 在消息保存後加入房間的快取，快取中沒有這個房間時不做任何事
+	AppendMessage(ctx context.Context, msg storage.ChatMessage) error
+	// InvalidateHistory 清除房間的快取 (例如消息被刪除之後)，下一次讀取時重新從資料庫載入
+	InvalidateHistory(ctx context.Context, roomID string) error
+}
+
+// Options 設置快取的大小與過期時間，零值使用預設值
+type Options struct {
+	// Prefix 所有鍵的前綴，讓多個環境或租戶共用一個 Redis，例如 TopicFormatter.Namespace()
+	Prefix      string
+	HistorySize int
+	HistoryTTL  time.Duration
+	PresenceTTL time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.HistorySize <= 0 {
+		o.HistorySize = DefaultHistorySize
+	}
+	if o.HistoryTTL <= 0 {
+		o.HistoryTTL = DefaultHistoryTTL
+	}
+	if o.PresenceTTL <= 0 {
+		o.PresenceTTL = DefaultPresenceTTL
+	}
+	return o
+}
+
+// Rate 是每個窗口允許的次數
+type Rate struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Enabled 是否需要限流，零值的 Rate 不限制
+func (r Rate) Enabled() bool {
+	return r.Limit > 0 && r.Window > 0
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Limit, r.Window)
+}
+
+// ErrInvalidRate 限流設定的格式錯誤
+var ErrInvalidRate = errors.New("invalid rate")
+
+// ParseRate 解析 "20/10s" 格式的限流設定 (每 10 秒 20 次)，空字串返回不限流的 Rate
+func ParseRate(s string) (Rate, error) {
+	if s == "" {
+		return Rate{}, nil
+	}
+	count, window, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("%w %q: want <count>/<window>, e.g. 20/10s", ErrInvalidRate, s)
+	}
+	limit, err := strconv.Atoi(count)
+	if err != nil || limit < 0 {
+		return Rate{}, fmt.Errorf("%w %q: bad count", ErrInvalidRate, s)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("%w %q: bad window", ErrInvalidRate, s)
+	}
+	return Rate{Limit: limit, Window: d}, nil
+}
+
+// windowIndex 返回 now 所在的窗口編號，同一個窗口的計數共用一個鍵
+func (r Rate) windowIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(r.Window)
+}
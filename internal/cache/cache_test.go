@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+// implementations 對每一種實現執行同一組測試
+func implementations(t *testing.T, opts Options) map[string]Cache {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	caches := map[string]Cache{
+		"memory": NewMemory(opts),
+		"redis":  NewRedis(client, opts),
+	}
+	t.Cleanup(func() {
+		for _, c := range caches {
+			c.Close()
+		}
+	})
+	return caches
+}
+
+func TestPresence(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range implementations(t, Options{PresenceTTL: 100 * time.Millisecond}) {
+		t.Run(name, func(t *testing.T) {
+			c.SetOnline(ctx, "room-1", "u1")
+			c.SetOnline(ctx, "room-1", "u2")
+			c.SetOnline(ctx, "room-2", "u3")
+			c.SetOffline(ctx, "room-1", "u2")
+
+			online, err := c.OnlineUsers(ctx, "room-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(online, []string{"u1"}) {
+				t.Fatalf("online = %v, want [u1]", online)
+			}
+
+			// Refresh 只延長仍然在線的用戶，不會把離線的 u2 加回來
+			time.Sleep(60 * time.Millisecond)
+			if err := c.Refresh(ctx, "room-1", []string{"u1", "u2"}); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(60 * time.Millisecond)
+			if online, _ := c.OnlineUsers(ctx, "room-1"); !slices.Equal(online, []string{"u1"}) {
+				t.Fatalf("online after refresh = %v, want [u1]", online)
+			}
+			if online, _ := c.OnlineUsers(ctx, "room-2"); len(online) != 0 {
+				t.Fatalf("online of room-2 after TTL = %v, want none", online)
+			}
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	ctx := context.Background()
+	rate := Rate{Limit: 3, Window: time.Hour}
+	for name, c := range implementations(t, Options{}) {
+		t.Run(name, func(t *testing.T) {
+			for i := range 5 {
+				allowed, err := c.Allow(ctx, "chat:u1", rate)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := i < rate.Limit; allowed != want {
+					t.Fatalf("attempt %d allowed = %v, want %v", i+1, allowed, want)
+				}
+			}
+			if allowed, _ := c.Allow(ctx, "chat:u2", rate); !allowed {
+				t.Fatal("other key was limited")
+			}
+			if allowed, _ := c.Allow(ctx, "chat:u1", Rate{}); !allowed {
+				t.Fatal("zero rate was limited")
+			}
+		})
+	}
+}
+
+func message(roomID string, i int) storage.ChatMessage {
+	return storage.ChatMessage{
+		RoomID:    roomID,
+		SenderID:  "u1",
+		Sender:    "alice",
+		Content:   fmt.Sprintf("message %d", i),
+		Timestamp: time.Date(2026, 1, 1, 0, 0, i, 0, time.UTC),
+	}
+}
+
+func contents(messages []storage.ChatMessage) []string {
+	var out []string
+	for _, msg := range messages {
+		out = append(out, msg.Content)
+	}
+	return out
+}
+
+func TestRecentMessages(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range implementations(t, Options{HistorySize: 3}) {
+		t.Run(name, func(t *testing.T) {
+			db := []storage.ChatMessage{message("room-1", 1), message("room-1", 2)}
+			loads := 0
+			load := func(ctx context.Context, roomID string, n int) ([]storage.ChatMessage, error) {
+				loads++
+				return lastN(db, n), nil
+			}
+			save := func(msg storage.ChatMessage) {
+				db = append(db, msg)
+				if err := c.AppendMessage(ctx, msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 第一次讀取從資料庫載入，之後從快取讀取
+			for range 2 {
+				got, err := c.RecentMessages(ctx, "room-1", 3, load)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(contents(got), []string{"message 1", "message 2"}) {
+					t.Fatalf("messages = %v", contents(got))
+				}
+			}
+			if loads != 1 {
+				t.Fatalf("loaded %d times, want 1", loads)
+			}
+
+			// 新消息加到快取，只保留最近 HistorySize 條
+			save(message("room-1", 3))
+			save(message("room-1", 4))
+			got, _ := c.RecentMessages(ctx, "room-1", 2, load)
+			if !slices.Equal(contents(got), []string{"message 3", "message 4"}) {
+				t.Fatalf("messages after append = %v", contents(got))
+			}
+			got, _ = c.RecentMessages(ctx, "room-1", 3, load)
+			if !slices.Equal(contents(got), []string{"message 2", "message 3", "message 4"}) {
+				t.Fatalf("messages after trim = %v", contents(got))
+			}
+			if loads != 1 {
+				t.Fatalf("loaded %d times, want 1", loads)
+			}
+
+			// 超過 HistorySize 的查詢直接讀取資料庫
+			if got, _ := c.RecentMessages(ctx, "room-1", 10, load); len(got) != 4 || loads != 2 {
+				t.Fatalf("got %d messages with %d loads, want 4 messages from the database", len(got), loads)
+			}
+
+			// 沒有載入的房間不會因為新消息而只快取到一部分的消息
+			save(message("room-2", 1))
+			db = append(db, message("room-2", 2))
+			got, _ = c.RecentMessages(ctx, "room-2", 3, func(ctx context.Context, roomID string, n int) ([]storage.ChatMessage, error) {
+				return []storage.ChatMessage{message("room-2", 1), message("room-2", 2)}, nil
+			})
+			if len(got) != 2 {
+				t.Fatalf("room-2 messages = %v", contents(got))
+			}
+		})
+	}
+}
+
+func TestRecentMessagesSkipsStaleLoad(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range implementations(t, Options{HistorySize: 3}) {
+		t.Run(name, func(t *testing.T) {
+			loads := 0
+			// 讀取資料庫期間有新消息保存，讀到的舊資料不能寫入快取，否則快取會少了這條消息
+			stale := func(ctx context.Context, roomID string, n int) ([]storage.ChatMessage, error) {
+				loads++
+				if loads == 1 {
+					c.AppendMessage(ctx, message(roomID, 2))
+				}
+				return []storage.ChatMessage{message(roomID, 1)}, nil
+			}
+			c.RecentMessages(ctx, "room-1", 3, stale)
+
+			fresh := func(ctx context.Context, roomID string, n int) ([]storage.ChatMessage, error) {
+				loads++
+				return []storage.ChatMessage{message(roomID, 1), message(roomID, 2)}, nil
+			}
+			got, err := c.RecentMessages(ctx, "room-1", 3, fresh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loads != 2 || !slices.Equal(contents(got), []string{"message 1", "message 2"}) {
+				t.Fatalf("messages = %v after %d loads, want both messages after reloading", contents(got), loads)
+			}
+		})
+	}
+}
+
+func TestInvalidateHistory(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range implementations(t, Options{HistorySize: 3}) {
+		t.Run(name, func(t *testing.T) {
+			db := []storage.ChatMessage{message("room-1", 1), message("room-1", 2)}
+			load := func(ctx context.Context, roomID string, n int) ([]storage.ChatMessage, error) {
+				return lastN(db, n), nil
+			}
+			c.RecentMessages(ctx, "room-1", 3, load)
+
+			// 消息被刪除之後重新從資料庫載入
+			db = db[1:]
+			if err := c.InvalidateHistory(ctx, "room-1"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.RecentMessages(ctx, "room-1", 3, load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(contents(got), []string{"message 2"}) {
+				t.Fatalf("messages after invalidation = %v", contents(got))
+			}
+			if err := c.InvalidateHistory(ctx, "room-unknown"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Rate
+		wantErr bool
+	}{
+		{"", Rate{}, false},
+		{"20/10s", Rate{Limit: 20, Window: 10 * time.Second}, false},
+		{"5/1m", Rate{Limit: 5, Window: time.Minute}, false},
+		{"20", Rate{}, true},
+		{"x/10s", Rate{}, true},
+		{"20/0s", Rate{}, true},
+		{"-1/10s", Rate{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
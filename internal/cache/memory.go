@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// Memory 是 in-process 的 Cache，資料只存在於本實例，多實例部署時要使用 Redis
+type Memory struct {
+	opts Options
+	now  func() time.Time
+
+	mu       sync.Mutex
+	presence map[string]map[string]time.Time // roomID -> userID -> 過期時間
+	counters map[string]counter
+	history  map[string]*memoryHistory
+}
+
+type counter struct {
+	window int64
+	count  int
+}
+
+type memoryHistory struct {
+	messages []storage.ChatMessage
+	loaded   bool
+	// version 每次 AppendMessage 與 InvalidateHistory 都會增加，讀取資料庫期間有新消息時不寫入讀到的舊資料
+	version   uint64
+	expiresAt time.Time
+}
+
+// NewMemory 創建一個 in-memory 快取
+func NewMemory(opts Options) *Memory {
+	return &Memory{
+		opts:     opts.withDefaults(),
+		now:      time.Now,
+		presence: make(map[string]map[string]time.Time),
+		counters: make(map[string]counter),
+		history:  make(map[string]*memoryHistory),
+	}
+}
+
+func (m *Memory) SetOnline(ctx context.Context, roomID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users, ok := m.presence[roomID]
+	if !ok {
+		users = make(map[string]time.Time)
+		m.presence[roomID] = users
+	}
+	users[userID] = m.now().Add(m.opts.PresenceTTL)
+	return nil
+}
+
+func (m *Memory) SetOffline(ctx context.Context, roomID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.presence[roomID], userID)
+	if len(m.presence[roomID]) == 0 {
+		delete(m.presence, roomID)
+	}
+	return nil
+}
+
+func (m *Memory) Refresh(ctx context.Context, roomID string, userIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	users := m.presence[roomID]
+	for _, userID := range userIDs {
+		if expiresAt, ok := users[userID]; ok && expiresAt.After(now) {
+			users[userID] = now.Add(m.opts.PresenceTTL)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) OnlineUsers(ctx context.Context, roomID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	var online []string
+	for userID, expiresAt := range m.presence[roomID] {
+		if expiresAt.After(now) {
+			online = append(online, userID)
+		} else {
+			delete(m.presence[roomID], userID)
+		}
+	}
+	return online, nil
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, rate Rate) (bool, error) {
+	if !rate.Enabled() {
+		return true, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	window := rate.windowIndex(m.now())
+	c := m.counters[key]
+	if c.window != window {
+		c = counter{window: window}
+	}
+	c.count++
+	m.counters[key] = c
+	return c.count <= rate.Limit, nil
+}
+
+func (m *Memory) RecentMessages(ctx context.Context, roomID string, limit int, load Loader) ([]storage.ChatMessage, error) {
+	if limit > m.opts.HistorySize {
+		return load(ctx, roomID, limit)
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	m.mu.Lock()
+	h := m.history[roomID]
+	if h != nil && h.loaded && h.expiresAt.After(m.now()) {
+		h.expiresAt = m.now().Add(m.opts.HistoryTTL)
+		messages := lastN(h.messages, limit)
+		m.mu.Unlock()
+		return messages, nil
+	}
+	if h == nil {
+		h = &memoryHistory{}
+		m.history[roomID] = h
+	}
+	version := h.version
+	m.mu.Unlock()
+
+	messages, err := load(ctx, roomID, m.opts.HistorySize)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if m.history[roomID] == h && h.version == version {
+		h.messages = slices.Clone(messages)
+		h.loaded = true
+		h.expiresAt = m.now().Add(m.opts.HistoryTTL)
+	}
+	m.mu.Unlock()
+	return lastN(messages, limit), nil
+}
+
+func (m *Memory) AppendMessage(ctx context.Context, msg storage.ChatMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.history[msg.RoomID]
+	if h == nil {
+		return nil
+	}
+	h.version++
+	if !h.loaded || !h.expiresAt.After(m.now()) {
+		h.loaded = false
+		h.messages = nil
+		return nil
+	}
+	h.messages = lastN(append(h.messages, msg), m.opts.HistorySize)
+	h.expiresAt = m.now().Add(m.opts.HistoryTTL)
+	return nil
+}
+
+func (m *Memory) InvalidateHistory(ctx context.Context, roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// 增加 version，正在讀取資料庫的舊資料不會寫回快取
+	if h := m.history[roomID]; h != nil {
+		h.version++
+		h.loaded = false
+		h.messages = nil
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// lastN 返回 messages 最後 n 條消息的副本
+func lastN(messages []storage.ChatMessage, n int) []storage.ChatMessage {
+	n = max(n, 0)
+	if n < len(messages) {
+		messages = messages[len(messages)-n:]
+	}
+	return slices.Clone(messages)
+}
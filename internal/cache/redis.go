@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+// keyRoot 所有鍵的共同前綴
+const keyRoot = "settlechat"
+
+// Redis 以 Redis 實現 Cache，所有實例共用
+//
+//	{prefix}presence:{roomID}            sorted set，成員是用戶 ID，分數是在線記錄的過期時間 (毫秒)
+//	{prefix}ratelimit:{key}:{window}     固定窗口的計數
+//	{prefix}history:{roomID}             list，房間最近的消息 (JSON，由舊到新)
+//	{prefix}history:{roomID}:loaded      存在時表示 list 已經從資料庫載入
+//	{prefix}history:{roomID}:version     每次 AppendMessage 與 InvalidateHistory 都會增加
+//
+// 同一個房間的 history 鍵以 {roomID} 作為 hash tag，在 Redis Cluster 中位於同一個 slot，Lua 腳本才能同時操作
+type Redis struct {
+	client redis.UniversalClient
+	opts   Options
+	prefix string
+}
+
+// NewRedis 以既有的 client 創建 Redis 快取，Close 會關閉 client
+func NewRedis(client redis.UniversalClient, opts Options) *Redis {
+	prefix := keyRoot + ":"
+	if opts.Prefix != "" {
+		prefix += opts.Prefix + ":"
+	}
+	return &Redis{client: client, opts: opts.withDefaults(), prefix: prefix}
+}
+
+// DialRedis 連線到 url (例如 redis://localhost:6379/0) 並確認 Redis 可以使用
+func DialRedis(ctx context.Context, url string, opts Options) (*Redis, error) {
+	redisOpts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+	client := redis.NewClient(redisOpts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ping redis: %w", err)
+	}
+	return NewRedis(client, opts), nil
+}
+
+func (r *Redis) presenceKey(roomID string) string {
+	return r.prefix + "presence:" + roomID
+}
+
+func (r *Redis) historyKeys(roomID string) []string {
+	list := r.prefix + "history:{" + roomID + "}"
+	return []string{list, list + ":loaded", list + ":version"}
+}
+
+func (r *Redis) SetOnline(ctx context.Context, roomID, userID string) error {
+	key := r.presenceKey(roomID)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, redis.Z{Score: r.presenceExpiry(), Member: userID})
+		pipe.PExpire(ctx, key, r.opts.PresenceTTL)
+		return nil
+	})
+	return err
+}
+
+func (r *Redis) SetOffline(ctx context.Context, roomID, userID string) error {
+	return r.client.ZRem(ctx, r.presenceKey(roomID), userID).Err()
+}
+
+func (r *Redis) Refresh(ctx context.Context, roomID string, userIDs []string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	key := r.presenceKey(roomID)
+	expiry := r.presenceExpiry()
+	members := make([]redis.Z, 0, len(userIDs))
+	for _, userID := range userIDs {
+		members = append(members, redis.Z{Score: expiry, Member: userID})
+	}
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		// 先移除已經過期的記錄，XX 只更新仍然存在的成員
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(time.Now().UnixMilli(), 10))
+		pipe.ZAddXX(ctx, key, members...)
+		pipe.PExpire(ctx, key, r.opts.PresenceTTL)
+		return nil
+	})
+	return err
+}
+
+func (r *Redis) OnlineUsers(ctx context.Context, roomID string) ([]string, error) {
+	return r.client.ZRangeByScore(ctx, r.presenceKey(roomID), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+}
+
+func (r *Redis) presenceExpiry() float64 {
+	return float64(time.Now().Add(r.opts.PresenceTTL).UnixMilli())
+}
+
+func (r *Redis) Allow(ctx context.Context, key string, rate Rate) (bool, error) {
+	if !rate.Enabled() {
+		return true, nil
+	}
+
+	counterKey := fmt.Sprintf("%sratelimit:%s:%d", r.prefix, key, rate.windowIndex(time.Now()))
+	var incr *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, counterKey)
+		pipe.PExpire(ctx, counterKey, rate.Window)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return incr.Val() <= int64(rate.Limit), nil
+}
+
+// fillHistory 在讀取資料庫期間沒有新消息 (version 沒有改變) 時，以讀到的消息取代房間的快取
+// KEYS: list, loaded, version；ARGV: 讀取前的 version、TTL (毫秒)、消息...
+var fillHistory = redis.NewScript(`
+local version = redis.call('GET', KEYS[3]) or '0'
+if version ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+if #ARGV > 2 then
+	redis.call('RPUSH', KEYS[1], unpack(ARGV, 3))
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+redis.call('SET', KEYS[2], '1', 'PX', ARGV[2])
+return 1
+`)
+
+// appendHistory 增加 version，房間已經載入時把消息加到最後並只保留最近的消息
+// KEYS: list, loaded, version；ARGV: 消息、保留的消息數、TTL (毫秒)
+var appendHistory = redis.NewScript(`
+redis.call('INCR', KEYS[3])
+redis.call('PEXPIRE', KEYS[3], ARGV[3])
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	return 0
+end
+redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('LTRIM', KEYS[1], -tonumber(ARGV[2]), -1)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+return 1
+`)
+
+// invalidateHistory 增加 version 並刪除已經載入的消息，正在讀取資料庫的舊資料不會寫回快取
+// KEYS: list, loaded, version；ARGV: TTL (毫秒)
+var invalidateHistory = redis.NewScript(`
+redis.call('INCR', KEYS[3])
+redis.call('PEXPIRE', KEYS[3], ARGV[1])
+redis.call('DEL', KEYS[1], KEYS[2])
+return 1
+`)
+
+func (r *Redis) RecentMessages(ctx context.Context, roomID string, limit int, load Loader) ([]storage.ChatMessage, error) {
+	if limit > r.opts.HistorySize {
+		return load(ctx, roomID, limit)
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	keys := r.historyKeys(roomID)
+	var loaded *redis.IntCmd
+	var cached *redis.StringSliceCmd
+	var version *redis.StringCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		loaded = pipe.Exists(ctx, keys[1])
+		cached = pipe.LRange(ctx, keys[0], int64(-limit), -1)
+		version = pipe.Get(ctx, keys[2])
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if loaded.Val() == 1 {
+		return decodeMessages(cached.Val())
+	}
+
+	before := version.Val()
+	if before == "" {
+		before = "0"
+	}
+	messages, err := load(ctx, roomID, r.opts.HistorySize)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []any{before, r.opts.HistoryTTL.Milliseconds()}
+	for _, msg := range messages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, fmt.Errorf("encode message: %w", err)
+		}
+		args = append(args, data)
+	}
+	// 寫入快取失敗不影響這次讀取，下一次讀取會再從資料庫載入
+	if err := fillHistory.Run(ctx, r.client, keys, args...).Err(); err != nil {
+		log.Printf("Failed to fill history cache of room %s: %v", roomID, err)
+	}
+	return lastN(messages, limit), nil
+}
+
+func (r *Redis) AppendMessage(ctx context.Context, msg storage.ChatMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("encode message: %w", err)
+	}
+	return appendHistory.Run(ctx, r.client, r.historyKeys(msg.RoomID), data, r.opts.HistorySize, r.opts.HistoryTTL.Milliseconds()).Err()
+}
+
+func (r *Redis) InvalidateHistory(ctx context.Context, roomID string) error {
+	return invalidateHistory.Run(ctx, r.client, r.historyKeys(roomID), r.opts.HistoryTTL.Milliseconds()).Err()
+}
+
+func decodeMessages(values []string) ([]storage.ChatMessage, error) {
+	messages := make([]storage.ChatMessage, 0, len(values))
+	for _, value := range values {
+		var msg storage.ChatMessage
+		if err := json.Unmarshal([]byte(value), &msg); err != nil {
+			return nil, fmt.Errorf("decode cached message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -1,28 +1,45 @@
 package chat
 
 import (
+	"context"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	messaging "github.com/ianwu0915/SettleChat/internal/messaging"
 	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Define Client Struct
-// Represnet a Websocker connection with a user and a corresponding room
+// Represent a connection (WebSocket, SSE or long-polling) with a user and a corresponding room
 type Client struct {
 	Hub      *Hub
 	ID       string
 	Username string
-	Conn     *websocket.Conn
+	Conn     Conn
 	Send     chan storage.ChatMessage // Message received from broadcast to the room
 	RoomID   string
 	EventBus *messaging.EventBus
+
+	// ReplaySince 客戶端重新連線時帶上的最後收到消息的時間，非零值時從 JetStream 補回之後的消息
+	ReplaySince time.Time
+
+	// done 在客戶端離開房間時關閉，等待中的 deliver 立即返回；sendMu 保證 Send 不會在送出途中被關閉
+	done      chan struct{}
+	sendMu    sync.Mutex
+	closeOnce sync.Once
+
+	lastActivity time.Time // 最後一次送出非心跳消息的時間
+	active       bool      // 這個連線是否已經有過活動
+	activityMu   sync.Mutex
 }
 
-func NewClient(hub *Hub, id, username string, conn *websocket.Conn, roomID string, eventBus *messaging.EventBus) *Client {
+func NewClient(hub *Hub, id, username string, conn Conn, roomID string, eventBus *messaging.EventBus) *Client {
 	return &Client{
 		Hub:      hub,
 		ID:       id,
@@ -31,6 +48,66 @@ func NewClient(hub *Hub, id, username string, conn *websocket.Conn, roomID strin
 		Send:     make(chan storage.ChatMessage),
 		RoomID:   roomID,
 		EventBus: eventBus,
+		done:     make(chan struct{}),
+
+		lastActivity: time.Now(),
+	}
+}
+
+// CloseSend 關閉 Send 讓 WritePump 結束，只會關閉一次
+// 必須在持有房間的 Mu 時呼叫，與房間內 (同樣持有 Mu) 的非阻塞廣播互斥
+func (c *Client) CloseSend() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.sendMu.Lock()
+		close(c.Send)
+		c.sendMu.Unlock()
+	})
+}
+
+// send 在 timeout 內把消息交給 WritePump，客戶端離開房間或太久沒有取走時返回 false
+// 不持有房間的 Mu，慢的客戶端不會擋住房間的廣播與其他客戶端離開
+func (c *Client) send(msg storage.ChatMessage, timeout time.Duration) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case c.Send <- msg:
+		return true
+	case <-c.done:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+// LastActivity 返回客戶端最後一次活動的時間
+func (c *Client) LastActivity() time.Time {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	return c.lastActivity
+}
+
+// touch 記錄客戶端的活動，如果用戶被自動設為 away 則恢復在線
+// 連線的第一次活動與閒置超過 AwayTimeout 後的活動都可能遇到其他實例 (或重啟之前) 設定的 away
+func (c *Client) touch() {
+	now := time.Now()
+	c.activityMu.Lock()
+	idle := now.Sub(c.lastActivity)
+	first := !c.active
+	c.lastActivity, c.active = now, true
+	c.activityMu.Unlock()
+
+	if c.Hub != nil {
+		c.Hub.markActive(c, first || idle >= c.Hub.AwayTimeout)
 	}
 }
 
@@ -41,7 +118,7 @@ const (
 	maxMessageSize = 1024
 )
 
-// Write the message recieved from the Send Channel into Websocket to the front-end to display
+// Write the message recieved from the Send Channel into the connection to the front-end to display
 func (c *Client) WritePump() {
 
 	ticker := time.NewTicker(pingPeriod)
@@ -53,33 +130,27 @@ func (c *Client) WritePump() {
 	for {
 		select {
 		case message, ok := <-c.Send:
-			// 設定 寫入Websocket的超時時間 避免碰到死掉的websocket
-			// 如果在 10 秒內沒有成功寫入，這次操作就會 fail，返回錯誤 → goroutine 可以結束，不會 hang 死
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-
 			if !ok { // no more values and the channel is closed
-				// Server主動要關掉連線時送這個
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				// Server主動要關掉連線，由 Close 通知客戶端
 				return
 			}
 
-			if err := c.Conn.WriteJSON(message); err != nil {
-				log.Printf("Error writing to WebSocket: %v", err)
+			// 寫入有超時時間，如果寫入失敗就結束 goroutine，不會 hang 死
+			if err := c.Conn.WriteMessage(message); err != nil {
+				log.Printf("Error writing to client %s: %v", c.ID, err)
 				return
 			}
 
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := c.Conn.Ping(); err != nil {
 				log.Printf("Error sending ping to client %s: %v", c.ID, err)
 				return
 			}
-			log.Printf("Sent ping to client: %s", c.ID) // 可選：用於調試
 		}
 	}
 }
 
-// Read the message input from the front-end passed into Websocket and pass into Room.Broadcast
+// Read the message input from the front-end passed into the connection and publish it as an event
 func (c *Client) ReadPump() {
 	log.Printf("client connected: %s (%s) in room %s", c.Username, c.ID, c.RoomID)
 	defer func() {
@@ -87,31 +158,14 @@ func (c *Client) ReadPump() {
 		c.Conn.Close()
 	}()
 
-	// 設置最大消息大小
-	c.Conn.SetReadLimit(maxMessageSize)
-
-	// 設置初始的讀取截止時間
-	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-
-	// 設置pong處理器，每當收到pong就延長截止時間
-	c.Conn.SetPongHandler(func(string) error {
-		// 重設讀取截止時間
-		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-		log.Printf("Received pong from client: %s", c.ID) // 可選：用於調試
-		return nil
-	})
-
-
-	// Read Message from Websocket:
+	// Read Message from the connection:
 	// 1. heartbeat msg
 	// 2. AI command
 	// 3. Normal ChatMessage
 	for {
 		var msg storage.ChatMessage
-		log.Println("waiting for message...")
 
-		// Read Message from WebSocket
-		if err := c.Conn.ReadJSON(&msg); err != nil {
+		if err := c.Conn.ReadMessage(&msg); err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Println("unexpected close error:", err)
 			} else {
@@ -122,38 +176,53 @@ func (c *Client) ReadPump() {
 
 		// 處理前端發送的心跳消息
 		if msg.Content == "" && msg.SenderID == "" {
-			// 這可能是前端發送的心跳消息，重置超時並忽略它
-			c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+			// 這可能是前端發送的心跳消息，連線已在讀取時重置超時，忽略它
 			log.Printf("Received heartbeat from client: %s", c.ID)
 			continue
 		}
 
-		// 補上消息的其他字段
+		c.touch()
+
+		isCommand := strings.HasPrefix(msg.Content, "/")
+		if c.Hub != nil && !c.Hub.allowMessage(c, isCommand) {
+			continue
+		}
+
+		// 補上消息的其他字段，ID 在保存時才產生，不接受客戶端帶來的值
+		msg.ID = 0
 		msg.RoomID = c.RoomID
 		msg.SenderID = c.ID
 		msg.Sender = c.Username
 		msg.Timestamp = time.Now()
 
+		// 每條消息都是一個 trace 的起點，之後的事件、handler、SQL 與廣播都接在這個 span 之下
+		ctx, span := tracing.Start(context.Background(), "receive chat message",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("settlechat.room_id", c.RoomID),
+				attribute.String("settlechat.user_id", c.ID),
+			),
+		)
+		var err error
+
 		// 先檢查是否是 AI 命令
-		if strings.HasPrefix(msg.Content, "/") {
+		if isCommand {
 			// 發布 AI 命令事件
 			if c.EventBus != nil {
-				if err := c.EventBus.PublishAICommandEvent(msg); err != nil {
+				if err = c.EventBus.PublishAICommandEvent(ctx, msg); err != nil {
 					log.Printf("Failed to publish AI command event: %v", err)
 				} else {
 					log.Printf("Published AI command event for %s in room %s", c.Username, c.RoomID)
 				}
 			}
 		} else {
-			// 不是AI命令：發布普通消息事件
+			// 不是AI命令：發布普通消息事件，客戶端的 client_msg_id 隨消息帶到 ack 與廣播
 			if c.EventBus != nil {
-				if err := c.EventBus.PublishNewMessageEvent(c.RoomID, c.ID, c.Username, msg.Content); err != nil {
+				if err = c.EventBus.PublishChatMessageEvent(ctx, msg); err != nil {
 					log.Printf("Failed to publish New Message event: %v", err)
 				}
 			}
 		}
-
-		// Rest Conn ReadDealLine 
-		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		tracing.End(span, err)
 	}
 }
@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// ErrConnClosed 連線已經關閉
+var ErrConnClosed = errors.New("connection closed")
+
+// Conn 抽象化客戶端的傳輸層，讓 WebSocket、SSE 與 long-polling 共用同一套 Hub/Room 廣播
+type Conn interface {
+	// ReadMessage 阻塞直到收到客戶端的下一條消息
+	ReadMessage(msg *storage.ChatMessage) error
+
+	// WriteMessage 把消息送到客戶端
+	WriteMessage(msg storage.ChatMessage) error
+
+	// Ping 定期呼叫以保持連線，返回錯誤代表連線已失效
+	Ping() error
+
+	// Close 關閉連線，可以重複呼叫
+	Close() error
+}
+
+// WebSocketConn 以 WebSocket 實現 Conn，幀的編碼在握手時協商
+type WebSocketConn struct {
+	conn  *websocket.Conn
+	codec codec.Codec
+}
+
+// NewWebSocketConn 包裝一個已升級的 WebSocket 連線，c 為 nil 時使用 JSON
+func NewWebSocketConn(conn *websocket.Conn, c codec.Codec) *WebSocketConn {
+	if c == nil {
+		c = codec.JSON
+	}
+
+	// 設置最大消息大小
+	conn.SetReadLimit(maxMessageSize)
+
+	// 設置初始的讀取截止時間
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+
+	// 設置pong處理器，每當收到pong就延長截止時間
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	return &WebSocketConn{conn: conn, codec: c}
+}
+
+func (c *WebSocketConn) ReadMessage(msg *storage.ChatMessage) error {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if err := c.codec.Unmarshal(data, msg); err != nil {
+		return fmt.Errorf("decode %s frame: %w", c.codec.Name(), err)
+	}
+
+	// 收到任何消息（包括前端心跳）都重設讀取截止時間
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	return nil
+}
+
+func (c *WebSocketConn) WriteMessage(msg storage.ChatMessage) error {
+	data, err := c.codec.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("encode %s frame: %w", c.codec.Name(), err)
+	}
+
+	frameType := websocket.TextMessage
+	if c.codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+
+	// 設定寫入的超時時間 避免碰到死掉的websocket
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(frameType, data)
+}
+
+func (c *WebSocketConn) Ping() error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+// Close 先嘗試送出 close frame 再關閉底層連線
+func (c *WebSocketConn) Close() error {
+	c.conn.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(writeWait))
+	return c.conn.Close()
+}
@@ -0,0 +1,248 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+const (
+	// long-polling 一次請求最多等待的時間
+	longPollTimeout = 25 * time.Second
+	// 超過這個時間沒有 poll 的 long-polling 連線視為已斷開
+	longPollSessionTimeout = 2 * longPollTimeout
+	// long-polling 等待被取走的消息上限
+	longPollQueueSize = 256
+	// 客戶端透過 HTTP POST 發送但尚未被 ReadPump 處理的消息上限
+	inboundQueueSize = 16
+)
+
+// ErrInboundFull 客戶端發送太快，ReadPump 來不及處理
+var ErrInboundFull = errors.New("inbound queue full")
+
+// HTTPConn 是透過 HTTP POST 接收客戶端消息的連線 (SSE 與 long-polling)
+type HTTPConn interface {
+	Conn
+
+	// SessionID 客戶端發送消息時用來找到這條連線
+	SessionID() string
+
+	// Deliver 把客戶端 POST 過來的消息交給 ReadPump
+	Deliver(msg storage.ChatMessage) error
+
+	// Done 在連線關閉時被關閉
+	Done() <-chan struct{}
+}
+
+// httpInbound 是 SSE 與 long-polling 共用的部分
+type httpInbound struct {
+	sessionID string
+	inbound   chan storage.ChatMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newHTTPInbound() httpInbound {
+	return httpInbound{
+		sessionID: uuid.NewString(),
+		inbound:   make(chan storage.ChatMessage, inboundQueueSize),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (c *httpInbound) SessionID() string {
+	return c.sessionID
+}
+
+func (c *httpInbound) Deliver(msg storage.ChatMessage) error {
+	select {
+	case <-c.closed:
+		return ErrConnClosed
+	default:
+	}
+
+	select {
+	case c.inbound <- msg:
+		return nil
+	case <-c.closed:
+		return ErrConnClosed
+	default:
+		return ErrInboundFull
+	}
+}
+
+func (c *httpInbound) ReadMessage(msg *storage.ChatMessage) error {
+	select {
+	case m := <-c.inbound:
+		*msg = m
+		return nil
+	case <-c.closed:
+		return ErrConnClosed
+	}
+}
+
+func (c *httpInbound) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// Done 在連線關閉時被關閉
+func (c *httpInbound) Done() <-chan struct{} {
+	return c.closed
+}
+
+// SSEConn 以 Server-Sent Events 推送消息給客戶端
+// 只能在建立它的 HTTP handler 還沒返回之前寫入
+type SSEConn struct {
+	httpInbound
+	w       http.ResponseWriter
+	flusher http.Flusher
+	mu      sync.Mutex
+}
+
+// NewSSEConn 設定 SSE 標頭並送出 session 事件
+func NewSSEConn(w http.ResponseWriter) (*SSEConn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming unsupported")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// 避免反向代理 (nginx) 緩衝整個串流
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	c := &SSEConn{
+		httpInbound: newHTTPInbound(),
+		w:           w,
+		flusher:     flusher,
+	}
+
+	data, _ := json.Marshal(map[string]string{"session_id": c.sessionID})
+	if err := c.writeEvent("session", data); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *SSEConn) WriteMessage(msg storage.ChatMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.writeEvent("", data)
+}
+
+// Ping 送出 SSE 註解行，讓代理不會因為閒置而切斷連線
+func (c *SSEConn) Ping() error {
+	return c.write(": ping\n\n")
+}
+
+func (c *SSEConn) writeEvent(event string, data []byte) error {
+	frame := fmt.Sprintf("data: %s\n\n", data)
+	if event != "" {
+		frame = fmt.Sprintf("event: %s\n%s", event, frame)
+	}
+	return c.write(frame)
+}
+
+func (c *SSEConn) write(frame string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return ErrConnClosed
+	default:
+	}
+
+	if _, err := c.w.Write([]byte(frame)); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// LongPollConn 把消息暫存起來，等客戶端用 GET 取走
+type LongPollConn struct {
+	httpInbound
+	queue    []storage.ChatMessage
+	notify   chan struct{}
+	lastPoll time.Time
+	mu       sync.Mutex
+}
+
+func NewLongPollConn() *LongPollConn {
+	return &LongPollConn{
+		httpInbound: newHTTPInbound(),
+		notify:      make(chan struct{}, 1),
+		lastPoll:    time.Now(),
+	}
+}
+
+func (c *LongPollConn) WriteMessage(msg storage.ChatMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return ErrConnClosed
+	default:
+	}
+
+	if len(c.queue) >= longPollQueueSize {
+		return fmt.Errorf("long-poll queue full for session %s", c.sessionID)
+	}
+	c.queue = append(c.queue, msg)
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Ping 檢查客戶端是否還在 poll，太久沒有 poll 就視為斷線
+func (c *LongPollConn) Ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.lastPoll) > longPollSessionTimeout {
+		return fmt.Errorf("long-poll session %s timed out", c.sessionID)
+	}
+	return nil
+}
+
+// Poll 取走所有等待中的消息，沒有消息時最多等待 longPollTimeout
+func (c *LongPollConn) Poll(ctx context.Context) ([]storage.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, longPollTimeout)
+	defer cancel()
+
+	for {
+		c.mu.Lock()
+		c.lastPoll = time.Now()
+		if len(c.queue) > 0 {
+			messages := c.queue
+			c.queue = nil
+			c.mu.Unlock()
+			return messages, nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.notify:
+		case <-c.closed:
+			return nil, ErrConnClosed
+		case <-ctx.Done():
+			return []storage.ChatMessage{}, nil
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+func TestDeliverInboundFull(t *testing.T) {
+	conn := NewLongPollConn()
+	for i := 0; i < inboundQueueSize; i++ {
+		if err := conn.Deliver(storage.ChatMessage{Content: "hi"}); err != nil {
+			t.Fatalf("deliver %d: %v", i, err)
+		}
+	}
+	if err := conn.Deliver(storage.ChatMessage{Content: "hi"}); !errors.Is(err, ErrInboundFull) {
+		t.Fatalf("deliver to full queue = %v, want ErrInboundFull", err)
+	}
+
+	// ReadPump 取走一條之後又可以送
+	var msg storage.ChatMessage
+	if err := conn.ReadMessage(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Deliver(storage.ChatMessage{Content: "hi"}); err != nil {
+		t.Fatalf("deliver after read = %v", err)
+	}
+
+	conn.Close()
+	if err := conn.Deliver(storage.ChatMessage{Content: "hi"}); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("deliver after close = %v, want ErrConnClosed", err)
+	}
+}
+
+func TestLongPollReturnsQueuedMessages(t *testing.T) {
+	conn := NewLongPollConn()
+	conn.WriteMessage(storage.ChatMessage{Content: "one"})
+	conn.WriteMessage(storage.ChatMessage{Content: "two"})
+
+	messages, err := conn.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Content != "one" || messages[1].Content != "two" {
+		t.Fatalf("Poll = %+v, want one and two", messages)
+	}
+
+	// 等待中的 Poll 在有新消息時返回
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.WriteMessage(storage.ChatMessage{Content: "three"})
+	}()
+	messages, err = conn.Poll(context.Background())
+	if err != nil || len(messages) != 1 || messages[0].Content != "three" {
+		t.Fatalf("Poll = %+v, %v, want three", messages, err)
+	}
+}
+
+func TestLongPollTimeoutAndClose(t *testing.T) {
+	conn := NewLongPollConn()
+
+	// 沒有消息時返回空陣列而不是 nil，客戶端收到 [] 後再 poll
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	messages, err := conn.Poll(ctx)
+	if err != nil || messages == nil || len(messages) != 0 {
+		t.Fatalf("Poll after timeout = %#v, %v, want empty", messages, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+	}()
+	if _, err := conn.Poll(context.Background()); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Poll after close = %v, want ErrConnClosed", err)
+	}
+	if err := conn.WriteMessage(storage.ChatMessage{Content: "late"}); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("write after close = %v, want ErrConnClosed", err)
+	}
+	select {
+	case <-conn.Done():
+	default:
+		t.Fatal("Done not closed")
+	}
+}
+
+func TestLongPollSessionExpires(t *testing.T) {
+	conn := NewLongPollConn()
+	if err := conn.Ping(); err != nil {
+		t.Fatalf("Ping on fresh session = %v", err)
+	}
+
+	conn.lastPoll = time.Now().Add(-longPollSessionTimeout - time.Second)
+	if err := conn.Ping(); err == nil {
+		t.Fatal("Ping after session timeout succeeded")
+	}
+}
+
+func TestSSEFraming(t *testing.T) {
+	w := httptest.NewRecorder()
+	conn, err := NewSSEConn(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	if err := conn.WriteMessage(storage.ChatMessage{Content: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := strings.Split(w.Body.String(), "\n\n")
+	if len(frames) != 4 || frames[3] != "" {
+		t.Fatalf("body = %q, want three frames", w.Body.String())
+	}
+	if want := `event: session` + "\n" + `data: {"session_id":"` + conn.SessionID() + `"}`; frames[0] != want {
+		t.Errorf("session frame = %q, want %q", frames[0], want)
+	}
+	if !strings.HasPrefix(frames[1], "data: {") || !strings.Contains(frames[1], `"content":"hello"`) || strings.Contains(frames[1], "\n") {
+		t.Errorf("message frame = %q", frames[1])
+	}
+	if frames[2] != ": ping" {
+		t.Errorf("ping frame = %q", frames[2])
+	}
+	if !w.Flushed {
+		t.Error("frames not flushed")
+	}
+
+	conn.Close()
+	if err := conn.WriteMessage(storage.ChatMessage{Content: "late"}); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("write after close = %v, want ErrConnClosed", err)
+	}
+}
@@ -3,7 +3,9 @@ package chat
 import (
 	"log"
 	"sync"
+	"time"
 
+	"github.com/ianwu0915/SettleChat/internal/cache"
 	"github.com/ianwu0915/SettleChat/internal/messaging"
 	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
 	"github.com/ianwu0915/SettleChat/internal/storage"
@@ -14,15 +16,31 @@ type Hub struct {
 	Rooms      map[string]*Room
 	Register   chan *Client
 	UnRegister chan *Client
-	Store      *storage.PostgresStore
+	Store      storage.Store
 	Publisher  *nats.NATSPublisher
 	Subscriber *nats.Subscriber
 	Topics     types.TopicFormatter
 	EventBus   *messaging.EventBus
 	mu         sync.Mutex
+
+	// AwayTimeout 用戶閒置多久後會被自動設為 away
+	AwayTimeout time.Duration
+	autoAway    map[string]bool // 被自動設為 away 的用戶
+	statusMu    sync.Mutex
+
+	// RoomLinger 房間最後一個客戶端離開後保留多久才被拆除
+	RoomLinger    time.Duration
+	roomListeners []func(RoomEvent)
+	listenersMu   sync.Mutex
+
+	// Cache 與其他實例共享的在線狀態與限流計數
+	Cache cache.Cache
+	// MessageRate 與 AICommandRate 是每個用戶 (跨所有連線與實例) 送出消息與 AI 命令的頻率上限
+	MessageRate   cache.Rate
+	AICommandRate cache.Rate
 }
 
-func NewHub(store *storage.PostgresStore, publisher *nats.NATSPublisher, subscriber *nats.Subscriber, topics types.TopicFormatter, eventbus *messaging.EventBus) *Hub {
+func NewHub(store storage.Store, publisher *nats.NATSPublisher, subscriber *nats.Subscriber, topics types.TopicFormatter, eventbus *messaging.EventBus) *Hub {
 	hub := &Hub{
 		Rooms:      make(map[string]*Room),
 		Register:   make(chan *Client),
@@ -32,6 +50,14 @@ func NewHub(store *storage.PostgresStore, publisher *nats.NATSPublisher, subscri
 		Subscriber: subscriber,
 		Topics:     topics,
 		EventBus:   eventbus,
+
+		AwayTimeout: defaultAwayTimeout,
+		autoAway:    make(map[string]bool),
+		RoomLinger:  defaultRoomLinger,
+
+		Cache:         cache.NewMemory(cache.Options{}),
+		MessageRate:   DefaultMessageRate,
+		AICommandRate: DefaultAICommandRate,
 	}
 
 	return hub
@@ -39,23 +65,27 @@ func NewHub(store *storage.PostgresStore, publisher *nats.NATSPublisher, subscri
 
 func (h *Hub) getOrCreateRoom(id string) *Room {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-
 	room, exist := h.Rooms[id]
-	if !exist {
-		log.Printf("Creating new room: %s", id)
-		room = NewRoom(id, h.Publisher, h.Subscriber, h.EventBus)
-		h.Rooms[id] = room
-		go room.Run(h.Subscriber)
-		log.Printf("Room %s created and started", id)
-	} else {
+	if exist {
 		log.Printf("Found existing room: %s", id)
+		h.retainRoomLocked(room)
+		h.mu.Unlock()
+		return room
 	}
 
+	log.Printf("Creating new room: %s", id)
+	room = NewRoom(id, h.Publisher, h.EventBus)
+	h.Rooms[id] = room
+	h.mu.Unlock()
+
+	h.emitRoomEvent(RoomActivated, id)
 	return room
 }
 
 func (h *Hub) Run() {
+	statusTicker := time.NewTicker(statusCheckInterval)
+	defer statusTicker.Stop()
+
 	for {
 		select {
 		case client := <-h.Register:
@@ -66,8 +96,13 @@ func (h *Hub) Run() {
 			h.mu.Lock()
 			if room, ok := h.Rooms[client.RoomID]; ok {
 				room.SaveRemoveClient(client)
+				h.releaseRoomLocked(room)
 			}
 			h.mu.Unlock()
+
+		case <-statusTicker.C:
+			go h.checkUserStatuses()
+			go h.refreshPresence()
 		}
 	}
 }
@@ -95,9 +130,14 @@ func (h *Hub) Close() {
 	defer h.mu.Unlock()
 
 	for _, room := range h.Rooms {
+		if room.lingerTimer != nil {
+			room.lingerTimer.Stop()
+		}
+		// 與 SaveRemoveClient 相同，先移出房間再關閉，補回歷史消息的 goroutine 不會再送給這些客戶端
 		room.Mu.Lock()
-		for _, client := range room.Clients {
-			close(client.Send)
+		for id, client := range room.Clients {
+			delete(room.Clients, id)
+			client.CloseSend()
 			client.Conn.Close()
 		}
 		room.Mu.Unlock()
@@ -105,6 +145,15 @@ func (h *Hub) Close() {
 	h.Rooms = make(map[string]*Room)
 }
 
+// HasRoom 判斷本實例是否持有該房間，用來過濾投遞型事件
+func (h *Hub) HasRoom(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, exists := h.Rooms[id]
+	return exists
+}
+
 // GetRoom 獲取指定ID的房間
 func (h *Hub) GetRoom(id string) *Room {
 	h.mu.Lock()
@@ -112,3 +161,20 @@ func (h *Hub) GetRoom(id string) *Room {
 
 	return h.Rooms[id]
 }
+
+// NotifyUser 只把消息送給用戶在本實例這個房間的連線，不會廣播也不會保存
+// 用戶不在本實例時返回 false，由其他實例送達
+func (h *Hub) NotifyUser(roomID, userID string, msg storage.ChatMessage) bool {
+	room := h.GetRoom(roomID)
+	if room == nil {
+		return false
+	}
+
+	room.Mu.Lock()
+	client := room.Clients[userID]
+	room.Mu.Unlock()
+	if client == nil {
+		return false
+	}
+	return room.deliver(client, msg)
+}
@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/cache"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+func newTestHub(t *testing.T, linger time.Duration) (*Hub, <-chan RoomEvent) {
+	t.Helper()
+	hub := NewHub(nil, nil, nil, nil, nil)
+	hub.RoomLinger = linger
+
+	events := make(chan RoomEvent, 16)
+	hub.OnRoomEvent(func(e RoomEvent) { events <- e })
+	go hub.Run()
+	return hub, events
+}
+
+func newTestClient(hub *Hub, userID, roomID string) *Client {
+	return NewClient(hub, userID, userID, NewLongPollConn(), roomID, nil)
+}
+
+func expectRoomEvent(t *testing.T, events <-chan RoomEvent, want RoomEventType, roomID string) {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.Type != want || e.RoomID != roomID {
+			t.Fatalf("got %s for room %s, want %s for room %s", e.Type, e.RoomID, want, roomID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", want)
+	}
+}
+
+func TestRoomTornDownAfterLinger(t *testing.T) {
+	hub, events := newTestHub(t, 20*time.Millisecond)
+
+	a := newTestClient(hub, "u1", "room-1")
+	b := newTestClient(hub, "u2", "room-1")
+	hub.Register <- a
+	hub.Register <- b
+	expectRoomEvent(t, events, RoomActivated, "room-1")
+
+	// Register 被 Hub 接收後才加入房間，等待兩個客戶端都加入
+	waitForClients(t, hub, 2)
+	if snapshot := hub.Snapshot(); snapshot.Rooms != 1 {
+		t.Fatalf("got %d rooms, want 1", snapshot.Rooms)
+	}
+
+	hub.UnRegister <- a
+	hub.UnRegister <- b
+	expectRoomEvent(t, events, RoomDeactivated, "room-1")
+
+	if hub.HasRoom("room-1") {
+		t.Error("room still held after teardown")
+	}
+	if snapshot := hub.Snapshot(); snapshot.Rooms != 0 || snapshot.Clients != 0 {
+		t.Errorf("got %d rooms and %d clients, want 0 and 0", snapshot.Rooms, snapshot.Clients)
+	}
+}
+
+func TestRejoinCancelsTeardown(t *testing.T) {
+	hub, events := newTestHub(t, 50*time.Millisecond)
+
+	hub.Register <- newTestClient(hub, "u1", "room-1")
+	expectRoomEvent(t, events, RoomActivated, "room-1")
+
+	first := hub.GetRoom("room-1")
+	hub.UnRegister <- newTestClient(hub, "u1", "room-1")
+	hub.Register <- newTestClient(hub, "u1", "room-1")
+
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected %s for room %s", e.Type, e.RoomID)
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	if hub.GetRoom("room-1") != first {
+		t.Error("room was recreated instead of reused")
+	}
+	waitForClients(t, hub, 1)
+	if snapshot := hub.Snapshot(); snapshot.RoomDetails[0].IdleSince != nil {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+}
+
+func waitForClients(t *testing.T, hub *Hub, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for hub.Snapshot().Clients != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d clients, want %d", hub.Snapshot().Clients, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAllowMessageLimitsEachUser(t *testing.T) {
+	hub, events := newTestHub(t, time.Minute)
+	hub.MessageRate = cache.Rate{Limit: 2, Window: time.Hour}
+
+	client := newTestClient(hub, "u1", "room-1")
+	hub.Register <- client
+	expectRoomEvent(t, events, RoomActivated, "room-1")
+	waitForClients(t, hub, 1)
+
+	notices := make(chan storage.ChatMessage, 1)
+	go func() {
+		for msg := range client.Send {
+			notices <- msg
+		}
+	}()
+
+	for i := range 2 {
+		if !hub.allowMessage(client, false) {
+			t.Fatalf("message %d was limited", i+1)
+		}
+	}
+	if hub.allowMessage(client, false) {
+		t.Fatal("third message was allowed")
+	}
+	select {
+	case msg := <-notices:
+		if msg.SenderID != "system" || msg.Content != rateLimitedNotice {
+			t.Errorf("got notice %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("limited client was not notified")
+	}
+
+	// AI 命令與其他用戶各自計數
+	if !hub.allowMessage(client, true) {
+		t.Error("AI command was limited by the message rate")
+	}
+	if !hub.allowMessage(newTestClient(hub, "u2", "room-1"), false) {
+		t.Error("other user was limited")
+	}
+}
+
+// TestSlowClientDoesNotBlockRoom 等待慢的客戶端取走消息時不持有房間的鎖，客戶端離開時送出立即結束
+func TestSlowClientDoesNotBlockRoom(t *testing.T) {
+	hub, events := newTestHub(t, time.Minute)
+	client := newTestClient(hub, "u1", "room-1")
+	hub.Register <- client
+	expectRoomEvent(t, events, RoomActivated, "room-1")
+	waitForClients(t, hub, 1)
+
+	// 沒有 WritePump 取走消息，NotifyUser 會等到 writeWait
+	delivered := make(chan bool, 1)
+	go func() {
+		delivered <- hub.NotifyUser("room-1", "u1", storage.ChatMessage{Content: "stuck"})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	locked := make(chan struct{})
+	go func() {
+		hub.HasRoom("room-1")
+		room := hub.GetRoom("room-1")
+		room.Mu.Lock()
+		room.Mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("room lock held while waiting for a slow client")
+	}
+
+	hub.UnRegister <- client
+	select {
+	case ok := <-delivered:
+		if ok {
+			t.Error("message delivered to a client that left")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delivery still waiting after the client left")
+	}
+}
+
+// TestCloseRemovesClients Hub.Close 之後仍在執行的 deliver 不會送到已經關閉的 Send
+func TestCloseRemovesClients(t *testing.T) {
+	hub, events := newTestHub(t, time.Minute)
+	client := newTestClient(hub, "u1", "room-1")
+	hub.Register <- client
+	expectRoomEvent(t, events, RoomActivated, "room-1")
+	waitForClients(t, hub, 1)
+	room := hub.GetRoom("room-1")
+
+	hub.Close()
+	if len(room.Clients) != 0 {
+		t.Fatalf("room still has %d clients after Close", len(room.Clients))
+	}
+	if room.deliver(client, storage.ChatMessage{Content: "late"}) {
+		t.Error("delivered to a client after Close")
+	}
+	if _, ok := <-client.Send; ok {
+		t.Error("Send not closed")
+	}
+}
@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 最後一個客戶端離開後，房間保留多久才被拆除，避免重新整理頁面時反覆建立房間
+const defaultRoomLinger = 30 * time.Second
+
+// RoomEventType 房間生命週期事件的類型
+type RoomEventType string
+
+const (
+	// RoomActivated 本實例開始持有房間 (第一個客戶端加入)
+	RoomActivated RoomEventType = "room.activated"
+	// RoomDeactivated 房間閒置超過 RoomLinger 後被拆除
+	RoomDeactivated RoomEventType = "room.deactivated"
+)
+
+// RoomEvent 是 Hub 發出的房間生命週期事件
+type RoomEvent struct {
+	Type   RoomEventType
+	RoomID string
+	Time   time.Time
+}
+
+// RoomSnapshot 是單一房間在某個時間點的狀態
+type RoomSnapshot struct {
+	ID          string     `json:"id"`
+	Clients     int        `json:"clients"`
+	ActivatedAt time.Time  `json:"activated_at"`
+	IdleSince   *time.Time `json:"idle_since,omitempty"` // 沒有客戶端、等待拆除的房間才有
+}
+
+// HubSnapshot 是本實例持有的房間與客戶端的快照，用於監控
+type HubSnapshot struct {
+	Rooms       int            `json:"rooms"`
+	Clients     int            `json:"clients"`
+	RoomLinger  string         `json:"room_linger"`
+	RoomDetails []RoomSnapshot `json:"room_details"`
+}
+
+// OnRoomEvent 註冊房間生命週期事件的監聽器，監聽器在 Hub 的鎖之外被呼叫
+func (h *Hub) OnRoomEvent(listener func(RoomEvent)) {
+	h.listenersMu.Lock()
+	defer h.listenersMu.Unlock()
+	h.roomListeners = append(h.roomListeners, listener)
+}
+
+func (h *Hub) emitRoomEvent(eventType RoomEventType, roomID string) {
+	event := RoomEvent{Type: eventType, RoomID: roomID, Time: time.Now()}
+	log.Printf("Room %s: %s", roomID, eventType)
+
+	h.listenersMu.Lock()
+	listeners := slices.Clone(h.roomListeners)
+	h.listenersMu.Unlock()
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// retainRoomLocked 取消房間等待中的拆除，呼叫者必須持有 h.mu
+func (h *Hub) retainRoomLocked(room *Room) {
+	if room.lingerTimer == nil {
+		return
+	}
+	room.lingerTimer.Stop()
+	room.lingerTimer = nil
+	room.idleSince = time.Time{}
+	// 已經觸發但還在等鎖的拆除會因為 generation 不同而放棄
+	room.generation++
+	log.Printf("Room %s reactivated before teardown", room.ID)
+}
+
+// releaseRoomLocked 在客戶端離開後呼叫，房間沒有客戶端時在 RoomLinger 後拆除，呼叫者必須持有 h.mu
+func (h *Hub) releaseRoomLocked(room *Room) {
+	room.Mu.Lock()
+	clients := len(room.Clients)
+	room.Mu.Unlock()
+
+	if clients > 0 || room.lingerTimer != nil {
+		return
+	}
+
+	room.idleSince = time.Now()
+	generation := room.generation
+	room.lingerTimer = time.AfterFunc(h.RoomLinger, func() {
+		h.teardownRoom(room, generation)
+	})
+	log.Printf("Room %s is empty, tearing down in %s", room.ID, h.RoomLinger)
+}
+
+// teardownRoom 把閒置的房間從 Hub 移除
+// 房間的事件都來自 Subscriber 的萬用主題訂閱，移除後 HasRoom 返回 false，
+// 投遞型 handler 就不再為這個房間處理事件，不需要個別取消訂閱
+func (h *Hub) teardownRoom(room *Room, generation uint64) {
+	h.mu.Lock()
+	if h.Rooms[room.ID] != room || room.generation != generation {
+		h.mu.Unlock()
+		return
+	}
+
+	room.Mu.Lock()
+	clients := len(room.Clients)
+	room.Mu.Unlock()
+	if clients > 0 {
+		h.mu.Unlock()
+		return
+	}
+
+	delete(h.Rooms, room.ID)
+	room.lingerTimer = nil
+	h.mu.Unlock()
+
+	h.emitRoomEvent(RoomDeactivated, room.ID)
+}
+
+// Snapshot 返回本實例目前持有的房間與客戶端數量
+func (h *Hub) Snapshot() HubSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snapshot := HubSnapshot{
+		Rooms:       len(h.Rooms),
+		RoomLinger:  h.RoomLinger.String(),
+		RoomDetails: make([]RoomSnapshot, 0, len(h.Rooms)),
+	}
+	for _, room := range h.Rooms {
+		room.Mu.Lock()
+		detail := RoomSnapshot{
+			ID:          room.ID,
+			Clients:     len(room.Clients),
+			ActivatedAt: room.activatedAt,
+		}
+		room.Mu.Unlock()
+
+		if !room.idleSince.IsZero() {
+			idleSince := room.idleSince
+			detail.IdleSince = &idleSince
+		}
+		snapshot.Clients += detail.Clients
+		snapshot.RoomDetails = append(snapshot.RoomDetails, detail)
+	}
+
+	slices.SortFunc(snapshot.RoomDetails, func(a, b RoomSnapshot) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return snapshot
+}
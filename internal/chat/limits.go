@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/cache"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+var (
+	// DefaultMessageRate 每個用戶每 10 秒最多 20 條消息
+	DefaultMessageRate = cache.Rate{Limit: 20, Window: 10 * time.Second}
+	// DefaultAICommandRate AI 命令很慢而且要花錢，每個用戶每分鐘最多 5 個
+	DefaultAICommandRate = cache.Rate{Limit: 5, Window: time.Minute}
+)
+
+const rateLimitedNotice = "You are sending messages too fast, please slow down."
+
+// allowMessage 檢查用戶是否超過送出消息 (或 AI 命令) 的頻率上限
+// 計數存在快取中，同一個用戶在不同連線與實例上送出的消息共用一個上限；快取無法使用時不限流
+func (h *Hub) allowMessage(client *Client, isCommand bool) bool {
+	if h.Cache == nil {
+		return true
+	}
+
+	key, rate := "message:"+client.ID, h.MessageRate
+	if isCommand {
+		key, rate = "ai:"+client.ID, h.AICommandRate
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	allowed, err := h.Cache.Allow(ctx, key, rate)
+	if err != nil {
+		log.Printf("Failed to check rate limit of user %s, allowing: %v", client.ID, err)
+		return true
+	}
+	if !allowed {
+		log.Printf("User %s exceeded rate limit %s of %s", client.ID, rate, key)
+		h.notify(client, rateLimitedNotice)
+	}
+	return allowed
+}
+
+// notify 只把系統消息送給這個客戶端，不會廣播也不會保存
+func (h *Hub) notify(client *Client, text string) {
+	h.mu.Lock()
+	room := h.Rooms[client.RoomID]
+	h.mu.Unlock()
+	if room == nil {
+		return
+	}
+
+	room.deliver(client, storage.ChatMessage{
+		RoomID:    client.RoomID,
+		SenderID:  "system",
+		Content:   text,
+		Timestamp: time.Now(),
+	})
+}
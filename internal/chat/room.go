@@ -1,10 +1,26 @@
 package chat
 
 import (
+	"context"
+	"errors"
 	"log"
 	"sync"
+	"time"
+
 	"github.com/ianwu0915/SettleChat/internal/messaging"
 	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// errClientGone 客戶端在補回消息的過程中離開了房間
+var errClientGone = errors.New("client left the room")
+
+const (
+	// historyLimit 客戶端加入房間時送出的歷史消息數
+	historyLimit = 50
+
+	// historyTimeout 等待歷史消息查詢回覆的時間
+	historyTimeout = 5 * time.Second
 )
 
 // What we do in Room: Fire a GoRoutine
@@ -13,21 +29,27 @@ import (
 // Room will broadcast the message to every users in the room
 
 type Room struct {
-	ID         string
-	Clients    map[string]*Client
-	Publisher  *nats.NATSPublisher
-	Subscriber *nats.Subscriber
-	EventBus   *messaging.EventBus
-	Mu         sync.Mutex
+	ID        string
+	Clients   map[string]*Client
+	Publisher *nats.NATSPublisher
+	EventBus  *messaging.EventBus
+	Mu        sync.Mutex
+
+	// 以下欄位由 Hub.mu 保護
+	activatedAt time.Time
+	idleSince   time.Time   // 最後一個客戶端離開的時間，有客戶端時為零值
+	lingerTimer *time.Timer // 等待中的拆除
+	generation  uint64      // 每次取消拆除都會增加，用來讓過期的拆除失效
 }
 
-func NewRoom(id string, publisher *nats.NATSPublisher, subscriber *nats.Subscriber, eventBus *messaging.EventBus) *Room {
+// NewRoom 創建房間，房間本身不持有 NATS 訂閱，事件由 Subscriber 的萬用主題訂閱路由進來
+func NewRoom(id string, publisher *nats.NATSPublisher, eventBus *messaging.EventBus) *Room {
 	return &Room{
-		ID:         id,
-		Clients:    make(map[string]*Client),
-		Publisher:  publisher,
-		Subscriber: subscriber,
-		EventBus:   eventBus,
+		ID:          id,
+		Clients:     make(map[string]*Client),
+		Publisher:   publisher,
+		EventBus:    eventBus,
+		activatedAt: time.Now(),
 	}
 }
 
@@ -38,20 +60,7 @@ func (r *Room) AddClient(client *Client) {
 	r.Clients[client.ID] = client
 	r.Mu.Unlock()
 
-	// 1. 先訂閱歷史消息響應主題（這是必要的基礎設施操作，保留）
-	if r.Subscriber != nil {
-		historyResponseTopic := r.Subscriber.Topics.GetHistoryResponseTopic(r.ID, client.ID)
-		log.Printf("Subscribing to history response topic: %s", historyResponseTopic)
-		if err := r.Subscriber.SubscribeTopic(historyResponseTopic); err != nil {
-			log.Printf("Failed to subscribe to history response topic for client %s: %v", client.ID, err)
-		} else {
-			log.Printf("Successfully subscribed to history response topic: %s", historyResponseTopic)
-		}
-	} else {
-		log.Printf("Warning: Subscriber is nil for room %s", r.ID)
-	}
-
-	// 2. 發布客戶端連接事件 (使用 EventBus)
+	// 1. 發布客戶端連接事件 (使用 EventBus)
 	if r.EventBus != nil {
 		if err := r.EventBus.PublishConnectEvent(r.ID, client.ID, client.Username); err != nil {
 			log.Printf("Failed to publish client connection event: %v", err)
@@ -60,22 +69,77 @@ func (r *Room) AddClient(client *Client) {
 		}
 	}
 
-	// 3. 發布歷史消息請求事件
-	if r.EventBus != nil {
-		if err := r.EventBus.PublishHistoryRequestEvent(r.ID, client.ID, 50); err != nil {
-			log.Printf("Failed to request history messages: %v", err)
-		} else {
-			log.Printf("新歷史消息方法：Successfully sent history request for client %s in room %s", client.ID, r.ID)
+	// 2. 斷線重連的客戶端從 JetStream 補回斷線期間的消息，其他客戶端查詢歷史消息
+	if r.EventBus == nil {
+		return
+	}
+	if !client.ReplaySince.IsZero() && r.EventBus.CanReplay() {
+		go r.replayMessages(client)
+	} else {
+		go r.sendHistory(client)
+	}
+}
+
+// sendHistory 以 request-reply 查詢最近的消息並送給客戶端，客戶端離開房間時停止
+func (r *Room) sendHistory(client *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), historyTimeout)
+	defer cancel()
+
+	messages, err := r.EventBus.RequestHistory(ctx, r.ID, client.ID, historyLimit)
+	if err != nil {
+		log.Printf("Failed to request history messages for client %s in room %s: %v", client.ID, r.ID, err)
+		return
+	}
+
+	for _, msg := range messages {
+		if !r.deliver(client, msg) {
+			log.Printf("Client %s left room %s while receiving history", client.ID, r.ID)
+			return
 		}
 	}
+	log.Printf("Sent %d history messages to client %s in room %s", len(messages), client.ID, r.ID)
+}
+
+// replayMessages 補回客戶端在 ReplaySince 之後錯過的消息，補回失敗時退回歷史消息請求
+func (r *Room) replayMessages(client *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	replayed := 0
+	err := r.EventBus.ReplayRoomMessages(ctx, r.ID, client.ReplaySince, func(msg storage.ChatMessage) error {
+		if !r.deliver(client, msg) {
+			return errClientGone
+		}
+		replayed++
+		return nil
+	})
 
+	switch {
+	case errors.Is(err, errClientGone):
+		log.Printf("Client %s left room %s during replay", client.ID, r.ID)
+	case err != nil:
+		log.Printf("Failed to replay messages for client %s in room %s: %v", client.ID, r.ID, err)
+		r.sendHistory(client)
+	default:
+		log.Printf("Replayed %d messages since %s for client %s in room %s", replayed, client.ReplaySince.Format(time.RFC3339), client.ID, r.ID)
+	}
+}
+
+// deliver 把消息送給仍在房間內的客戶端，客戶端已經離開或太久沒有取走時返回 false
+// 只在檢查成員時持有 Mu，等待客戶端取走消息時不持有
+func (r *Room) deliver(client *Client, msg storage.ChatMessage) bool {
+	r.Mu.Lock()
+	member := r.Clients[client.ID] == client
+	r.Mu.Unlock()
+
+	return member && client.send(msg, writeWait)
 }
 
 func (r *Room) SaveRemoveClient(client *Client) {
 	r.Mu.Lock()
 	if _, exist := r.Clients[client.ID]; exist {
 		delete(r.Clients, client.ID)
-		close(client.Send)
+		client.CloseSend()
 
 		// 1. 發布客戶端斷開連接事件
 		if r.EventBus != nil {
@@ -85,27 +149,6 @@ func (r *Room) SaveRemoveClient(client *Client) {
 				log.Printf("Published client disconnect event for %s in room %s", client.ID, r.ID)
 			}
 		}
-
-		// 2. 取消訂閱歷史消息響應主題
-		if r.Subscriber != nil {
-			historyResponseTopic := r.Subscriber.Topics.GetHistoryResponseTopic(r.ID, client.ID)
-			log.Printf("Unsubscribing from history response topic: %s", historyResponseTopic)
-			if err := r.Subscriber.UnsubscribeTopic(historyResponseTopic); err != nil {
-				log.Printf("Failed to unsubscribe from history response topic for client %s: %v", client.ID, err)
-			} else {
-				log.Printf("Successfully unsubscribed from history response topic: %s", historyResponseTopic)
-			}
-		}
 	}
 	r.Mu.Unlock()
 }
-
-func (r *Room) Run(subscriber *nats.Subscriber) {
-	// 訂閱房間的所有相關主題
-	if err := subscriber.SubscribeToRoom(r.ID); err != nil {
-		log.Printf("Failed to subscribe to room %s: %v", r.ID, err)
-		return
-	}
-
-	log.Printf("Room %s is now active with subscriptions", r.ID)
-}
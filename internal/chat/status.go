@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+const (
+	// 用戶所有連線都沒有活動超過這個時間就會被自動設為 away
+	defaultAwayTimeout = 5 * time.Minute
+	// 多久檢查一次閒置的用戶與過期的狀態文字
+	statusCheckInterval = 30 * time.Second
+)
+
+// SetUserStatus 更新用戶的全域狀態，並發布到該用戶所在的每一個房間
+func (h *Hub) SetUserStatus(ctx context.Context, username string, status storage.UserStatus) error {
+	if err := h.Store.UpdateUserStatus(ctx, status); err != nil {
+		return fmt.Errorf("update user status: %w", err)
+	}
+
+	// 手動設定狀態後就不再是自動離開
+	h.statusMu.Lock()
+	delete(h.autoAway, status.UserID)
+	h.statusMu.Unlock()
+
+	return h.propagateUserStatus(ctx, username, status)
+}
+
+// propagateUserStatus 把狀態發布到用戶所在的所有房間
+func (h *Hub) propagateUserStatus(ctx context.Context, username string, status storage.UserStatus) error {
+	if h.EventBus == nil {
+		return nil
+	}
+
+	rooms, err := h.Store.GetUserRooms(ctx, status.UserID)
+	if err != nil {
+		return fmt.Errorf("get user rooms: %w", err)
+	}
+
+	roomIDs := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		roomIDs = append(roomIDs, room.ID)
+	}
+
+	log.Printf("Propagating status %q of user %s to %d rooms", status.Status, status.UserID, len(roomIDs))
+	return h.EventBus.PublishUserStatusEvent(roomIDs, username, status)
+}
+
+// transitionUserStatus 只有在目前狀態為 from 時才切換為 to，並發布新的狀態
+func (h *Hub) transitionUserStatus(ctx context.Context, userID, username, from, to string) (bool, error) {
+	changed, err := h.Store.CompareAndSetUserStatus(ctx, userID, from, to)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	status, err := h.Store.GetUserStatus(ctx, userID)
+	if err != nil {
+		return true, err
+	}
+	return true, h.propagateUserStatus(ctx, username, *status)
+}
+
+// markActive 在客戶端有活動時被呼叫，若用戶之前被自動設為 away 則恢復在線
+// 本實例設定的自動離開記錄在 autoAway；mayBeAway 為 true 時其他實例或重啟之前設定的也會檢查，
+// 儲存中的 AutoAway 保證手動設定的 away 不會被恢復
+func (h *Hub) markActive(client *Client, mayBeAway bool) {
+	h.statusMu.Lock()
+	wasAutoAway := h.autoAway[client.ID]
+	delete(h.autoAway, client.ID)
+	h.statusMu.Unlock()
+
+	if (!wasAutoAway && !mayBeAway) || h.Store == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := h.transitionUserStatus(ctx, client.ID, client.Username, storage.UserStatusAway, storage.UserStatusOnline); err != nil {
+		log.Printf("Failed to restore online status for user %s: %v", client.ID, err)
+	}
+}
+
+// checkUserStatuses 把閒置的用戶設為 away，並清除過期的自訂狀態文字
+func (h *Hub) checkUserStatuses() {
+	if h.Store == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, client := range h.idleUsers(time.Now().Add(-h.AwayTimeout)) {
+		changed, err := h.transitionUserStatus(ctx, client.ID, client.Username, storage.UserStatusOnline, storage.UserStatusAway)
+		if err != nil {
+			log.Printf("Failed to set user %s away: %v", client.ID, err)
+			continue
+		}
+		if changed {
+			h.statusMu.Lock()
+			h.autoAway[client.ID] = true
+			h.statusMu.Unlock()
+			log.Printf("User %s is now away after inactivity", client.ID)
+		}
+	}
+
+	expired, err := h.Store.ClearExpiredStatusText(ctx)
+	if err != nil {
+		log.Printf("Failed to clear expired status text: %v", err)
+		return
+	}
+	for _, status := range expired {
+		user, err := h.Store.GetUserByID(ctx, status.UserID)
+		if err != nil {
+			log.Printf("Failed to get user %s: %v", status.UserID, err)
+			continue
+		}
+		if err := h.propagateUserStatus(ctx, user.UserName, status); err != nil {
+			log.Printf("Failed to propagate expired status of user %s: %v", status.UserID, err)
+		}
+	}
+}
+
+// idleUsers 返回所有連線最後活動時間都早於 before 的用戶（每個用戶一個代表客戶端）
+func (h *Hub) idleUsers(before time.Time) []*Client {
+	latest := make(map[string]*Client)
+
+	h.mu.Lock()
+	for _, room := range h.Rooms {
+		room.Mu.Lock()
+		for _, client := range room.Clients {
+			if cur, ok := latest[client.ID]; !ok || client.LastActivity().After(cur.LastActivity()) {
+				latest[client.ID] = client
+			}
+		}
+		room.Mu.Unlock()
+	}
+	h.mu.Unlock()
+
+	h.statusMu.Lock()
+	defer h.statusMu.Unlock()
+
+	var idle []*Client
+	for userID, client := range latest {
+		if h.autoAway[userID] {
+			continue
+		}
+		if client.LastActivity().Before(before) {
+			idle = append(idle, client)
+		}
+	}
+	return idle
+}
+
+// refreshPresence 延長本實例客戶端在快取中的在線記錄，實例停止刷新後它的用戶在 PresenceTTL 後視為離線
+func (h *Hub) refreshPresence() {
+	if h.Cache == nil {
+		return
+	}
+
+	rooms := make(map[string][]string)
+	h.mu.Lock()
+	for id, room := range h.Rooms {
+		room.Mu.Lock()
+		for userID := range room.Clients {
+			rooms[id] = append(rooms[id], userID)
+		}
+		room.Mu.Unlock()
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for roomID, userIDs := range rooms {
+		if err := h.Cache.Refresh(ctx, roomID, userIDs); err != nil {
+			log.Printf("Failed to refresh presence of room %s: %v", roomID, err)
+		}
+	}
+}
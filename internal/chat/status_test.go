@@ -0,0 +1,195 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/messaging"
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	memstore "github.com/ianwu0915/SettleChat/internal/storage/memory"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// newStatusTestHub 建立使用記憶體儲存的 Hub，返回用戶 ID 與房間內收到的在線狀態消息
+func newStatusTestHub(t *testing.T) (*Hub, *memstore.Store, string, <-chan *types.PresenceMessage) {
+	t.Helper()
+	ctx := context.Background()
+	transport := memory.NewTransport()
+	t.Cleanup(func() { transport.Close() })
+	topics := nats.NewTopicFormatter("")
+
+	store := memstore.NewStore()
+	userID, err := store.Register(ctx, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roomID, _ := store.CreateRoom(ctx, "general", userID)
+	if err := store.AddUserToRoom(ctx, userID, roomID); err != nil {
+		t.Fatal(err)
+	}
+
+	presence := make(chan *types.PresenceMessage, 10)
+	transport.Subscribe(topics.GetPresenceTopic(roomID), func(msg *types.Message) {
+		event, err := types.Events.Decode(codec.ForContentType(msg.Header.Get(codec.HeaderContentType)), msg.Data, types.EventTypeUserPresence)
+		if err != nil {
+			t.Errorf("decode presence: %v", err)
+			return
+		}
+		presence <- event.Payload.(*types.PresenceMessage)
+	})
+
+	hub := NewHub(store, nil, nil, topics, messaging.NewEventBus(transport, topics))
+	return hub, store, userID, presence
+}
+
+// joinIdle 直接把客戶端加入房間，最後活動時間設為 idle 之前
+func joinIdle(hub *Hub, userID, roomID string, idle time.Duration) *Client {
+	client := NewClient(hub, userID, "alice", NewLongPollConn(), roomID, nil)
+	client.lastActivity = time.Now().Add(-idle)
+
+	room := hub.getOrCreateRoom(roomID)
+	room.Mu.Lock()
+	room.Clients[client.ID] = client
+	room.Mu.Unlock()
+	return client
+}
+
+func expectPresence(t *testing.T, presence <-chan *types.PresenceMessage, status string) *types.PresenceMessage {
+	t.Helper()
+	select {
+	case msg := <-presence:
+		if msg.Status != status {
+			t.Fatalf("got presence %q, want %q", msg.Status, status)
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for presence %q", status)
+		return nil
+	}
+}
+
+func userStatus(t *testing.T, store *memstore.Store, userID string) *storage.UserStatus {
+	t.Helper()
+	status, err := store.GetUserStatus(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestIdleUserSetAwayAndRestored(t *testing.T) {
+	hub, store, userID, presence := newStatusTestHub(t)
+	hub.AwayTimeout = time.Minute
+	client := joinIdle(hub, userID, "room-1", 2*time.Minute)
+
+	hub.checkUserStatuses()
+	if got := userStatus(t, store, userID).Status; got != storage.UserStatusAway {
+		t.Fatalf("status after inactivity = %q, want away", got)
+	}
+	expectPresence(t, presence, storage.UserStatusAway)
+
+	// 已經自動離開的用戶不會重複發布
+	hub.checkUserStatuses()
+	select {
+	case msg := <-presence:
+		t.Fatalf("unexpected presence %q", msg.Status)
+	default:
+	}
+
+	hub.markActive(client, false)
+	if got := userStatus(t, store, userID).Status; got != storage.UserStatusOnline {
+		t.Fatalf("status after activity = %q, want online", got)
+	}
+	expectPresence(t, presence, storage.UserStatusOnline)
+}
+
+func TestActiveUserNotSetAway(t *testing.T) {
+	hub, store, userID, _ := newStatusTestHub(t)
+	hub.AwayTimeout = time.Minute
+
+	// 同一用戶只要有一個連線仍有活動就不算閒置
+	joinIdle(hub, userID, "room-1", 2*time.Minute)
+	joinIdle(hub, userID, "room-2", 0)
+
+	hub.checkUserStatuses()
+	if got := userStatus(t, store, userID).Status; got != storage.UserStatusOnline {
+		t.Fatalf("status = %q, want online", got)
+	}
+}
+
+func TestManualStatusNotOverriddenByAway(t *testing.T) {
+	hub, store, userID, presence := newStatusTestHub(t)
+	hub.AwayTimeout = time.Minute
+	client := joinIdle(hub, userID, "room-1", 2*time.Minute)
+
+	if err := hub.SetUserStatus(context.Background(), "alice", storage.UserStatus{UserID: userID, Status: storage.UserStatusDND}); err != nil {
+		t.Fatal(err)
+	}
+	expectPresence(t, presence, storage.UserStatusDND)
+
+	hub.checkUserStatuses()
+	client.touch()
+	if got := userStatus(t, store, userID).Status; got != storage.UserStatusDND {
+		t.Fatalf("status = %q, want dnd", got)
+	}
+}
+
+func TestAutoAwayFromAnotherInstanceRestored(t *testing.T) {
+	hub, store, userID, presence := newStatusTestHub(t)
+	ctx := context.Background()
+	hub.AwayTimeout = time.Minute
+
+	// 另一個實例 (或重啟之前的本實例) 把用戶自動設為 away，本實例沒有記錄
+	if ok, err := store.CompareAndSetUserStatus(ctx, userID, storage.UserStatusOnline, storage.UserStatusAway); err != nil || !ok {
+		t.Fatalf("CompareAndSetUserStatus = %v, %v", ok, err)
+	}
+	client := joinIdle(hub, userID, "room-1", 0)
+
+	client.touch()
+	if got := userStatus(t, store, userID).Status; got != storage.UserStatusOnline {
+		t.Fatalf("status after first activity = %q, want online", got)
+	}
+	expectPresence(t, presence, storage.UserStatusOnline)
+
+	// 手動設定的 away 在用戶有活動時保留
+	if err := hub.SetUserStatus(ctx, "alice", storage.UserStatus{UserID: userID, Status: storage.UserStatusAway}); err != nil {
+		t.Fatal(err)
+	}
+	expectPresence(t, presence, storage.UserStatusAway)
+	client.lastActivity = time.Now().Add(-2 * time.Minute)
+	client.touch()
+	if got := userStatus(t, store, userID); got.Status != storage.UserStatusAway || got.AutoAway {
+		t.Fatalf("status after activity = %+v, want manual away", got)
+	}
+}
+
+func TestExpiredStatusTextCleared(t *testing.T) {
+	hub, store, userID, presence := newStatusTestHub(t)
+	ctx := context.Background()
+
+	expiresAt := time.Now().Add(-time.Second)
+	if err := store.UpdateUserStatus(ctx, storage.UserStatus{UserID: userID, Status: storage.UserStatusOnline, Text: "in a meeting", ExpiresAt: &expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	hub.checkUserStatuses()
+	status := userStatus(t, store, userID)
+	if status.Text != "" || status.ExpiresAt != nil {
+		t.Fatalf("status after expiry = %+v, want text cleared", status)
+	}
+	if msg := expectPresence(t, presence, storage.UserStatusOnline); msg.StatusText != "" || msg.Username != "alice" {
+		t.Fatalf("presence = %+v, want alice without status text", msg)
+	}
+
+	// 尚未過期的狀態文字保留
+	expiresAt = time.Now().Add(time.Hour)
+	store.UpdateUserStatus(ctx, storage.UserStatus{UserID: userID, Status: storage.UserStatusOnline, Text: "lunch", ExpiresAt: &expiresAt})
+	hub.checkUserStatuses()
+	if got := userStatus(t, store, userID).Text; got != "lunch" {
+		t.Fatalf("status text = %q, want lunch", got)
+	}
+}
@@ -0,0 +1,80 @@
+package codec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HeaderContentType 是 NATS 消息標頭中記錄 payload 編碼的欄位
+const HeaderContentType = "Content-Type"
+
+// Codec 定義一種線上傳輸格式，WebSocket 幀與 EventBus 的 NATS payload 共用
+type Codec interface {
+	// Name 用於設定與 WebSocket 子協議協商，例如 "json"
+	Name() string
+
+	// ContentType 寫入 NATS 標頭，讓訂閱端知道如何解碼
+	ContentType() string
+
+	// Binary 為 true 時 WebSocket 使用 binary frame，否則使用 text frame
+	Binary() bool
+
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON     Codec = jsonCodec{}
+	MsgPack  Codec = msgpackCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+// 依照伺服器偏好排序，協商時較前面的優先
+var registry = []Codec{MsgPack, Protobuf, JSON}
+
+// Get 根據名稱取得 Codec，名稱為空時返回 JSON
+func Get(name string) (Codec, error) {
+	if name == "" {
+		return JSON, nil
+	}
+	for _, c := range registry {
+		if strings.EqualFold(c.Name(), name) {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec: %q", name)
+}
+
+// ForContentType 根據 NATS 標頭取得 Codec，沒有標頭或不認得時當作 JSON（舊格式的消息）
+func ForContentType(contentType string) Codec {
+	for _, c := range registry {
+		if c.ContentType() == contentType {
+			return c
+		}
+	}
+	return JSON
+}
+
+// Subprotocol 返回 Codec 對應的 WebSocket 子協議名稱
+func Subprotocol(c Codec) string {
+	return "settlechat." + c.Name()
+}
+
+// Subprotocols 返回伺服器支援的所有 WebSocket 子協議，依偏好排序
+func Subprotocols() []string {
+	protocols := make([]string, 0, len(registry))
+	for _, c := range registry {
+		protocols = append(protocols, Subprotocol(c))
+	}
+	return protocols
+}
+
+// FromSubprotocol 根據握手時選定的子協議取得 Codec，沒有子協議時使用 JSON
+func FromSubprotocol(protocol string) Codec {
+	for _, c := range registry {
+		if Subprotocol(c) == protocol {
+			return c
+		}
+	}
+	return JSON
+}
@@ -0,0 +1,119 @@
+package codec_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+func TestChatMessageRoundTrip(t *testing.T) {
+	expiresAt := time.Date(2025, 6, 2, 12, 30, 45, 0, time.UTC)
+	want := storage.ChatMessage{
+		ID:        1 << 40,
+		RoomID:    "room-1",
+		SenderID:  "user-1",
+		Sender:    "Alice",
+		Content:   "哈囉 hello 👋",
+		Timestamp: time.Date(2025, 6, 1, 12, 30, 45, 123456789, time.UTC),
+
+		ClientMsgID: "c-42",
+		Ack:         storage.MessageAckSaved,
+
+		ExpiresIn:     86400,
+		ExpiresAt:     &expiresAt,
+		RemovedBefore: &expiresAt,
+	}
+
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack, codec.Protobuf} {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+
+			var got storage.ChatMessage
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+
+			assertMessage(t, got, want)
+		})
+	}
+}
+
+func TestEventRoundTrip(t *testing.T) {
+	want := storage.ChatMessage{RoomID: "room-1", SenderID: "user-1", Sender: "Alice", Content: "hello"}
+	event := types.NewEnvelope(types.EventTypeNewMessage, "room-1", "user-1", want)
+
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack} {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := c.Marshal(event)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+
+			got, err := types.Events.Decode(c, data, "")
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+
+			if got.GetType() != event.GetType() || got.ID != event.ID || got.Actor != "user-1" {
+				t.Errorf("got %+v want %+v", got, event)
+			}
+			payload, ok := got.Payload.(*storage.ChatMessage)
+			if !ok {
+				t.Fatalf("got payload %T want *storage.ChatMessage", got.Payload)
+			}
+			assertMessage(t, *payload, want)
+		})
+	}
+}
+
+func TestProtobufRejectsEvents(t *testing.T) {
+	_, err := codec.Protobuf.Marshal(types.NewEnvelope(types.EventTypeConnect, "room-1", "user-1", types.ConnectionMessage{}))
+	if !errors.Is(err, codec.ErrUnsupportedType) {
+		t.Errorf("got %v want ErrUnsupportedType", err)
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	if got := codec.FromSubprotocol("settlechat.msgpack"); got != codec.MsgPack {
+		t.Errorf("got %q want msgpack", got.Name())
+	}
+	if got := codec.FromSubprotocol(""); got != codec.JSON {
+		t.Errorf("got %q want json for no subprotocol", got.Name())
+	}
+	if got := codec.ForContentType(""); got != codec.JSON {
+		t.Errorf("got %q want json for missing header", got.Name())
+	}
+	if _, err := codec.Get("xml"); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+}
+
+func assertMessage(t testing.TB, got, want storage.ChatMessage) {
+	t.Helper()
+	if got.ID != want.ID || got.RoomID != want.RoomID || got.SenderID != want.SenderID || got.Sender != want.Sender || got.Content != want.Content ||
+		got.ClientMsgID != want.ClientMsgID || got.Ack != want.Ack {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+	if !got.Timestamp.Equal(want.Timestamp) {
+		t.Errorf("got timestamp %v want %v", got.Timestamp, want.Timestamp)
+	}
+	if got.ExpiresIn != want.ExpiresIn || !equalTime(got.ExpiresAt, want.ExpiresAt) ||
+		!equalTime(got.RemovedBefore, want.RemovedBefore) || !equalTime(got.ExpiredBefore, want.ExpiredBefore) {
+		t.Errorf("got expiry %d %v %v %v want %d %v %v %v", got.ExpiresIn, got.ExpiresAt, got.RemovedBefore, got.ExpiredBefore,
+			want.ExpiresIn, want.ExpiresAt, want.RemovedBefore, want.ExpiredBefore)
+	}
+}
+
+func equalTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,43 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupportedType 類型沒有 Protobuf 的對應結構
+var ErrUnsupportedType = errors.New("type does not support protobuf encoding")
+
+// ProtoMarshaler 由有 Protobuf schema 的類型實現（例如 storage.ChatMessage）
+type ProtoMarshaler interface {
+	MarshalProto() ([]byte, error)
+}
+
+// ProtoUnmarshaler 由有 Protobuf schema 的類型實現
+type ProtoUnmarshaler interface {
+	UnmarshalProto(data []byte) error
+}
+
+// protobufCodec 只支援實現了 ProtoMarshaler/ProtoUnmarshaler 的類型，
+// 因此適用於 WebSocket 幀，不適用於 NATS 上的事件
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string        { return "protobuf" }
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+func (protobufCodec) Binary() bool        { return true }
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(ProtoMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+	}
+	return m.MarshalProto()
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(ProtoUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+	}
+	return m.UnmarshalProto(data)
+}
@@ -2,14 +2,12 @@ package event_handlers
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"time"
 
 	"github.com/ianwu0915/SettleChat/internal/ai"
 	"github.com/ianwu0915/SettleChat/internal/storage"
 	"github.com/ianwu0915/SettleChat/internal/types"
-	"github.com/nats-io/nats.go"
 )
 
 // AICommandHandler 處理 AI 命令
@@ -29,31 +27,31 @@ func NewAICommandHandler(publisher types.NATSPublisher, topics types.TopicFormat
 	}
 }
 
-func (h *AICommandHandler) Handle(msg *nats.Msg) error {
+func (h *AICommandHandler) Handle(msg *types.Message) error {
 	// 1. 解析 AI 命令事件
-	var event types.AICommandEvent
-	if err := json.Unmarshal(msg.Data, &event); err != nil {
+	_, command, err := decodeEvent[storage.ChatMessage](msg, types.EventTypeNewAICommand)
+	if err != nil {
 		log.Printf("Failed to unmarshal AI command event: %v", err)
 		return err
 	}
 
 	// 2. 創建上下文
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(msg.Context(), 30*time.Second)
 	defer cancel()
 
 	// 3. 處理 AI 命令
-	isCommand, response, err := h.manager.HandleAIMessage(ctx, *event.Message)
+	isCommand, response, err := h.manager.HandleAIMessage(ctx, *command)
 	if err != nil {
 		log.Printf("Failed to handle AI command: %v", err)
 		// 發布錯誤消息
 		errorMsg := storage.ChatMessage{
-			RoomID:    event.Message.RoomID,
+			RoomID:    command.RoomID,
 			SenderID:  "system",
 			Sender:    "System",
 			Content:   "Sorry, I encountered an error processing your command.",
 			Timestamp: time.Now(),
 		}
-		return h.publishResponse(errorMsg)
+		return h.publishResponse(msg.Context(), errorMsg)
 	}
 
 	log.Println(response)
@@ -65,28 +63,22 @@ func (h *AICommandHandler) Handle(msg *nats.Msg) error {
 
 	// 4. 發布 AI 回應
 	responseMsg := storage.ChatMessage{
-		RoomID:    event.Message.RoomID,
+		RoomID:    command.RoomID,
 		SenderID:  "ai",
 		Sender:    "AI Assistant",
 		Content:   response,
 		Timestamp: time.Now(),
 	}
 
-	return h.publishResponse(responseMsg)
+	return h.publishResponse(msg.Context(), responseMsg)
 }
 
 // publishResponse 發布 AI 回應到聊天室
-func (h *AICommandHandler) publishResponse(msg storage.ChatMessage) error {
-	// 序列化消息
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Failed to marshal AI response: %v", err)
-		return err
-	}
-
+func (h *AICommandHandler) publishResponse(ctx context.Context, msg storage.ChatMessage) error {
 	// 發布到廣播主題
 	broadcastTopic := h.topics.GetBroadcastTopic(msg.RoomID)
-	if err := h.publisher.Publish(broadcastTopic, data); err != nil {
+	event := types.NewEnvelope(types.EventTypeBroadcastMsg, msg.RoomID, msg.SenderID, msg)
+	if err := publishEvent(ctx, h.publisher, broadcastTopic, event); err != nil {
 		log.Printf("Failed to publish AI response: %v", err)
 		return err
 	}
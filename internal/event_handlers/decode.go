@@ -0,0 +1,69 @@
+package event_handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/tracing"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// decodeEvent 根據消息標頭的 Content-Type 解碼事件，返回目前版本的 payload
+// 沒有標頭的消息（例如 handler 之間直接發布的）都是 JSON；
+// 沒有 Envelope 也沒有 type 欄位的舊格式消息當作 fallbackType。
+// 無法解碼的消息重新投遞也不會成功，錯誤會包裝 ErrPermanent
+func decodeEvent[T any](msg *types.Message, fallbackType string) (*types.Envelope, *T, error) {
+	c := codec.ForContentType(msg.Header.Get(codec.HeaderContentType))
+	event, err := types.Events.Decode(c, msg.Data, fallbackType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", types.ErrPermanent, err)
+	}
+
+	payload, ok := event.Payload.(*T)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unexpected payload %T for %s", types.ErrPermanent, event.Payload, event.Type)
+	}
+	return event, payload, nil
+}
+
+// encodeEvent 以 JSON 編碼事件，標頭帶上 Content-Type 與去重 ID
+func encodeEvent(topic string, event types.Envelope) (*types.Message, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %s event: %w", event.Type, err)
+	}
+	msg := types.NewMessage(topic, data)
+	msg.Header.Set(codec.HeaderContentType, codec.JSON.ContentType())
+	msg.Header.Set(types.HeaderMsgID, event.ID)
+	return msg, nil
+}
+
+// publishEvent 以 JSON 編碼事件並發布到 topic，ctx 的 trace context 隨標頭傳給訂閱端
+func publishEvent(ctx context.Context, publisher types.NATSPublisher, topic string, event types.Envelope) (err error) {
+	msg, err := encodeEvent(topic, event)
+	if err != nil {
+		return err
+	}
+	_, span := tracing.StartPublish(ctx, msg, event.Type)
+	defer func() { tracing.End(span, err) }()
+	return publisher.PublishMsg(msg)
+}
+
+// outboxEvent 以 JSON 編碼事件，作為與業務資料同一個交易寫入的 outbox 資料
+// ctx 的 trace context 保存在標頭中，relay 發布時接回同一個 trace
+func outboxEvent(ctx context.Context, topic string, event types.Envelope) (storage.OutboxMessage, error) {
+	msg, err := encodeEvent(topic, event)
+	if err != nil {
+		return storage.OutboxMessage{}, err
+	}
+	tracing.Inject(ctx, msg.Header)
+	return storage.OutboxMessage{
+		EventID: event.ID,
+		Subject: msg.Subject,
+		Header:  msg.Header,
+		Data:    msg.Data,
+	}, nil
+}
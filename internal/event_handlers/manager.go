@@ -1,9 +1,12 @@
 package event_handlers
 
 import (
+	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/ianwu0915/SettleChat/internal/ai"
+	"github.com/ianwu0915/SettleChat/internal/cache"
 	"github.com/ianwu0915/SettleChat/internal/chat"
 	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
 
@@ -13,18 +16,28 @@ import (
 
 // HandlerManager 負責管理所有NATS事件處理器
 type HandlerManager struct {
-	store      *storage.PostgresStore
+	store      storage.Store
 	publisher  types.NATSPublisher
 	topics     types.TopicFormatter
 	env        string
 	hub        *chat.Hub
 	aiManager  *ai.Manager
+	cache      cache.Cache
+	writer     *storage.MessageWriter
 	handlers   map[string]types.MessageHandler
+	modes      map[string]types.DeliveryMode
+	retries    map[string]types.RetryPolicy
+	timeouts   map[string]time.Duration
+
+	// middlewares 套用到所有 handler，keyMiddlewares 只套用到指定的 handler
+	middlewares    []types.Middleware
+	keyMiddlewares map[string][]types.Middleware
+	metrics        *HandlerMetrics
 }
 
 // NewHandlerManager 創建一個新的 HandlerManager 實例
 func NewHandlerManager(
-	store *storage.PostgresStore,
+	store storage.Store,
 	publisher types.NATSPublisher,
 	topics types.TopicFormatter,
 	env string,
@@ -38,30 +51,125 @@ func NewHandlerManager(
 		env:       env,
 		hub:       hub,
 		aiManager: aiManager,
+		cache:     cache.NewMemory(cache.Options{}),
 		handlers:  make(map[string]types.MessageHandler),
+		modes:     make(map[string]types.DeliveryMode),
+		retries:   make(map[string]types.RetryPolicy),
+		timeouts:  make(map[string]time.Duration),
+
+		keyMiddlewares: make(map[string][]types.Middleware),
+		metrics:        NewHandlerMetrics(),
 	}
 }
 
 // Initialize 初始化所有處理器
+// 工作型 (DeliveryWork) 的處理器會寫資料庫或產生新事件，多實例時只能由一個實例處理；
+// 投遞型 (DeliveryFanout) 的處理器把事件推送給本地客戶端，每個實例都要收到；
+// 持久型 (DeliveryDurable) 的處理器在啟用 JetStream 時不會因為實例停機或處理失敗而遺失事件；
+// 查詢處理器不能是持久型：請求端只等待一次回覆，JetStream 也不保存查詢主題
 func (m *HandlerManager) Initialize() {
-	m.handlers["user.joined"] = NewUserJoinedHandler(m.store, m.publisher, m.topics, m.env)
-	m.handlers["user.left"] = NewUserLeftHandler(m.store, m.publisher, m.topics, m.env)
-	m.handlers["user.presence"] = NewPresenceHandler(m.store, m.topics, m.env)
-	m.handlers["message.chat"] = NewChatMessageHandler(m.store, m.publisher, m.topics)
-	m.handlers["message.history.request"] = NewHistoryHandler(m.store, m.publisher, m.topics, m.env)
-	m.handlers["message.history.response"] = NewHistoryResponseHandler(m.hub)
-	m.handlers["message.broadcast"] = NewBroadcastHandler(m.hub)
-	m.handlers["system.message"] = NewSystemMessageHandler(m.publisher, m.topics, m.env)
-	m.handlers["connection.event"] = NewConnectionEventHandler(m.store, m.publisher, m.topics)
-	m.handlers["ai.command"] = NewAICommandHandler(m.publisher, m.topics, m.env, m.aiManager)
+	m.add("user.joined", NewUserJoinedHandler(m.store, m.publisher, m.topics, m.env), types.DeliveryWork)
+	m.add("user.left", NewUserLeftHandler(m.store, m.publisher, m.topics, m.env), types.DeliveryWork)
+	m.add("user.presence", NewPresenceHandler(m.store, m.cache, m.topics, m.env), types.DeliveryWork)
+	m.add("message.chat", NewChatMessageHandler(m.messageSaver(), m.publisher, m.topics, m.cache), types.DeliveryDurable)
+	m.add("message.broadcast", NewBroadcastHandler(m.hub), types.DeliveryFanout)
+	m.add("message.ack", NewMessageAckHandler(m.hub), types.DeliveryFanout)
+	m.add("system.message", NewSystemMessageHandler(m.publisher, m.topics, m.env), types.DeliveryWork)
+	m.add("connection.event", NewConnectionEventHandler(m.store, m.publisher, m.topics), types.DeliveryWork)
+	m.add("ai.command", NewAICommandHandler(m.publisher, m.topics, m.env, m.aiManager), types.DeliveryDurable)
+
+	// 查詢是 request-reply，由 queue group 內其中一個實例回覆到請求的 inbox 主題
+	m.add("query.history", NewHistoryHandler(m.store, m.publisher, m.cache), types.DeliveryWork)
+	m.add("query.members", NewRoomMembersHandler(m.store, m.publisher, m.cache), types.DeliveryWork)
+	m.add("query.room", NewRoomStateHandler(m.store, m.publisher, m.cache), types.DeliveryWork)
+
+	// AI 請求很慢而且要花錢，失敗時只重試一次，也只處理房間成員的命令
+	m.SetRetryPolicy("ai.command", types.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Second, MaxBackoff: time.Second})
+	m.SetTimeout("ai.command", time.Minute)
+	m.UseFor("ai.command", Authorize(roomMembersOnly(m.store, types.EventTypeNewAICommand)))
+
+	// 每個 handler 都會 recover panic、記錄結構化日誌與處理指標
+	m.Use(Recover(), Logging(slog.Default()), Metrics(m.metrics))
+}
+
+func (m *HandlerManager) add(topic string, handler types.MessageHandler, mode types.DeliveryMode) {
+	m.handlers[topic] = handler
+	m.modes[topic] = mode
+}
+
+// SetCache 設置在線狀態與歷史消息的快取 (預設是只屬於本實例的 in-memory 快取)，需要在 Initialize 之前呼叫
+func (m *HandlerManager) SetCache(c cache.Cache) {
+	m.cache = c
+}
+
+// SetMessageWriter 設置批次寫入聊天消息的 MessageWriter，需要在 Initialize 之前呼叫
+// 沒有設置時每條消息各自以一個交易寫入
+func (m *HandlerManager) SetMessageWriter(w *storage.MessageWriter) {
+	m.writer = w
+}
+
+func (m *HandlerManager) messageSaver() storage.MessageSaver {
+	if m.writer != nil {
+		return m.writer
+	}
+	return m.store
+}
+
+// SetDeliveryMode 覆蓋指定處理器的投遞方式，需要在 Register 之前呼叫
+func (m *HandlerManager) SetDeliveryMode(topic string, mode types.DeliveryMode) {
+	m.modes[topic] = mode
 }
 
-// Register 註冊所有處理器到NATS訂閱器
+// SetRetryPolicy 覆蓋指定處理器的重試策略，需要在 Register 之前呼叫
+// 沒有設置的處理器使用 types.DefaultRetryPolicy
+func (m *HandlerManager) SetRetryPolicy(topic string, policy types.RetryPolicy) {
+	m.retries[topic] = policy
+}
+
+// SetTimeout 覆蓋指定處理器處理一條消息的時間上限，需要在 Register 之前呼叫
+// 沒有設置的處理器使用 DefaultHandlerTimeout
+func (m *HandlerManager) SetTimeout(topic string, timeout time.Duration) {
+	m.timeouts[topic] = timeout
+}
+
+// Use 加入套用到所有處理器的 middleware，先加入的在外層，需要在 Register 之前呼叫
+func (m *HandlerManager) Use(middlewares ...types.Middleware) {
+	m.middlewares = append(m.middlewares, middlewares...)
+}
+
+// UseFor 加入只套用到指定處理器的 middleware，位於 Use 加入的 middleware 內層
+func (m *HandlerManager) UseFor(topic string, middlewares ...types.Middleware) {
+	m.keyMiddlewares[topic] = append(m.keyMiddlewares[topic], middlewares...)
+}
+
+// Metrics 返回所有處理器的處理指標
+func (m *HandlerManager) Metrics() *HandlerMetrics {
+	return m.metrics
+}
+
+// chain 以 middleware 包裝處理器：Use 的在最外層，然後是 UseFor 的，最內層是 Timeout
+func (m *HandlerManager) chain(topic string, handler types.MessageHandler) types.MessageHandler {
+	timeout, ok := m.timeouts[topic]
+	if !ok {
+		timeout = DefaultHandlerTimeout
+	}
+
+	middlewares := append([]types.Middleware{}, m.middlewares...)
+	middlewares = append(middlewares, m.keyMiddlewares[topic]...)
+	middlewares = append(middlewares, Timeout(timeout))
+	return types.Chain(topic, handler, middlewares...)
+}
+
+// Register 以 middleware 包裝所有處理器並註冊到NATS訂閱器
 func (m *HandlerManager) Register(subscriber *nats.Subscriber) {
 	for topic, handler := range m.handlers {
+		handler = m.chain(topic, handler)
 		parts := strings.Split(topic, ".")
 		if len(parts) >= 2 {
-			subscriber.RegisterHandler(parts[0], strings.Join(parts[1:], "."), handler)
+			subscriber.RegisterHandlerWithMode(parts[0], strings.Join(parts[1:], "."), handler, m.modes[topic])
+		}
+		if policy, ok := m.retries[topic]; ok {
+			subscriber.SetRetryPolicy(topic, policy)
 		}
 	}
 }
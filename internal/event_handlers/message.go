@@ -2,172 +2,229 @@ package event_handlers
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 
+	"github.com/ianwu0915/SettleChat/internal/cache"
 	"github.com/ianwu0915/SettleChat/internal/chat"
 	"github.com/ianwu0915/SettleChat/internal/storage"
 	"github.com/ianwu0915/SettleChat/internal/types"
-	"github.com/nats-io/nats.go"
 )
 
 // 在這邊確認是否是
 
 // ChatMessageHandler 處理聊天消息
+// store 可以是直接寫入的 MessageStore，或是批次寫入的 storage.MessageWriter
 type ChatMessageHandler struct {
-	store     *storage.PostgresStore
+	store     storage.MessageSaver
 	publisher types.NATSPublisher
 	topics    types.TopicFormatter
+	history   cache.History
 }
 
-func NewChatMessageHandler(store *storage.PostgresStore, publisher types.NATSPublisher, topics types.TopicFormatter) *ChatMessageHandler {
+func NewChatMessageHandler(store storage.MessageSaver, publisher types.NATSPublisher, topics types.TopicFormatter, history cache.History) *ChatMessageHandler {
 	return &ChatMessageHandler{
 		store:     store,
 		publisher: publisher,
 		topics:    topics,
+		history:   history,
 	}
 }
 
 
-func (h *ChatMessageHandler) Handle(msg *nats.Msg) error {
-	// 先嘗試解析為 types.ChatMessageEvent
-	var event types.ChatMessageEvent
-	if err := json.Unmarshal(msg.Data, &event); err != nil {
-		log.Printf("嘗試舊的方式直接解析為 storage.ChatMessage")
-		// 嘗試舊的方式直接解析為 storage.ChatMessage
-		
-		var chatMsg storage.ChatMessage
-		if err := json.Unmarshal(msg.Data, &chatMsg); err != nil {
-			log.Printf("舊方式解析失敗: %v", err)
-			return err
-		}
-		
-		// 確保必要的字段存在
-		if chatMsg.SenderID == "" {
-			log.Printf("Warning: SenderID is empty in the message")
-		}
-		if chatMsg.Sender == "" {
-			log.Printf("Warning: Sender is empty in the message")
-		}
-		
-		// 儲存消息到數據庫
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		if err := h.store.SaveMessage(ctx, chatMsg); err != nil {
-			log.Printf("Failed to save message to database: %v", err)
-			return err
-		}
-
-		// 廣播消息給所有客戶端
-		broadcastTopic := h.topics.GetBroadcastTopic(chatMsg.RoomID)
-		if err := h.publisher.Publish(broadcastTopic, msg.Data); err != nil {
-			log.Printf("Failed to broadcast message: %v", err)
-			return err
-		}
+func (h *ChatMessageHandler) Handle(msg *types.Message) error {
+	event, chatMsg, err := decodeEvent[storage.ChatMessage](msg, types.EventTypeNewMessage)
+	if err != nil {
+		log.Printf("Failed to decode chat message: %v", err)
+		return err
+	}
 
-		return nil
+	// 確保必要的字段存在
+	if chatMsg.SenderID == "" {
+		log.Printf("Warning: SenderID is empty in the message")
 	}
-	
-	// 成功解析為 ChatMessageEvent，轉換為 storage.ChatMessage
-	log.Printf("成功解析為 ChatMessageEvent，轉換為 storage.ChatMessage")
-	chatMsg := storage.ChatMessage{
-		RoomID:    event.RoomID,
-		SenderID:  event.SenderID,
-		Sender:    event.Sender,
-		Content:   event.Content,
-		Timestamp: event.Timestamp,
+
+	// 廣播事件與消息在同一個交易寫入 outbox，由 OutboxRelay 發布，
+	// 避免保存成功但廣播失敗（或崩潰）造成消息永遠沒有送達
+	// 廣播的事件 ID 由原始事件決定，重複投遞的同一個事件不會再保存一次
+	// 廣播帶著保存時分配的消息 ID，客戶端以它作為向上捲動的游標 (before_id)
+	broadcast := types.NewEnvelope(types.EventTypeBroadcastMsg, chatMsg.RoomID, chatMsg.SenderID, chatMsg)
+	if event.ID != "" {
+		broadcast.ID = event.ID + ".broadcast"
 	}
-	
-	// 儲存消息到數據庫
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	topic := h.topics.GetBroadcastTopic(chatMsg.RoomID)
+
+	ctx, cancel := context.WithTimeout(msg.Context(), 5*time.Second)
 	defer cancel()
 
-	if err := h.store.SaveMessage(ctx, chatMsg); err != nil {
+	id, err := h.store.SaveMessageWithOutbox(ctx, *chatMsg, func(saved storage.ChatMessage) (storage.OutboxMessage, error) {
+		event := broadcast
+		event.Payload = saved
+		return outboxEvent(msg.Context(), topic, event)
+	})
+	if err != nil {
 		log.Printf("Failed to save message to database: %v", err)
+		// 不會再重試時通知發送者消息沒有保存，由客戶端決定是否重新送出
+		if msg.LastAttempt() || errors.Is(err, types.ErrPermanent) {
+			h.ack(msg.Context(), event.ID, chatMsg, err)
+		}
 		return err
 	}
-
-	// 將 chatMsg 重新序列化以便廣播
-	broadcastData, err := json.Marshal(chatMsg)
-	if err != nil {
-		log.Printf("Failed to marshal chat message for broadcast: %v", err)
-		return err
+	if id == 0 {
+		// 上一次投遞可能已經保存但沒有來得及確認
+		log.Printf("Message event %s was already saved, skipping", event.ID)
+		h.ack(ctx, event.ID, chatMsg, nil)
+		return nil
 	}
 
-	// 廣播消息給所有客戶端
-	broadcastTopic := h.topics.GetBroadcastTopic(chatMsg.RoomID)
-	if err := h.publisher.Publish(broadcastTopic, broadcastData); err != nil {
-		log.Printf("Failed to broadcast message: %v", err)
-		return err
+	chatMsg.ID = id
+
+	// 系統消息不屬於歷史消息，資料庫查詢也會略過它們
+	if chatMsg.SenderID != "system" {
+		cached := *chatMsg
+		cached.ClientMsgID = ""
+		if err := h.history.AppendMessage(ctx, cached); err != nil {
+			log.Printf("Failed to append message to history cache of room %s: %v", chatMsg.RoomID, err)
+		}
 	}
 
-	log.Printf("Message from %s processed and broadcasted successfully", chatMsg.Sender)
+	h.ack(ctx, event.ID, chatMsg, nil)
+	log.Printf("Message from %s saved, broadcast queued in outbox", chatMsg.Sender)
 	return nil
 }
 
-// HistoryHandler 處理歷史消息請求
+// ack 把保存的結果推送給發送者：失敗一定推送，成功只在客戶端帶了 ClientMsgID 時推送
+// ack 發布失敗只記錄日誌，不影響消息的處理
+func (h *ChatMessageHandler) ack(ctx context.Context, eventID string, chatMsg *storage.ChatMessage, saveErr error) {
+	if chatMsg.SenderID == "" || chatMsg.SenderID == "system" {
+		return
+	}
+	if saveErr == nil && chatMsg.ClientMsgID == "" {
+		return
+	}
+
+	ack := types.MessageAck{
+		RoomID:      chatMsg.RoomID,
+		UserID:      chatMsg.SenderID,
+		EventID:     eventID,
+		ClientMsgID: chatMsg.ClientMsgID,
+		Status:      storage.MessageAckSaved,
+		Timestamp:   time.Now(),
+	}
+	if saveErr != nil {
+		// 不把資料庫的錯誤細節送給客戶端
+		ack.Status = storage.MessageAckFailed
+		ack.Error = "message could not be saved"
+	}
+
+	event := types.NewEnvelope(types.EventTypeMessageAck, chatMsg.RoomID, chatMsg.SenderID, ack)
+	if err := publishEvent(ctx, h.publisher, h.topics.GetMessageAckTopic(chatMsg.RoomID), event); err != nil {
+		log.Printf("Failed to publish %s ack of message event %s: %v", ack.Status, eventID, err)
+	}
+}
+
+// HistoryHandler 回覆歷史消息查詢
+// 最近的消息優先從快取讀取，客戶端每次連線都會查詢，不需要每次都讀取資料庫
 type HistoryHandler struct {
-	store     *storage.PostgresStore
+	store     storage.MessageStore
 	publisher types.NATSPublisher
-	topics    types.TopicFormatter
-	env       string
+	history   cache.History
 }
 
-func NewHistoryHandler(store *storage.PostgresStore, publisher types.NATSPublisher, topics types.TopicFormatter, env string) *HistoryHandler {
+func NewHistoryHandler(store storage.MessageStore, publisher types.NATSPublisher, history cache.History) *HistoryHandler {
 	return &HistoryHandler{
 		store:     store,
 		publisher: publisher,
-		topics:    topics,
-		env:       env,
+		history:   history,
 	}
 }
 
-func (h *HistoryHandler) Handle(msg *nats.Msg) error {
-	var payload types.HistoryRequest
-	if err := json.Unmarshal(msg.Data, &payload); err != nil {
-		log.Printf("Failed to unmarshal history request: %v", err)
-		return err
-	}
+func (h *HistoryHandler) Handle(msg *types.Message) error {
+	return respond(h.publisher, msg, types.EventTypeHistoryRequest, types.EventTypeHistoryResponse,
+		func(ctx context.Context, request *types.HistoryRequest) (any, error) {
+			log.Printf("Received history request for room %s from user %s", request.RoomID, request.UserID)
 
-	log.Printf("Received history request for room %s from user %s", payload.RoomID, payload.UserID)
+			limit := request.Limit
+			if limit <= 0 || limit > maxHistoryLimit {
+				limit = maxHistoryLimit
+			}
+			// 向上捲動讀取的是較舊的消息，不經過只保存最近消息的快取；更早的月份可能從封存檔案讀取
+			if request.Before != nil {
+				before := storage.MessageCursor{Timestamp: *request.Before, ID: request.BeforeID}
+				messages, err := h.store.GetMessagesBefore(ctx, request.RoomID, before, limit)
+				if err != nil {
+					return nil, fmt.Errorf("get messages before %s: %w", request.Before.Format(time.RFC3339), err)
+				}
+				return types.HistoryResponse{RoomID: request.RoomID, Messages: storage.WithoutExpired(messages, time.Now())}, nil
+			}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+			messages, err := recentMessages(ctx, h.history, h.store, request.RoomID, limit)
+			if err != nil {
+				return nil, fmt.Errorf("get recent messages: %w", err)
+			}
 
-	messages, err := h.store.GetRecentMessages(ctx, payload.RoomID, payload.Limit)
+			log.Printf("Found %d messages for room %s", len(messages), request.RoomID)
+			return types.HistoryResponse{RoomID: request.RoomID, Messages: messages}, nil
+		})
+}
+
+// recentMessages 從快取讀取房間最近的消息，快取無法使用時直接讀取資料庫
+// 快取中的消息可能在快取之後才過期，返回前再篩選一次
+func recentMessages(ctx context.Context, history cache.History, store storage.MessageStore, roomID string, limit int) ([]storage.ChatMessage, error) {
+	var loadErr error
+	messages, err := history.RecentMessages(ctx, roomID, limit, func(ctx context.Context, roomID string, n int) ([]storage.ChatMessage, error) {
+		messages, err := store.GetRecentMessages(ctx, roomID, n)
+		loadErr = err
+		return messages, err
+	})
+	if err != nil && loadErr == nil {
+		log.Printf("Failed to read history cache of room %s, falling back to the database: %v", roomID, err)
+		messages, err = store.GetRecentMessages(ctx, roomID, limit)
+	}
 	if err != nil {
-		log.Printf("Failed to get recent messages: %v", err)
-		return err
+		return nil, err
 	}
+	return storage.WithoutExpired(messages, time.Now()), nil
+}
 
-	log.Printf("Found %d messages for room %s", len(messages), payload.RoomID)
+// MessageAckHandler 把消息確認推送給發送者在本實例的連線
+type MessageAckHandler struct {
+	hub *chat.Hub
+}
 
-	response := types.HistoryResponse{
-		RoomID:   payload.RoomID,
-		Messages: messages,
-	}
+func NewMessageAckHandler(hub *chat.Hub) *MessageAckHandler {
+	return &MessageAckHandler{hub: hub}
+}
 
-	responseData, err := json.Marshal(response)
+func (h *MessageAckHandler) Handle(msg *types.Message) error {
+	_, ack, err := decodeEvent[types.MessageAck](msg, types.EventTypeMessageAck)
 	if err != nil {
-		log.Printf("Failed to marshal history response: %v", err)
 		return err
 	}
 
-	// 使用特定用戶的響應主題
-	replyTopic := h.topics.GetHistoryResponseTopic(payload.RoomID, payload.UserID)
-	if err := h.publisher.Publish(replyTopic, responseData); err != nil {
-		log.Printf("Failed to publish history response: %v", err)
-		return err
+	notice := storage.ChatMessage{
+		RoomID:      ack.RoomID,
+		SenderID:    "system",
+		Timestamp:   ack.Timestamp,
+		ClientMsgID: ack.ClientMsgID,
+		Ack:         ack.Status,
+	}
+	if ack.Status == storage.MessageAckFailed {
+		notice.Content = messageFailedNotice
 	}
 
-	log.Printf("Successfully sent history response to %s", replyTopic)
+	// 發送者可能連在其他實例，本實例沒有這個用戶的連線時略過
+	if h.hub.NotifyUser(ack.RoomID, ack.UserID, notice) {
+		log.Printf("Sent %s ack of message event %s to %s", ack.Status, ack.EventID, ack.UserID)
+	}
 	return nil
 }
 
+// messageFailedNotice 消息保存失敗時送給發送者的系統消息
+const messageFailedNotice = "Your message could not be delivered. Please send it again."
+
 // BroadcastHandler 處理廣播消息
 type BroadcastHandler struct {
 	hub *chat.Hub
@@ -179,26 +236,21 @@ func NewBroadcastHandler(hub *chat.Hub) *BroadcastHandler {
 	}
 }
 
-func (h *BroadcastHandler) Handle(msg *nats.Msg) error {
-	var chatMsg storage.ChatMessage
-	
-	// 先嘗試解析為 types.ChatMessageEvent
-	var event types.ChatMessageEvent
-	if err := json.Unmarshal(msg.Data, &event); err != nil {
-		// 嘗試舊的方式直接解析為 storage.ChatMessage
-		if err := json.Unmarshal(msg.Data, &chatMsg); err != nil {
-			log.Printf("Failed to unmarshal broadcast message: %v", err)
-			return err
-		}
-	} else {
-		// 從 event 轉換為 storage.ChatMessage
-		chatMsg = storage.ChatMessage{
-			RoomID:    event.RoomID,
-			SenderID:  event.SenderID,
-			Sender:    event.Sender,
-			Content:   event.Content,
-			Timestamp: event.Timestamp,
-		}
+func (h *BroadcastHandler) Handle(msg *types.Message) error {
+	_, chatMsg, err := decodeEvent[storage.ChatMessage](msg, types.EventTypeBroadcastMsg)
+	if err != nil {
+		log.Printf("Failed to unmarshal broadcast message: %v", err)
+		return err
+	}
+
+	// 廣播延遲送達時消息可能已經過期 (閱後即焚)，不再送給客戶端
+	if chatMsg.Expired(time.Now()) {
+		log.Printf("Message in room %s expired before delivery, dropped", chatMsg.RoomID)
+		return nil
+	}
+	// 保留規則或過期清理刪除了消息，通知客戶端移除 (見 messaging.RetentionSweeper)
+	if chatMsg.RemovedBefore != nil || chatMsg.ExpiredBefore != nil {
+		log.Printf("Notifying clients of room %s to remove purged messages", chatMsg.RoomID)
 	}
 
 	// 獲取對應的房間
@@ -212,106 +264,15 @@ func (h *BroadcastHandler) Handle(msg *nats.Msg) error {
 	room.Mu.Lock()
 	for _, client := range room.Clients {
 		select {
-		case client.Send <- chatMsg:
+		case client.Send <- *chatMsg:
 			log.Printf("Sent message to client %s", client.ID)
 		default:
 			log.Printf("Client %s send buffer full, message dropped", client.ID)
-			close(client.Send)
 			delete(room.Clients, client.ID)
+			client.CloseSend()
 		}
 	}
 	room.Mu.Unlock()
 
 	return nil
 }
-
-// HistoryResponseHandler 處理歷史消息回應
-type HistoryResponseHandler struct {
-	hub *chat.Hub
-}
-
-func NewHistoryResponseHandler(hub *chat.Hub) *HistoryResponseHandler {
-	return &HistoryResponseHandler{
-		hub: hub,
-	}
-}
-
-func (h *HistoryResponseHandler) Handle(msg *nats.Msg) error {
-	var response types.HistoryResponse
-	if err := json.Unmarshal(msg.Data, &response); err != nil {
-		log.Printf("Failed to unmarshal history response: %v", err)
-		return err
-	}
-
-	// 從主題中提取用戶ID (格式: settlechat.message.history.response.{roomID}.{userID})
-	parts := strings.Split(msg.Subject, ".")
-	if len(parts) < 6 {
-		log.Printf("Invalid history response topic format: %s", msg.Subject)
-		return fmt.Errorf("invalid history response topic format: %s", msg.Subject)
-	}
-	userID := parts[5]
-
-	log.Printf("Received history response for room %s, user %s with %d messages",
-		response.RoomID, userID, len(response.Messages))
-
-	// 查找對應的客戶端
-	client, found := h.hub.FindClient(response.RoomID, userID)
-	if !found {
-		log.Printf("Client not found: room=%s, user=%s", response.RoomID, userID)
-		return fmt.Errorf("client not found: room=%s, user=%s", response.RoomID, userID)
-	}
-
-	// 計算消息總數，以便顯示進度
-	totalMessages := len(response.Messages)
-	if totalMessages == 0 {
-		log.Printf("No history messages to send for client %s", client.ID)
-		return nil
-	}
-
-	// 發送歷史消息（已經是按時間順序從舊到新排列）
-	// 使用批量發送策略，每批次發送5條消息，並在批次之間添加短暫延遲
-	const batchSize = 10
-	const delayBetweenBatches = 50 * time.Millisecond
-	
-	for i := 0; i < totalMessages; i += batchSize {
-		// 計算當前批次的結束位置
-		end := i + batchSize
-		if end > totalMessages {
-			end = totalMessages
-		}
-		
-		// 處理當前批次的消息
-		for j := i; j < end; j++ {
-			message := response.Messages[j]
-			select {
-			case client.Send <- message:
-				log.Printf("Sent history message %d/%d to client %s", j+1, totalMessages, client.ID)
-			default:
-				log.Printf("Client %s send buffer full at message %d/%d, waiting before retry...", 
-					client.ID, j+1, totalMessages)
-				
-				// 如果發送通道已滿，等待一段時間後再嘗試
-				time.Sleep(100 * time.Millisecond)
-				
-				// 重試發送，如果仍然失敗則報錯
-				select {
-				case client.Send <- message:
-					log.Printf("Retry success: Sent history message %d/%d to client %s", 
-						j+1, totalMessages, client.ID)
-				default:
-					log.Printf("Client %s send buffer still full after retry, message %d/%d dropped", 
-						client.ID, j+1, totalMessages)
-					return fmt.Errorf("client send buffer full after retry")
-				}
-			}
-		}
-		
-		// 批次之間添加延遲，給客戶端處理消息的時間
-		if end < totalMessages {
-			time.Sleep(delayBetweenBatches)
-		}
-	}
-
-	log.Printf("Successfully sent all %d history messages to client %s", totalMessages, client.ID)
-	return nil
-}
@@ -0,0 +1,164 @@
+package event_handlers
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/cache"
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	memstore "github.com/ianwu0915/SettleChat/internal/storage/memory"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// failingSaver 每次保存都失敗
+type failingSaver struct{}
+
+func (failingSaver) SaveMessageWithOutbox(ctx context.Context, msg storage.ChatMessage, event storage.MessageEvent) (int64, error) {
+	return 0, errors.New("database unavailable")
+}
+
+func TestChatMessageHandlerAcksSender(t *testing.T) {
+	transport := memory.NewTransport()
+	defer transport.Close()
+	topics := nats.NewTopicFormatter("")
+	publisher := nats.NewPublisher(transport, "test", topics)
+
+	acks := make(chan types.MessageAck, 4)
+	transport.Subscribe(topics.GetMessageAckTopic("room-1"), func(msg *types.Message) {
+		if _, ack, err := decodeEvent[types.MessageAck](msg, types.EventTypeMessageAck); err == nil {
+			acks <- *ack
+		}
+	})
+	expectAck := func(t *testing.T, status string) types.MessageAck {
+		t.Helper()
+		select {
+		case ack := <-acks:
+			if ack.Status != status || ack.UserID != "u1" || ack.ClientMsgID != "c-1" {
+				t.Fatalf("unexpected ack: %+v", ack)
+			}
+			return ack
+		case <-time.After(time.Second):
+			t.Fatalf("no %s ack published", status)
+			return types.MessageAck{}
+		}
+	}
+	expectNoAck := func(t *testing.T) {
+		t.Helper()
+		select {
+		case ack := <-acks:
+			t.Fatalf("unexpected ack: %+v", ack)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	newMessage := func(attempt, maxAttempts int) *types.Message {
+		chatMsg := storage.ChatMessage{RoomID: "room-1", SenderID: "u1", Sender: "alice", Content: "hi", ClientMsgID: "c-1", Timestamp: time.Now()}
+		msg, err := encodeEvent(topics.GetMessageTopic("room-1"), types.NewEnvelope(types.EventTypeNewMessage, "room-1", "u1", chatMsg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Attempt, msg.MaxAttempts = attempt, maxAttempts
+		return msg
+	}
+
+	t.Run("saved", func(t *testing.T) {
+		store := memstore.NewStore()
+		handler := NewChatMessageHandler(store, publisher, topics, cache.NewMemory(cache.Options{}))
+		if err := handler.Handle(newMessage(1, 4)); err != nil {
+			t.Fatal(err)
+		}
+		expectAck(t, storage.MessageAckSaved)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		handler := NewChatMessageHandler(failingSaver{}, publisher, topics, cache.NewMemory(cache.Options{}))
+
+		// 還會重試時不通知發送者
+		if err := handler.Handle(newMessage(1, 4)); err == nil {
+			t.Fatal("handler ignored the save error")
+		}
+		expectNoAck(t)
+
+		if err := handler.Handle(newMessage(4, 4)); err == nil {
+			t.Fatal("handler ignored the save error")
+		}
+		if ack := expectAck(t, storage.MessageAckFailed); ack.Error == "" {
+			t.Fatal("failed ack has no error")
+		}
+	})
+}
+
+// 廣播與快取中的消息帶著保存時的 ID，客戶端可以直接拿它作為向上捲動的游標
+// 三條消息的時間相同，游標只有時間時會漏掉同一時間較早的消息
+func TestChatMessageHandlerCursorFromBroadcast(t *testing.T) {
+	transport := memory.NewTransport()
+	defer transport.Close()
+	topics := nats.NewTopicFormatter("")
+	publisher := nats.NewPublisher(transport, "test", topics)
+	store := memstore.NewStore()
+	history := cache.NewMemory(cache.Options{})
+	handler := NewChatMessageHandler(store, publisher, topics, history)
+	ctx := context.Background()
+
+	// 快取只保存已經載入過的房間
+	if _, err := recentMessages(ctx, history, store, "room-1", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Now().UTC().Truncate(time.Millisecond)
+	for _, content := range []string{"one", "two", "three"} {
+		chatMsg := storage.ChatMessage{RoomID: "room-1", SenderID: "u1", Sender: "alice", Content: content, Timestamp: at}
+		msg, err := encodeEvent(topics.GetMessageTopic("room-1"), types.NewEnvelope(types.EventTypeNewMessage, "room-1", "u1", chatMsg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.Handle(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var broadcasts []storage.ChatMessage
+	if _, err := store.RelayOutbox(ctx, 10, func(out storage.OutboxMessage) error {
+		_, chatMsg, err := decodeEvent[storage.ChatMessage](&types.Message{Subject: out.Subject, Header: out.Header, Data: out.Data}, types.EventTypeBroadcastMsg)
+		if err != nil {
+			return err
+		}
+		broadcasts = append(broadcasts, *chatMsg)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(broadcasts) != 3 {
+		t.Fatalf("relayed %d broadcasts, want 3", len(broadcasts))
+	}
+
+	cached, err := recentMessages(ctx, history, store, "room-1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 1 {
+		t.Fatalf("cache returned %d messages, want 1", len(cached))
+	}
+
+	for name, last := range map[string]storage.ChatMessage{"broadcast": broadcasts[2], "cache": cached[0]} {
+		if last.ID == 0 {
+			t.Fatalf("%s message has no id", name)
+		}
+		page, err := store.GetMessagesBefore(ctx, "room-1", storage.MessageCursor{Timestamp: last.Timestamp, ID: last.ID}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, msg := range page {
+			got = append(got, msg.Content)
+		}
+		if !slices.Equal(got, []string{"one", "two"}) {
+			t.Fatalf("page before %s message = %v, want [one two]", name, got)
+		}
+	}
+}
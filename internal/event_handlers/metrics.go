@@ -0,0 +1,88 @@
+package event_handlers
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HandlerStats 是一個 handler 的處理統計
+type HandlerStats struct {
+	Handler   string  `json:"handler"`
+	Handled   int64   `json:"handled"`
+	Failed    int64   `json:"failed"`
+	Panics    int64   `json:"panics"`
+	Timeouts  int64   `json:"timeouts"`
+	InFlight  int64   `json:"in_flight"`
+	AvgMillis float64 `json:"avg_ms"`
+	MaxMillis float64 `json:"max_ms"`
+	LastError string  `json:"last_error,omitempty"`
+
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+// HandlerMetrics 記錄每個 handler 的處理次數、錯誤與延遲，由 Metrics middleware 更新
+type HandlerMetrics struct {
+	mu    sync.Mutex
+	stats map[string]*HandlerStats
+}
+
+func NewHandlerMetrics() *HandlerMetrics {
+	return &HandlerMetrics{stats: make(map[string]*HandlerStats)}
+}
+
+// start 記錄 handler 開始處理一條消息，返回處理完成時呼叫的函數
+func (m *HandlerMetrics) start(handlerKey string) func(error) {
+	begin := time.Now()
+
+	m.mu.Lock()
+	stats, ok := m.stats[handlerKey]
+	if !ok {
+		stats = &HandlerStats{Handler: handlerKey}
+		m.stats[handlerKey] = stats
+	}
+	stats.InFlight++
+	m.mu.Unlock()
+
+	return func(err error) {
+		latency := time.Since(begin)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		stats.InFlight--
+		stats.Handled++
+		stats.totalLatency += latency
+		stats.maxLatency = max(stats.maxLatency, latency)
+		if err == nil {
+			return
+		}
+		stats.Failed++
+		stats.LastError = err.Error()
+		switch {
+		case errors.Is(err, ErrHandlerPanic):
+			stats.Panics++
+		case errors.Is(err, ErrHandlerTimeout):
+			stats.Timeouts++
+		}
+	}
+}
+
+// Snapshot 返回每個 handler 目前的統計，按 handler 排序
+func (m *HandlerMetrics) Snapshot() []HandlerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make([]HandlerStats, 0, len(m.stats))
+	for _, stats := range m.stats {
+		s := *stats
+		if s.Handled > 0 {
+			s.AvgMillis = float64(s.totalLatency.Microseconds()) / float64(s.Handled) / 1000
+		}
+		s.MaxMillis = float64(s.maxLatency.Microseconds()) / 1000
+		snapshot = append(snapshot, s)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Handler < snapshot[j].Handler })
+	return snapshot
+}
@@ -0,0 +1,153 @@
+package event_handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+var (
+	// ErrHandlerPanic handler 發生 panic，同樣的事件重試也會 panic，因此同時包裝 types.ErrPermanent
+	ErrHandlerPanic = errors.New("handler panicked")
+
+	// ErrHandlerTimeout handler 沒有在期限內完成，會依重試策略重試
+	ErrHandlerTimeout = errors.New("handler timed out")
+
+	// ErrUnauthorized AuthorizeFunc 以包裝 ErrUnauthorized 的錯誤拒絕事件
+	ErrUnauthorized = errors.New("event not authorized")
+)
+
+// DefaultHandlerTimeout 沒有以 SetTimeout 設置時，每個 handler 處理一條消息的時間上限
+const DefaultHandlerTimeout = 10 * time.Second
+
+// panicError 把 recover 的值轉換成錯誤並記錄 stack
+func panicError(handlerKey string, msg *types.Message, recovered any) error {
+	log.Printf("Error: Handler %s panicked on %s: %v\n%s", handlerKey, msg.Subject, recovered, debug.Stack())
+	return fmt.Errorf("%w: %w: %v", types.ErrPermanent, ErrHandlerPanic, recovered)
+}
+
+// Recover 把 handler 的 panic 轉換成錯誤，避免 panic 終止傳輸層的回調 goroutine
+func Recover() types.Middleware {
+	return func(handlerKey string, next types.MessageHandler) types.MessageHandler {
+		return types.HandlerFunc(func(msg *types.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = panicError(handlerKey, msg, r)
+				}
+			}()
+			return next.Handle(msg)
+		})
+	}
+}
+
+// Logging 以結構化日誌記錄每條消息的處理結果，帶上事件 ID、投遞次數與處理時間
+func Logging(logger *slog.Logger) types.Middleware {
+	return func(handlerKey string, next types.MessageHandler) types.MessageHandler {
+		return types.HandlerFunc(func(msg *types.Message) error {
+			start := time.Now()
+			err := next.Handle(msg)
+
+			attrs := []any{
+				slog.String("handler", handlerKey),
+				slog.String("event_id", msg.Header.Get(types.HeaderMsgID)),
+				slog.String("subject", msg.Subject),
+				slog.Int("attempt", msg.Attempt),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if err != nil {
+				logger.Error("event handler failed", append(attrs, slog.Any("error", err))...)
+			} else {
+				logger.Debug("event handled", attrs...)
+			}
+			return err
+		})
+	}
+}
+
+// Metrics 把每條消息的處理時間與結果記錄到 metrics，panic 記錄後繼續往外傳給 Recover
+func Metrics(metrics *HandlerMetrics) types.Middleware {
+	return func(handlerKey string, next types.MessageHandler) types.MessageHandler {
+		return types.HandlerFunc(func(msg *types.Message) (err error) {
+			done := metrics.start(handlerKey)
+			defer func() {
+				if r := recover(); r != nil {
+					done(ErrHandlerPanic)
+					panic(r)
+				}
+				done(err)
+			}()
+			return next.Handle(msg)
+		})
+	}
+}
+
+// Timeout 限制 handler 處理一條消息的時間
+// handler 從 msg.Context() 取得期限，超時後 context 被取消；Timeout 會等 handler 返回才返回，
+// 確保同一個房間的下一條消息或重試不會與還沒結束的 handler 同時執行
+func Timeout(timeout time.Duration) types.Middleware {
+	return func(handlerKey string, next types.MessageHandler) types.MessageHandler {
+		return types.HandlerFunc(func(msg *types.Message) (err error) {
+			ctx, cancel := context.WithTimeout(msg.Context(), timeout)
+			defer cancel()
+			defer func() {
+				if r := recover(); r != nil {
+					err = panicError(handlerKey, msg, r)
+				}
+			}()
+
+			err = next.Handle(msg.WithContext(ctx))
+			// 超時後才完成的 handler 以它自己的結果為準，只有失敗時才記為超時
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && msg.Context().Err() == nil {
+				return fmt.Errorf("%w after %s: %w", ErrHandlerTimeout, timeout, err)
+			}
+			return err
+		})
+	}
+}
+
+// AuthorizeFunc 決定事件是否可以交給 handler 處理
+// 拒絕時返回包裝 ErrUnauthorized 的錯誤；其他錯誤 (例如查詢資料庫失敗) 視為暫時性的，事件會被重試
+type AuthorizeFunc func(ctx context.Context, handlerKey string, msg *types.Message) error
+
+// Authorize 在 handler 之前執行授權檢查，被拒絕的事件不會重試
+func Authorize(authorize AuthorizeFunc) types.Middleware {
+	return func(handlerKey string, next types.MessageHandler) types.MessageHandler {
+		return types.HandlerFunc(func(msg *types.Message) error {
+			err := authorize(msg.Context(), handlerKey, msg)
+			switch {
+			case errors.Is(err, ErrUnauthorized):
+				log.Printf("Rejected event on %s for handler %s: %v", msg.Subject, handlerKey, err)
+				return fmt.Errorf("%w: %w", types.ErrPermanent, err)
+			case err != nil:
+				return fmt.Errorf("authorize event: %w", err)
+			}
+			return next.Handle(msg)
+		})
+	}
+}
+
+// roomMembersOnly 只接受房間成員送出的消息 (payload 為 storage.ChatMessage 的事件)
+func roomMembersOnly(store storage.RoomStore, fallbackType string) AuthorizeFunc {
+	return func(ctx context.Context, handlerKey string, msg *types.Message) error {
+		_, chatMsg, err := decodeEvent[storage.ChatMessage](msg, fallbackType)
+		if err != nil {
+			// 無法解碼的事件交給 handler 處理與回報
+			return nil
+		}
+		member, err := store.IsRoomMember(ctx, chatMsg.RoomID, chatMsg.SenderID)
+		if err != nil {
+			return fmt.Errorf("check membership of %s in room %s: %w", chatMsg.SenderID, chatMsg.RoomID, err)
+		}
+		if !member {
+			return fmt.Errorf("%w: user %s is not a member of room %s", ErrUnauthorized, chatMsg.SenderID, chatMsg.RoomID)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,189 @@
+package event_handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+func TestMiddlewareChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) types.Middleware {
+		return func(handlerKey string, next types.MessageHandler) types.MessageHandler {
+			return types.HandlerFunc(func(msg *types.Message) error {
+				calls = append(calls, name+":"+handlerKey)
+				return next.Handle(msg)
+			})
+		}
+	}
+
+	manager := NewHandlerManager(nil, nil, nil, "test", nil, nil)
+	manager.Use(trace("outer"))
+	manager.UseFor("message.chat", trace("chat"))
+
+	handler := types.HandlerFunc(func(msg *types.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+	manager.chain("message.chat", handler).Handle(types.NewMessage("settlechat.message.chat.room-1", nil))
+	manager.chain("user.joined", handler).Handle(types.NewMessage("settlechat.user.joined.room-1", nil))
+
+	want := "outer:message.chat chat:message.chat handler outer:user.joined handler"
+	if got := strings.Join(calls, " "); got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestMiddlewareRecoversPanics(t *testing.T) {
+	metrics := NewHandlerMetrics()
+	panicking := types.HandlerFunc(func(msg *types.Message) error { panic("boom") })
+
+	for name, middlewares := range map[string][]types.Middleware{
+		"recover": {Recover(), Metrics(metrics)},
+		"timeout": {Metrics(metrics), Timeout(time.Second)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := types.Chain("message.chat", panicking, middlewares...).Handle(types.NewMessage("settlechat.message.chat.room-1", nil))
+			if !errors.Is(err, ErrHandlerPanic) || !errors.Is(err, types.ErrPermanent) {
+				t.Fatalf("got %v, want a permanent ErrHandlerPanic", err)
+			}
+		})
+	}
+
+	stats := metrics.Snapshot()
+	if len(stats) != 1 || stats[0].Handled != 2 || stats[0].Panics != 2 || stats[0].InFlight != 0 {
+		t.Errorf("unexpected metrics: %+v", stats)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	metrics := NewHandlerMetrics()
+	slow := types.HandlerFunc(func(msg *types.Message) error {
+		<-msg.Context().Done()
+		return msg.Context().Err()
+	})
+
+	handler := types.Chain("ai.command", slow, Metrics(metrics), Timeout(20*time.Millisecond))
+	err := handler.Handle(types.NewMessage("settlechat.ai.command.room-1", nil))
+	if !errors.Is(err, ErrHandlerTimeout) || errors.Is(err, types.ErrPermanent) {
+		t.Fatalf("got %v, want a retryable ErrHandlerTimeout", err)
+	}
+	if stats := metrics.Snapshot(); stats[0].Timeouts != 1 || stats[0].Failed != 1 {
+		t.Errorf("unexpected metrics: %+v", stats)
+	}
+}
+
+func TestTimeoutKeepsRoomOrder(t *testing.T) {
+	transport := memory.NewTransport()
+	defer transport.Close()
+	topics := nats.NewTopicFormatter("")
+
+	// 第一次處理 "0" 時不理會 context，超時後仍在執行
+	var mu sync.Mutex
+	var seen []string
+	running, overlapped := 0, false
+	slow := types.HandlerFunc(func(msg *types.Message) error {
+		mu.Lock()
+		running++
+		overlapped = overlapped || running > 1
+		first := string(msg.Data) == "0" && msg.Attempt == 1
+		mu.Unlock()
+
+		if first {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		running--
+		seen = append(seen, fmt.Sprintf("%s/%d", msg.Data, msg.Attempt))
+		if first {
+			return msg.Context().Err()
+		}
+		return nil
+	})
+
+	done := make(chan struct{})
+	handler := types.HandlerFunc(func(msg *types.Message) error {
+		err := slow.Handle(msg)
+		if string(msg.Data) == "2" {
+			close(done)
+		}
+		return err
+	})
+
+	subscriber := nats.NewSubscriber(transport, nil, "test", topics)
+	subscriber.SetRetryPolicy("", types.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	subscriber.RegisterHandlerWithMode("message", "chat", types.Chain("message.chat", handler, Timeout(20*time.Millisecond)), types.DeliveryWork)
+	if err := subscriber.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+
+	for i := 0; i < 3; i++ {
+		transport.Publish(types.NewMessage(topics.GetMessageTopic("room-1"), []byte(fmt.Sprint(i))))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the room's events")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if overlapped {
+		t.Error("handler ran concurrently for the same room")
+	}
+	// 超時的 "0" 結束後才重試，之後才處理 "1" 與 "2"
+	if got, want := strings.Join(seen, " "), "0/1 0/2 1/1 2/1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAuthorizeMiddleware(t *testing.T) {
+	handled := 0
+	next := types.HandlerFunc(func(msg *types.Message) error {
+		handled++
+		return nil
+	})
+	outage := errors.New("database unavailable")
+	authorize := func(ctx context.Context, handlerKey string, msg *types.Message) error {
+		switch msg.Header.Get("User") {
+		case "member":
+			return nil
+		case "outage":
+			return outage
+		default:
+			return ErrUnauthorized
+		}
+	}
+	handler := types.Chain("ai.command", next, Authorize(authorize))
+
+	send := func(user string) error {
+		msg := types.NewMessage("settlechat.ai.command.room-1", nil)
+		msg.Header.Set("User", user)
+		return handler.Handle(msg)
+	}
+
+	if err := send("member"); err != nil || handled != 1 {
+		t.Fatalf("member rejected: %v", err)
+	}
+	if err := send("stranger"); !errors.Is(err, ErrUnauthorized) || !errors.Is(err, types.ErrPermanent) {
+		t.Errorf("got %v, want a permanent ErrUnauthorized", err)
+	}
+	if err := send("outage"); !errors.Is(err, outage) || errors.Is(err, types.ErrPermanent) {
+		t.Errorf("got %v, want a retryable error", err)
+	}
+	if handled != 1 {
+		t.Errorf("handler ran %d times, want 1", handled)
+	}
+}
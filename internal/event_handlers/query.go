@@ -0,0 +1,153 @@
+package event_handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/cache"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+const (
+	// queryTimeout 響應者處理一個查詢的時間上限，請求端通常也只等待這麼久
+	queryTimeout = 5 * time.Second
+
+	// maxHistoryLimit 一次歷史消息查詢最多返回的消息數
+	maxHistoryLimit = 50
+)
+
+// respond 解碼 request-reply 的查詢，把 query 的結果或 QueryError 回覆到請求的 inbox 主題 (msg.Reply)
+// 查詢失敗時回覆錯誤而不返回錯誤：請求端在等待的是這一次回覆，重試只會回覆到已經關閉的 inbox
+func respond[Req any](publisher types.NATSPublisher, msg *types.Message, requestType, responseType string, query func(context.Context, *Req) (any, error)) error {
+	if msg.Reply == "" {
+		return fmt.Errorf("%w: %s on %s has no reply subject", types.ErrPermanent, requestType, msg.Subject)
+	}
+
+	event, request, err := decodeEvent[Req](msg, requestType)
+	if err != nil {
+		log.Printf("Failed to decode %s: %v", requestType, err)
+		return reply(msg.Context(), publisher, msg.Reply, types.NewEnvelope(types.EventTypeQueryError, "", "", types.QueryError{
+			Code:    types.QueryErrorBadRequest,
+			Message: err.Error(),
+		}))
+	}
+
+	ctx, cancel := context.WithTimeout(msg.Context(), queryTimeout)
+	defer cancel()
+
+	result, err := query(ctx, request)
+	if err != nil {
+		log.Printf("Failed to answer %s for room %s: %v", requestType, event.RoomID, err)
+		code := types.QueryErrorInternal
+		if errors.Is(err, storage.ErrRoomNotFound) {
+			code = types.QueryErrorNotFound
+		}
+		result, responseType = types.QueryError{Code: code, Message: err.Error()}, types.EventTypeQueryError
+	}
+	return reply(ctx, publisher, msg.Reply, types.NewEnvelope(responseType, event.RoomID, event.Actor, result))
+}
+
+// reply 把響應發布到請求的 inbox 主題，請求端已經放棄等待時響應會被丟棄
+func reply(ctx context.Context, publisher types.NATSPublisher, inbox string, event types.Envelope) error {
+	if err := publishEvent(ctx, publisher, inbox, event); err != nil {
+		log.Printf("Failed to reply %s to %s: %v", event.Type, inbox, err)
+		return err
+	}
+	return nil
+}
+
+// roomMembers 返回房間成員，在線狀態以快取中所有實例共享的在線用戶為準，快取無法使用時使用資料庫的記錄
+func roomMembers(ctx context.Context, store storage.RoomStore, presence cache.Presence, roomID string) ([]storage.RoomMember, error) {
+	members, err := store.GetRoomMembers(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("get room members: %w", err)
+	}
+
+	online, err := presence.OnlineUsers(ctx, roomID)
+	if err != nil {
+		log.Printf("Failed to read presence of room %s from cache: %v", roomID, err)
+		return members, nil
+	}
+	for i := range members {
+		members[i].IsOnline = slices.Contains(online, members[i].UserID)
+	}
+	return members, nil
+}
+
+// RoomMembersHandler 回覆房間成員查詢
+type RoomMembersHandler struct {
+	store     storage.RoomStore
+	publisher types.NATSPublisher
+	cache     cache.Cache
+}
+
+func NewRoomMembersHandler(store storage.RoomStore, publisher types.NATSPublisher, c cache.Cache) *RoomMembersHandler {
+	return &RoomMembersHandler{
+		store:     store,
+		publisher: publisher,
+		cache:     c,
+	}
+}
+
+func (h *RoomMembersHandler) Handle(msg *types.Message) error {
+	return respond(h.publisher, msg, types.EventTypeRoomMembersRequest, types.EventTypeRoomMembersResponse,
+		func(ctx context.Context, request *types.RoomMembersRequest) (any, error) {
+			if _, err := h.store.GetRoom(ctx, request.RoomID); err != nil {
+				return nil, err
+			}
+			members, err := roomMembers(ctx, h.store, h.cache, request.RoomID)
+			if err != nil {
+				return nil, err
+			}
+			return types.RoomMembersResponse{RoomID: request.RoomID, Members: members}, nil
+		})
+}
+
+// RoomStateHandler 回覆房間狀態查詢
+type RoomStateHandler struct {
+	store     storage.Store
+	publisher types.NATSPublisher
+	cache     cache.Cache
+}
+
+func NewRoomStateHandler(store storage.Store, publisher types.NATSPublisher, c cache.Cache) *RoomStateHandler {
+	return &RoomStateHandler{
+		store:     store,
+		publisher: publisher,
+		cache:     c,
+	}
+}
+
+func (h *RoomStateHandler) Handle(msg *types.Message) error {
+	return respond(h.publisher, msg, types.EventTypeRoomStateRequest, types.EventTypeRoomStateResponse,
+		func(ctx context.Context, request *types.RoomStateRequest) (any, error) {
+			room, err := h.store.GetRoom(ctx, request.RoomID)
+			if err != nil {
+				return nil, err
+			}
+			members, err := roomMembers(ctx, h.store, h.cache, request.RoomID)
+			if err != nil {
+				return nil, err
+			}
+			latest, err := recentMessages(ctx, h.cache, h.store, request.RoomID, 1)
+			if err != nil {
+				return nil, fmt.Errorf("get latest message: %w", err)
+			}
+
+			state := types.RoomState{Room: *room, MemberCount: len(members)}
+			for _, member := range members {
+				if member.IsOnline {
+					state.OnlineCount++
+				}
+			}
+			if len(latest) > 0 {
+				state.LastMessageAt = &latest[0].Timestamp
+			}
+			return state, nil
+		})
+}
@@ -0,0 +1,149 @@
+package event_handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/cache"
+	"github.com/ianwu0915/SettleChat/internal/messaging"
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	memstore "github.com/ianwu0915/SettleChat/internal/storage/memory"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// membersResponder 以固定的成員表回覆房間成員查詢
+type membersResponder struct {
+	publisher types.NATSPublisher
+	members   map[string][]storage.RoomMember
+	block     chan struct{}
+}
+
+func (h *membersResponder) Handle(msg *types.Message) error {
+	return respond(h.publisher, msg, types.EventTypeRoomMembersRequest, types.EventTypeRoomMembersResponse,
+		func(ctx context.Context, request *types.RoomMembersRequest) (any, error) {
+			if h.block != nil {
+				<-h.block
+			}
+			members, ok := h.members[request.RoomID]
+			if !ok {
+				return nil, fmt.Errorf("room %s: %w", request.RoomID, storage.ErrRoomNotFound)
+			}
+			return types.RoomMembersResponse{RoomID: request.RoomID, Members: members}, nil
+		})
+}
+
+func startResponder(t *testing.T, transport *memory.Transport, handler types.MessageHandler) *messaging.EventBus {
+	t.Helper()
+	topics := nats.NewTopicFormatter("")
+	subscriber := nats.NewSubscriber(transport, nil, "test", topics)
+	subscriber.RegisterHandlerWithMode("query", "members", handler, types.DeliveryWork)
+	if err := subscriber.Start(); err != nil {
+		t.Fatalf("failed to start subscriber: %v", err)
+	}
+	t.Cleanup(func() { subscriber.Close() })
+	return messaging.NewEventBus(transport, topics)
+}
+
+func TestRoomMembersRequestReply(t *testing.T) {
+	transport := memory.NewTransport()
+	defer transport.Close()
+
+	handler := &membersResponder{
+		publisher: nats.NewPublisher(transport, "test", nats.NewTopicFormatter("")),
+		members: map[string][]storage.RoomMember{
+			"room-1": {{UserID: "u1", Username: "alice", IsOnline: true}, {UserID: "u2", Username: "bob"}},
+		},
+	}
+	eventBus := startResponder(t, transport, handler)
+
+	members, err := eventBus.RequestRoomMembers(context.Background(), "room-1")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if len(members) != 2 || members[0].Username != "alice" || !members[0].IsOnline {
+		t.Errorf("unexpected members: %+v", members)
+	}
+
+	t.Run("query error", func(t *testing.T) {
+		_, err := eventBus.RequestRoomMembers(context.Background(), "missing")
+		var queryErr *types.QueryError
+		if !errors.As(err, &queryErr) || queryErr.Code != types.QueryErrorNotFound {
+			t.Fatalf("got %v, want a not_found QueryError", err)
+		}
+	})
+}
+
+// TestRoomMembersHandler 以 in-memory store 與快取執行真正的 handler
+func TestRoomMembersHandler(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.NewStore()
+	alice, _ := store.Register(ctx, "alice", "secret")
+	bob, _ := store.Register(ctx, "bob", "secret")
+	roomID, _ := store.CreateRoom(ctx, "general", alice)
+	store.AddUserToRoom(ctx, alice, roomID)
+	store.AddUserToRoom(ctx, bob, roomID)
+
+	presence := cache.NewMemory(cache.Options{})
+	presence.SetOnline(ctx, roomID, bob)
+
+	transport := memory.NewTransport()
+	defer transport.Close()
+	publisher := nats.NewPublisher(transport, "test", nats.NewTopicFormatter(""))
+	eventBus := startResponder(t, transport, NewRoomMembersHandler(store, publisher, presence))
+
+	members, err := eventBus.RequestRoomMembers(ctx, roomID)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if len(members) != 2 || members[0].Username != "alice" || members[0].IsOnline || !members[1].IsOnline {
+		t.Errorf("unexpected members: %+v", members)
+	}
+
+	_, err = eventBus.RequestRoomMembers(ctx, "missing")
+	var queryErr *types.QueryError
+	if !errors.As(err, &queryErr) || queryErr.Code != types.QueryErrorNotFound {
+		t.Fatalf("got %v, want a not_found QueryError", err)
+	}
+}
+
+func TestRequestWithoutResponders(t *testing.T) {
+	transport := memory.NewTransport()
+	defer transport.Close()
+
+	eventBus := messaging.NewEventBus(transport, nats.NewTopicFormatter(""))
+	_, err := eventBus.RequestRoomState(context.Background(), "room-1")
+	if !errors.Is(err, types.ErrNoResponders) {
+		t.Fatalf("got %v, want ErrNoResponders", err)
+	}
+}
+
+func TestRequestTimeoutAndCancellation(t *testing.T) {
+	transport := memory.NewTransport()
+	defer transport.Close()
+
+	block := make(chan struct{})
+	defer close(block)
+	handler := &membersResponder{publisher: nats.NewPublisher(transport, "test", nats.NewTopicFormatter("")), block: block}
+	eventBus := startResponder(t, transport, handler).WithRequestTimeout(50 * time.Millisecond)
+
+	t.Run("default timeout", func(t *testing.T) {
+		_, err := eventBus.RequestRoomMembers(context.Background(), "room-1")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want DeadlineExceeded", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		_, err := eventBus.RequestRoomMembers(ctx, "room-1")
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want Canceled", err)
+		}
+	})
+}
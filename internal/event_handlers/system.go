@@ -1,12 +1,10 @@
 package event_handlers
 
 import (
-	"encoding/json"
 	"time"
 
 	"github.com/ianwu0915/SettleChat/internal/storage"
 	"github.com/ianwu0915/SettleChat/internal/types"
-	"github.com/nats-io/nats.go"
 )
 
 // SystemMessageHandler 處理系統消息
@@ -24,9 +22,9 @@ func NewSystemMessageHandler(publisher types.NATSPublisher, topics types.TopicFo
 	}
 }
 
-func (h *SystemMessageHandler) Handle(msg *nats.Msg) error {
-	var payload types.SystemMessage
-	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+func (h *SystemMessageHandler) Handle(msg *types.Message) error {
+	_, payload, err := decodeEvent[types.SystemMessage](msg, types.EventTypeSystemMessage)
+	if err != nil {
 		return err
 	}
 
@@ -39,10 +37,5 @@ func (h *SystemMessageHandler) Handle(msg *nats.Msg) error {
 		Timestamp: time.Now(),
 	}
 
-	messageData, err := json.Marshal(chatMsg)
-	if err != nil {
-		return err
-	}
-
-	return h.publisher.Publish(messageTopic, messageData)
+	return publishEvent(msg.Context(), h.publisher, messageTopic, types.NewEnvelope(types.EventTypeNewMessage, payload.RoomID, "", chatMsg))
 }
@@ -0,0 +1,45 @@
+package event_handlers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+func TestSystemMessageHandlerPublishesChatMessage(t *testing.T) {
+	transport := memory.NewTransport()
+	defer transport.Close()
+
+	topics := nats.NewTopicFormatter("")
+	handler := NewSystemMessageHandler(nats.NewPublisher(transport, "test", topics), topics, "test")
+
+	published := make(chan *types.Message, 1)
+	transport.Subscribe(topics.GetMessageTopic("room-1"), func(msg *types.Message) { published <- msg })
+
+	event := types.NewEnvelope(types.EventTypeSystemMessage, "room-1", "", types.SystemMessage{RoomID: "room-1", Message: "maintenance at noon"})
+	data, _ := json.Marshal(event)
+	if err := handler.Handle(types.NewMessage(topics.GetSystemMessageTopic("room-1"), data)); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+
+	select {
+	case msg := <-published:
+		event, chatMsg, err := decodeEvent[storage.ChatMessage](msg, "")
+		if err != nil {
+			t.Fatalf("invalid chat message: %v", err)
+		}
+		if event.Type != types.EventTypeNewMessage {
+			t.Errorf("got event type %q want %q", event.Type, types.EventTypeNewMessage)
+		}
+		if chatMsg.SenderID != "system" || chatMsg.Content != "maintenance at noon" {
+			t.Errorf("unexpected chat message: %+v", chatMsg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no chat message published")
+	}
+}
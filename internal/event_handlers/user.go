@@ -1,26 +1,24 @@
 package event_handlers
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"time"
 
+	"github.com/ianwu0915/SettleChat/internal/cache"
 	"github.com/ianwu0915/SettleChat/internal/storage"
 	"github.com/ianwu0915/SettleChat/internal/types"
-	"github.com/nats-io/nats.go"
 )
 
 // UserJoinedHandler 處理用戶加入事件
 type UserJoinedHandler struct {
-	store     *storage.PostgresStore
+	store     storage.Store
 	publisher types.NATSPublisher
 	topics    types.TopicFormatter
 	env       string
 }
 
-func NewUserJoinedHandler(store *storage.PostgresStore, publisher types.NATSPublisher, topics types.TopicFormatter, env string) *UserJoinedHandler {
+func NewUserJoinedHandler(store storage.Store, publisher types.NATSPublisher, topics types.TopicFormatter, env string) *UserJoinedHandler {
 	return &UserJoinedHandler{
 		store:     store,
 		publisher: publisher,
@@ -29,15 +27,15 @@ func NewUserJoinedHandler(store *storage.PostgresStore, publisher types.NATSPubl
 	}
 }
 
-func (h *UserJoinedHandler) Handle(msg *nats.Msg) error {
-	var payload types.UserJoinedMessage
-	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+func (h *UserJoinedHandler) Handle(msg *types.Message) error {
+	_, payload, err := decodeEvent[types.UserJoinedMessage](msg, types.EventTypeUserJoined)
+	if err != nil {
 		log.Printf("Failed to unmarshal user joined message: %v", err)
 		return err
 	}
 
 	// 將用戶添加到房間
-	if err := h.store.AddUserToRoom(context.Background(), payload.UserID, payload.RoomID); err != nil {
+	if err := h.store.AddUserToRoom(msg.Context(), payload.UserID, payload.RoomID); err != nil {
 		log.Printf("Failed to add user to room in database: %v", err)
 		return err
 	}
@@ -50,28 +48,32 @@ func (h *UserJoinedHandler) Handle(msg *nats.Msg) error {
 		Message:   systemMsg,
 		Timestamp: time.Now(),
 	}
-	systemData, err := json.Marshal(systemPayload)
-	if err != nil {
-		log.Printf("Failed to marshal system message: %v", err)
-		return err
-	}
-	if err := h.publisher.Publish(systemTopic, systemData); err != nil {
+	systemEvent := types.NewEnvelope(types.EventTypeSystemMessage, payload.RoomID, payload.UserID, systemPayload)
+	if err := publishEvent(msg.Context(), h.publisher, systemTopic, systemEvent); err != nil {
 		log.Printf("Failed to publish system message: %v", err)
 	}
 
-	// 發布在線狀態更新
+	// 發布在線狀態更新，帶上用戶的全域狀態
 	presenceTopic := h.topics.GetPresenceTopic(payload.RoomID)
 	presenceMsg := types.PresenceMessage{
 		RoomID:   payload.RoomID,
 		UserID:   payload.UserID,
 		Username: payload.Username,
 		IsOnline: true,
-	}
-	presenceData, err := json.Marshal(presenceMsg)
-	if err != nil {
-		return err
-	}
-	if err := h.publisher.Publish(presenceTopic, presenceData); err != nil {
+		Status:   storage.UserStatusOnline,
+	}
+	if status, err := h.store.GetUserStatus(msg.Context(), payload.UserID); err != nil {
+		log.Printf("Failed to get user status, assuming online: %v", err)
+	} else {
+		visible := status.Visible()
+		presenceMsg.IsOnline = visible.IsOnline()
+		presenceMsg.Status = visible.Status
+		presenceMsg.StatusText = visible.Text
+		presenceMsg.StatusEmoji = visible.Emoji
+		presenceMsg.StatusExpiresAt = visible.ExpiresAt
+	}
+	presenceEvent := types.NewEnvelope(types.EventTypeUserPresence, payload.RoomID, payload.UserID, presenceMsg)
+	if err := publishEvent(msg.Context(), h.publisher, presenceTopic, presenceEvent); err != nil {
 		log.Printf("Failed to publish presence message: %v", err)
 	}
 
@@ -80,13 +82,13 @@ func (h *UserJoinedHandler) Handle(msg *nats.Msg) error {
 
 // UserLeftHandler 處理用戶離開事件
 type UserLeftHandler struct {
-	store     *storage.PostgresStore
+	store     storage.RoomStore
 	publisher types.NATSPublisher
 	topics    types.TopicFormatter
 	env       string
 }
 
-func NewUserLeftHandler(store *storage.PostgresStore, publisher types.NATSPublisher, topics types.TopicFormatter, env string) *UserLeftHandler {
+func NewUserLeftHandler(store storage.RoomStore, publisher types.NATSPublisher, topics types.TopicFormatter, env string) *UserLeftHandler {
 	return &UserLeftHandler{
 		store:     store,
 		publisher: publisher,
@@ -95,9 +97,9 @@ func NewUserLeftHandler(store *storage.PostgresStore, publisher types.NATSPublis
 	}
 }
 
-func (h *UserLeftHandler) Handle(msg *nats.Msg) error {
-	var payload types.UserLeftMessage
-	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+func (h *UserLeftHandler) Handle(msg *types.Message) error {
+	_, payload, err := decodeEvent[types.UserLeftMessage](msg, types.EventTypeUserLeft)
+	if err != nil {
 		log.Printf("Failed to unmarshal user left message: %v", err)
 		return err
 	}
@@ -116,12 +118,8 @@ func (h *UserLeftHandler) Handle(msg *nats.Msg) error {
 		Message:   systemMsg,
 		Timestamp: time.Now(),
 	}
-	systemData, err := json.Marshal(systemPayload)
-	if err != nil {
-		log.Printf("Failed to marshal system message: %v", err)
-		return err
-	}
-	if err := h.publisher.Publish(systemTopic, systemData); err != nil {
+	systemEvent := types.NewEnvelope(types.EventTypeSystemMessage, payload.RoomID, payload.UserID, systemPayload)
+	if err := publishEvent(msg.Context(), h.publisher, systemTopic, systemEvent); err != nil {
 		log.Printf("Failed to publish system message: %v", err)
 	}
 
@@ -132,12 +130,10 @@ func (h *UserLeftHandler) Handle(msg *nats.Msg) error {
 		UserID:   payload.UserID,
 		Username: payload.Username,
 		IsOnline: false,
+		Status:   storage.UserStatusOffline,
 	}
-	presenceData, err := json.Marshal(presenceMsg)
-	if err != nil {
-		return err
-	}
-	if err := h.publisher.Publish(presenceTopic, presenceData); err != nil {
+	presenceEvent := types.NewEnvelope(types.EventTypeUserPresence, payload.RoomID, payload.UserID, presenceMsg)
+	if err := publishEvent(msg.Context(), h.publisher, presenceTopic, presenceEvent); err != nil {
 		log.Printf("Failed to publish presence message: %v", err)
 	}
 
@@ -145,43 +141,57 @@ func (h *UserLeftHandler) Handle(msg *nats.Msg) error {
 }
 
 // PresenceHandler 處理用戶在線狀態
+// 在線狀態同時寫入資料庫與快取，查詢房間成員時以快取中的在線用戶為準
 type PresenceHandler struct {
-	store  *storage.PostgresStore
-	topics types.TopicFormatter
-	env    string
+	store    storage.UserStore
+	presence cache.Presence
+	topics   types.TopicFormatter
+	env      string
 }
 
 // NewPresenceHandler 創建新的 PresenceHandler
-func NewPresenceHandler(store *storage.PostgresStore, topics types.TopicFormatter, env string) *PresenceHandler {
+func NewPresenceHandler(store storage.UserStore, presence cache.Presence, topics types.TopicFormatter, env string) *PresenceHandler {
 	return &PresenceHandler{
-		store:  store,
-		topics: topics,
-		env:    env,
+		store:    store,
+		presence: presence,
+		topics:   topics,
+		env:      env,
 	}
 }
 
 // Handle 處理用戶在線狀態消息
-func (h *PresenceHandler) Handle(msg *nats.Msg) error {
-	var presence types.PresenceMessage
-	if err := json.Unmarshal(msg.Data, &presence); err != nil {
+func (h *PresenceHandler) Handle(msg *types.Message) error {
+	// v1 的消息解碼時已經補上 Status
+	_, presence, err := decodeEvent[types.PresenceMessage](msg, types.EventTypeUserPresence)
+	if err != nil {
 		log.Printf("Failed to unmarshal presence message: %v", err)
 		return err
 	}
 
 	// 更新數據庫中的在線狀態
-	if err := h.store.UpdatePresence(context.Background(), presence.RoomID, presence.UserID, presence.IsOnline); err != nil {
+	if err := h.store.UpdatePresence(msg.Context(), presence.RoomID, presence.UserID, presence.IsOnline); err != nil {
 		log.Printf("Failed to update presence in database: %v", err)
 		return err
 	}
 
+	// 隱身的用戶 IsOnline 為 false，不會出現在快取的在線用戶中
+	if presence.IsOnline {
+		err = h.presence.SetOnline(msg.Context(), presence.RoomID, presence.UserID)
+	} else {
+		err = h.presence.SetOffline(msg.Context(), presence.RoomID, presence.UserID)
+	}
+	if err != nil {
+		log.Printf("Failed to update presence in cache: %v", err)
+	}
+
 	// 更新用戶的最後活動時間
-	if err := h.store.UpdateLastActive(context.Background(), presence.UserID); err != nil {
+	if err := h.store.UpdateLastActive(msg.Context(), presence.UserID); err != nil {
 		log.Printf("Failed to update user's last active time: %v", err)
 		// 不返回錯誤，因為這不是關鍵操作
 	}
 
-	log.Printf("Updated presence for user %s (%s) in room %s: online=%v",
-		presence.Username, presence.UserID, presence.RoomID, presence.IsOnline)
+	log.Printf("Updated presence for user %s (%s) in room %s: online=%v status=%q",
+		presence.Username, presence.UserID, presence.RoomID, presence.IsOnline, presence.Status)
 
 	return nil
 }
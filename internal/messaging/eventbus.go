@@ -1,160 +1,282 @@
 package messaging
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"time"
 
+	"github.com/ianwu0915/SettleChat/internal/codec"
 	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/tracing"
 	"github.com/ianwu0915/SettleChat/internal/types"
-	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
 )
 
+// ErrReplayUnavailable 傳輸層沒有保存事件，無法補回消息
+var ErrReplayUnavailable = errors.New("event replay is not available on this transport")
+
+// DefaultRequestTimeout 查詢的 context 沒有期限時等待響應的時間
+const DefaultRequestTimeout = 5 * time.Second
+
 // EventBus 提供統一的事件發布機制
 type EventBus struct {
-	natsManager *nats.NATSManager
-	nat_topic_formatter      types.TopicFormatter
+	transport           types.Transport
+	nat_topic_formatter types.TopicFormatter
+	codec               codec.Codec
+	requestTimeout      time.Duration
 }
 
-// NewEventBus 創建一個新的事件總線
-func NewEventBus(natsManager *nats.NATSManager, nat_topic_formatter types.TopicFormatter) *EventBus {
+// NewEventBus 創建一個新的事件總線，預設以 JSON 編碼事件
+// transport 可以是 NATS (nats.NewTransport) 或單機的 in-memory 實現
+func NewEventBus(transport types.Transport, nat_topic_formatter types.TopicFormatter) *EventBus {
 	return &EventBus{
-		natsManager: natsManager,
-		nat_topic_formatter:      nat_topic_formatter,
+		transport:           transport,
+		nat_topic_formatter: nat_topic_formatter,
+		codec:               codec.JSON,
+		requestTimeout:      DefaultRequestTimeout,
 	}
 }
 
+// WithCodec 設置事件 payload 的編碼，編碼會寫入 NATS 標頭讓訂閱端解碼
+func (eb *EventBus) WithCodec(c codec.Codec) *EventBus {
+	eb.codec = c
+	return eb
+}
+
+// WithRequestTimeout 設置查詢的 context 沒有期限時等待響應的時間
+func (eb *EventBus) WithRequestTimeout(timeout time.Duration) *EventBus {
+	eb.requestTimeout = timeout
+	return eb
+}
+
 // PublishEvent 發布事件到相應的主題
-// 根據event類型得到對應的NATS topics 並透過natsManager發布
-func (eb *EventBus) PublishEvent(event types.Event, roomID string) error {
-	data, err := json.Marshal(event)
+// 根據event類型得到對應的NATS topics 並透過傳輸層發布，事件類型必須登記在 types.Events
+func (eb *EventBus) PublishEvent(event types.Envelope) error {
+	return eb.PublishEventContext(context.Background(), event)
+}
+
+// PublishEventContext 與 PublishEvent 相同，並把 ctx 的 trace context 寫入消息標頭，
+// 訂閱端的 handler 會接在同一個 trace 之下
+func (eb *EventBus) PublishEventContext(ctx context.Context, event types.Envelope) (err error) {
+	msg, err := eb.Encode(event)
 	if err != nil {
-		return fmt.Errorf("marshal event error: %w", err)
+		return err
 	}
+	log.Printf("Publishing event type [%s] v%d to topic: %s", event.Type, event.Version, msg.Subject)
 
-	// Get Topic of event using nats_topic formatter
-	topic := eb.getNatsTopicForEvent(event, roomID)
-	log.Printf("Publishing event type [%s] to topic: %s", event.GetType(), topic)
+	_, span := tracing.StartPublish(ctx, msg, event.Type)
+	defer func() { tracing.End(span, err) }()
 
-	// NatsManager發布到對應topic
-	if err := eb.natsManager.Publish(topic, data); err != nil {
+	// 透過傳輸層發布到對應topic
+	if err := eb.transport.Publish(msg); err != nil {
 		return fmt.Errorf("publish event error: %w", err)
 	}
-
 	return nil
 }
 
-// getNatsTopicForEvent 根據事件類型獲取對應的NATS主題
-func (eb *EventBus) getNatsTopicForEvent(event types.Event, roomID string) string {
-	eventType := event.GetType()
-
-	// 根據事件類型前綴確定主題
-	if strings.HasPrefix(eventType, "connection.") {
-		return eb.nat_topic_formatter.GetConnectionTopic(roomID)
+// Encode 以設定的編碼序列化事件，返回發布到對應主題的消息
+// 標頭帶有 payload 的 Content-Type 與以事件 ID 作為的去重 ID
+func (eb *EventBus) Encode(event types.Envelope) (*types.Message, error) {
+	if _, ok := types.Events.CurrentVersion(event.Type); !ok {
+		return nil, fmt.Errorf("%w: %q", types.ErrUnknownEventType, event.Type)
 	}
 
-	if eventType == types.EventTypeUserJoined {
-		return eb.nat_topic_formatter.GetUserJoinedTopic(roomID)
+	data, err := eb.codec.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("marshal event error: %w", err)
 	}
 
-	if eventType == types.EventTypeUserLeft {
-		return eb.nat_topic_formatter.GetUserLeftTopic(roomID)
+	topic, err := eb.getNatsTopicForEvent(event)
+	if err != nil {
+		return nil, err
 	}
 
-	if eventType == types.EventTypeUserPresence {
-		return eb.nat_topic_formatter.GetPresenceTopic(roomID)
-	}
+	msg := types.NewMessage(topic, data)
+	msg.Header.Set(codec.HeaderContentType, eb.codec.ContentType())
+	msg.Header.Set(types.HeaderMsgID, event.ID)
+	return msg, nil
+}
 
-	if eventType == types.EventTypeNewMessage {
-		return eb.nat_topic_formatter.GetMessageTopic(roomID)
+// OutboxMessage 把事件轉換成 outbox 的一筆資料，與業務資料在同一個交易寫入後由 OutboxRelay 發布
+// ctx 的 trace context 會保存在標頭中，relay 發布時接回同一個 trace
+func (eb *EventBus) OutboxMessage(ctx context.Context, event types.Envelope) (storage.OutboxMessage, error) {
+	msg, err := eb.Encode(event)
+	if err != nil {
+		return storage.OutboxMessage{}, err
 	}
+	tracing.Inject(ctx, msg.Header)
+	return storage.OutboxMessage{
+		EventID: event.ID,
+		Subject: msg.Subject,
+		Header:  msg.Header,
+		Data:    msg.Data,
+	}, nil
+}
 
-	if eventType == types.EventTypeBroadcastMsg {
-		return eb.nat_topic_formatter.GetBroadcastTopic(roomID)
-	}
+// CanReplay 是否可以從傳輸層 (JetStream) 補回房間的消息
+func (eb *EventBus) CanReplay() bool {
+	durable, ok := eb.transport.(types.DurableTransport)
+	return ok && durable.Durable()
+}
 
-	if eventType == types.EventTypeNewAICommand {
-		return eb.nat_topic_formatter.GetAICommandTopic(roomID)
+// ReplayRoomMessages 依序補回房間在 since 之後廣播的消息，用於斷線重連的客戶端
+// 傳輸層沒有保存事件時返回 ErrReplayUnavailable
+func (eb *EventBus) ReplayRoomMessages(ctx context.Context, roomID string, since time.Time, fn func(storage.ChatMessage) error) error {
+	if !eb.CanReplay() {
+		return ErrReplayUnavailable
 	}
 
-	// HistoryRequest + HistoryResponse
-	if strings.HasPrefix(eventType, "message.history") {
-		// 歷史消息請求和響應使用不同的主題
-		if strings.Contains(eventType, "request") {
-			return eb.nat_topic_formatter.GetHistoryRequestTopic(roomID)
+	topic := eb.nat_topic_formatter.GetBroadcastTopic(roomID)
+	return eb.transport.(types.DurableTransport).Replay(ctx, topic, since, func(msg *types.Message) error {
+		c := codec.ForContentType(msg.Header.Get(codec.HeaderContentType))
+		event, err := types.Events.Decode(c, msg.Data, types.EventTypeBroadcastMsg)
+		if err != nil {
+			log.Printf("Skipping undecodable broadcast during replay of room %s: %v", roomID, err)
+			return nil
+		}
+		chatMsg, ok := event.Payload.(*storage.ChatMessage)
+		if !ok {
+			log.Printf("Skipping %s event during replay of room %s", event.Type, roomID)
+			return nil
 		}
+		// 補回期間已經過期的消息不再送給客戶端
+		if chatMsg.Expired(time.Now()) {
+			return nil
+		}
+		return fn(*chatMsg)
+	})
+}
+
+// getNatsTopicForEvent 根據事件類型獲取對應的NATS主題
+// 查詢的響應回覆到請求的 inbox 主題，沒有對應的主題
+func (eb *EventBus) getNatsTopicForEvent(event types.Envelope) (string, error) {
+	eventType := event.Type
+	roomID := event.RoomID
+
+	// 根據事件類型前綴確定主題
+	if strings.HasPrefix(eventType, "connection.") {
+		return eb.nat_topic_formatter.GetConnectionTopic(roomID), nil
+	}
 
-		// 對於響應，我們假設使用的是歷史消息響應事件類型
-		// 這部分需要根據實際的歷史消息響應事件結構來調整
-		// 暫時使用固定的用戶ID "system"
-		return eb.nat_topic_formatter.GetHistoryResponseTopic(roomID, "system")
+	switch eventType {
+	case types.EventTypeUserJoined:
+		return eb.nat_topic_formatter.GetUserJoinedTopic(roomID), nil
+	case types.EventTypeUserLeft:
+		return eb.nat_topic_formatter.GetUserLeftTopic(roomID), nil
+	case types.EventTypeUserPresence:
+		return eb.nat_topic_formatter.GetPresenceTopic(roomID), nil
+	case types.EventTypeNewMessage:
+		return eb.nat_topic_formatter.GetMessageTopic(roomID), nil
+	case types.EventTypeBroadcastMsg:
+		return eb.nat_topic_formatter.GetBroadcastTopic(roomID), nil
+	case types.EventTypeMessageAck:
+		return eb.nat_topic_formatter.GetMessageAckTopic(roomID), nil
+	case types.EventTypeNewAICommand:
+		return eb.nat_topic_formatter.GetAICommandTopic(roomID), nil
+	case types.EventTypeSystemMessage:
+		return eb.nat_topic_formatter.GetSystemMessageTopic(roomID), nil
+	case types.EventTypeHistoryRequest:
+		return eb.nat_topic_formatter.GetHistoryQueryTopic(roomID), nil
+	case types.EventTypeRoomMembersRequest:
+		return eb.nat_topic_formatter.GetRoomMembersQueryTopic(roomID), nil
+	case types.EventTypeRoomStateRequest:
+		return eb.nat_topic_formatter.GetRoomStateQueryTopic(roomID), nil
 	}
 
-	// 默認使用系統消息主題
-	return eb.nat_topic_formatter.GetSystemMessageTopic(roomID)
+	return "", fmt.Errorf("event type %q is not published to a topic", eventType)
 }
 
 // PublishConnectEvent 發布連接事件
 func (eb *EventBus) PublishConnectEvent(roomID, userID, username string) error {
-	event := types.NewConnectEvent(roomID, userID, username)
-	return eb.PublishEvent(event, roomID)
+	payload := types.ConnectionMessage{RoomID: roomID, UserID: userID, Username: username}
+	return eb.PublishEvent(types.NewEnvelope(types.EventTypeConnect, roomID, userID, payload))
 }
 
 // PublishDisconnectEvent 發布斷開連接事件
 func (eb *EventBus) PublishDisconnectEvent(roomID, userID, username string) error {
-	event := types.NewDisconnectEvent(roomID, userID, username)
-	return eb.PublishEvent(event, roomID)
+	payload := types.ConnectionMessage{RoomID: roomID, UserID: userID, Username: username}
+	return eb.PublishEvent(types.NewEnvelope(types.EventTypeDisconnect, roomID, userID, payload))
 }
 
 // PublishUserJoinedEvent 發布用戶加入事件
 func (eb *EventBus) PublishUserJoinedEvent(roomID, userID, username string) error {
-	event := types.NewUserJoinedEvent(roomID, userID, username)
-	return eb.PublishEvent(event, roomID)
+	payload := types.UserJoinedMessage{RoomID: roomID, UserID: userID, Username: username, JoinedAt: time.Now()}
+	return eb.PublishEvent(types.NewEnvelope(types.EventTypeUserJoined, roomID, userID, payload))
 }
 
 // PublishUserLeftEvent 發布用戶離開事件
 func (eb *EventBus) PublishUserLeftEvent(roomID, userID, username string) error {
-	event := types.NewUserLeftEvent(roomID, userID, username)
-	return eb.PublishEvent(event, roomID)
+	payload := types.UserLeftMessage{RoomID: roomID, UserID: userID, Username: username, LeftAt: time.Now()}
+	return eb.PublishEvent(types.NewEnvelope(types.EventTypeUserLeft, roomID, userID, payload))
 }
 
 // PublishPresenceEvent 發布在線狀態事件
 func (eb *EventBus) PublishPresenceEvent(roomID, userID, username string, isOnline bool) error {
-	event := types.NewPresenceEvent(roomID, userID, username, isOnline)
-	return eb.PublishEvent(event, roomID)
-}
-
-// PublishNewMessageEvent 發布新訊息事件
-func (eb *EventBus) PublishNewMessageEvent(roomID, senderID, sender, content string) error {
-	event := types.ChatMessageEvent{
-		RoomID:    roomID,
-		SenderID:  senderID,
-		Sender:    sender,
-		Content:   content,
-		Timestamp: time.Now(),
+	status := storage.UserStatusOnline
+	if !isOnline {
+		status = storage.UserStatusOffline
 	}
+	payload := types.PresenceMessage{RoomID: roomID, UserID: userID, Username: username, IsOnline: isOnline, Status: status}
+	return eb.PublishEvent(types.NewEnvelope(types.EventTypeUserPresence, roomID, userID, payload))
+}
 
-	data, err := json.Marshal(event)
-	if err != nil {
-		return fmt.Errorf("failed to marshal message event: %w", err)
+// PublishUserStatusEvent 將用戶的全域狀態發布到該用戶所在的每一個房間
+// 隱身的用戶會以離線狀態發布
+func (eb *EventBus) PublishUserStatusEvent(roomIDs []string, username string, status storage.UserStatus) error {
+	visible := status.Visible()
+	var errs []error
+	for _, roomID := range roomIDs {
+		payload := types.PresenceMessage{
+			RoomID:          roomID,
+			UserID:          status.UserID,
+			Username:        username,
+			IsOnline:        visible.IsOnline(),
+			Status:          visible.Status,
+			StatusText:      visible.Text,
+			StatusEmoji:     visible.Emoji,
+			StatusExpiresAt: visible.ExpiresAt,
+		}
+		event := types.NewEnvelope(types.EventTypeUserPresence, roomID, status.UserID, payload)
+		if err := eb.PublishEvent(event); err != nil {
+			errs = append(errs, fmt.Errorf("room %s: %w", roomID, err))
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	topic := eb.nat_topic_formatter.GetMessageTopic(roomID)
-	return eb.natsManager.Publish(topic, data)
+// PublishNewMessageEvent 發布新訊息事件，消息時間即為事件的 Timestamp
+func (eb *EventBus) PublishNewMessageEvent(ctx context.Context, roomID, senderID, sender, content string) error {
+	return eb.PublishChatMessageEvent(ctx, storage.ChatMessage{
+		RoomID:   roomID,
+		SenderID: senderID,
+		Sender:   sender,
+		Content:  content,
+	})
 }
 
-// PublishHistoryRequestEvent 發布歷史消息請求事件
-func (eb *EventBus) PublishHistoryRequestEvent(roomID, userID string, limit int) error {
-	event := types.NewHistoryRequestEvent(roomID, userID, limit)
-	return eb.PublishEvent(event, roomID)
+// PublishChatMessageEvent 發布客戶端送出的消息 (保留 ClientMsgID)，消息時間即為事件的 Timestamp
+// 客戶端以 ExpiresIn 要求的存在時間 (最長 storage.MaxMessageTTL) 換算成 ExpiresAt
+func (eb *EventBus) PublishChatMessageEvent(ctx context.Context, msg storage.ChatMessage) error {
+	event := types.NewEnvelope(types.EventTypeNewMessage, msg.RoomID, msg.SenderID, nil)
+	msg.Timestamp = event.Timestamp
+	msg.Ack = ""
+	msg.ExpiresAt, msg.RemovedBefore, msg.ExpiredBefore = nil, nil, nil
+	if msg.ExpiresIn > 0 {
+		ttl := storage.MaxMessageTTL
+		if msg.ExpiresIn < int(ttl/time.Second) {
+			ttl = time.Duration(msg.ExpiresIn) * time.Second
+		}
+		expiresAt := msg.Timestamp.Add(ttl)
+		msg.ExpiresAt = &expiresAt
+	}
+	msg.ExpiresIn = 0
+	event.Payload = msg
+	return eb.PublishEventContext(ctx, event)
 }
 
 // PublishAICommandEvent 發布 AI 命令事件
-func (eb *EventBus) PublishAICommandEvent(msg storage.ChatMessage) error {
-	// 創建 AI 命令事件
-	event := types.NewAICommandEvent(&msg)
-	return eb.PublishEvent(event, msg.RoomID)
+func (eb *EventBus) PublishAICommandEvent(ctx context.Context, msg storage.ChatMessage) error {
+	return eb.PublishEventContext(ctx, types.NewEnvelope(types.EventTypeNewAICommand, msg.RoomID, msg.SenderID, msg))
 }
- 
\ No newline at end of file
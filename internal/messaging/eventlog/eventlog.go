@@ -0,0 +1,175 @@
+// Package eventlog 觀察、錄製與重播事件總線上的消息，供 settlectl events 排查事件流程
+package eventlog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// Record 是錄下來的一條消息，保存原始的標頭與 payload，重播時發布的內容與錄製時完全相同
+type Record struct {
+	ReceivedAt time.Time    `json:"received_at"`
+	Subject    string       `json:"subject"`
+	Category   string       `json:"category"`
+	Action     string       `json:"action"`
+	RoomID     string       `json:"room_id"`
+	Header     types.Header `json:"header,omitempty"`
+	Data       []byte       `json:"data"`
+}
+
+// Topic 返回錄製時解析的主題，重播時以目標命名空間的 TopicFormatter 重新格式化
+func (r Record) Topic() types.Topic {
+	return types.Topic{Category: r.Category, Action: r.Action, RoomID: r.RoomID}
+}
+
+// Event 是解碼後的消息，無法解碼時 Envelope 為 nil、DecodeErr 為解碼錯誤
+type Event struct {
+	Record
+	Envelope  *types.Envelope
+	DecodeErr error
+}
+
+// NewEvent 解析消息的主題並解碼事件，主題不屬於 topics 的命名空間時返回錯誤
+func NewEvent(topics types.TopicFormatter, msg *types.Message, receivedAt time.Time) (Event, error) {
+	topic, err := topics.ParseTopic(msg.Subject)
+	if err != nil {
+		return Event{}, err
+	}
+	event := Event{Record: Record{
+		ReceivedAt: receivedAt,
+		Subject:    msg.Subject,
+		Category:   topic.Category,
+		Action:     topic.Action,
+		RoomID:     topic.RoomID,
+		Header:     msg.Header,
+		Data:       msg.Data,
+	}}
+	event.decode()
+	return event, nil
+}
+
+func (e *Event) decode() {
+	c := codec.ForContentType(e.Header.Get(codec.HeaderContentType))
+	e.Envelope, e.DecodeErr = types.Events.Decode(c, e.Data, "")
+}
+
+// Filter 選擇要觀察、錄製或重播的事件，空的欄位不過濾
+type Filter struct {
+	// Topics handler key，例如 "message.chat"
+	Topics []string
+	RoomID string
+	// UserID 觸發事件的用戶 (Envelope.Actor)
+	UserID string
+	// Types 事件類型，例如 "message.new"
+	Types []string
+}
+
+// Match 事件是否符合所有條件，依用戶或類型過濾時無法解碼的事件不符合
+func (f Filter) Match(event Event) bool {
+	topic := event.Topic()
+	if len(f.Topics) > 0 && !slices.Contains(f.Topics, topic.HandlerKey()) {
+		return false
+	}
+	if f.RoomID != "" && topic.RoomID != f.RoomID {
+		return false
+	}
+	if f.UserID == "" && len(f.Types) == 0 {
+		return true
+	}
+	if event.Envelope == nil {
+		return false
+	}
+	if f.UserID != "" && event.Envelope.Actor != f.UserID {
+		return false
+	}
+	return len(f.Types) == 0 || slices.Contains(f.Types, event.Envelope.Type)
+}
+
+// Watch 訂閱 subject (例如 TopicFormatter.GetNamespaceWildcardTopic)，直到 ctx 結束或 fn 返回錯誤
+// 不屬於 topics 命名空間的消息會被略過，符合 filter 的事件依收到的順序交給 fn
+func Watch(ctx context.Context, transport types.Transport, subject string, topics types.TopicFormatter, filter Filter, fn func(Event) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var mu sync.Mutex
+	sub, err := transport.Subscribe(subject, func(msg *types.Message) {
+		event, err := NewEvent(topics, msg, time.Now())
+		if err != nil || !filter.Match(event) {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		if err := fn(event); err != nil {
+			cancel(err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("subscribe %s: %w", subject, err)
+	}
+	defer sub.Unsubscribe()
+
+	<-ctx.Done()
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return nil
+}
+
+// Writer 把事件以一行一個 JSON 的格式寫入錄製檔
+type Writer struct {
+	enc *json.Encoder
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+func (w *Writer) Write(record Record) error {
+	return w.enc.Encode(record)
+}
+
+// Reader 依序讀取錄製檔中的事件
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &Reader{scanner: scanner}
+}
+
+// Next 返回下一個事件，讀完時返回 io.EOF
+func (r *Reader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			return Record{}, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return record, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
@@ -0,0 +1,153 @@
+package eventlog
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/messaging"
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// watchUntil 在背景觀察 subject，收到 n 個事件後返回
+func watchUntil(t *testing.T, transport types.Transport, topics *nats.TopicFormatter, filter Filter, n int) <-chan []Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	result := make(chan []Event, 1)
+	ready := make(chan struct{})
+	go func() {
+		var events []Event
+		ctx, done := context.WithCancel(ctx)
+		defer done()
+		close(ready)
+		Watch(ctx, transport, topics.GetNamespaceWildcardTopic(), topics, filter, func(event Event) error {
+			events = append(events, event)
+			if len(events) == n {
+				done()
+			}
+			return nil
+		})
+		result <- events
+	}()
+	<-ready
+	// 等待訂閱建立
+	time.Sleep(50 * time.Millisecond)
+	return result
+}
+
+func TestRecordAndReplayIntoAnotherNamespace(t *testing.T) {
+	transport := memory.NewTransport()
+	t.Cleanup(func() { transport.Close() })
+
+	prod, _ := nats.NewNamespacedTopicFormatter(nats.Namespace{Environment: "prod", Tenant: "acme"})
+	dev := nats.NewTopicFormatter("dev")
+	prodBus := messaging.NewEventBus(transport, prod).WithCodec(codec.MsgPack)
+
+	// 只錄製 room-1 的消息，其他房間、其他命名空間的事件都不應該被錄到
+	recorded := watchUntil(t, transport, prod, Filter{RoomID: "room-1"}, 3)
+	ctx := context.Background()
+	for _, publish := range []func() error{
+		func() error { return prodBus.PublishNewMessageEvent(ctx, "room-1", "u1", "alice", "hello") },
+		func() error { return prodBus.PublishNewMessageEvent(ctx, "room-2", "u2", "bob", "other room") },
+		func() error { return prodBus.PublishUserJoinedEvent("room-1", "u2", "bob") },
+		func() error {
+			return messaging.NewEventBus(transport, dev).PublishNewMessageEvent(ctx, "room-1", "u3", "carol", "dev")
+		},
+		func() error {
+			return prodBus.PublishAICommandEvent(ctx, storage.ChatMessage{RoomID: "room-1", SenderID: "u1", Content: "/help"})
+		},
+	} {
+		if err := publish(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := <-recorded
+	if len(events) != 3 {
+		t.Fatalf("recorded %d events, want 3", len(events))
+	}
+	var file bytes.Buffer
+	writer := NewWriter(&file)
+	for _, event := range events {
+		if event.Envelope == nil {
+			t.Fatalf("event on %s not decoded: %v", event.Subject, event.DecodeErr)
+		}
+		if event.Envelope.RoomID != "room-1" {
+			t.Errorf("recorded event of room %s", event.Envelope.RoomID)
+		}
+		if err := writer.Write(event.Record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 只重播 alice 觸發的事件到 dev 命名空間
+	replayed := watchUntil(t, transport, dev, Filter{}, 2)
+	n, err := Replay(ctx, transport, dev, NewReader(&file), ReplayOptions{Filter: Filter{UserID: "u1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("replayed %d events, want 2", n)
+	}
+
+	got := <-replayed
+	if len(got) != 2 {
+		t.Fatalf("received %d replayed events, want 2", len(got))
+	}
+	// alice 的消息與 AI 命令是錄製檔中的第一與第三個事件
+	for i, original := range []Event{events[0], events[2]} {
+		event := got[i]
+		if event.Envelope == nil || event.Envelope.Type != original.Envelope.Type {
+			t.Fatalf("replayed event %d = %+v, want %s", i, event.Envelope, original.Envelope.Type)
+		}
+		if event.Subject != dev.FormatTopic(original.Topic()) {
+			t.Errorf("replayed subject = %s, want %s", event.Subject, dev.FormatTopic(original.Topic()))
+		}
+		if !bytes.Equal(event.Data, original.Data) {
+			t.Errorf("replayed payload of %s differs from the recording", event.Envelope.Type)
+		}
+		originalID := original.Header.Get(types.HeaderMsgID)
+		if id := event.Header.Get(types.HeaderMsgID); id == originalID || id == "" {
+			t.Errorf("replayed dedup ID = %q, want a new ID derived from %q", id, originalID)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	envelope := types.NewEnvelope(types.EventTypeNewMessage, "room-1", "u1", storage.ChatMessage{})
+	event := Event{Record: Record{Category: "message", Action: "chat", RoomID: "room-1"}, Envelope: &envelope}
+	undecodable := Event{Record: Record{Category: "message", Action: "chat", RoomID: "room-1"}}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		event  Event
+		want   bool
+	}{
+		{"empty filter", Filter{}, event, true},
+		{"topic", Filter{Topics: []string{"ai.command", "message.chat"}}, event, true},
+		{"other topic", Filter{Topics: []string{"message.broadcast"}}, event, false},
+		{"room", Filter{RoomID: "room-1"}, event, true},
+		{"other room", Filter{RoomID: "room-2"}, event, false},
+		{"user", Filter{UserID: "u1"}, event, true},
+		{"other user", Filter{UserID: "u2"}, event, false},
+		{"type", Filter{Types: []string{types.EventTypeNewMessage}}, event, true},
+		{"other type", Filter{Types: []string{types.EventTypeUserJoined}}, event, false},
+		{"undecodable by room", Filter{RoomID: "room-1"}, undecodable, true},
+		{"undecodable by user", Filter{UserID: "u1"}, undecodable, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.event); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package eventlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// ReplayOptions 設置重播的方式
+type ReplayOptions struct {
+	// Speed 重播速度相對於錄製時的倍數，1 依原本的時間間隔重播；0 不等待，盡快發布
+	Speed float64
+	// KeepIDs 保留原本的去重 ID (types.HeaderMsgID)
+	// 預設會換成新的 ID，否則 JetStream 與 Subscriber 會把去重窗口內重播的事件當成重複的事件丟棄
+	KeepIDs bool
+	// Filter 只重播符合條件的事件
+	Filter Filter
+}
+
+// Replay 把錄製檔中的事件依序發布到 transport，主題以 topics 重新格式化，
+// 所以在 prod 錄下來的事件可以重播到本地的 dev 命名空間；返回發布的事件數量
+func Replay(ctx context.Context, transport types.Transport, topics types.TopicFormatter, reader *Reader, opts ReplayOptions) (int, error) {
+	published := 0
+	var previous time.Time
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return published, nil
+		}
+		if err != nil {
+			return published, err
+		}
+
+		event := Event{Record: record}
+		event.decode()
+		if !opts.Filter.Match(event) {
+			continue
+		}
+
+		if opts.Speed > 0 && !previous.IsZero() {
+			if gap := record.ReceivedAt.Sub(previous); gap > 0 {
+				if err := sleep(ctx, time.Duration(float64(gap)/opts.Speed)); err != nil {
+					return published, err
+				}
+			}
+		}
+		previous = record.ReceivedAt
+		if err := ctx.Err(); err != nil {
+			return published, err
+		}
+
+		msg := types.NewMessage(topics.FormatTopic(record.Topic()), record.Data)
+		maps.Copy(msg.Header, record.Header)
+		if id := msg.Header.Get(types.HeaderMsgID); id != "" && !opts.KeepIDs {
+			msg.Header.Set(types.HeaderMsgID, fmt.Sprintf("%s.replay-%d", id, time.Now().UnixNano()))
+		}
+		if err := transport.Publish(msg); err != nil {
+			return published, fmt.Errorf("publish %s: %w", msg.Subject, err)
+		}
+		published++
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
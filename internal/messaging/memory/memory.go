@@ -0,0 +1,220 @@
+// Package memory 提供 types.Transport 的 in-process 實現，
+// 讓 SettleChat 可以不依賴 NATS 以單機模式執行，也讓 handler 可以在沒有 broker 的情況下測試
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// ErrClosed 傳輸層已經關閉
+var ErrClosed = errors.New("memory transport closed")
+
+// Transport 以 in-process 的訂閱表實現 types.Transport
+// 與 NATS 相同：主題支援 * 與 > 萬用字元，同一個訂閱的回調依序執行，queue group 內每條消息只交給一個訂閱者
+type Transport struct {
+	mu     sync.RWMutex
+	subs   map[*subscription]struct{}
+	closed bool
+
+	// queueNext 每個 queue group 的輪詢位置
+	queueNext map[string]uint64
+	inboxSeq  atomic.Uint64
+}
+
+// NewTransport 創建一個 in-memory 傳輸層
+func NewTransport() *Transport {
+	return &Transport{
+		subs:      make(map[*subscription]struct{}),
+		queueNext: make(map[string]uint64),
+	}
+}
+
+func (t *Transport) Publish(msg *types.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return ErrClosed
+	}
+
+	queues := make(map[string][]*subscription)
+	for sub := range t.subs {
+		if !types.SubjectMatches(sub.subject, msg.Subject) {
+			continue
+		}
+		if sub.queue == "" {
+			sub.enqueue(*msg)
+			continue
+		}
+		queues[sub.queue] = append(queues[sub.queue], sub)
+	}
+
+	// queue group 以輪詢方式挑選其中一個訂閱者
+	for queue, members := range queues {
+		next := t.queueNext[queue]
+		t.queueNext[queue] = next + 1
+		members[next%uint64(len(members))].enqueue(*msg)
+	}
+	return nil
+}
+
+func (t *Transport) Subscribe(subject string, handler func(*types.Message)) (types.Subscription, error) {
+	return t.subscribe(subject, "", handler)
+}
+
+func (t *Transport) QueueSubscribe(subject, queue string, handler func(*types.Message)) (types.Subscription, error) {
+	return t.subscribe(subject, queue, handler)
+}
+
+// Request 以一次性的 inbox 主題等待第一個回覆
+func (t *Transport) Request(ctx context.Context, msg *types.Message) (*types.Message, error) {
+	inbox := fmt.Sprintf("_INBOX.memory.%d", t.inboxSeq.Add(1))
+	replies := make(chan *types.Message, 1)
+
+	sub, err := t.Subscribe(inbox, func(reply *types.Message) {
+		select {
+		case replies <- reply:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	if !t.hasSubscribers(msg.Subject) {
+		return nil, fmt.Errorf("%w: %s", types.ErrNoResponders, msg.Subject)
+	}
+
+	request := *msg
+	request.Reply = inbox
+	if err := t.Publish(&request); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close 取消所有訂閱，之後的 Publish 都會失敗
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	for sub := range t.subs {
+		sub.stop()
+	}
+	t.subs = make(map[*subscription]struct{})
+	return nil
+}
+
+func (t *Transport) subscribe(subject, queue string, handler func(*types.Message)) (types.Subscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, ErrClosed
+	}
+
+	sub := &subscription{
+		transport: t,
+		subject:   subject,
+		queue:     queue,
+		handler:   handler,
+		notify:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	t.subs[sub] = struct{}{}
+	go sub.run()
+	return sub, nil
+}
+
+func (t *Transport) hasSubscribers(subject string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for sub := range t.subs {
+		if types.SubjectMatches(sub.subject, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscription 有自己的 goroutine 與無上限的待處理佇列，發布端不會被慢的 handler 阻塞
+type subscription struct {
+	transport *Transport
+	subject   string
+	queue     string
+	handler   func(*types.Message)
+
+	mu       sync.Mutex
+	pending  []*types.Message
+	notify   chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (s *subscription) Subject() string {
+	return s.subject
+}
+
+func (s *subscription) Unsubscribe() error {
+	s.transport.mu.Lock()
+	delete(s.transport.subs, s)
+	s.transport.mu.Unlock()
+
+	s.stop()
+	return nil
+}
+
+func (s *subscription) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// enqueue 每個訂閱者拿到自己的一份消息
+func (s *subscription) enqueue(msg types.Message) {
+	s.mu.Lock()
+	s.pending = append(s.pending, &msg)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscription) run() {
+	for {
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return
+		}
+
+		s.mu.Lock()
+		batch := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+
+		for _, msg := range batch {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			s.handler(msg)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPublishSubscribeWildcards(t *testing.T) {
+	transport := NewTransport()
+	defer transport.Close()
+
+	var exact, single, full atomic.Int64
+	transport.Subscribe("settlechat.message.chat.room1", func(*types.Message) { exact.Add(1) })
+	transport.Subscribe("settlechat.message.chat.*", func(*types.Message) { single.Add(1) })
+	transport.Subscribe("settlechat.message.>", func(*types.Message) { full.Add(1) })
+
+	transport.Publish(types.NewMessage("settlechat.message.chat.room1", nil))
+	transport.Publish(types.NewMessage("settlechat.message.chat.room2", nil))
+	transport.Publish(types.NewMessage("settlechat.message.history.response.room1.u1", nil))
+
+	waitFor(t, func() bool { return exact.Load() == 1 && single.Load() == 2 && full.Load() == 3 })
+}
+
+func TestQueueSubscribeDeliversOnce(t *testing.T) {
+	transport := NewTransport()
+	defer transport.Close()
+
+	var a, b atomic.Int64
+	transport.QueueSubscribe("work.*", "workers", func(*types.Message) { a.Add(1) })
+	transport.QueueSubscribe("work.*", "workers", func(*types.Message) { b.Add(1) })
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		transport.Publish(types.NewMessage("work.room1", nil))
+	}
+
+	waitFor(t, func() bool { return a.Load()+b.Load() == n })
+	if a.Load() == 0 || b.Load() == 0 {
+		t.Errorf("queue group not balanced: a=%d b=%d", a.Load(), b.Load())
+	}
+}
+
+func TestSubscriptionCallbacksAreSerial(t *testing.T) {
+	transport := NewTransport()
+	defer transport.Close()
+
+	var got []string
+	done := make(chan struct{})
+	transport.Subscribe("ordered", func(msg *types.Message) {
+		got = append(got, string(msg.Data))
+		if len(got) == 3 {
+			close(done)
+		}
+	})
+
+	for _, data := range []string{"1", "2", "3"} {
+		transport.Publish(types.NewMessage("ordered", []byte(data)))
+	}
+
+	<-done
+	if got[0] != "1" || got[1] != "2" || got[2] != "3" {
+		t.Errorf("got %v, want messages in publish order", got)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	transport := NewTransport()
+	defer transport.Close()
+
+	transport.Subscribe("echo", func(msg *types.Message) {
+		transport.Publish(types.NewMessage(msg.Reply, append([]byte("re: "), msg.Data...)))
+	})
+
+	reply, err := transport.Request(context.Background(), types.NewMessage("echo", []byte("hi")))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if string(reply.Data) != "re: hi" {
+		t.Errorf("got %q, want %q", reply.Data, "re: hi")
+	}
+
+	t.Run("no responders", func(t *testing.T) {
+		_, err := transport.Request(context.Background(), types.NewMessage("nobody", nil))
+		if !errors.Is(err, types.ErrNoResponders) {
+			t.Errorf("got %v, want ErrNoResponders", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		transport.Subscribe("silent", func(*types.Message) {})
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := transport.Request(ctx, types.NewMessage("silent", nil)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, want context.DeadlineExceeded", err)
+		}
+	})
+}
+
+func TestUnsubscribeAndClose(t *testing.T) {
+	transport := NewTransport()
+
+	var count atomic.Int64
+	sub, _ := transport.Subscribe("topic", func(*types.Message) { count.Add(1) })
+	sub.Unsubscribe()
+	transport.Publish(types.NewMessage("topic", nil))
+	time.Sleep(20 * time.Millisecond)
+	if count.Load() != 0 {
+		t.Errorf("got %d messages after unsubscribe, want 0", count.Load())
+	}
+
+	transport.Close()
+	if err := transport.Publish(types.NewMessage("topic", nil)); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v, want ErrClosed", err)
+	}
+}
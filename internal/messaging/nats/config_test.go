@@ -0,0 +1,307 @@
+package nats
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	server "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+)
+
+// runSecuredServer 以 opts 在隨機埠啟動一個需要認證的內嵌 NATS 伺服器
+func runSecuredServer(t *testing.T, opts *server.Options) *server.Server {
+	t.Helper()
+	opts.Host = "127.0.0.1"
+	opts.Port = -1
+	opts.NoLog = true
+	opts.NoSigs = true
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+// connectWith 以 cfg 連線並確認可以收發消息，返回連線錯誤
+func connectWith(t *testing.T, url string, cfg ConnectionConfig) error {
+	t.Helper()
+	cfg.ConnectTimeout = 2 * time.Second
+	manager := NewNATSManager(url, false).WithConfig(cfg)
+	if err := manager.Connect(); err != nil {
+		return err
+	}
+	t.Cleanup(manager.Disconnect)
+
+	conn, err := manager.GetConn()
+	if err != nil {
+		return err
+	}
+	sub, err := conn.SubscribeSync("settlechat.test.secure")
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := conn.Publish("settlechat.test.secure", []byte("ping")); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if _, err := sub.NextMsg(2 * time.Second); err != nil {
+		t.Fatalf("no message over the secured connection: %v", err)
+	}
+	return nil
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConnectUserPassword(t *testing.T) {
+	ns := runSecuredServer(t, &server.Options{Username: "settle", Password: "s3cret"})
+
+	if err := connectWith(t, ns.ClientURL(), ConnectionConfig{User: "settle", Password: "s3cret"}); err != nil {
+		t.Fatalf("connect with valid password: %v", err)
+	}
+	if err := connectWith(t, ns.ClientURL(), ConnectionConfig{User: "settle", Password: "wrong"}); err == nil {
+		t.Fatal("expected authorization error with a wrong password")
+	}
+	if err := connectWith(t, ns.ClientURL(), ConnectionConfig{}); err == nil {
+		t.Fatal("expected authorization error without credentials")
+	}
+}
+
+func TestConnectToken(t *testing.T) {
+	ns := runSecuredServer(t, &server.Options{Authorization: "token-123"})
+
+	if err := connectWith(t, ns.ClientURL(), ConnectionConfig{Token: "token-123"}); err != nil {
+		t.Fatalf("connect with valid token: %v", err)
+	}
+	if err := connectWith(t, ns.ClientURL(), ConnectionConfig{Token: "other"}); err == nil {
+		t.Fatal("expected authorization error with a wrong token")
+	}
+}
+
+func TestConnectNKey(t *testing.T) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _ := user.PublicKey()
+	seed, _ := user.Seed()
+	ns := runSecuredServer(t, &server.Options{Nkeys: []*server.NkeyUser{{Nkey: publicKey}}})
+
+	if err := connectWith(t, ns.ClientURL(), ConnectionConfig{NKeyFile: writeFile(t, "user.nk", seed)}); err != nil {
+		t.Fatalf("connect with NKey seed: %v", err)
+	}
+
+	other, _ := nkeys.CreateUser()
+	otherSeed, _ := other.Seed()
+	if err := connectWith(t, ns.ClientURL(), ConnectionConfig{NKeyFile: writeFile(t, "other.nk", otherSeed)}); err == nil {
+		t.Fatal("expected authorization error with an unknown NKey")
+	}
+}
+
+func TestConnectCredentialsFile(t *testing.T) {
+	// operator -> account -> user 的 JWT 信任鏈
+	operator, _ := nkeys.CreateOperator()
+	operatorKey, _ := operator.PublicKey()
+	operatorClaims := jwt.NewOperatorClaims(operatorKey)
+
+	account, _ := nkeys.CreateAccount()
+	accountKey, _ := account.PublicKey()
+	accountJWT, err := jwt.NewAccountClaims(accountKey).Encode(operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := nkeys.CreateUser()
+	userKey, _ := user.PublicKey()
+	userJWT, err := jwt.NewUserClaims(userKey).Encode(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, _ := user.Seed()
+	creds, err := jwt.FormatUserConfig(userJWT, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := &server.MemAccResolver{}
+	resolver.Store(accountKey, accountJWT)
+	ns := runSecuredServer(t, &server.Options{
+		TrustedOperators: []*jwt.OperatorClaims{operatorClaims},
+		AccountResolver:  resolver,
+	})
+
+	if err := connectWith(t, ns.ClientURL(), ConnectionConfig{CredentialsFile: writeFile(t, "user.creds", creds)}); err != nil {
+		t.Fatalf("connect with credentials file: %v", err)
+	}
+	if err := connectWith(t, ns.ClientURL(), ConnectionConfig{}); err == nil {
+		t.Fatal("expected authorization error without credentials")
+	}
+}
+
+func TestConnectMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := ca.writeCert(t, dir, "ca.pem", ca.cert)
+	serverCert, serverKey := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+
+	tlsConfig, err := server.GenTLSConfig(&server.TLSConfigOpts{
+		CertFile: serverCert,
+		KeyFile:  serverKey,
+		CaFile:   caFile,
+		Verify:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := runSecuredServer(t, &server.Options{TLS: true, TLSConfig: tlsConfig, TLSVerify: true, TLSTimeout: 2})
+	url := "tls://" + ns.Addr().String()
+
+	secure := ConnectionConfig{TLSCAFile: caFile, TLSCertFile: clientCert, TLSKeyFile: clientKey}
+	if err := connectWith(t, url, secure); err != nil {
+		t.Fatalf("connect with client certificate: %v", err)
+	}
+	if err := connectWith(t, url, ConnectionConfig{TLSCAFile: caFile}); err == nil {
+		t.Fatal("expected handshake error without a client certificate")
+	}
+	if err := connectWith(t, url, ConnectionConfig{TLSCertFile: clientCert, TLSKeyFile: clientKey}); err == nil {
+		t.Fatal("expected certificate error without the CA")
+	}
+}
+
+func TestConnectionTuning(t *testing.T) {
+	ns := runEmbeddedServer(t)
+	manager := NewNATSManager(ns.ClientURL(), false).WithConfig(ConnectionConfig{
+		Name:             "settlechat-test",
+		PingInterval:     15 * time.Second,
+		MaxPingsOut:      3,
+		ReconnectWait:    250 * time.Millisecond,
+		MaxReconnects:    10,
+		ReconnectBufSize: 1 << 20,
+	})
+	if err := manager.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(manager.Disconnect)
+
+	conn, _ := manager.GetConn()
+	opts := conn.Opts
+	if opts.Name != "settlechat-test" || opts.PingInterval != 15*time.Second || opts.MaxPingsOut != 3 ||
+		opts.ReconnectWait != 250*time.Millisecond || opts.MaxReconnect != 10 || opts.ReconnectBufSize != 1<<20 {
+		t.Errorf("connection options not applied: %+v", opts)
+	}
+}
+
+func TestConnectionConfigValidation(t *testing.T) {
+	seedFile := writeFile(t, "user.nk", []byte("SU..."))
+	for name, cfg := range map[string]ConnectionConfig{
+		"two auth methods":   {User: "settle", Token: "token"},
+		"password only":      {Password: "s3cret"},
+		"cert without key":   {TLSCertFile: seedFile},
+		"missing creds file": {CredentialsFile: filepath.Join(t.TempDir(), "missing.creds")},
+		"missing CA":         {TLSCAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"negative limit":     {MaxReconnects: -1},
+	} {
+		if err := NewNATSManager("nats://127.0.0.1:1", false).WithConfig(cfg).Connect(); err == nil {
+			t.Errorf("%s: expected configuration error", name)
+		}
+	}
+}
+
+// testCA 是測試用的自簽 CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "settlechat test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue 簽發 127.0.0.1 的憑證，返回憑證與私鑰的檔案
+func (ca *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return ca.writeCert(t, dir, name+".pem", cert), keyFile
+}
+
+func (ca *testCA) writeCert(t *testing.T, dir, name string, cert *x509.Certificate) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
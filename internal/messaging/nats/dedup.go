@@ -0,0 +1,44 @@
+package nats
+
+import "sync"
+
+// defaultDedupWindow 每個 Subscriber 記住最近處理成功的消息 ID 數量
+const defaultDedupWindow = 10000
+
+// dedupWindow 記住最近 size 個處理成功的消息 ID，用於略過至少一次投遞產生的重複消息
+type dedupWindow struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+	ring []string
+	next int
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{
+		seen: make(map[string]struct{}, size),
+		ring: make([]string, size),
+	}
+}
+
+// Seen 是否已經處理過 id
+func (d *dedupWindow) Seen(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.seen[id]
+	return ok
+}
+
+// Add 記錄 id，超過容量時忘記最舊的 id
+func (d *dedupWindow) Add(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[id]; ok {
+		return
+	}
+	if old := d.ring[d.next]; old != "" {
+		delete(d.seen, old)
+	}
+	d.ring[d.next] = id
+	d.seen[id] = struct{}{}
+	d.next = (d.next + 1) % len(d.ring)
+}
@@ -0,0 +1,228 @@
+package nats
+
+import (
+	"sync"
+	"time"
+)
+
+// DispatcherConfig 設置 Subscriber 執行 handler 的 worker pool
+type DispatcherConfig struct {
+	// Workers 同時執行 handler 的 goroutine 數，也就是最多同時處理幾個房間
+	Workers int
+	// QueueSize 所有房間等待處理的消息總數上限，超過時傳輸層的回調會阻塞 (背壓)
+	QueueSize int
+}
+
+// DefaultDispatcherConfig 返回預設的 worker pool 設定
+func DefaultDispatcherConfig() DispatcherConfig {
+	return DispatcherConfig{
+		Workers:   16,
+		QueueSize: 1024,
+	}
+}
+
+// DispatcherStats 是 worker pool 的即時狀態與累計的背壓指標
+type DispatcherStats struct {
+	Workers       int     `json:"workers"`
+	Busy          int     `json:"busy"`       // 正在執行 handler 的 worker
+	Queued        int     `json:"queued"`     // 等待處理的消息
+	MaxQueued     int     `json:"max_queued"` // Queued 的最高值
+	QueueSize     int     `json:"queue_size"`
+	ActiveRooms   int     `json:"active_rooms"` // 有消息正在處理或等待處理的房間
+	Retrying      int     `json:"retrying"`     // 等待重試的房間，等待期間不佔用 worker
+	Processed     int64   `json:"processed"`
+	Blocked       int64   `json:"blocked"`    // 佇列已滿而需要等待的提交次數
+	BlockedMillis float64 `json:"blocked_ms"` // 提交等待的總時間
+}
+
+// job 處理一條消息，返回大於 0 的 retryAfter 時在這段時間之後重新執行
+type job func() (retryAfter time.Duration)
+
+// roomQueue 是一個房間等待處理的消息，同一時間最多只有一個 worker 在處理
+type roomQueue struct {
+	key    string
+	jobs   []job
+	active bool // 在 ready 佇列中、正在被 worker 處理或等待重試
+}
+
+// dispatcher 以房間為單位排序消息：同一個房間的消息依提交順序逐一處理，不同房間由多個 worker 並行處理
+// 一個房間的慢 handler (例如 AI 請求) 只會阻塞該房間，不會阻塞同一個主題上的其他房間
+// 失敗等待重試的消息留在房間佇列的最前面，退避期間房間的後續消息等待，但 worker 去處理其他房間
+type dispatcher struct {
+	cfg DispatcherConfig
+
+	mu     sync.Mutex
+	work   *sync.Cond // 有房間可以處理或正在關閉
+	space  *sync.Cond // 佇列有空位或正在關閉
+	rooms  map[string]*roomQueue
+	ready  []*roomQueue
+	timers map[*roomQueue]*time.Timer // 等待重試的房間
+	closed bool
+	wg     sync.WaitGroup
+
+	queued      int
+	maxQueued   int
+	busy        int
+	processed   int64
+	blocked     int64
+	blockedTime time.Duration
+}
+
+func newDispatcher(cfg DispatcherConfig) *dispatcher {
+	defaults := DefaultDispatcherConfig()
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaults.Workers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaults.QueueSize
+	}
+
+	d := &dispatcher{
+		cfg:    cfg,
+		rooms:  make(map[string]*roomQueue),
+		timers: make(map[*roomQueue]*time.Timer),
+	}
+	d.work = sync.NewCond(&d.mu)
+	d.space = sync.NewCond(&d.mu)
+
+	d.wg.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+// submit 把消息的處理排到房間 key 的佇列，佇列已滿時阻塞直到有空位
+// 關閉後提交的消息直接丟棄並返回 false
+func (d *dispatcher) submit(key string, fn job) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.queued >= d.cfg.QueueSize && !d.closed {
+		start := time.Now()
+		d.blocked++
+		for d.queued >= d.cfg.QueueSize && !d.closed {
+			d.space.Wait()
+		}
+		d.blockedTime += time.Since(start)
+	}
+	if d.closed {
+		return false
+	}
+
+	room, ok := d.rooms[key]
+	if !ok {
+		room = &roomQueue{key: key}
+		d.rooms[key] = room
+	}
+	room.jobs = append(room.jobs, fn)
+	d.queued++
+	d.maxQueued = max(d.maxQueued, d.queued)
+
+	if !room.active {
+		room.active = true
+		d.ready = append(d.ready, room)
+		d.work.Signal()
+	}
+	return true
+}
+
+func (d *dispatcher) worker() {
+	defer d.wg.Done()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		// 關閉時等待重試中的房間也處理完才結束
+		for len(d.ready) == 0 && !(d.closed && len(d.timers) == 0) {
+			d.work.Wait()
+		}
+		if len(d.ready) == 0 {
+			return
+		}
+
+		room := d.ready[0]
+		d.ready = d.ready[1:]
+		fn := room.jobs[0]
+		d.busy++
+
+		d.mu.Unlock()
+		retryAfter := fn()
+		d.mu.Lock()
+
+		d.busy--
+		if retryAfter > 0 {
+			d.retry(room, retryAfter)
+			continue
+		}
+		room.jobs = room.jobs[1:]
+		d.queued--
+		d.processed++
+		d.space.Signal()
+
+		// 房間還有消息時排到 ready 佇列的最後，讓其他房間也有機會被處理
+		if len(room.jobs) > 0 {
+			d.ready = append(d.ready, room)
+			d.work.Signal()
+		} else {
+			room.active = false
+			delete(d.rooms, room.key)
+		}
+	}
+}
+
+// retry 在 delay 之後把房間排回 ready 佇列，再次執行最前面的消息；關閉中不等待，必須持有 mu
+func (d *dispatcher) retry(room *roomQueue, delay time.Duration) {
+	if d.closed {
+		d.ready = append(d.ready, room)
+		d.work.Signal()
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// close 已經停止計時器並排回了房間
+		if d.timers[room] != timer {
+			return
+		}
+		delete(d.timers, room)
+		d.ready = append(d.ready, room)
+		d.work.Broadcast()
+	})
+	d.timers[room] = timer
+}
+
+// close 停止接受新的消息，等待已經排入佇列的消息處理完；等待重試的房間立即排回 ready 佇列
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	d.closed = true
+	for room, timer := range d.timers {
+		timer.Stop()
+		delete(d.timers, room)
+		d.ready = append(d.ready, room)
+	}
+	d.work.Broadcast()
+	d.space.Broadcast()
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+func (d *dispatcher) stats() DispatcherStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return DispatcherStats{
+		Workers:       d.cfg.Workers,
+		Busy:          d.busy,
+		Queued:        d.queued,
+		MaxQueued:     d.maxQueued,
+		QueueSize:     d.cfg.QueueSize,
+		ActiveRooms:   len(d.rooms),
+		Retrying:      len(d.timers),
+		Processed:     d.processed,
+		Blocked:       d.blocked,
+		BlockedMillis: float64(d.blockedTime.Microseconds()) / 1000,
+	}
+}
@@ -0,0 +1,189 @@
+package nats
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// orderHandler 記錄每個房間收到消息的順序，slowRoom 的消息會等到 release 關閉
+type orderHandler struct {
+	mu       sync.Mutex
+	seen     map[string][]string
+	slowRoom string
+	release  chan struct{}
+}
+
+func (h *orderHandler) Handle(msg *types.Message) error {
+	topic, _ := NewTopicFormatter("").ParseTopic(msg.Subject)
+	if topic.RoomID == h.slowRoom {
+		<-h.release
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seen[topic.RoomID] = append(h.seen[topic.RoomID], string(msg.Data))
+	return nil
+}
+
+func (h *orderHandler) count(roomID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.seen[roomID])
+}
+
+func TestSubscriberOrdersEventsPerRoom(t *testing.T) {
+	for name, newTransport := range clusters(t) {
+		t.Run(name, func(t *testing.T) {
+			transport := newTransport(t)
+			topics := NewTopicFormatter("")
+			handler := &orderHandler{seen: make(map[string][]string), slowRoom: "slow", release: make(chan struct{})}
+
+			subscriber := NewSubscriber(transport, nil, "test", topics)
+			subscriber.SetDispatcherConfig(DispatcherConfig{Workers: 4, QueueSize: 100})
+			// 同一個房間的聊天消息與廣播在不同的主題上，也要依收到的順序處理
+			subscriber.RegisterHandlerWithMode("message", "chat", handler, types.DeliveryWork)
+			subscriber.RegisterHandlerWithMode("message", "broadcast", handler, types.DeliveryWork)
+			if err := subscriber.Start(); err != nil {
+				t.Fatalf("failed to start subscriber: %v", err)
+			}
+			defer subscriber.Close()
+
+			for i := 0; i < 10; i++ {
+				for _, room := range []string{"slow", "fast"} {
+					subject := topics.GetMessageTopic(room)
+					if i%2 == 1 {
+						subject = topics.GetBroadcastTopic(room)
+					}
+					transport.Publish(types.NewMessage(subject, []byte(fmt.Sprint(i))))
+					// 讓兩個主題的消息依發布順序到達
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			// 慢的房間不會阻塞其他房間
+			waitFor(t, func() bool { return handler.count("fast") == 10 })
+			if got := handler.count("slow"); got != 0 {
+				t.Fatalf("slow room processed %d messages before release", got)
+			}
+			close(handler.release)
+			waitFor(t, func() bool { return handler.count("slow") == 10 })
+
+			for _, room := range []string{"slow", "fast"} {
+				for i, data := range handler.seen[room] {
+					if data != fmt.Sprint(i) {
+						t.Fatalf("room %s processed out of order: %v", room, handler.seen[room])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDispatcherBackpressure(t *testing.T) {
+	d := newDispatcher(DispatcherConfig{Workers: 1, QueueSize: 2})
+	release := make(chan struct{})
+
+	// 一個在處理中、一個在佇列中，第三個需要等待
+	d.submit("room-1", func() time.Duration { <-release; return 0 })
+	d.submit("room-2", func() time.Duration { return 0 })
+
+	submitted := make(chan struct{})
+	go func() {
+		d.submit("room-3", func() time.Duration { return 0 })
+		close(submitted)
+	}()
+
+	select {
+	case <-submitted:
+		t.Fatal("submit did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if stats := d.stats(); stats.Queued != 2 || stats.Busy != 1 || stats.Blocked != 1 {
+		t.Errorf("unexpected stats while full: %+v", stats)
+	}
+
+	close(release)
+	<-submitted
+	d.close()
+
+	stats := d.stats()
+	if stats.Processed != 3 || stats.Queued != 0 || stats.MaxQueued != 2 || stats.ActiveRooms != 0 {
+		t.Errorf("unexpected stats after drain: %+v", stats)
+	}
+	if d.submit("room-1", func() time.Duration { return 0 }) {
+		t.Error("submit succeeded after close")
+	}
+}
+
+// TestDispatcherRetryFreesWorker 等待重試的消息不佔用 worker，但同一個房間的後續消息仍然在它之後處理
+func TestDispatcherRetryFreesWorker(t *testing.T) {
+	d := newDispatcher(DispatcherConfig{Workers: 1, QueueSize: 10})
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+
+	attempts := 0
+	d.submit("room-1", func() time.Duration {
+		attempts++
+		record(fmt.Sprintf("1/%d", attempts))
+		if attempts == 1 {
+			return 100 * time.Millisecond
+		}
+		return 0
+	})
+	d.submit("room-1", func() time.Duration { record("1/next"); return 0 })
+	done := make(chan struct{})
+	d.submit("room-2", func() time.Duration { record("2"); close(done); return 0 })
+
+	// 唯一的 worker 在 room-1 退避期間處理 room-2
+	select {
+	case <-done:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("room-2 waited for room-1's backoff")
+	}
+	if stats := d.stats(); stats.Retrying != 1 || stats.Busy != 0 {
+		t.Errorf("stats during backoff = %+v", stats)
+	}
+
+	d.close()
+	mu.Lock()
+	defer mu.Unlock()
+	if got := fmt.Sprint(order); got != "[1/1 2 1/2 1/next]" {
+		t.Fatalf("order = %s", got)
+	}
+}
+
+// TestDispatcherCloseRunsPendingRetries 關閉時不等待退避，立即再執行等待重試的消息
+func TestDispatcherCloseRunsPendingRetries(t *testing.T) {
+	d := newDispatcher(DispatcherConfig{Workers: 1, QueueSize: 10})
+	attempts := 0
+	d.submit("room-1", func() time.Duration {
+		attempts++
+		if attempts == 1 {
+			return time.Hour
+		}
+		return 0
+	})
+	waitFor(t, func() bool { return d.stats().Retrying == 1 })
+
+	closed := make(chan struct{})
+	go func() {
+		d.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close waited for the backoff")
+	}
+	if attempts != 2 || d.stats().Processed != 1 {
+		t.Fatalf("attempts = %d, stats = %+v", attempts, d.stats())
+	}
+}
@@ -0,0 +1,225 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// 補回消息時每次向 JetStream 拿多少條
+	replayBatchSize = 100
+	// 每次拿取最多等待多久
+	replayFetchWait = 2 * time.Second
+)
+
+// ErrJetStreamDisabled 在沒有啟用 JetStream 時呼叫需要它的功能
+var ErrJetStreamDisabled = errors.New("jetstream is not enabled")
+
+// JetStreamConfig 是 JetStream 模式的設定
+type JetStreamConfig struct {
+	// MaxAge 事件在 stream 中保留多久，也是重新連線的客戶端最多能補回多久的消息
+	MaxAge time.Duration
+	// Replicas stream 的副本數，叢集部署時設為 3
+	Replicas int
+	// AckWait handler 多久沒有 ack 就重新投遞
+	AckWait time.Duration
+	// MaxDeliver 每個事件最多投遞幾次
+	MaxDeliver int
+	// NakDelay 第一次處理失敗後等多久重新投遞，之後每次加倍
+	NakDelay time.Duration
+}
+
+// DefaultJetStreamConfig 返回預設的 JetStream 設定
+func DefaultJetStreamConfig() JetStreamConfig {
+	return JetStreamConfig{
+		MaxAge:     24 * time.Hour,
+		Replicas:   1,
+		AckWait:    30 * time.Second,
+		MaxDeliver: 5,
+		NakDelay:   time.Second,
+	}
+}
+
+// nakDelay 返回第 numDelivered 次處理失敗後的重新投遞延遲 (指數退避，最多一分鐘)
+func (c JetStreamConfig) nakDelay(numDelivered uint64) time.Duration {
+	delay := c.NakDelay
+	for i := uint64(1); i < numDelivered && delay < time.Minute; i++ {
+		delay *= 2
+	}
+	return min(delay, time.Minute)
+}
+
+// Streams 返回每個事件類別的 stream 名稱與它涵蓋的主題
+// 查詢主題是 request-reply，不會被保存：JetStream 會代替響應者回覆 PubAck
+func (t *TopicFormatter) Streams() map[string][]string {
+	streams := make(map[string][]string)
+	for _, route := range topicRoutes {
+		if route.query {
+			continue
+		}
+		// stream 名稱不能有 "."，命名空間的 token 沒有 "_"，以 "_" 連接不會混淆
+		name := strings.ToUpper(strings.ReplaceAll(t.basePrefix, ".", "_") + "_" + route.category)
+		streams[name] = append(streams[name], t.GetWildcardTopic(route.category, route.action))
+	}
+	return streams
+}
+
+// EnableJetStream 為每個事件類別建立 (或更新) stream，之後發布到這些主題的事件都會經過 JetStream 持久化
+func (m *NATSManager) EnableJetStream(ctx context.Context, topics *TopicFormatter, cfg JetStreamConfig) error {
+	conn, err := m.GetConn()
+	if err != nil {
+		return err
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+
+	var subjects []string
+	for name, streamSubjects := range topics.Streams() {
+		_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     name,
+			Subjects: streamSubjects,
+			MaxAge:   cfg.MaxAge,
+			Replicas: cfg.Replicas,
+			Storage:  jetstream.FileStorage,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create stream %s: %w", name, err)
+		}
+		log.Printf("JetStream stream %s ready for %v", name, streamSubjects)
+		subjects = append(subjects, streamSubjects...)
+	}
+
+	m.mutex.Lock()
+	m.js = js
+	m.jsConfig = cfg
+	m.streamSubjects = subjects
+	m.mutex.Unlock()
+	return nil
+}
+
+// JetStream 返回 JetStream 的 context，沒有啟用時返回 nil
+func (m *NATSManager) JetStream() (jetstream.JetStream, JetStreamConfig) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.js, m.jsConfig
+}
+
+// streamed 判斷主題是否被某個 stream 保存
+func (m *NATSManager) streamed(subject string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.js == nil {
+		return false
+	}
+	for _, pattern := range m.streamSubjects {
+		if types.SubjectMatches(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConsumeDurable 以 durable pull consumer 消費主題，同名的 consumer 在多個實例之間分攤消息，
+// handler 需要自己 ack，沒有 ack 的消息會在 AckWait 後重新投遞
+func (m *NATSManager) ConsumeDurable(ctx context.Context, durable, subject string, handler jetstream.MessageHandler) (jetstream.ConsumeContext, error) {
+	js, cfg := m.JetStream()
+	if js == nil {
+		return nil, ErrJetStreamDisabled
+	}
+
+	stream, err := js.StreamNameBySubject(ctx, subject)
+	if err != nil {
+		return nil, fmt.Errorf("no stream for subject %s: %w", subject, err)
+	}
+
+	consumer, err := js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       cfg.AckWait,
+		MaxDeliver:    cfg.MaxDeliver,
+		// 第一次建立時只處理之後的事件，之後由 durable consumer 記住進度
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer %s: %w", durable, err)
+	}
+
+	log.Printf("Consuming %s with durable consumer %s on stream %s", subject, durable, stream)
+	return consumer.Consume(handler)
+}
+
+// Replay 依序讀出某主題在 since 之後保存的事件，讀到呼叫當下最後一條為止
+func (m *NATSManager) Replay(ctx context.Context, subject string, since time.Time, fn func(*types.Message) error) error {
+	js, _ := m.JetStream()
+	if js == nil {
+		return ErrJetStreamDisabled
+	}
+
+	streamName, err := js.StreamNameBySubject(ctx, subject)
+	if err != nil {
+		return fmt.Errorf("no stream for subject %s: %w", subject, err)
+	}
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return fmt.Errorf("failed to get stream %s: %w", streamName, err)
+	}
+
+	// 先找出最後一條，沒有比 since 新的事件就不需要建立 consumer
+	last, err := stream.GetLastMsgForSubject(ctx, subject)
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get last message for %s: %w", subject, err)
+	}
+	if !last.Time.After(since) {
+		return nil
+	}
+
+	consumer, err := stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{subject},
+		DeliverPolicy:  jetstream.DeliverByStartTimePolicy,
+		OptStartTime:   &since,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create replay consumer for %s: %w", subject, err)
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		batch, err := consumer.Fetch(replayBatchSize, jetstream.FetchMaxWait(replayFetchWait))
+		if err != nil {
+			return fmt.Errorf("replay %s: %w", subject, err)
+		}
+		for msg := range batch.Messages() {
+			meta, err := msg.Metadata()
+			if err != nil {
+				return fmt.Errorf("replay %s: %w", subject, err)
+			}
+			if err := fn(fromJetStreamMsg(msg)); err != nil {
+				return err
+			}
+			if meta.Sequence.Stream >= last.Sequence {
+				return nil
+			}
+		}
+		if err := batch.Error(); err != nil {
+			return fmt.Errorf("replay %s: %w", subject, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+	server "github.com/nats-io/nats-server/v2/server"
+)
+
+// flakyHandler 前 failures 次呼叫返回錯誤
+type flakyHandler struct {
+	failures int64
+	calls    atomic.Int64
+}
+
+func (h *flakyHandler) Handle(msg *types.Message) error {
+	if h.calls.Add(1) <= h.failures {
+		return errors.New("temporary failure")
+	}
+	return nil
+}
+
+// runJetStreamServer 啟動一個啟用 JetStream 的內嵌 NATS 伺服器
+func runJetStreamServer(t testing.TB) *server.Server {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func connectJetStream(t testing.TB, url string) *NATSManager {
+	t.Helper()
+	manager := NewNATSManager(url, false)
+	if err := manager.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(manager.Disconnect)
+
+	cfg := DefaultJetStreamConfig()
+	cfg.NakDelay = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := manager.EnableJetStream(ctx, NewTopicFormatter(""), cfg); err != nil {
+		t.Fatalf("failed to enable jetstream: %v", err)
+	}
+	return manager
+}
+
+func startDurableSubscriber(t testing.TB, manager *NATSManager, handler types.MessageHandler) *Subscriber {
+	t.Helper()
+	subscriber := NewSubscriber(NewTransport(manager), nil, "test", NewTopicFormatter(""))
+	subscriber.RegisterHandlerWithMode("message", "chat", handler, types.DeliveryDurable)
+	if err := subscriber.Start(); err != nil {
+		t.Fatalf("failed to start subscriber: %v", err)
+	}
+	return subscriber
+}
+
+func TestDurableHandlerReceivesEventsPublishedWhileDown(t *testing.T) {
+	ns := runJetStreamServer(t)
+	manager := connectJetStream(t, ns.ClientURL())
+	topics := NewTopicFormatter("")
+
+	handler := &countingHandler{}
+	subscriber := startDurableSubscriber(t, manager, handler)
+	if err := manager.Publish(topics.GetMessageTopic("room-1"), []byte(`{}`)); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	waitFor(t, func() bool { return handler.count.Load() == 1 })
+
+	// 模擬處理實例停機期間發布的事件
+	subscriber.Close()
+	for i := 0; i < 3; i++ {
+		if err := manager.Publish(topics.GetMessageTopic("room-1"), []byte(`{}`)); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+
+	restarted := &countingHandler{}
+	defer startDurableSubscriber(t, manager, restarted).Close()
+	waitFor(t, func() bool { return restarted.count.Load() == 3 })
+}
+
+func TestDurableHandlerRedeliversOnError(t *testing.T) {
+	ns := runJetStreamServer(t)
+	manager := connectJetStream(t, ns.ClientURL())
+
+	handler := &flakyHandler{failures: 2}
+	defer startDurableSubscriber(t, manager, handler).Close()
+
+	if err := manager.Publish(NewTopicFormatter("").GetMessageTopic("room-1"), []byte(`{}`)); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	waitFor(t, func() bool { return handler.calls.Load() == 3 })
+	time.Sleep(100 * time.Millisecond)
+	if got := handler.calls.Load(); got != 3 {
+		t.Errorf("got %d deliveries, want 3 (acked after the third)", got)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ns := runJetStreamServer(t)
+	manager := connectJetStream(t, ns.ClientURL())
+	topic := NewTopicFormatter("").GetBroadcastTopic("room-1")
+
+	manager.Publish(topic, []byte(`"before"`))
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	manager.Publish(topic, []byte(`"after-1"`))
+	manager.Publish(NewTopicFormatter("").GetBroadcastTopic("room-2"), []byte(`"other room"`))
+	manager.Publish(topic, []byte(`"after-2"`))
+
+	var got []string
+	err := manager.Replay(context.Background(), topic, since, func(msg *types.Message) error {
+		got = append(got, string(msg.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if len(got) != 2 || got[0] != `"after-1"` || got[1] != `"after-2"` {
+		t.Errorf("got %v, want the two messages after since", got)
+	}
+
+	t.Run("nothing newer", func(t *testing.T) {
+		err := manager.Replay(context.Background(), topic, time.Now(), func(msg *types.Message) error {
+			t.Errorf("unexpected message %s", msg.Data)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("replay failed: %v", err)
+		}
+	})
+}
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		want             bool
+	}{
+		{"settlechat.message.chat.*", "settlechat.message.chat.room1", true},
+		{"settlechat.message.chat.*", "settlechat.message.chat.room1.extra", false},
+		{"settlechat.message.chat.*", "settlechat.message.broadcast.room1", false},
+		{"settlechat.message.>", "settlechat.message.history.response.room1.u1", true},
+		{"settlechat.message.>", "settlechat.message", false},
+	}
+	for _, tt := range tests {
+		if got := types.SubjectMatches(tt.pattern, tt.subject); got != tt.want {
+			t.Errorf("SubjectMatches(%q, %q) = %v, want %v", tt.pattern, tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestStreamsExcludeQueries(t *testing.T) {
+	// JetStream 會以 PubAck 回覆發布到 stream 主題的請求，查詢主題不能被保存
+	for name, subjects := range NewTopicFormatter("").Streams() {
+		for _, subject := range subjects {
+			if types.SubjectMatches(subject, NewTopicFormatter("").GetHistoryQueryTopic("room-1")) {
+				t.Errorf("stream %s captures query subject %s", name, subject)
+			}
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package nats
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 type NATSManager struct {
@@ -14,7 +16,13 @@ type NATSManager struct {
 	reconnect bool
 	url       string
 	mutex     sync.RWMutex
+	config    ConnectionConfig
 	options   []nats.Option
+
+	// JetStream 模式，見 EnableJetStream
+	js             jetstream.JetStream
+	jsConfig       JetStreamConfig
+	streamSubjects []string
 }
 
 func NewNATSManager(url string, reconnect bool) *NATSManager {
@@ -36,24 +44,24 @@ func (m *NATSManager) Connect() error {
 		return nil
 	}
 
+	// 認證、TLS 與連線參數來自 ConnectionConfig
+	opts, err := m.config.options()
+	if err != nil {
+		return fmt.Errorf("invalid NATS configuration: %w", err)
+	}
+
 	// Default Setup Options
-	opts := []nats.Option{
-		nats.Name("SettleChat"),
+	opts = append(opts,
 		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
 			log.Printf("NATS disconnected: %v", err)
 		}),
 		nats.ReconnectHandler(func(nc *nats.Conn) {
-			log.Printf("NASTS reconnected to %s", nc.ConnectedUrl())
+			log.Printf("NASTS reconnected to %s", nc.ConnectedUrlRedacted())
 		}),
 		nats.ErrorHandler(func(nc *nats.Conn, s *nats.Subscription, err error) {
 			log.Printf("NATS error: %v", err)
 		}),
-		nats.MaxReconnects(-1), //Retry forever (every 2 secs)
-
-		// nats.ReconnectWait(time.Second * 5) // 每 5 秒嘗試一次 reconnect
-		// nats.Timeout(time.Second * 2)       // 初始連線 timeout
-		// nats.PingInterval(time.Minute * 2)  // 心跳 ping 頻率
-	}
+	)
 
 	// Handle Customized options
 	if len(m.options) > 0 {
@@ -68,7 +76,7 @@ func (m *NATSManager) Connect() error {
 	}
 
 	m.conn = conn
-	log.Printf("Connected to NATS server at %s", m.url)
+	log.Printf("Connected to NATS server at %s", conn.ConnectedUrlRedacted())
 	return nil
 }
 
@@ -106,11 +114,30 @@ func (m *NATSManager) GetConn() (*nats.Conn, error) {
 
 // Publish data to the Subject
 func (m *NATSManager) Publish(subject string, data []byte) error {
+	return m.PublishMsg(&nats.Msg{Subject: subject, Data: data})
+}
+
+// PublishMsg 發布帶有標頭的消息 (例如 payload 的 Content-Type)
+// 啟用 JetStream 時，被 stream 保存的主題會等待 JetStream 確認已經寫入
+func (m *NATSManager) PublishMsg(msg *nats.Msg) error {
+	if m.streamed(msg.Subject) {
+		js, _ := m.JetStream()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if _, err := js.PublishMsg(ctx, msg); err != nil {
+			log.Printf("Couldn't Publish %s to JetStream: %s", msg.Subject, err)
+			return err
+		}
+		return nil
+	}
+
 	conn, err := m.GetConn()
 	if err != nil {
 		log.Printf("Couldn't Publish since its Disconnected with the server: %s", err)
+		return err
 	}
-	return conn.Publish(subject, data)
+	return conn.PublishMsg(msg)
 }
 
 // Publish data to the Subject
@@ -122,12 +149,31 @@ func (m *NATSManager) Publish(subject string, data []byte) error {
 func (m *NATSManager) Subscribe(subject string, msgHandler nats.MsgHandler) (*nats.Subscription, error) {
 	conn, err := m.GetConn()
 	if err != nil {
-		log.Printf("Couldn't Publish since its Disconnected with the server: %s", err)
+		log.Printf("Couldn't Subscribe since its Disconnected with the server: %s", err)
+		return nil, err
 	}
 
 	return conn.Subscribe(subject, msgHandler)
 }
 
+// QueueSubscribe 以 queue group 訂閱主題
+// 同一個 queue group 內的訂閱者中，每條消息只會交給其中一個
+func (m *NATSManager) QueueSubscribe(subject, queue string, msgHandler nats.MsgHandler) (*nats.Subscription, error) {
+	conn, err := m.GetConn()
+	if err != nil {
+		log.Printf("Couldn't Subscribe since its Disconnected with the server: %s", err)
+		return nil, err
+	}
+
+	return conn.QueueSubscribe(subject, queue, msgHandler)
+}
+
+// WithConfig 設置連線的認證、TLS 與連線參數，下一次 Connect 時生效
+func (m *NATSManager) WithConfig(cfg ConnectionConfig) *NATSManager {
+	m.config = cfg
+	return m
+}
+
 // WithOptions 設置自定義的NATS連接選項
 func (m *NATSManager) WithOptions(options ...nats.Option) *NATSManager {
 	m.options = append(m.options, options...)
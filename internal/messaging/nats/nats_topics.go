@@ -1,23 +1,99 @@
 package nats
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// topicRoot 是所有主題的第一個 token
+const topicRoot = "settlechat"
+
+// ErrInvalidNamespace 命名空間不是合法的主題 token
+var ErrInvalidNamespace = errors.New("invalid topic namespace")
+
+// namespaceToken 環境與租戶只能是小寫字母、數字與連字號，
+// 這樣它們在主題、JetStream stream 與 consumer 名稱中都合法，也不會與分隔符號混淆
+var namespaceToken = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Namespace 隔離共用同一個 NATS 叢集的環境 (dev、staging、prod) 與租戶
+// 主題的形式為 settlechat[.{environment}[.{tenant}]].{category}.{action}.{roomID}
+type Namespace struct {
+	// Environment 例如 "prod"，空字串為預設命名空間
+	Environment string
+	// Tenant 選填，設置時 Environment 也必須設置
+	Tenant string
+}
+
+// Validate 檢查命名空間的每個 token
+func (n Namespace) Validate() error {
+	if n.Tenant != "" && n.Environment == "" {
+		return fmt.Errorf("%w: tenant %q requires an environment", ErrInvalidNamespace, n.Tenant)
+	}
+	for _, token := range n.tokens() {
+		if !namespaceToken.MatchString(token) {
+			return fmt.Errorf("%w: %q must be lowercase letters, digits and hyphens", ErrInvalidNamespace, token)
+		}
+	}
+	return nil
+}
+
+// String 返回以 "." 連接的命名空間，例如 "prod.acme"；預設命名空間為空字串
+func (n Namespace) String() string {
+	return strings.Join(n.tokens(), ".")
+}
+
+func (n Namespace) tokens() []string {
+	var tokens []string
+	if n.Environment != "" {
+		tokens = append(tokens, n.Environment)
+	}
+	if n.Tenant != "" {
+		tokens = append(tokens, n.Tenant)
+	}
+	return tokens
+}
 
 // TopicFormatter 實現了 types.TopicFormatter 接口
 type TopicFormatter struct {
-	// basePrefix 是所有主題的基礎前綴
+	namespace Namespace
+	// basePrefix 是所有主題的基礎前綴，例如 settlechat.prod.acme
 	basePrefix string
 }
 
-// NewTopicFormatter 創建一個新的 TopicFormatter 實例
-func NewTopicFormatter(env string) *TopicFormatter {
+// NewNamespacedTopicFormatter 創建命名空間內的 TopicFormatter，不同命名空間的主題互不相交
+func NewNamespacedTopicFormatter(namespace Namespace) (*TopicFormatter, error) {
+	if err := namespace.Validate(); err != nil {
+		return nil, err
+	}
 	return &TopicFormatter{
-		basePrefix: fmt.Sprintf("settlechat%s", env),
+		namespace:  namespace,
+		basePrefix: strings.Join(append([]string{topicRoot}, namespace.tokens()...), "."),
+	}, nil
+}
+
+// NewTopicFormatter 創建環境 env 的 TopicFormatter，env 為空字串時使用預設命名空間
+// env 不合法時 panic，從設定讀取的命名空間應該使用 NewNamespacedTopicFormatter
+func NewTopicFormatter(env string) *TopicFormatter {
+	t, err := NewNamespacedTopicFormatter(Namespace{Environment: env})
+	if err != nil {
+		panic(err)
 	}
+	return t
+}
+
+// Namespace 返回主題的命名空間，例如 "prod.acme"
+func (t *TopicFormatter) Namespace() string {
+	return t.namespace.String()
 }
 
-// formatTopic 是一個輔助方法，用於格式化主題字符串
+// formatTopic 是一個輔助方法，用於格式化主題字符串，房間 ID 會被轉義成單一個主題 token
 func (t *TopicFormatter) formatTopic(category, action, roomID string) string {
-	return fmt.Sprintf("%s.%s.%s.%s", t.basePrefix, category, action, roomID)
+	return fmt.Sprintf("%s.%s.%s.%s", t.basePrefix, category, action, escapeRoomID(roomID))
 }
 
 // GetPresenceTopic 返回在線狀態的主題
@@ -50,14 +126,24 @@ func (t *TopicFormatter) GetBroadcastTopic(roomID string) string {
 	return t.formatTopic("message", "broadcast", roomID)
 }
 
-// GetHistoryRequestTopic 返回歷史消息請求的主題
-func (t *TopicFormatter) GetHistoryRequestTopic(roomID string) string {
-	return t.formatTopic("message", "history.request", roomID)
+// GetMessageAckTopic 返回消息確認的主題，每個實例把確認推送給本地的發送者
+func (t *TopicFormatter) GetMessageAckTopic(roomID string) string {
+	return t.formatTopic("message", "ack", roomID)
 }
 
-// GetHistoryResponseTopic 返回歷史消息響應的主題
-func (t *TopicFormatter) GetHistoryResponseTopic(roomID, userID string) string {
-	return fmt.Sprintf("%s.%s", t.formatTopic("message", "history.response", roomID), userID)
+// GetHistoryQueryTopic 返回歷史消息查詢的主題，響應回覆到請求的 inbox 主題
+func (t *TopicFormatter) GetHistoryQueryTopic(roomID string) string {
+	return t.formatTopic("query", "history", roomID)
+}
+
+// GetRoomMembersQueryTopic 返回房間成員查詢的主題
+func (t *TopicFormatter) GetRoomMembersQueryTopic(roomID string) string {
+	return t.formatTopic("query", "members", roomID)
+}
+
+// GetRoomStateQueryTopic 返回房間狀態查詢的主題
+func (t *TopicFormatter) GetRoomStateQueryTopic(roomID string) string {
+	return t.formatTopic("query", "room", roomID)
 }
 
 // GetConnectionTopic 返回連接事件的主題
@@ -69,3 +155,142 @@ func (t *TopicFormatter) GetConnectionTopic(roomID string) string {
 func (t *TopicFormatter) GetAICommandTopic(roomID string) string {
 	return t.formatTopic("ai", "command", roomID)
 }
+
+// topicRoute 是路由表中的一項：一個類別與動作，以及是否為 request-reply 的查詢
+type topicRoute struct {
+	category string
+	action   string
+	query    bool
+}
+
+// topicRoutes 列出所有 Get*Topic 會產生的主題形式
+var topicRoutes = []topicRoute{
+	{category: "user", action: "presence"},
+	{category: "user", action: "joined"},
+	{category: "user", action: "left"},
+	{category: "system", action: "message"},
+	{category: "message", action: "chat"},
+	{category: "message", action: "broadcast"},
+	{category: "message", action: "ack"},
+	{category: "connection", action: "event"},
+	{category: "ai", action: "command"},
+	{category: "query", action: "history", query: true},
+	{category: "query", action: "members", query: true},
+	{category: "query", action: "room", query: true},
+}
+
+// FormatTopic 把解析後的主題格式化回主題字串，是 ParseTopic 的反函數
+// 用於把一個命名空間的主題轉換到另一個命名空間，例如重播錄下來的事件
+func (t *TopicFormatter) FormatTopic(topic types.Topic) string {
+	return t.formatTopic(topic.Category, topic.Action, topic.RoomID)
+}
+
+// GetNamespaceWildcardTopic 返回匹配命名空間內所有主題的萬用主題，例如 settlechat.prod.>
+// 預設命名空間的萬用主題也會匹配其他命名空間的主題，訂閱端要以 ParseTopic 過濾
+func (t *TopicFormatter) GetNamespaceWildcardTopic() string {
+	return t.basePrefix + ".>"
+}
+
+// GetWildcardTopic 返回匹配某類別與動作在所有房間的萬用主題，例如 settlechat.message.chat.*
+// 萬用字元只匹配一個 token，所以不會匹配到其他命名空間的主題
+func (t *TopicFormatter) GetWildcardTopic(category, action string) string {
+	return fmt.Sprintf("%s.%s.%s.*", t.basePrefix, category, action)
+}
+
+// ParseTopic 根據路由表把主題解析回類別、動作與房間，是各個 Get*Topic 的反函數
+// 其他命名空間的主題，以及不是由 formatTopic 產生的房間 token (例如沒有轉義的字元) 都會返回錯誤
+func (t *TopicFormatter) ParseTopic(topic string) (types.Topic, error) {
+	rest, ok := strings.CutPrefix(topic, t.basePrefix+".")
+	if !ok {
+		return types.Topic{}, fmt.Errorf("topic %q does not start with %q", topic, t.basePrefix)
+	}
+	tokens := strings.Split(rest, ".")
+
+	for _, route := range topicRoutes {
+		routeTokens := append([]string{route.category}, strings.Split(route.action, ".")...)
+		if len(tokens) <= len(routeTokens) || !slices.Equal(tokens[:len(routeTokens)], routeTokens) {
+			continue
+		}
+
+		if ids := tokens[len(routeTokens):]; len(ids) == 1 {
+			roomID, err := unescapeRoomID(ids[0])
+			if err != nil {
+				return types.Topic{}, fmt.Errorf("topic %q: %w", topic, err)
+			}
+			return types.Topic{Category: route.category, Action: route.action, RoomID: roomID}, nil
+		}
+	}
+
+	return types.Topic{}, fmt.Errorf("unknown topic: %q", topic)
+}
+
+// emptyRoomID 是空房間 ID 的 token；轉義後的 "%" 後面一定跟著兩個十六進位數字，不會與其他 ID 混淆
+const emptyRoomID = "%"
+
+// roomIDSafe 不需要轉義的字元，UUID 形式的房間 ID 原樣出現在主題中
+func roomIDSafe(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// escapeRoomID 把房間 ID 轉義成一個主題 token：其他字元 (包括 "."、"*"、">"、空白與 "%") 以 %XX 表示
+func escapeRoomID(roomID string) string {
+	if roomID == "" {
+		return emptyRoomID
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(roomID); i++ {
+		c := roomID[i]
+		if roomIDSafe(c) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// unescapeRoomID 是 escapeRoomID 的反函數，只接受 escapeRoomID 會產生的 token
+func unescapeRoomID(token string) (string, error) {
+	if token == emptyRoomID {
+		return "", nil
+	}
+	if token == "" {
+		return "", errors.New("empty room token")
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		if roomIDSafe(c) {
+			b.WriteByte(c)
+			continue
+		}
+		if c != '%' || i+2 >= len(token) {
+			return "", fmt.Errorf("invalid character %q in room token %q", c, token)
+		}
+		decoded, ok := unhex(token[i+1], token[i+2])
+		if !ok || roomIDSafe(decoded) {
+			return "", fmt.Errorf("invalid escape %q in room token %q", token[i:i+3], token)
+		}
+		b.WriteByte(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// unhex 解碼 escapeRoomID 產生的兩個大寫十六進位數字
+func unhex(hi, lo byte) (byte, bool) {
+	digit := func(c byte) (byte, bool) {
+		switch {
+		case c >= '0' && c <= '9':
+			return c - '0', true
+		case c >= 'A' && c <= 'F':
+			return c - 'A' + 10, true
+		}
+		return 0, false
+	}
+	h, ok1 := digit(hi)
+	l, ok2 := digit(lo)
+	return h<<4 | l, ok1 && ok2
+}
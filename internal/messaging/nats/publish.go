@@ -6,19 +6,19 @@ import (
 	"github.com/ianwu0915/SettleChat/internal/types"
 )
 
-// Publish publish message to NATS
+// Publish publish message to the event transport (NATS or in-memory)
 type NATSPublisher struct {
-	natsManager *NATSManager
-	env         string
-	topics      types.TopicFormatter
+	transport types.Transport
+	env       string
+	topics    types.TopicFormatter
 }
 
-func NewPublisher(natsManager *NATSManager, env string, topics types.TopicFormatter) *NATSPublisher {
+func NewPublisher(transport types.Transport, env string, topics types.TopicFormatter) *NATSPublisher {
 	log.Printf("Creating new publisher for environment: %s", env)
 	p := &NATSPublisher{
-		natsManager: natsManager,
-		env:         env,
-		topics:      topics,
+		transport: transport,
+		env:       env,
+		topics:    topics,
 	}
 	log.Printf("Publisher created successfully with env: %s", env)
 	return p
@@ -26,7 +26,12 @@ func NewPublisher(natsManager *NATSManager, env string, topics types.TopicFormat
 
 // Publish implements the types.NATSPublisher interface
 func (p *NATSPublisher) Publish(topic string, data []byte) error {
-	return p.natsManager.Publish(topic, data)
+	return p.transport.Publish(types.NewMessage(topic, data))
+}
+
+// PublishMsg implements the types.NATSPublisher interface
+func (p *NATSPublisher) PublishMsg(msg *types.Message) error {
+	return p.transport.Publish(msg)
 }
 
 // GetTopics returns the topic formatter
@@ -0,0 +1,121 @@
+package nats
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// recordingSink 記錄寫入的死信
+type recordingSink struct {
+	mu      sync.Mutex
+	letters []storage.DeadLetter
+}
+
+func (s *recordingSink) SaveDeadLetter(ctx context.Context, letter storage.DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func (s *recordingSink) snapshot() []storage.DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]storage.DeadLetter(nil), s.letters...)
+}
+
+var fastRetry = types.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := types.RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, w := range want {
+		if got := policy.Backoff(i + 1); got != w {
+			t.Errorf("Backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+func TestFailedHandlersRetryThenDeadLetter(t *testing.T) {
+	for name, connect := range clusters(t) {
+		t.Run(name, func(t *testing.T) {
+			topics := NewTopicFormatter("")
+			transport := connect(t)
+			sink := &recordingSink{}
+
+			recovers := &flakyHandler{failures: 2}
+			alwaysFails := &flakyHandler{failures: 1 << 30}
+			broadcast := &flakyHandler{failures: 1 << 30}
+
+			subscriber := NewSubscriber(transport, nil, "test", topics)
+			subscriber.RegisterHandlerWithMode("message", "chat", recovers, types.DeliveryWork)
+			subscriber.RegisterHandlerWithMode("user", "joined", alwaysFails, types.DeliveryWork)
+			subscriber.RegisterHandlerWithMode("message", "broadcast", broadcast, types.DeliveryFanout)
+			subscriber.SetRetryPolicy("", fastRetry)
+			subscriber.SetDeadLetterSink(sink)
+			if err := subscriber.Start(); err != nil {
+				t.Fatalf("failed to start subscriber: %v", err)
+			}
+			t.Cleanup(subscriber.Unsubscribe)
+			if nt, ok := transport.(*NATSTransport); ok {
+				conn, _ := nt.manager.GetConn()
+				conn.Flush()
+			}
+
+			publish(t, transport, topics.GetMessageTopic("room-1"))
+			publish(t, transport, topics.GetUserJoinedTopic("room-1"))
+			publish(t, transport, topics.GetBroadcastTopic("room-1"))
+
+			waitFor(t, func() bool {
+				return recovers.calls.Load() == 3 && alwaysFails.calls.Load() == 3 && broadcast.calls.Load() == 3
+			})
+			time.Sleep(50 * time.Millisecond)
+
+			letters := sink.snapshot()
+			if len(letters) != 1 {
+				t.Fatalf("got %d dead letters, want 1: %+v", len(letters), letters)
+			}
+			letter := letters[0]
+			if letter.HandlerKey != "user.joined" || letter.Subject != topics.GetUserJoinedTopic("room-1") {
+				t.Errorf("unexpected dead letter %+v", letter)
+			}
+			if letter.Attempts != 3 || string(letter.Data) != `{}` || letter.Error == "" {
+				t.Errorf("dead letter should capture payload, error and attempts: %+v", letter)
+			}
+		})
+	}
+}
+
+func TestDurableHandlerDeadLettersAfterMaxAttempts(t *testing.T) {
+	ns := runJetStreamServer(t)
+	manager := connectJetStream(t, ns.ClientURL())
+	sink := &recordingSink{}
+
+	handler := &flakyHandler{failures: 1 << 30}
+	subscriber := NewSubscriber(NewTransport(manager), nil, "test", NewTopicFormatter(""))
+	subscriber.RegisterHandlerWithMode("message", "chat", handler, types.DeliveryDurable)
+	subscriber.SetRetryPolicy("message.chat", fastRetry)
+	subscriber.SetDeadLetterSink(sink)
+	if err := subscriber.Start(); err != nil {
+		t.Fatalf("failed to start subscriber: %v", err)
+	}
+	defer subscriber.Close()
+
+	if err := manager.Publish(NewTopicFormatter("").GetMessageTopic("room-1"), []byte(`{}`)); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	waitFor(t, func() bool { return len(sink.snapshot()) == 1 })
+	time.Sleep(100 * time.Millisecond)
+	if got := handler.calls.Load(); got != 3 {
+		t.Errorf("got %d deliveries, want 3", got)
+	}
+	if letter := sink.snapshot()[0]; letter.Attempts != 3 || letter.HandlerKey != "message.chat" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+}
@@ -1,215 +1,447 @@
 package nats
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
+
 	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/tracing"
 	"github.com/ianwu0915/SettleChat/internal/types"
-	"github.com/nats-io/nats.go"
 )
 
-// Subscriber 管理 NATS 訂閱
-// 每一個訂閱都有對應的Handler 去接收並處理發布到主題的訊息
+// Subscriber 管理事件傳輸層 (NATS 或 in-memory) 上的訂閱
+// 每個註冊的 handler 只有一個萬用主題訂閱 (例如 settlechat.message.chat.*)，
+// 訂閱數量與房間數量無關；收到消息後以 TopicFormatter 解析主題並路由到 handler
+// 工作型 handler 以 queue group 訂閱，多個實例之間每個事件只處理一次；
+// 投遞型 handler 以一般訂閱，但只處理本實例有客戶端的房間；
+// 持久型 handler 在傳輸層支援持久化 (JetStream) 時以 durable consumer 消費
+//
+// handler 返回錯誤時依 RetryPolicy 以指數退避重試，一般訂閱在本地重試，
+// durable consumer 交給 JetStream 重新投遞；重試用完後工作型與持久型 handler 的事件寫入死信
+//
+// 收到的消息按房間交給 worker pool：同一個房間的事件 (不論主題) 依收到的順序逐一處理，
+// 不同房間並行處理；等待處理的消息超過上限時傳輸層的回調會阻塞
 type Subscriber struct {
-	natsManager *NATSManager
-	store       *storage.PostgresStore
-	subs        []*nats.Subscription
+	transport   types.Transport
+	store       storage.Store
+	subs        []types.Subscription
 	env         string
 	handlers    map[string]types.MessageHandler
+	modes       map[string]types.DeliveryMode
 	Topics      types.TopicFormatter
+
+	// isLocalRoom 判斷本實例是否有該房間的客戶端，nil 代表所有房間都是本地的
+	isLocalRoom func(roomID string) bool
+	mu          sync.RWMutex
+
+	retryPolicies map[string]types.RetryPolicy
+	defaultRetry  types.RetryPolicy
+	deadLetters   types.DeadLetterSink
+	processed     *dedupWindow
+	done          chan struct{}
+	closeOnce     sync.Once
+
+	dispatcherConfig DispatcherConfig
+	dispatcher       *dispatcher
 }
 
-func NewSubscriber(natsManager *NATSManager, store *storage.PostgresStore, env string, topics types.TopicFormatter) *Subscriber {
+func NewSubscriber(transport types.Transport, store storage.Store, env string, topics types.TopicFormatter) *Subscriber {
 	log.Printf("Creating new subscriber for environment: %s", env)
 	s := &Subscriber{
-		natsManager: natsManager,
+		transport:   transport,
 		store:       store,
-		subs:        make([]*nats.Subscription, 0),
+		subs:        make([]types.Subscription, 0),
 		env:         env,
 		handlers:    make(map[string]types.MessageHandler),
+		modes:       make(map[string]types.DeliveryMode),
 		Topics:      topics,
+
+		retryPolicies: make(map[string]types.RetryPolicy),
+		defaultRetry:  types.DefaultRetryPolicy(),
+		processed:     newDedupWindow(defaultDedupWindow),
+		done:          make(chan struct{}),
+
+		dispatcherConfig: DefaultDispatcherConfig(),
 	}
 	log.Printf("Subscriber created successfully with env: %s", env)
 	return s
 }
 
-// RegisterHandler 註冊消息處理器
+// RegisterHandler 註冊投遞型消息處理器，每個實例都會收到消息
 func (s *Subscriber) RegisterHandler(category, action string, handler types.MessageHandler) {
+	s.RegisterHandlerWithMode(category, action, handler, types.DeliveryFanout)
+}
+
+// RegisterHandlerWithMode 註冊消息處理器並指定多實例間的投遞方式
+func (s *Subscriber) RegisterHandlerWithMode(category, action string, handler types.MessageHandler, mode types.DeliveryMode) {
 	handlerKey := category + "." + action
-	log.Printf("Registering handler for %s", handlerKey)
+	log.Printf("Registering %s handler for %s", mode, handlerKey)
 	s.handlers[handlerKey] = handler
+	s.modes[handlerKey] = mode
 	log.Printf("Handler registered successfully for %s", handlerKey)
 }
 
-// SubscribeToRoom 訂閱特定房間的所有相關主題
-func (s *Subscriber) SubscribeToRoom(roomID string) error {
-	log.Printf("Starting subscription process for room: %s", roomID)
+// SetLocalRoomFilter 設置判斷房間是否有本地客戶端的函數，投遞型 handler 只處理本地房間
+func (s *Subscriber) SetLocalRoomFilter(isLocalRoom func(roomID string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isLocalRoom = isLocalRoom
+}
 
-	// 訂閱用戶加入相關事件
-	userJoinedTopic := s.Topics.GetUserJoinedTopic(roomID)
-	log.Printf("Subscribing to user joined topic: %s", userJoinedTopic)
-	if err := s.SubscribeTopic(userJoinedTopic); err != nil {
-		log.Printf("Failed to subscribe to user joined topic: %v", err)
-		return err
+// SetRetryPolicy 設置 handler 的重試策略，handlerKey 為空時設置所有 handler 的預設策略
+func (s *Subscriber) SetRetryPolicy(handlerKey string, policy types.RetryPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if handlerKey == "" {
+		s.defaultRetry = policy
+		return
 	}
+	s.retryPolicies[handlerKey] = policy
+}
 
-	// 訂閱用戶離開相關事件
-	userLeftTopic := s.Topics.GetUserLeftTopic(roomID)
-	log.Printf("Subscribing to user left topic: %s", userLeftTopic)
-	if err := s.SubscribeTopic(userLeftTopic); err != nil {
-		log.Printf("Failed to subscribe to user left topic: %v", err)
-		return err
-	}
+// SetDeadLetterSink 設置保存死信的地方，沒有設置時重試失敗的事件只記錄在日誌
+func (s *Subscriber) SetDeadLetterSink(sink types.DeadLetterSink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadLetters = sink
+}
 
-	// 訂閱訊息相關事件
-	messageTopic := s.Topics.GetMessageTopic(roomID)
-	log.Printf("Subscribing to message topic: %s", messageTopic)
-	if err := s.SubscribeTopic(messageTopic); err != nil {
-		log.Printf("Failed to subscribe to message topic: %v", err)
-		return err
+// SetDispatcherConfig 設置 worker pool 的大小與佇列上限，需要在 Start 之前呼叫
+func (s *Subscriber) SetDispatcherConfig(cfg DispatcherConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dispatcherConfig = cfg
+}
+
+// DispatcherStats 返回 worker pool 的佇列長度與背壓指標，Start 之前返回零值
+func (s *Subscriber) DispatcherStats() DispatcherStats {
+	s.mu.RLock()
+	d := s.dispatcher
+	s.mu.RUnlock()
+	if d == nil {
+		return DispatcherStats{}
 	}
+	return d.stats()
+}
 
-	// 訂閱廣播消息事件
-	broadcastTopic := s.Topics.GetBroadcastTopic(roomID)
-	log.Printf("Subscribing to broadcast topic: %s", broadcastTopic)
-	if err := s.SubscribeTopic(broadcastTopic); err != nil {
-		log.Printf("Failed to subscribe to broadcast topic: %v", err)
-		return err
+func (s *Subscriber) retryPolicy(handlerKey string) types.RetryPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if policy, ok := s.retryPolicies[handlerKey]; ok {
+		return policy
 	}
+	return s.defaultRetry
+}
 
-	// 訂閱系統消息事件
-	systemTopic := s.Topics.GetSystemMessageTopic(roomID)
-	log.Printf("Subscribing to system topic: %s", systemTopic)
-	if err := s.SubscribeTopic(systemTopic); err != nil {
-		log.Printf("Failed to subscribe to system topic: %v", err)
-		return err
+// queueGroup 返回工作型 handler 使用的 queue group 名稱，同一命名空間的所有實例共用
+func (s *Subscriber) queueGroup(handlerKey string) string {
+	return strings.Join(s.nameTokens(handlerKey), ".")
+}
+
+// durableName 返回持久型 handler 的 consumer 名稱，同一命名空間的所有實例共用
+// consumer 名稱不能有 "."，命名空間與 handler key 都沒有 "_"，以 "_" 連接不會混淆
+func (s *Subscriber) durableName(handlerKey string) string {
+	return strings.Join(s.nameTokens(handlerKey), "_")
+}
+
+// nameTokens 返回 queue group 與 consumer 名稱的組成部分，例如 [settlechat prod acme message chat]
+func (s *Subscriber) nameTokens(handlerKey string) []string {
+	tokens := []string{"settlechat"}
+	if namespace := s.Topics.Namespace(); namespace != "" {
+		tokens = append(tokens, strings.Split(namespace, ".")...)
 	}
+	return append(tokens, strings.Split(handlerKey, ".")...)
+}
 
-	// 訂閱用戶上線狀態事件
-	userPresenceTopic := s.Topics.GetPresenceTopic(roomID)
-	log.Printf("Subscribing to presence topic: %s", userPresenceTopic)
-	if err := s.SubscribeTopic(userPresenceTopic); err != nil {
-		log.Printf("Failed to subscribe to presence topic: %v", err)
-		return err
+// Start 啟動 worker pool，為每個註冊的 handler 訂閱一個涵蓋所有房間的萬用主題
+func (s *Subscriber) Start() error {
+	s.mu.Lock()
+	if s.dispatcher == nil {
+		s.dispatcher = newDispatcher(s.dispatcherConfig)
 	}
+	s.mu.Unlock()
 
-	// 訂閱聊天室歷史訊息
-	historyMessageRequestTopic := s.Topics.GetHistoryRequestTopic(roomID)
-	log.Printf("Subscribing to history message topic: %s", historyMessageRequestTopic)
-	if err := s.SubscribeTopic(historyMessageRequestTopic); err != nil {
-		log.Printf("Failed to subscribe to history message topic: %v", err)
-		return err
+	for handlerKey := range s.handlers {
+		category, action, _ := strings.Cut(handlerKey, ".")
+		if err := s.SubscribeTopic(s.Topics.GetWildcardTopic(category, action)); err != nil {
+			return err
+		}
 	}
 
-	// 訂閱連接事件
-	connectionTopic := s.Topics.GetConnectionTopic(roomID)
-	log.Printf("Subscribing to connection event topic: %s", connectionTopic)
-	if err := s.SubscribeTopic(connectionTopic); err != nil {
-		log.Printf("Failed to subscribe to connection event topic: %v", err)
-		return err
+	log.Printf("Subscriber started with %d subscriptions", len(s.subs))
+	return nil
+}
+
+// SubscribeTopic 訂閱特定主題 (可以是萬用主題)
+func (s *Subscriber) SubscribeTopic(topic string) error {
+	log.Printf("Attempting to subscribe to topic: %s", topic)
+
+	handlerKey, mode := s.deliveryMode(topic)
+
+	var sub types.Subscription
+	var err error
+	durable, isDurable := s.transport.(types.DurableTransport)
+	switch {
+	case mode == types.DeliveryDurable && isDurable && durable.Durable():
+		name := s.durableName(handlerKey)
+		log.Printf("Consuming topic %s with durable consumer %s", topic, name)
+		sub, err = durable.ConsumeDurable(name, topic, s.enqueueDurable)
+	case mode == types.DeliveryWork || mode == types.DeliveryDurable:
+		// 傳輸層沒有持久化時，持久型 handler 退回 queue group
+		queue := s.queueGroup(handlerKey)
+		log.Printf("Subscribing to topic %s with queue group %s", topic, queue)
+		sub, err = s.transport.QueueSubscribe(topic, queue, s.enqueue)
+	default:
+		sub, err = s.transport.Subscribe(topic, s.enqueue)
 	}
 
-	// 訂閱ai command事件
-	aicommandTopic := s.Topics.GetAICommandTopic(roomID)
-	log.Printf("Subscribing to AI command event topic: %s", aicommandTopic)
-	if err := s.SubscribeTopic(aicommandTopic); err != nil {
-		log.Printf("Failed to subscribe to ai command topic: %v", err)
-		return err
+	if err != nil {
+		log.Printf("Error: Failed to subscribe to topic %s: %v", topic, err)
+		return fmt.Errorf("failed to subscribe to topic %s: %w", topic, err)
 	}
 
+	s.mu.Lock()
+	s.subs = append(s.subs, sub)
+	s.mu.Unlock()
+	log.Printf("Successfully subscribed to topic: %s", topic)
+	return nil
+}
 
-	log.Printf("Successfully subscribed to all topics for room: %s", roomID)
+// roomKey 返回消息所屬的房間，作為 worker pool 排序的單位；無法解析的主題共用一個空的 key
+func (s *Subscriber) roomKey(subject string) string {
+	topic, err := s.Topics.ParseTopic(subject)
+	if err != nil {
+		return ""
+	}
+	return topic.RoomID
+}
 
-	return nil
+// enqueue 把一般訂閱收到的消息排到所屬房間的佇列
+func (s *Subscriber) enqueue(msg *types.Message) {
+	attempt := 0
+	var err error
+	if !s.submit(msg, func() time.Duration {
+		attempt++
+		var retryAfter time.Duration
+		retryAfter, err = s.dispatch(msg, attempt, err)
+		return retryAfter
+	}) {
+		log.Printf("Subscriber closed, dropping message for topic %s", msg.Subject)
+	}
 }
 
-// SubscribeTopic 訂閱特定主題
-func (s *Subscriber) SubscribeTopic(topic string) error {
-	log.Printf("Attempting to subscribe to topic: %s", topic)
+// enqueueDurable 把 durable consumer 收到的消息排到所屬房間的佇列，處理完成後 ack
+// 關閉中無法排入的消息不 ack，由 JetStream 重新投遞
+func (s *Subscriber) enqueueDurable(msg *types.Message, ack func(error)) {
+	if !s.submit(msg, func() time.Duration {
+		ack(s.consume(msg))
+		return 0
+	}) {
+		ack(fmt.Errorf("subscriber closed"))
+	}
+}
 
-	sub, err := s.natsManager.Subscribe(topic, func(msg *nats.Msg) {
-		log.Printf("Received message on topic: %s", msg.Subject)
+func (s *Subscriber) submit(msg *types.Message, fn job) bool {
+	s.mu.RLock()
+	d := s.dispatcher
+	s.mu.RUnlock()
+	if d != nil {
+		return d.submit(s.roomKey(msg.Subject), fn)
+	}
 
-		// 從主題中提取類別和動作
-		parts := parseTopic(msg.Subject)
-		if len(parts) < 4 {
-			log.Printf("Error: Invalid topic format: %s (expected at least 4 parts)", msg.Subject)
-			return
+	// 沒有經過 Start 的訂閱 (例如直接呼叫 SubscribeTopic) 在傳輸層的回調中處理與重試
+	for {
+		delay := fn()
+		if delay <= 0 {
+			return true
+		}
+		select {
+		case <-time.After(delay):
+		case <-s.done:
 		}
+	}
+}
 
-		handlerKey := parts[1] + "." + parts[2]
-		log.Printf("Looking for handler with key: %s", handlerKey)
+// dispatch 處理一般訂閱收到的消息的第 attempt 次嘗試，prev 是上一次的錯誤
+// 失敗時返回指數退避的等待時間與這次的錯誤；dispatcher 在等待期間讓同一個房間的後續消息等待，
+// 保持處理順序，但不佔用 worker
+func (s *Subscriber) dispatch(msg *types.Message, attempt int, prev error) (time.Duration, error) {
+	handlerKey, mode := s.deliveryMode(msg.Subject)
+	policy := s.retryPolicy(handlerKey)
+	msg.MaxAttempts = policy.Attempts()
+	msg.Attempt = attempt
+
+	if attempt > 1 && s.closing() {
+		// 關閉中，不再重試，保存到死信避免遺失
+		s.deadLetter(msg, handlerKey, mode, fmt.Errorf("subscriber closed while retrying: %w", prev))
+		return 0, prev
+	}
 
-		handler, exists := s.handlers[handlerKey]
-		if !exists {
-			log.Printf("Error: No handler found for topic: %s (key: %s)", msg.Subject, handlerKey)
-			return
-		}
+	err := s.route(msg)
+	if err == nil {
+		return 0, nil
+	}
+	if errors.Is(err, types.ErrPermanent) || attempt >= policy.Attempts() {
+		s.deadLetter(msg, handlerKey, mode, err)
+		return 0, err
+	}
 
-		log.Printf("Processing message with handler for key: %s", handlerKey)
-		if err := handler.Handle(msg); err != nil {
-			log.Printf("Error: Failed to handle message for topic %s: %v", msg.Subject, err)
-		} else {
-			log.Printf("Successfully processed message for topic: %s", msg.Subject)
-		}
-	})
+	delay := policy.Backoff(attempt)
+	log.Printf("Retrying message for topic %s in %s (attempt %d)", msg.Subject, delay, attempt)
+	return delay, err
+}
+
+// closing 判斷 Subscriber 是否正在關閉
+func (s *Subscriber) closing() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// consume 處理 durable consumer 收到的消息，重試交給 JetStream 的重新投遞
+// 投遞次數用完時寫入死信，並返回 ErrPermanent 讓 JetStream 不再投遞
+// (JetStreamConfig.MaxDeliver 需要不小於 MaxAttempts，否則 JetStream 會先放棄)
+func (s *Subscriber) consume(msg *types.Message) error {
+	handlerKey, mode := s.deliveryMode(msg.Subject)
+	msg.MaxAttempts = s.retryPolicy(handlerKey).Attempts()
+
+	err := s.route(msg)
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, types.ErrPermanent) && !msg.LastAttempt() {
+		return err
+	}
+
+	s.deadLetter(msg, handlerKey, mode, err)
+	if errors.Is(err, types.ErrPermanent) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", types.ErrPermanent, err)
+}
+
+// deadLetter 保存重試後仍然失敗的事件
+// 投遞型 handler 只影響本實例的客戶端，重新發布會重複推送給其他實例，因此不寫入死信
+func (s *Subscriber) deadLetter(msg *types.Message, handlerKey string, mode types.DeliveryMode, cause error) {
+	if mode == types.DeliveryFanout {
+		log.Printf("Error: Dropping message for topic %s after %d attempts: %v", msg.Subject, msg.Attempt, cause)
+		return
+	}
+
+	s.mu.RLock()
+	sink := s.deadLetters
+	s.mu.RUnlock()
+	if sink == nil {
+		log.Printf("Error: No dead letter sink, dropping message for topic %s after %d attempts: %v", msg.Subject, msg.Attempt, cause)
+		return
+	}
+
+	letter := storage.DeadLetter{
+		HandlerKey: handlerKey,
+		Subject:    msg.Subject,
+		Header:     msg.Header,
+		Data:       msg.Data,
+		Error:      cause.Error(),
+		Attempts:   msg.Attempt,
+		FailedAt:   time.Now(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sink.SaveDeadLetter(ctx, letter); err != nil {
+		log.Printf("Error: Failed to save dead letter for topic %s: %v", msg.Subject, err)
+		return
+	}
+	log.Printf("Dead-lettered message for topic %s after %d attempts: %v", msg.Subject, msg.Attempt, cause)
+}
 
+// route 解析收到的主題並交給對應的 handler，返回 handler 的錯誤
+// 無法路由的消息返回包裝了 types.ErrPermanent 的錯誤，持久型 consumer 不會重新投遞
+func (s *Subscriber) route(msg *types.Message) error {
+	topic, err := s.Topics.ParseTopic(msg.Subject)
 	if err != nil {
-		log.Printf("Error: Failed to subscribe to topic %s: %v", topic, err)
-		return fmt.Errorf("failed to subscribe to topic %s: %w", topic, err)
+		log.Printf("Error: Invalid topic format: %v", err)
+		return fmt.Errorf("%w: %v", types.ErrPermanent, err)
 	}
 
-	s.subs = append(s.subs, sub)
-	log.Printf("Successfully subscribed to topic: %s", topic)
+	handlerKey := topic.HandlerKey()
+	handler, exists := s.handlers[handlerKey]
+	if !exists {
+		log.Printf("Error: No handler found for topic: %s (key: %s)", msg.Subject, handlerKey)
+		return fmt.Errorf("%w: no handler for topic %s", types.ErrPermanent, msg.Subject)
+	}
+
+	// 投遞型 handler 只需要處理本實例有客戶端的房間
+	if s.modes[handlerKey] == types.DeliveryFanout && !s.hasLocalRoom(topic.RoomID) {
+		return nil
+	}
+
+	// outbox 至少發布一次，已經處理成功的事件直接略過
+	msgID := msg.Header.Get(types.HeaderMsgID)
+	if msgID != "" && s.processed.Seen(handlerKey+"/"+msgID) {
+		log.Printf("Skipping duplicate message %s for topic %s", msgID, msg.Subject)
+		return nil
+	}
+
+	// handler 的 span 接在發布端寫入標頭的 trace 之下
+	ctx, span := tracing.StartConsume(msg.Context(), msg, handlerKey)
+	err = handler.Handle(msg.WithContext(ctx))
+	tracing.End(span, err)
+	if err != nil {
+		log.Printf("Error: Failed to handle message for topic %s: %v", msg.Subject, err)
+		return err
+	}
+	if msgID != "" {
+		s.processed.Add(handlerKey + "/" + msgID)
+	}
+	log.Printf("Successfully processed message for topic: %s", msg.Subject)
 	return nil
 }
 
-// parseTopic 解析主題字符串
-func parseTopic(topic string) []string {
-	parts := strings.Split(topic, ".")
-	log.Printf("Parsed topic %s into %d parts", topic, len(parts))
-
-	// 處理 AI 命令主題
-	if len(parts) >= 3 && parts[0] == "ai" && parts[1] == "command" {
-		// 將 ai.command 作為一個完整的 action
-		newParts := make([]string, 0)
-		newParts = append(newParts, "settlechat") // 基礎前綴
-		newParts = append(newParts, "ai")         // category
-		newParts = append(newParts, "command")    // action
-		newParts = append(newParts, parts[2:]...) // roomID 等其他部分
-		log.Printf("Reformatted AI command topic parts: %v", newParts)
-		return newParts
-	}
-
-	// 如果是歷史消息相關主題，需要特殊處理
-	if len(parts) >= 4 && parts[1] == "message" {
-		if parts[2] == "history" && parts[3] == "request" {
-			// 將 history.request 作為一個完整的 action
-			newParts := make([]string, 0)
-			newParts = append(newParts, parts[0])          // settlechat
-			newParts = append(newParts, parts[1])          // message
-			newParts = append(newParts, "history.request") // 完整的 action
-			newParts = append(newParts, parts[4:]...)      // roomID 等其他部分
-			log.Printf("Reformatted history request topic parts: %v", newParts)
-			return newParts
-		} else if parts[2] == "history" && parts[3] == "response" {
-			// 將 history.response 作為一個完整的 action
-			newParts := make([]string, 0)
-			newParts = append(newParts, parts[0])           // settlechat
-			newParts = append(newParts, parts[1])           // message
-			newParts = append(newParts, "history.response") // 完整的 action
-			newParts = append(newParts, parts[4:]...)       // roomID 和 userID
-			log.Printf("Reformatted history response topic parts: %v", newParts)
-			return newParts
+func (s *Subscriber) hasLocalRoom(roomID string) bool {
+	s.mu.RLock()
+	isLocalRoom := s.isLocalRoom
+	s.mu.RUnlock()
+
+	return isLocalRoom == nil || isLocalRoom(roomID)
+}
+
+// deliveryMode 返回主題對應的 handler key 與投遞方式，沒有註冊的 handler 視為投遞型
+func (s *Subscriber) deliveryMode(topic string) (string, types.DeliveryMode) {
+	// 萬用主題的 "*" 不是合法的房間 token，ParseTopic 無法解析，以各個 handler 的萬用主題比對
+	for handlerKey, mode := range s.modes {
+		category, action, _ := strings.Cut(handlerKey, ".")
+		if topic == s.Topics.GetWildcardTopic(category, action) {
+			return handlerKey, mode
 		}
 	}
 
-	return parts
+	parsed, err := s.Topics.ParseTopic(topic)
+	if err != nil {
+		return "", types.DeliveryFanout
+	}
+
+	handlerKey := parsed.HandlerKey()
+	mode, ok := s.modes[handlerKey]
+	if !ok {
+		return handlerKey, types.DeliveryFanout
+	}
+	return handlerKey, mode
 }
 
 // Unsubscribe 取消所有訂閱
 func (s *Subscriber) Unsubscribe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	log.Printf("Starting unsubscribe process for %d subscriptions", len(s.subs))
 	for i, sub := range s.subs {
 		if err := sub.Unsubscribe(); err != nil {
@@ -222,19 +454,31 @@ func (s *Subscriber) Unsubscribe() {
 	log.Println("Completed unsubscribe process for all subscriptions")
 }
 
-// Close 清理訂閱並關閉資源
+// Close 清理訂閱並關閉資源，正在等待重試的消息會直接寫入死信，佇列中的消息處理完才返回
 func (s *Subscriber) Close() error {
 	log.Println("Closing subscriber and cleaning up resources")
+	s.closeOnce.Do(func() { close(s.done) })
 	s.Unsubscribe()
+
+	s.mu.Lock()
+	d := s.dispatcher
+	s.dispatcher = nil
+	s.mu.Unlock()
+	if d != nil {
+		d.close()
+	}
 	log.Println("Subscriber closed successfully")
 	return nil
 }
 
 // UnsubscribeTopic 取消訂閱特定主題
 func (s *Subscriber) UnsubscribeTopic(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	log.Printf("Attempting to unsubscribe from topic: %s", topic)
 	for i, sub := range s.subs {
-		if sub.Subject == topic {
+		if sub.Subject() == topic {
 			if err := sub.Unsubscribe(); err != nil {
 				log.Printf("Error unsubscribing from topic %s: %v", topic, err)
 				return err
@@ -248,3 +492,10 @@ func (s *Subscriber) UnsubscribeTopic(topic string) error {
 	log.Printf("No subscription found for topic: %s", topic)
 	return fmt.Errorf("no subscription found for topic: %s", topic)
 }
+
+// SubscriptionCount 返回目前的訂閱數量
+func (s *Subscriber) SubscriptionCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.subs)
+}
@@ -0,0 +1,253 @@
+package nats
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/types"
+	server "github.com/nats-io/nats-server/v2/server"
+)
+
+// countingHandler 計算收到的消息數量
+type countingHandler struct {
+	count atomic.Int64
+}
+
+func (h *countingHandler) Handle(msg *types.Message) error {
+	h.count.Add(1)
+	return nil
+}
+
+// runEmbeddedServer 在隨機埠啟動一個內嵌的 NATS 伺服器
+func runEmbeddedServer(t testing.TB) *server.Server {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+// cluster 為每個模擬的實例返回一個連到同一個 broker 的傳輸層
+type cluster func(t testing.TB) types.Transport
+
+// clusters 讓同一個測試分別在 NATS 與 in-memory 傳輸層上執行
+func clusters(t *testing.T) map[string]cluster {
+	ns := runEmbeddedServer(t)
+	shared := memory.NewTransport()
+	t.Cleanup(func() { shared.Close() })
+
+	return map[string]cluster{
+		"nats": func(t testing.TB) types.Transport {
+			manager := NewNATSManager(ns.ClientURL(), false)
+			if err := manager.Connect(); err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			t.Cleanup(manager.Disconnect)
+			return NewTransport(manager)
+		},
+		// 同一個 process 內的實例共用一個 in-memory 傳輸層
+		"memory": func(t testing.TB) types.Transport {
+			return shared
+		},
+	}
+}
+
+// instance 模擬一個 SettleChat 伺服器實例的訂閱端
+type instance struct {
+	work      *countingHandler
+	broadcast *countingHandler
+}
+
+// startInstance 啟動一個實例，localRooms 為該實例有客戶端的房間
+func startInstance(t testing.TB, transport types.Transport, localRooms ...string) *instance {
+	t.Helper()
+	inst := &instance{work: &countingHandler{}, broadcast: &countingHandler{}}
+	subscriber := NewSubscriber(transport, nil, "test", NewTopicFormatter(""))
+	subscriber.RegisterHandlerWithMode("message", "chat", inst.work, types.DeliveryWork)
+	subscriber.RegisterHandlerWithMode("message", "broadcast", inst.broadcast, types.DeliveryFanout)
+
+	subscriber.SetLocalRoomFilter(func(roomID string) bool {
+		return slices.Contains(localRooms, roomID)
+	})
+	if err := subscriber.Start(); err != nil {
+		t.Fatalf("failed to start subscriber: %v", err)
+	}
+	t.Cleanup(subscriber.Unsubscribe)
+
+	if nt, ok := transport.(*NATSTransport); ok {
+		conn, _ := nt.manager.GetConn()
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("failed to flush subscriptions: %v", err)
+		}
+	}
+	return inst
+}
+
+func publish(t testing.TB, transport types.Transport, topic string) {
+	t.Helper()
+	if err := transport.Publish(types.NewMessage(topic, []byte(`{}`))); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+}
+
+func TestWorkAndFanoutAcrossInstances(t *testing.T) {
+	for name, connect := range clusters(t) {
+		t.Run(name, func(t *testing.T) {
+			roomID := "room-1"
+			topics := NewTopicFormatter("")
+
+			a := startInstance(t, connect(t), roomID)
+			b := startInstance(t, connect(t), roomID)
+			publisher := connect(t)
+
+			const n = 50
+			for i := 0; i < n; i++ {
+				publish(t, publisher, topics.GetMessageTopic(roomID))
+				publish(t, publisher, topics.GetBroadcastTopic(roomID))
+			}
+
+			waitFor(t, func() bool {
+				return a.work.count.Load()+b.work.count.Load() >= n &&
+					a.broadcast.count.Load() == n && b.broadcast.count.Load() == n
+			})
+			// 等一下確認沒有重複處理的消息晚到
+			time.Sleep(100 * time.Millisecond)
+
+			t.Run("work handlers process each message once", func(t *testing.T) {
+				if got := a.work.count.Load() + b.work.count.Load(); got != n {
+					t.Errorf("got %d messages processed, want %d", got, n)
+				}
+			})
+
+			t.Run("fanout handlers deliver to every instance", func(t *testing.T) {
+				if got := a.broadcast.count.Load(); got != n {
+					t.Errorf("instance a got %d broadcasts, want %d", got, n)
+				}
+				if got := b.broadcast.count.Load(); got != n {
+					t.Errorf("instance b got %d broadcasts, want %d", got, n)
+				}
+			})
+		})
+	}
+}
+
+func TestFanoutOnlyDeliversToLocalRooms(t *testing.T) {
+	for name, connect := range clusters(t) {
+		t.Run(name, func(t *testing.T) {
+			topics := NewTopicFormatter("")
+
+			a := startInstance(t, connect(t), "room-a")
+			b := startInstance(t, connect(t), "room-b")
+			publisher := connect(t)
+
+			// 房間數量增加不會增加訂閱數量
+			for _, roomID := range []string{"room-a", "room-b", "room-c"} {
+				publish(t, publisher, topics.GetBroadcastTopic(roomID))
+				publish(t, publisher, topics.GetMessageTopic(roomID))
+			}
+
+			waitFor(t, func() bool {
+				return a.work.count.Load()+b.work.count.Load() >= 3 &&
+					a.broadcast.count.Load() >= 1 && b.broadcast.count.Load() >= 1
+			})
+			time.Sleep(100 * time.Millisecond)
+
+			if got := a.broadcast.count.Load(); got != 1 {
+				t.Errorf("instance a got %d broadcasts, want 1", got)
+			}
+			if got := b.broadcast.count.Load(); got != 1 {
+				t.Errorf("instance b got %d broadcasts, want 1", got)
+			}
+			// 工作型 handler 不受本地房間過濾影響
+			if got := a.work.count.Load() + b.work.count.Load(); got != 3 {
+				t.Errorf("got %d messages processed, want 3", got)
+			}
+		})
+	}
+}
+
+func waitFor(t testing.TB, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestDuplicateMessagesProcessedOnce(t *testing.T) {
+	for name, connect := range clusters(t) {
+		t.Run(name, func(t *testing.T) {
+			topics := NewTopicFormatter("")
+			inst := startInstance(t, connect(t), "room-1")
+			publisher := connect(t)
+
+			// outbox relay 崩潰後重新發布同一個事件
+			for _, id := range []string{"event-1", "event-1", "event-2"} {
+				msg := types.NewMessage(topics.GetMessageTopic("room-1"), []byte(`{}`))
+				msg.Header.Set(types.HeaderMsgID, id)
+				if err := publisher.Publish(msg); err != nil {
+					t.Fatalf("publish failed: %v", err)
+				}
+			}
+
+			waitFor(t, func() bool { return inst.work.count.Load() >= 2 })
+			time.Sleep(100 * time.Millisecond)
+			if got := inst.work.count.Load(); got != 2 {
+				t.Errorf("got %d messages processed, want 2", got)
+			}
+		})
+	}
+}
+
+// Start 為每個 handler 訂閱的萬用主題都要解析出 handler 註冊的投遞方式，
+// 否則工作型與持久型 handler 會退回投遞型，在每個實例都執行一次
+func TestDeliveryModeOfWildcardTopics(t *testing.T) {
+	handlers := []struct {
+		category, action string
+		mode             types.DeliveryMode
+	}{
+		{"message", "chat", types.DeliveryWork},
+		{"message", "broadcast", types.DeliveryFanout},
+		{"user", "joined", types.DeliveryDurable},
+		{"query", "history", types.DeliveryWork},
+	}
+
+	for _, namespace := range []Namespace{{}, {Environment: "prod"}, {Environment: "prod", Tenant: "acme"}} {
+		t.Run(namespace.String(), func(t *testing.T) {
+			topics, err := NewNamespacedTopicFormatter(namespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subscriber := NewSubscriber(memory.NewTransport(), nil, "test", topics)
+			for _, h := range handlers {
+				subscriber.RegisterHandlerWithMode(h.category, h.action, &countingHandler{}, h.mode)
+			}
+
+			for _, h := range handlers {
+				topic := topics.GetWildcardTopic(h.category, h.action)
+				handlerKey, mode := subscriber.deliveryMode(topic)
+				if want := h.category + "." + h.action; handlerKey != want || mode != h.mode {
+					t.Errorf("deliveryMode(%q) = %q, %v; want %q, %v", topic, handlerKey, mode, want, h.mode)
+				}
+			}
+
+			// 具體房間的主題仍然以 ParseTopic 解析
+			if handlerKey, mode := subscriber.deliveryMode(topics.GetMessageTopic("room-1")); handlerKey != "message.chat" || mode != types.DeliveryWork {
+				t.Errorf("deliveryMode of a room topic = %q, %v; want message.chat, work", handlerKey, mode)
+			}
+		})
+	}
+}
@@ -1,6 +1,12 @@
 package nats
 
-import "testing"
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
 
 
 
@@ -33,10 +39,244 @@ func TestUserLeftJoinTopic(t *testing.T) {
 	})
 }
 
+func TestParseTopic(t *testing.T) {
+	formatter := setupNewTopicFormatter()
+
+	tests := []struct {
+		topic string
+		want  types.Topic
+	}{
+		{formatter.GetMessageTopic("123"), types.Topic{Category: "message", Action: "chat", RoomID: "123"}},
+		{formatter.GetHistoryQueryTopic("123"), types.Topic{Category: "query", Action: "history", RoomID: "123"}},
+		{formatter.GetRoomMembersQueryTopic("123"), types.Topic{Category: "query", Action: "members", RoomID: "123"}},
+		{formatter.GetAICommandTopic("123"), types.Topic{Category: "ai", Action: "command", RoomID: "123"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			got, err := formatter.ParseTopic(tt.topic)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("invalid topics", func(t *testing.T) {
+		for _, topic := range []string{
+			"other.message.chat.123",
+			"settlechat.message.chat",
+			"settlechat.message.unknown.123",
+			"settlechat.message.history.response.123.u1",
+			"settlechat.query.history.123.u1",
+		} {
+			if _, err := formatter.ParseTopic(topic); err == nil {
+				t.Errorf("expected error for %q", topic)
+			}
+		}
+	})
+}
+
+func TestGetWildcardTopic(t *testing.T) {
+	formatter := setupNewTopicFormatter()
+
+	assertCorrect(t, formatter.GetWildcardTopic("message", "chat"), "settlechat.message.chat.*")
+	assertCorrect(t, formatter.GetWildcardTopic("query", "history"), "settlechat.query.history.*")
+}
 
 func assertCorrect(t testing.TB, got, want string) {
 	t.Helper()
 	if got != want {
 		t.Errorf("got %q want %q", got, want)
 	}
-}
\ No newline at end of file
+}
+
+// roomTopics 列出每個以房間產生主題的 TopicFormatter 方法與它對應的類別、動作
+func roomTopics(formatter *TopicFormatter) []struct {
+	name             string
+	format           func(roomID string) string
+	category, action string
+} {
+	return []struct {
+		name             string
+		format           func(roomID string) string
+		category, action string
+	}{
+		{"GetPresenceTopic", formatter.GetPresenceTopic, "user", "presence"},
+		{"GetUserJoinedTopic", formatter.GetUserJoinedTopic, "user", "joined"},
+		{"GetUserLeftTopic", formatter.GetUserLeftTopic, "user", "left"},
+		{"GetSystemMessageTopic", formatter.GetSystemMessageTopic, "system", "message"},
+		{"GetMessageTopic", formatter.GetMessageTopic, "message", "chat"},
+		{"GetBroadcastTopic", formatter.GetBroadcastTopic, "message", "broadcast"},
+		{"GetConnectionTopic", formatter.GetConnectionTopic, "connection", "event"},
+		{"GetAICommandTopic", formatter.GetAICommandTopic, "ai", "command"},
+		{"GetHistoryQueryTopic", formatter.GetHistoryQueryTopic, "query", "history"},
+		{"GetRoomMembersQueryTopic", formatter.GetRoomMembersQueryTopic, "query", "members"},
+		{"GetRoomStateQueryTopic", formatter.GetRoomStateQueryTopic, "query", "room"},
+	}
+}
+
+func TestTopicRoundTrip(t *testing.T) {
+	namespaces := []Namespace{
+		{},
+		{Environment: "dev"},
+		{Environment: "prod", Tenant: "acme"},
+		{Environment: "staging-2", Tenant: "tenant-42"},
+	}
+	roomIDs := []string{
+		"123",
+		"4f9c1c1e-8a3b-4b1e-9a55-2c7d0e6f1a90",
+		"room_1",
+		"a.b",
+		"*",
+		">",
+		"with space",
+		"tab\tand\nnewline",
+		"100%",
+		"%41",
+		"中文房間",
+		"",
+	}
+
+	for _, namespace := range namespaces {
+		formatter, err := NewNamespacedTopicFormatter(namespace)
+		if err != nil {
+			t.Fatalf("NewNamespacedTopicFormatter(%+v): %v", namespace, err)
+		}
+		prefix := strings.Join(append([]string{"settlechat"}, namespace.tokens()...), ".")
+
+		for _, method := range roomTopics(formatter) {
+			for _, roomID := range roomIDs {
+				topic := method.format(roomID)
+				assertSubjectToken(t, topic, prefix)
+
+				got, err := formatter.ParseTopic(topic)
+				if err != nil {
+					t.Errorf("%s %s(%q) = %q: %v", namespace, method.name, roomID, topic, err)
+					continue
+				}
+				want := types.Topic{Category: method.category, Action: method.action, RoomID: roomID}
+				if got != want {
+					t.Errorf("%s %s(%q): parsed %+v, want %+v", namespace, method.name, roomID, got, want)
+				}
+			}
+
+			wildcard := formatter.GetWildcardTopic(method.category, method.action)
+			if want := prefix + "." + method.category + "." + method.action + ".*"; wildcard != want {
+				t.Errorf("GetWildcardTopic(%q, %q) = %q, want %q", method.category, method.action, wildcard, want)
+			}
+		}
+	}
+}
+
+// assertSubjectToken 檢查主題以命名空間開頭，且房間 ID 只佔一個合法的 NATS token
+func assertSubjectToken(t *testing.T, topic, prefix string) {
+	t.Helper()
+	if !strings.HasPrefix(topic, prefix+".") {
+		t.Errorf("topic %q does not start with %q", topic, prefix)
+	}
+	tokens := strings.Split(strings.TrimPrefix(topic, prefix+"."), ".")
+	if len(tokens) != 3 {
+		t.Errorf("topic %q has %d tokens after the namespace, want 3", topic, len(tokens))
+	}
+	for _, token := range tokens {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			t.Errorf("topic %q has invalid token %q", topic, token)
+		}
+	}
+}
+
+func TestParseTopicRejectsOtherNamespaces(t *testing.T) {
+	formatters := []*TopicFormatter{
+		NewTopicFormatter(""),
+		NewTopicFormatter("dev"),
+		NewTopicFormatter("prod"),
+	}
+	acme, err := NewNamespacedTopicFormatter(Namespace{Environment: "prod", Tenant: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatters = append(formatters, acme)
+
+	for _, publisher := range formatters {
+		topic := publisher.GetMessageTopic("room1")
+		for _, subscriber := range formatters {
+			_, err := subscriber.ParseTopic(topic)
+			if own := publisher == subscriber; own != (err == nil) {
+				t.Errorf("namespace %q parsing %q: err = %v", subscriber.Namespace(), topic, err)
+			}
+		}
+	}
+}
+
+func TestParseTopicRejectsNonCanonicalRoomTokens(t *testing.T) {
+	formatter := NewTopicFormatter("dev")
+
+	for _, token := range []string{
+		"%41",    // 'A' 不需要轉義
+		"%2e",    // 小寫十六進位
+		"%2",     // 不完整的轉義
+		"%ZZ",    // 不是十六進位
+		"a%",     // 結尾的 %
+		"房間",     // 沒有轉義的非 ASCII 字元
+		"a+b",    // 沒有轉義的符號
+		"%%2E2E", // 轉義後的 "%" 必須是 %25
+	} {
+		topic := "settlechat.dev.message.chat." + token
+		if got, err := formatter.ParseTopic(topic); err == nil {
+			t.Errorf("ParseTopic(%q) = %+v, want error", topic, got)
+		}
+	}
+}
+
+func TestNamespaceValidate(t *testing.T) {
+	valid := []Namespace{
+		{},
+		{Environment: "dev"},
+		{Environment: "prod-eu", Tenant: "acme-1"},
+	}
+	for _, namespace := range valid {
+		if _, err := NewNamespacedTopicFormatter(namespace); err != nil {
+			t.Errorf("NewNamespacedTopicFormatter(%+v): %v", namespace, err)
+		}
+	}
+
+	invalid := []Namespace{
+		{Tenant: "acme"},
+		{Environment: "Prod"},
+		{Environment: "prod.eu"},
+		{Environment: "prod_eu"},
+		{Environment: "*"},
+		{Environment: ">"},
+		{Environment: "prod", Tenant: "a b"},
+		{Environment: "-prod"},
+	}
+	for _, namespace := range invalid {
+		if _, err := NewNamespacedTopicFormatter(namespace); !errors.Is(err, ErrInvalidNamespace) {
+			t.Errorf("NewNamespacedTopicFormatter(%+v) error = %v, want ErrInvalidNamespace", namespace, err)
+		}
+	}
+}
+
+func TestNamespacedNames(t *testing.T) {
+	formatter, err := NewNamespacedTopicFormatter(Namespace{Environment: "prod", Tenant: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber := NewSubscriber(nil, nil, "prod", formatter)
+
+	assertCorrect(t, subscriber.queueGroup("message.chat"), "settlechat.prod.acme.message.chat")
+	assertCorrect(t, subscriber.durableName("message.chat"), "settlechat_prod_acme_message_chat")
+
+	streams := formatter.Streams()
+	subjects, ok := streams["SETTLECHAT_PROD_ACME_MESSAGE"]
+	if !ok {
+		t.Fatalf("missing namespaced message stream: %v", streams)
+	}
+	for _, subject := range subjects {
+		if !strings.HasPrefix(subject, "settlechat.prod.acme.message.") {
+			t.Errorf("stream subject %q is outside the namespace", subject)
+		}
+	}
+}
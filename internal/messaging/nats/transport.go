@@ -0,0 +1,175 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSTransport 以 NATS 實現 types.Transport，啟用 JetStream 後也實現 types.DurableTransport
+type NATSTransport struct {
+	manager *NATSManager
+}
+
+// NewTransport 把 NATSManager 包裝成與傳輸層無關的 types.Transport
+func NewTransport(manager *NATSManager) *NATSTransport {
+	return &NATSTransport{manager: manager}
+}
+
+func (t *NATSTransport) Publish(msg *types.Message) error {
+	return t.manager.PublishMsg(toNatsMsg(msg))
+}
+
+func (t *NATSTransport) Subscribe(subject string, handler func(*types.Message)) (types.Subscription, error) {
+	sub, err := t.manager.Subscribe(subject, func(msg *nats.Msg) {
+		handler(fromNatsMsg(msg))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &natsSubscription{sub: sub}, nil
+}
+
+func (t *NATSTransport) QueueSubscribe(subject, queue string, handler func(*types.Message)) (types.Subscription, error) {
+	sub, err := t.manager.QueueSubscribe(subject, queue, func(msg *nats.Msg) {
+		handler(fromNatsMsg(msg))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &natsSubscription{sub: sub}, nil
+}
+
+func (t *NATSTransport) Request(ctx context.Context, msg *types.Message) (*types.Message, error) {
+	conn, err := t.manager.GetConn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.RequestMsgWithContext(ctx, toNatsMsg(msg))
+	if errors.Is(err, nats.ErrNoResponders) {
+		return nil, fmt.Errorf("%w: %s", types.ErrNoResponders, msg.Subject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fromNatsMsg(reply), nil
+}
+
+// Durable 是否已經啟用 JetStream
+func (t *NATSTransport) Durable() bool {
+	js, _ := t.manager.JetStream()
+	return js != nil
+}
+
+// ConsumeDurable 以 JetStream durable consumer 消費主題
+// handler 以 nil 呼叫 ack 時才 ack；失敗時以指數退避 nak，超過 MaxDeliver 次或錯誤包裝了 types.ErrPermanent 時不再投遞
+// 消息的 Attempt 為 JetStream 的投遞次數，Subscriber 以此決定何時寫入死信
+func (t *NATSTransport) ConsumeDurable(durable, subject string, handler func(*types.Message, func(error))) (types.Subscription, error) {
+	_, cfg := t.manager.JetStream()
+
+	consumer, err := t.manager.ConsumeDurable(context.Background(), durable, subject, func(msg jetstream.Msg) {
+		handler(fromJetStreamMsg(msg), func(err error) {
+			settle(msg, cfg, err)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &consumerSubscription{subject: subject, consumer: consumer}, nil
+}
+
+// settle 依處理結果 ack、nak 或終止 JetStream 消息
+func settle(msg jetstream.Msg, cfg JetStreamConfig, err error) {
+	switch {
+	case err == nil:
+		if err := msg.Ack(); err != nil {
+			log.Printf("Error: Failed to ack message for topic %s: %v", msg.Subject(), err)
+		}
+	case errors.Is(err, types.ErrPermanent):
+		// 重新投遞也沒有用
+		msg.Term()
+	default:
+		meta, metaErr := msg.Metadata()
+		if metaErr != nil {
+			msg.Nak()
+			return
+		}
+		if cfg.MaxDeliver > 0 && meta.NumDelivered >= uint64(cfg.MaxDeliver) {
+			log.Printf("Error: Giving up on message %d for topic %s after %d attempts", meta.Sequence.Stream, msg.Subject(), meta.NumDelivered)
+			msg.Term()
+			return
+		}
+		delay := cfg.nakDelay(meta.NumDelivered)
+		log.Printf("Redelivering message %d for topic %s in %s (attempt %d)", meta.Sequence.Stream, msg.Subject(), delay, meta.NumDelivered)
+		msg.NakWithDelay(delay)
+	}
+}
+
+func (t *NATSTransport) Replay(ctx context.Context, subject string, since time.Time, fn func(*types.Message) error) error {
+	return t.manager.Replay(ctx, subject, since, fn)
+}
+
+// natsSubscription 把 *nats.Subscription 包裝成 types.Subscription
+type natsSubscription struct {
+	sub *nats.Subscription
+}
+
+func (s *natsSubscription) Subject() string {
+	return s.sub.Subject
+}
+
+func (s *natsSubscription) Unsubscribe() error {
+	return s.sub.Unsubscribe()
+}
+
+// consumerSubscription 把 JetStream 的 ConsumeContext 包裝成 types.Subscription
+type consumerSubscription struct {
+	subject  string
+	consumer jetstream.ConsumeContext
+}
+
+func (s *consumerSubscription) Subject() string {
+	return s.subject
+}
+
+func (s *consumerSubscription) Unsubscribe() error {
+	s.consumer.Stop()
+	return nil
+}
+
+func toNatsMsg(msg *types.Message) *nats.Msg {
+	return &nats.Msg{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Header:  nats.Header(msg.Header),
+		Data:    msg.Data,
+	}
+}
+
+func fromNatsMsg(msg *nats.Msg) *types.Message {
+	return &types.Message{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Header:  types.Header(msg.Header),
+		Data:    msg.Data,
+	}
+}
+
+func fromJetStreamMsg(msg jetstream.Msg) *types.Message {
+	m := &types.Message{
+		Subject: msg.Subject(),
+		Header:  types.Header(msg.Headers()),
+		Data:    msg.Data(),
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		m.Attempt = int(meta.NumDelivered)
+	}
+	return m
+}
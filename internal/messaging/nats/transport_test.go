@@ -0,0 +1,48 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+func TestTransportRequest(t *testing.T) {
+	for name, connect := range clusters(t) {
+		t.Run(name, func(t *testing.T) {
+			responder := connect(t)
+			sub, err := responder.Subscribe("settlechat.test.echo", func(msg *types.Message) {
+				reply := types.NewMessage(msg.Reply, msg.Data)
+				reply.Header.Set("X-Echo", msg.Header.Get("X-Request"))
+				responder.Publish(reply)
+			})
+			if err != nil {
+				t.Fatalf("subscribe failed: %v", err)
+			}
+			defer sub.Unsubscribe()
+			if nt, ok := responder.(*NATSTransport); ok {
+				conn, _ := nt.manager.GetConn()
+				conn.Flush()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			request := types.NewMessage("settlechat.test.echo", []byte("ping"))
+			request.Header.Set("X-Request", "1")
+			reply, err := connect(t).Request(ctx, request)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if string(reply.Data) != "ping" || reply.Header.Get("X-Echo") != "1" {
+				t.Errorf("unexpected reply: %q %v", reply.Data, reply.Header)
+			}
+
+			if _, err := connect(t).Request(ctx, types.NewMessage("settlechat.test.nobody", nil)); !errors.Is(err, types.ErrNoResponders) {
+				t.Errorf("got %v, want ErrNoResponders", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package messaging
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/tracing"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// OutboxStore 保存等待發布的事件，由 storage.Store 實現
+type OutboxStore interface {
+	RelayOutbox(ctx context.Context, limit int, publish func(storage.OutboxMessage) error) (int, error)
+	DeletePublishedOutbox(ctx context.Context, before time.Time) (int64, error)
+}
+
+// OutboxRelay 把 outbox 中的事件發布到傳輸層
+// 發布後、標記為已發布前崩潰的話事件會再發布一次 (至少一次)，
+// 訂閱端以標頭中的去重 ID (types.HeaderMsgID) 略過重複的事件
+type OutboxRelay struct {
+	store     OutboxStore
+	transport types.Transport
+
+	// Interval 沒有待發布事件時的輪詢間隔
+	Interval time.Duration
+	// BatchSize 每個交易最多發布的事件數量
+	BatchSize int
+	// Retention 已發布的事件保留多久後刪除
+	Retention time.Duration
+}
+
+// NewOutboxRelay 創建 relay，預設每 100ms 輪詢、每批 100 筆、已發布的事件保留 1 小時
+func NewOutboxRelay(store OutboxStore, transport types.Transport) *OutboxRelay {
+	return &OutboxRelay{
+		store:     store,
+		transport: transport,
+		Interval:  100 * time.Millisecond,
+		BatchSize: 100,
+		Retention: time.Hour,
+	}
+}
+
+// Run 持續發布 outbox 中的事件直到 ctx 結束
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(r.Retention)
+	defer cleanup.Stop()
+
+	for {
+		if _, err := r.Flush(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Outbox relay error: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cleanup.C:
+			deleted, err := r.store.DeletePublishedOutbox(ctx, time.Now().Add(-r.Retention))
+			if err != nil {
+				log.Printf("Failed to clean up published outbox rows: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Cleaned up %d published outbox rows", deleted)
+			}
+		}
+	}
+}
+
+// Flush 發布目前所有待發布的事件，返回發布的數量
+func (r *OutboxRelay) Flush(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, err := r.store.RelayOutbox(ctx, r.BatchSize, r.publish)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < r.BatchSize {
+			return total, nil
+		}
+	}
+}
+
+// publish 發布一筆 outbox 資料，寫入 outbox 時的 trace context 作為 producer span 的父 span
+func (r *OutboxRelay) publish(out storage.OutboxMessage) (err error) {
+	msg := types.NewMessage(out.Subject, out.Data)
+	for key, values := range out.Header {
+		msg.Header[key] = values
+	}
+	if msg.Header.Get(types.HeaderMsgID) == "" {
+		msg.Header.Set(types.HeaderMsgID, out.EventID)
+	}
+
+	_, span := tracing.StartPublish(tracing.Extract(context.Background(), msg.Header), msg, "")
+	defer func() { tracing.End(span, err) }()
+	return r.transport.Publish(msg)
+}
@@ -0,0 +1,110 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// memoryOutbox 模擬 outbox 資料表
+type memoryOutbox struct {
+	mu        sync.Mutex
+	rows      []storage.OutboxMessage
+	published map[int64]bool
+}
+
+func (o *memoryOutbox) add(out storage.OutboxMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out.ID = int64(len(o.rows) + 1)
+	o.rows = append(o.rows, out)
+}
+
+func (o *memoryOutbox) RelayOutbox(ctx context.Context, limit int, publish func(storage.OutboxMessage) error) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, out := range o.rows {
+		if n == limit {
+			break
+		}
+		if o.published[out.ID] {
+			continue
+		}
+		if err := publish(out); err != nil {
+			return n, err
+		}
+		o.published[out.ID] = true
+		n++
+	}
+	return n, nil
+}
+
+func (o *memoryOutbox) DeletePublishedOutbox(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// failingTransport 在 failures 次之前的發布都失敗
+type failingTransport struct {
+	types.Transport
+	failures int
+}
+
+func (t *failingTransport) Publish(msg *types.Message) error {
+	if t.failures > 0 {
+		t.failures--
+		return errors.New("nats unavailable")
+	}
+	return t.Transport.Publish(msg)
+}
+
+func TestOutboxRelayPublishesWithDedupID(t *testing.T) {
+	transport := memory.NewTransport()
+	defer transport.Close()
+
+	bus := NewEventBus(transport, nats.NewTopicFormatter(""))
+	outbox := &memoryOutbox{published: make(map[int64]bool)}
+
+	received := make(chan *types.Message, 10)
+	transport.Subscribe("settlechat.>", func(msg *types.Message) { received <- msg })
+
+	event := types.NewEnvelope(types.EventTypeUserJoined, "room-1", "user-1", types.UserJoinedMessage{RoomID: "room-1", UserID: "user-1"})
+	out, err := bus.OutboxMessage(context.Background(), event)
+	if err != nil {
+		t.Fatalf("OutboxMessage failed: %v", err)
+	}
+	outbox.add(out)
+
+	relay := NewOutboxRelay(outbox, &failingTransport{Transport: transport, failures: 1})
+
+	// 第一次發布失敗，事件留在 outbox
+	if n, err := relay.Flush(context.Background()); err == nil || n != 0 {
+		t.Fatalf("got n=%d err=%v, want publish error", n, err)
+	}
+	if n, err := relay.Flush(context.Background()); err != nil || n != 1 {
+		t.Fatalf("got n=%d err=%v, want 1 published", n, err)
+	}
+
+	select {
+	case msg := <-received:
+		if got := msg.Header.Get(types.HeaderMsgID); got != event.ID {
+			t.Errorf("got dedup id %q want %q", got, event.ID)
+		}
+		if msg.Subject != out.Subject {
+			t.Errorf("got subject %q want %q", msg.Subject, out.Subject)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not published")
+	}
+
+	if n, _ := relay.Flush(context.Background()); n != 0 {
+		t.Errorf("published events should not be relayed again, got %d", n)
+	}
+}
@@ -0,0 +1,97 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/tracing"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// Request 以 request-reply 發送查詢事件並等待其中一個響應者回覆
+// 傳輸層為每個請求建立一次性的 inbox 主題，不需要預先訂閱響應主題。
+// ctx 取消時立即返回；ctx 沒有期限時最多等待 requestTimeout。
+// 響應者回覆 QueryError 時返回 *types.QueryError，沒有響應者時返回包裝 types.ErrNoResponders 的錯誤
+func (eb *EventBus) Request(ctx context.Context, event types.Envelope) (_ *types.Envelope, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, eb.requestTimeout)
+		defer cancel()
+	}
+
+	msg, err := eb.Encode(event)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := tracing.StartRequest(ctx, msg, event.Type)
+	defer func() { tracing.End(span, err) }()
+
+	reply, err := eb.transport.Request(ctx, msg)
+	if err != nil {
+		return nil, fmt.Errorf("%s request to %s: %w", event.Type, msg.Subject, err)
+	}
+
+	c := codec.ForContentType(reply.Header.Get(codec.HeaderContentType))
+	response, err := types.Events.Decode(c, reply.Data, "")
+	if err != nil {
+		return nil, fmt.Errorf("decode %s response: %w", event.Type, err)
+	}
+	if queryErr, ok := response.Payload.(*types.QueryError); ok {
+		return nil, queryErr
+	}
+	return response, nil
+}
+
+// request 發送查詢並把響應解碼成 T
+func request[T any](ctx context.Context, eb *EventBus, event types.Envelope) (*T, error) {
+	response, err := eb.Request(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := response.Payload.(*T)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %s response to %s", response.Type, event.Type)
+	}
+	return payload, nil
+}
+
+// RequestHistory 查詢房間最近的 limit 條消息，按時間從舊到新排列
+func (eb *EventBus) RequestHistory(ctx context.Context, roomID, userID string, limit int) ([]storage.ChatMessage, error) {
+	payload := types.HistoryRequest{RoomID: roomID, UserID: userID, Limit: limit}
+	response, err := request[types.HistoryResponse](ctx, eb, types.NewEnvelope(types.EventTypeHistoryRequest, roomID, userID, payload))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received %d history messages for user %s in room %s", len(response.Messages), userID, roomID)
+	return response.Messages, nil
+}
+
+// RequestHistoryBefore 查詢房間在游標之前的 limit 條消息，用於向上捲動，按時間從舊到新排列
+func (eb *EventBus) RequestHistoryBefore(ctx context.Context, roomID, userID string, before storage.MessageCursor, limit int) ([]storage.ChatMessage, error) {
+	payload := types.HistoryRequest{RoomID: roomID, UserID: userID, Limit: limit, Before: &before.Timestamp, BeforeID: before.ID}
+	response, err := request[types.HistoryResponse](ctx, eb, types.NewEnvelope(types.EventTypeHistoryRequest, roomID, userID, payload))
+	if err != nil {
+		return nil, err
+	}
+	return response.Messages, nil
+}
+
+// RequestRoomMembers 查詢房間成員與各自的在線狀態
+func (eb *EventBus) RequestRoomMembers(ctx context.Context, roomID string) ([]storage.RoomMember, error) {
+	payload := types.RoomMembersRequest{RoomID: roomID}
+	response, err := request[types.RoomMembersResponse](ctx, eb, types.NewEnvelope(types.EventTypeRoomMembersRequest, roomID, "", payload))
+	if err != nil {
+		return nil, err
+	}
+	return response.Members, nil
+}
+
+// RequestRoomState 查詢房間資訊、成員數與最後一條消息的時間
+func (eb *EventBus) RequestRoomState(ctx context.Context, roomID string) (*types.RoomState, error) {
+	payload := types.RoomStateRequest{RoomID: roomID}
+	return request[types.RoomState](ctx, eb, types.NewEnvelope(types.EventTypeRoomStateRequest, roomID, "", payload))
+}
@@ -0,0 +1,104 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+// RetentionStore 刪除過期與超出保留規則的消息，由 storage.Store 實現
+type RetentionStore interface {
+	PurgeMessages(ctx context.Context, now time.Time) ([]storage.PurgeResult, error)
+}
+
+// HistoryInvalidator 清除房間的歷史消息快取，由 cache.History 實現
+type HistoryInvalidator interface {
+	InvalidateHistory(ctx context.Context, roomID string) error
+}
+
+// 刪除消息後廣播給房間的系統消息
+const (
+	retentionRemovedNotice = "Older messages were removed by this room's retention policy."
+	retentionExpiredNotice = "Expired messages were removed."
+)
+
+// RetentionSweeper 定期刪除過期與超出房間保留規則的消息，清除房間的歷史快取，
+// 並以系統消息 (帶有 RemovedBefore / ExpiredBefore) 廣播給房間，讓客戶端移除畫面上的消息
+// 多個實例可以同時執行，每條被刪除的消息只會由一個實例通知
+type RetentionSweeper struct {
+	store   RetentionStore
+	history HistoryInvalidator
+	bus     *EventBus
+
+	// Interval 兩次清理的間隔，也是閱後即焚消息在資料庫中最長多留的時間
+	Interval time.Duration
+}
+
+// NewRetentionSweeper 創建清理工作，預設每分鐘執行一次
+func NewRetentionSweeper(store RetentionStore, history HistoryInvalidator, bus *EventBus) *RetentionSweeper {
+	return &RetentionSweeper{
+		store:    store,
+		history:  history,
+		bus:      bus,
+		Interval: time.Minute,
+	}
+}
+
+// Run 持續清理直到 ctx 結束
+func (s *RetentionSweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Sweep(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("Retention sweeper error: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep 刪除在 now 時應該刪除的消息並通知每個有消息被刪除的房間，返回清理的結果
+// 消息已經刪除後，清除快取或通知失敗只記錄日誌
+func (s *RetentionSweeper) Sweep(ctx context.Context, now time.Time) ([]storage.PurgeResult, error) {
+	results, err := s.store.PurgeMessages(ctx, now)
+	if err != nil {
+		return nil, fmt.Errorf("purge messages: %w", err)
+	}
+
+	for _, result := range results {
+		log.Printf("Purged %d messages of room %s", result.Deleted, result.RoomID)
+		if err := s.history.InvalidateHistory(ctx, result.RoomID); err != nil {
+			log.Printf("Failed to invalidate history cache of room %s: %v", result.RoomID, err)
+		}
+		if err := s.bus.PublishEventContext(ctx, s.notice(result, now)); err != nil {
+			log.Printf("Failed to notify room %s of purged messages: %v", result.RoomID, err)
+		}
+	}
+	return results, nil
+}
+
+// notice 返回通知房間移除消息的廣播事件
+func (s *RetentionSweeper) notice(result storage.PurgeResult, now time.Time) types.Envelope {
+	msg := storage.ChatMessage{
+		RoomID:        result.RoomID,
+		SenderID:      "system",
+		Sender:        "System",
+		Content:       retentionExpiredNotice,
+		Timestamp:     now,
+		RemovedBefore: result.RemovedBefore,
+		ExpiredBefore: result.ExpiredBefore,
+	}
+	if result.RemovedBefore != nil {
+		msg.Content = retentionRemovedNotice
+	}
+	return types.NewEnvelope(types.EventTypeBroadcastMsg, result.RoomID, "system", msg)
+}
@@ -0,0 +1,71 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/cache"
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/messaging/memory"
+	"github.com/ianwu0915/SettleChat/internal/messaging/nats"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	memstore "github.com/ianwu0915/SettleChat/internal/storage/memory"
+	"github.com/ianwu0915/SettleChat/internal/types"
+)
+
+func TestRetentionSweeperNotifiesRoom(t *testing.T) {
+	ctx := context.Background()
+	transport := memory.NewTransport()
+	defer transport.Close()
+	topics := nats.NewTopicFormatter("")
+	bus := NewEventBus(transport, topics)
+
+	store := memstore.NewStore()
+	roomID, _ := store.CreateRoom(ctx, "general", "user-1")
+	if _, err := store.SetRetentionPolicy(ctx, storage.RetentionPolicy{RoomID: roomID, Mode: storage.RetentionKeepLast, KeepLast: 1}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for i, content := range []string{"old", "new"} {
+		store.SaveMessage(ctx, storage.ChatMessage{RoomID: roomID, SenderID: "user-1", Content: content, Timestamp: now.Add(time.Duration(i-2) * time.Minute)})
+	}
+
+	// 清理之前快取了兩條消息
+	history := cache.NewMemory(cache.Options{})
+	cached, _ := history.RecentMessages(ctx, roomID, 10, store.GetRecentMessages)
+	if len(cached) != 2 {
+		t.Fatalf("cached %d messages, want 2", len(cached))
+	}
+
+	received := make(chan *types.Message, 10)
+	transport.Subscribe(topics.GetBroadcastTopic(roomID), func(msg *types.Message) { received <- msg })
+
+	results, err := NewRetentionSweeper(store, history, bus).Sweep(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Deleted != 1 {
+		t.Fatalf("Sweep = %+v, want 1 message of %s", results, roomID)
+	}
+
+	select {
+	case msg := <-received:
+		event, err := types.Events.Decode(codec.ForContentType(msg.Header.Get(codec.HeaderContentType)), msg.Data, types.EventTypeBroadcastMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notice := event.Payload.(*storage.ChatMessage)
+		if notice.SenderID != "system" || notice.RemovedBefore == nil || !notice.RemovedBefore.Equal(now.Add(-time.Minute)) {
+			t.Fatalf("notice = %+v, want messages before the kept one removed", notice)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("removal notice not published")
+	}
+
+	// 快取被清除，下一次讀取只有保留的消息
+	cached, _ = history.RecentMessages(ctx, roomID, 10, store.GetRecentMessages)
+	if len(cached) != 1 || cached[0].Content != "new" {
+		t.Fatalf("cached messages after sweep = %+v", cached)
+	}
+}
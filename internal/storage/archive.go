@@ -0,0 +1,547 @@
+package storage
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 冷分區封存後的檔案結構：每個月份一個目錄，每個房間一個 gzip 壓縮的 JSON Lines 檔案
+//
+//	<ArchiveDir>/messages-2025-01/<base64url(room_id)>.jsonl.gz
+//
+// 檔案中的消息依時間由舊到新排序；房間 ID 以 base64url 編碼，任何字元都可以作為檔名
+const (
+	archiveDirLayout = "2006-01"
+	archiveFileExt   = ".jsonl.gz"
+)
+
+// MessageArchive 是一個已經封存到本地檔案、並從資料庫刪除的月份
+type MessageArchive struct {
+	Month      time.Time `json:"month"`
+	Path       string    `json:"path"` // 月份目錄，相對路徑以 PostgresStore.ArchiveDir 為基準
+	Messages   int64     `json:"messages"`
+	Rooms      int       `json:"rooms"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// archiveRecord 是封存檔案中的一行，與 ChatMessage 分開定義，ChatMessage 的 JSON 之後改變也能讀取已經封存的檔案
+type archiveRecord struct {
+	ID        int64      `json:"id"`
+	RoomID    string     `json:"room_id"`
+	SenderID  string     `json:"sender_id"`
+	Sender    string     `json:"sender"`
+	Content   string     `json:"content"`
+	Timestamp time.Time  `json:"timestamp"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func archiveRecordOf(msg ChatMessage) archiveRecord {
+	return archiveRecord{
+		ID:        msg.ID,
+		RoomID:    msg.RoomID,
+		SenderID:  msg.SenderID,
+		Sender:    msg.Sender,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp.UTC(),
+		ExpiresAt: msg.ExpiresAt,
+	}
+}
+
+func (r archiveRecord) message() ChatMessage {
+	return ChatMessage{
+		ID:        r.ID,
+		RoomID:    r.RoomID,
+		SenderID:  r.SenderID,
+		Sender:    r.Sender,
+		Content:   r.Content,
+		Timestamp: r.Timestamp,
+		ExpiresAt: r.ExpiresAt,
+	}
+}
+
+func archiveMonthDir(month time.Time) string {
+	return "messages-" + monthStart(month).Format(archiveDirLayout)
+}
+
+func archiveRoomFile(roomID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(roomID)) + archiveFileExt
+}
+
+// archiveWriter 把依房間排序的消息寫入暫存目錄，全部寫完並 fsync 後才改名為月份目錄，
+// 中途失敗不會留下不完整的封存
+type archiveWriter struct {
+	tmp, final string
+
+	room     string
+	file     *os.File
+	gz       *gzip.Writer
+	buf      *bufio.Writer
+	enc      *json.Encoder
+	rooms    int
+	messages int64
+}
+
+func newArchiveWriter(baseDir string, month time.Time) (*archiveWriter, error) {
+	if err := os.MkdirAll(baseDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create archive dir: %w", err)
+	}
+	name := archiveMonthDir(month)
+	tmp, err := os.MkdirTemp(baseDir, "."+name+"-*")
+	if err != nil {
+		return nil, fmt.Errorf("create archive dir: %w", err)
+	}
+	return &archiveWriter{tmp: tmp, final: filepath.Join(baseDir, name)}, nil
+}
+
+// Write 寫入一條消息，同一個房間的消息必須連續寫入
+func (w *archiveWriter) Write(msg ChatMessage) error {
+	if w.file == nil || msg.RoomID != w.room {
+		if err := w.closeRoom(); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filepath.Join(w.tmp, archiveRoomFile(msg.RoomID)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("create archive file: %w", err)
+		}
+		w.room, w.file = msg.RoomID, file
+		w.buf = bufio.NewWriter(file)
+		w.gz = gzip.NewWriter(w.buf)
+		w.enc = json.NewEncoder(w.gz)
+		w.rooms++
+	}
+	w.messages++
+	return w.enc.Encode(archiveRecordOf(msg))
+}
+
+func (w *archiveWriter) closeRoom() error {
+	if w.file == nil {
+		return nil
+	}
+	file := w.file
+	w.file = nil
+	defer file.Close()
+
+	if err := w.gz.Close(); err != nil {
+		return fmt.Errorf("write archive file: %w", err)
+	}
+	if err := w.buf.Flush(); err != nil {
+		return fmt.Errorf("write archive file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("sync archive file: %w", err)
+	}
+	return file.Close()
+}
+
+// Commit 把暫存目錄改名為月份目錄；上一次失敗的封存 (資料庫沒有記錄) 留下的同名目錄會被取代
+func (w *archiveWriter) Commit() error {
+	if err := w.closeRoom(); err != nil {
+		return err
+	}
+	if err := syncDir(w.tmp); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(w.final); err != nil {
+		return fmt.Errorf("remove stale archive: %w", err)
+	}
+	if err := os.Rename(w.tmp, w.final); err != nil {
+		return fmt.Errorf("rename archive: %w", err)
+	}
+	return syncDir(filepath.Dir(w.final))
+}
+
+// Abort 刪除暫存目錄
+func (w *archiveWriter) Abort() {
+	if w.file != nil {
+		w.file.Close()
+	}
+	os.RemoveAll(w.tmp)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %w", dir, err)
+	}
+	return nil
+}
+
+// readArchiveFile 讀取一個房間在一個月份的封存消息，只保留 keep 返回 true 的消息
+// 房間在這個月份沒有消息時沒有檔案，返回空的結果
+func readArchiveFile(monthDir, roomID string, keep func(ChatMessage) bool) ([]ChatMessage, error) {
+	file, err := os.Open(filepath.Join(monthDir, archiveRoomFile(roomID)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("read archive %s: %w", file.Name(), err)
+	}
+	defer gz.Close()
+
+	var messages []ChatMessage
+	dec := json.NewDecoder(gz)
+	for {
+		var record archiveRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read archive %s: %w", file.Name(), err)
+		}
+		if msg := record.message(); keep(msg) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+// rewriteArchiveFile 只保留一個房間封存檔案中 keep 返回 true 的消息，返回刪除的消息數量
+// 寫入暫存檔並 fsync 後才取代原來的檔案；沒有保留任何消息時刪除檔案，removedFile 為 true
+func rewriteArchiveFile(monthDir, roomID string, keep func(ChatMessage) bool) (deleted int64, removedFile bool, err error) {
+	messages, err := readArchiveFile(monthDir, roomID, func(ChatMessage) bool { return true })
+	if err != nil || len(messages) == 0 {
+		return 0, false, err
+	}
+	kept := slices.DeleteFunc(slices.Clone(messages), func(msg ChatMessage) bool { return !keep(msg) })
+	if len(kept) == len(messages) {
+		return 0, false, nil
+	}
+	deleted = int64(len(messages) - len(kept))
+
+	path := filepath.Join(monthDir, archiveRoomFile(roomID))
+	if len(kept) == 0 {
+		if err := os.Remove(path); err != nil {
+			return 0, false, fmt.Errorf("remove archive file: %w", err)
+		}
+		return deleted, true, syncDir(monthDir)
+	}
+
+	file, err := os.CreateTemp(monthDir, "."+archiveRoomFile(roomID)+"-*")
+	if err != nil {
+		return 0, false, fmt.Errorf("create archive file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	buf := bufio.NewWriter(file)
+	gz := gzip.NewWriter(buf)
+	enc := json.NewEncoder(gz)
+	for _, msg := range kept {
+		if err := enc.Encode(archiveRecordOf(msg)); err != nil {
+			return 0, false, fmt.Errorf("write archive file: %w", err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return 0, false, fmt.Errorf("write archive file: %w", err)
+	}
+	if err := buf.Flush(); err != nil {
+		return 0, false, fmt.Errorf("write archive file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return 0, false, fmt.Errorf("sync archive file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return 0, false, fmt.Errorf("write archive file: %w", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return 0, false, fmt.Errorf("rename archive file: %w", err)
+	}
+	return deleted, false, syncDir(monthDir)
+}
+
+// archiveIndexTTL 是已封存月份清單的快取時間；其他實例封存的月份最晚在這段時間之後才會被讀取
+const archiveIndexTTL = time.Minute
+
+// archiveCache 快取 MessageArchives 的結果，房間的消息不足一頁時 (新房間很常見) 不必每次都查詢 message_archives
+// 封存每個月才發生一次，本實例封存時立即失效
+type archiveCache struct {
+	mu       sync.Mutex
+	archives []MessageArchive
+	loadedAt time.Time
+}
+
+func (c *archiveCache) get(ctx context.Context, p *PostgresStore) ([]MessageArchive, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.loadedAt.IsZero() && time.Since(c.loadedAt) < archiveIndexTTL {
+		return c.archives, nil
+	}
+	archives, err := p.MessageArchives(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.archives, c.loadedAt = archives, time.Now()
+	return archives, nil
+}
+
+func (c *archiveCache) invalidate() {
+	c.mu.Lock()
+	c.loadedAt = time.Time{}
+	c.mu.Unlock()
+}
+
+// MessageArchives 返回已經封存的月份，由舊到新排序
+func (p *PostgresStore) MessageArchives(ctx context.Context) ([]MessageArchive, error) {
+	rows, err := p.DB.Query(ctx, `
+		SELECT month, path, messages, rooms, archived_at
+		FROM message_archives
+		ORDER BY month ASC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list message archives: %w", err)
+	}
+	archives, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (MessageArchive, error) {
+		var a MessageArchive
+		err := row.Scan(&a.Month, &a.Path, &a.Messages, &a.Rooms, &a.ArchivedAt)
+		a.Month = a.Month.UTC()
+		return a, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list message archives: %w", err)
+	}
+	return archives, nil
+}
+
+// ArchivedMonths 返回已經封存的月份 (UTC 的月初)
+func (p *PostgresStore) ArchivedMonths(ctx context.Context) ([]time.Time, error) {
+	archives, err := p.MessageArchives(ctx)
+	if err != nil {
+		return nil, err
+	}
+	months := make([]time.Time, len(archives))
+	for i, a := range archives {
+		months[i] = a.Month
+	}
+	return months, nil
+}
+
+// ArchivePartition 把一個月份分區的消息匯出到 ArchiveDir，確認筆數後從資料庫移除分區
+// 匯出期間仍然寫入這個分區的消息 (例如時間偏差很大的客戶端) 會讓筆數不符，這次封存放棄，下次重試
+func (p *PostgresStore) ArchivePartition(ctx context.Context, partition MessagePartition) (*MessageArchive, error) {
+	w, err := newArchiveWriter(p.ArchiveDir, partition.Month)
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			w.Abort()
+		}
+	}()
+
+	table := pgx.Identifier{partition.Name}.Sanitize()
+	rows, err := p.DB.Query(ctx, fmt.Sprintf(`
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at
+		FROM %s
+		ORDER BY room_id, timestamp, id
+	`, table))
+	if err != nil {
+		return nil, fmt.Errorf("export partition %s: %w", partition.Name, err)
+	}
+	for rows.Next() {
+		var msg ChatMessage
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Sender, &msg.Content, &msg.Timestamp, &msg.ExpiresAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("export partition %s: %w", partition.Name, err)
+		}
+		if err := w.Write(msg); err != nil {
+			rows.Close()
+			return nil, err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("export partition %s: %w", partition.Name, err)
+	}
+	if err := w.Commit(); err != nil {
+		return nil, err
+	}
+	committed = true
+
+	archive := &MessageArchive{
+		Month:    partition.Month,
+		Path:     archiveMonthDir(partition.Month),
+		Messages: w.messages,
+		Rooms:    w.rooms,
+	}
+
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// 先 DETACH：之後不會再有消息寫入這個分區，筆數在交易內確認；
+	// 鎖住 messages 直到交易結束，期間寫入消息會等待
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE messages DETACH PARTITION %s`, table)); err != nil {
+		return nil, fmt.Errorf("detach partition %s: %w", partition.Name, err)
+	}
+	var count int64
+	if err := tx.QueryRow(ctx, fmt.Sprintf(`SELECT count(*) FROM %s`, table)).Scan(&count); err != nil {
+		return nil, fmt.Errorf("count partition %s: %w", partition.Name, err)
+	}
+	if count != archive.Messages {
+		return nil, fmt.Errorf("partition %s has %d messages, exported %d; it changed during the export", partition.Name, count, archive.Messages)
+	}
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO message_archives (month, path, messages, rooms)
+		VALUES ($1, $2, $3, $4)
+		RETURNING archived_at
+	`, archive.Month, archive.Path, archive.Messages, archive.Rooms).Scan(&archive.ArchivedAt); err != nil {
+		return nil, fmt.Errorf("record archive: %w", err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`DROP TABLE %s`, table)); err != nil {
+		return nil, fmt.Errorf("drop partition %s: %w", partition.Name, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	p.archiveIndex.invalidate()
+	return archive, nil
+}
+
+// archivePath 返回封存月份目錄的實際路徑
+func (p *PostgresStore) archivePath(a MessageArchive) string {
+	if filepath.IsAbs(a.Path) {
+		return a.Path
+	}
+	return filepath.Join(p.ArchiveDir, a.Path)
+}
+
+// readArchives 依序讀取 archives 中一個房間的消息；封存檔案無法讀取時記錄後略過，
+// 資料庫中的消息仍然返回，不因為封存檔案的問題讓整個查詢失敗
+func (p *PostgresStore) readArchives(archives []MessageArchive, roomID string, keep func(ChatMessage) bool, enough func(n int) bool) []ChatMessage {
+	var messages []ChatMessage
+	for _, a := range archives {
+		found, err := readArchiveFile(p.archivePath(a), roomID, keep)
+		if err != nil {
+			log.Printf("Failed to read archived messages of room %s for %s: %v", roomID, a.Month.Format(archiveDirLayout), err)
+			continue
+		}
+		messages = append(messages, found...)
+		if enough(len(messages)) {
+			break
+		}
+	}
+	return messages
+}
+
+// readThroughBefore 資料庫中游標之前的消息不足 limit 條時，從封存檔案由新到舊補足
+// before 為 nil 代表從最新的消息開始；結果由舊到新排序
+func (p *PostgresStore) readThroughBefore(ctx context.Context, roomID string, before *MessageCursor, limit int, messages []ChatMessage) ([]ChatMessage, error) {
+	if len(messages) >= limit {
+		return messages, nil
+	}
+	archives, err := p.archiveIndex.get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(archives) == 0 {
+		return messages, nil
+	}
+	// 資料庫已經返回的消息之前的月份，由新到舊
+	bound := before
+	if len(messages) > 0 {
+		oldest := CursorOf(messages[0])
+		bound = &oldest
+	}
+	var candidates []MessageArchive
+	for _, a := range slices.Backward(archives) {
+		if bound == nil || !a.Month.After(bound.Timestamp) {
+			candidates = append(candidates, a)
+		}
+	}
+	if len(candidates) == 0 {
+		return messages, nil
+	}
+
+	need := limit - len(messages)
+	now := time.Now()
+	cutoff, err := p.archiveRetentionCutoff(ctx, roomID, now)
+	if err != nil {
+		return nil, err
+	}
+	candidates = slices.DeleteFunc(candidates, func(a MessageArchive) bool {
+		return cutoff != nil && !a.Month.AddDate(0, 1, 0).After(*cutoff)
+	})
+	archived := p.readArchives(candidates, roomID, func(msg ChatMessage) bool {
+		return msg.SenderID != "system" && !msg.Expired(now) && (bound == nil || bound.Includes(msg)) &&
+			(cutoff == nil || !msg.Timestamp.Before(*cutoff))
+	}, func(n int) bool { return n >= need })
+
+	messages = append(archived, messages...)
+	sortByTime(messages)
+	if len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return messages, nil
+}
+
+// readThroughRange 加入 [startTime, endTime] 中已經封存的消息，結果由舊到新排序
+func (p *PostgresStore) readThroughRange(ctx context.Context, roomID string, startTime, endTime time.Time, messages []ChatMessage) ([]ChatMessage, error) {
+	archives, err := p.archiveIndex.get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []MessageArchive
+	for _, a := range archives {
+		if a.Month.AddDate(0, 1, 0).After(startTime) && !a.Month.After(endTime) {
+			candidates = append(candidates, a)
+		}
+	}
+	if len(candidates) == 0 {
+		return messages, nil
+	}
+
+	now := time.Now()
+	cutoff, err := p.archiveRetentionCutoff(ctx, roomID, now)
+	if err != nil {
+		return nil, err
+	}
+	candidates = slices.DeleteFunc(candidates, func(a MessageArchive) bool {
+		return cutoff != nil && !a.Month.AddDate(0, 1, 0).After(*cutoff)
+	})
+	archived := p.readArchives(candidates, roomID, func(msg ChatMessage) bool {
+		return !msg.Expired(now) && !msg.Timestamp.Before(startTime) && !msg.Timestamp.After(endTime) &&
+			(cutoff == nil || !msg.Timestamp.Before(*cutoff))
+	}, func(int) bool { return false })
+	messages = append(archived, messages...)
+	sortByTime(messages)
+	return messages, nil
+}
+
+// sortByTime 依時間由舊到新排序，時間相同時依 ID
+func sortByTime(messages []ChatMessage) {
+	slices.SortStableFunc(messages, func(a, b ChatMessage) int {
+		if c := a.Timestamp.Compare(b.Timestamp); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	month := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	messages := []ChatMessage{
+		{ID: 1, RoomID: "room/a", SenderID: "u1", Sender: "alice", Content: "hi", Timestamp: month.Add(time.Hour)},
+		{ID: 3, RoomID: "room/a", SenderID: "system", Sender: "system", Content: "joined", Timestamp: month.Add(2 * time.Hour)},
+		{ID: 2, RoomID: "room-b", SenderID: "u2", Sender: "bob", Content: "hello", Timestamp: month.Add(time.Hour)},
+	}
+
+	w, err := newArchiveWriter(dir, month)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range messages {
+		if err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if w.rooms != 2 || w.messages != 3 {
+		t.Fatalf("archived %d messages of %d rooms", w.messages, w.rooms)
+	}
+
+	// 只留下月份目錄，暫存目錄已經改名
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "messages-2025-01" {
+		t.Fatalf("archive dir has %v", entries)
+	}
+
+	monthDir := filepath.Join(dir, "messages-2025-01")
+	got, err := readArchiveFile(monthDir, "room/a", func(msg ChatMessage) bool { return msg.SenderID != "system" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != messages[0] {
+		t.Fatalf("room/a = %+v, want %+v", got, messages[:1])
+	}
+
+	// 這個月份沒有消息的房間沒有檔案
+	if got, err := readArchiveFile(monthDir, "room-c", func(ChatMessage) bool { return true }); err != nil || got != nil {
+		t.Fatalf("room-c = %+v, %v", got, err)
+	}
+}
+
+func TestRewriteArchiveFile(t *testing.T) {
+	dir := t.TempDir()
+	month := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	w, err := newArchiveWriter(dir, month)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, content := range []string{"m0", "m1", "m2"} {
+		msg := ChatMessage{ID: int64(i + 1), RoomID: "room-a", SenderID: "u1", Content: content, Timestamp: month.Add(time.Duration(i) * time.Hour)}
+		if err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	monthDir := filepath.Join(dir, "messages-2025-01")
+	after := func(cutoff time.Time) func(ChatMessage) bool {
+		return func(msg ChatMessage) bool { return !msg.Timestamp.Before(cutoff) }
+	}
+
+	deleted, removed, err := rewriteArchiveFile(monthDir, "room-a", after(month.Add(time.Hour)))
+	if err != nil || deleted != 1 || removed {
+		t.Fatalf("rewrite = %d, %v, %v, want 1 deleted", deleted, removed, err)
+	}
+	got, err := readArchiveFile(monthDir, "room-a", func(ChatMessage) bool { return true })
+	if err != nil || len(got) != 2 || got[0].Content != "m1" || got[1].Content != "m2" || got[0].ID != 2 {
+		t.Fatalf("room-a after rewrite = %+v, %v", got, err)
+	}
+
+	// 沒有需要刪除的消息時不改寫
+	if deleted, _, err := rewriteArchiveFile(monthDir, "room-a", after(month)); err != nil || deleted != 0 {
+		t.Fatalf("rewrite without changes = %d, %v", deleted, err)
+	}
+
+	// 全部刪除時移除檔案，不留下暫存檔
+	deleted, removed, err = rewriteArchiveFile(monthDir, "room-a", after(month.AddDate(0, 1, 0)))
+	if err != nil || deleted != 2 || !removed {
+		t.Fatalf("rewrite = %d, %v, %v, want file removed", deleted, removed, err)
+	}
+	if entries, _ := os.ReadDir(monthDir); len(entries) != 0 {
+		t.Fatalf("month dir has %v", entries)
+	}
+	if deleted, removed, err := rewriteArchiveFile(monthDir, "room-a", after(month)); err != nil || deleted != 0 || removed {
+		t.Fatalf("rewrite of missing file = %d, %v, %v", deleted, removed, err)
+	}
+}
+
+func TestPartitionName(t *testing.T) {
+	month := time.Date(2025, time.March, 17, 23, 0, 0, 0, time.FixedZone("UTC-5", -5*3600))
+	name := partitionName(month)
+	// UTC 已經是 3 月 18 日，仍然在 3 月
+	if name != "messages_p202503" {
+		t.Fatalf("partitionName = %q", name)
+	}
+	parsed, ok := parsePartitionName(name)
+	if !ok || !parsed.Equal(time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("parsePartitionName(%q) = %v, %v", name, parsed, ok)
+	}
+	for _, name := range []string{"messages_default", "messages_p2025", "messages_pabcdef", "messages"} {
+		if _, ok := parsePartitionName(name); ok {
+			t.Errorf("parsePartitionName(%q) accepted", name)
+		}
+	}
+}
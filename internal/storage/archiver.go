@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// archiveLockKey 是 pg_advisory_lock 的鍵，多個實例同時只有一個執行封存
+const archiveLockKey int64 = 0x5e771ec4a8
+
+// MessageArchiver 定期維護 messages 的月份分區：預先建立之後的分區，並把冷分區封存到 ArchiveDir
+type MessageArchiver struct {
+	store *PostgresStore
+
+	// After 月份結束多久之後封存，不大於 0 時不封存，只建立分區
+	After time.Duration
+	// Ahead 預先建立的未來月份數量，避免月初的消息寫入 messages_default
+	Ahead int
+	// Interval 兩次執行的間隔
+	Interval time.Duration
+}
+
+// NewMessageArchiver 創建封存工作，預設每小時執行、預先建立 2 個月的分區、月份結束 90 天後封存
+func NewMessageArchiver(store *PostgresStore) *MessageArchiver {
+	return &MessageArchiver{
+		store:    store,
+		After:    90 * 24 * time.Hour,
+		Ahead:    2,
+		Interval: time.Hour,
+	}
+}
+
+// Run 持續維護分區直到 ctx 結束
+func (a *MessageArchiver) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := a.RunOnce(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("Message archiver error: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce 建立缺少的分區並封存在 now 時已經超過 After 的月份，返回這次封存的月份
+// 另一個實例正在執行時直接返回
+func (a *MessageArchiver) RunOnce(ctx context.Context, now time.Time) ([]MessageArchive, error) {
+	conn, err := a.store.DB.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, archiveLockKey).Scan(&locked); err != nil {
+		return nil, fmt.Errorf("try archive lock: %w", err)
+	}
+	if !locked {
+		return nil, nil
+	}
+	defer func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.Exec(unlockCtx, `SELECT pg_advisory_unlock($1)`, archiveLockKey); err != nil {
+			log.Printf("Failed to release archive lock: %v", err)
+		}
+	}()
+
+	created, err := a.store.EnsureMessagePartitions(ctx, now, a.Ahead)
+	for _, partition := range created {
+		log.Printf("Created message partition %s", partition.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.After <= 0 {
+		return nil, nil
+	}
+
+	partitions, err := a.store.MessagePartitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var archived []MessageArchive
+	for _, partition := range partitions {
+		if partition.End().After(now.Add(-a.After)) {
+			break
+		}
+		archive, err := a.store.ArchivePartition(ctx, partition)
+		if err != nil {
+			return archived, fmt.Errorf("archive %s: %w", partition.Name, err)
+		}
+		log.Printf("Archived %d messages of %d rooms from %s to %s", archive.Messages, archive.Rooms, partition.Name, a.store.archivePath(*archive))
+		archived = append(archived, *archive)
+	}
+	return archived, nil
+}
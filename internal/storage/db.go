@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"time"
 
@@ -10,84 +11,122 @@ import (
 
 type PostgresStore struct {
 	DB *pgxpool.Pool
+	// ArchiveDir 是封存冷分區的本地目錄 (見 ArchivePartition)，歷史查詢捲動到已經封存的月份時從這裡讀取；
+	// 多個實例必須共用同一個目錄
+	ArchiveDir string
+
+	// searchConfig 是 messages.search_vector 與搜尋查詢使用的 text search 設定
+	searchConfig string
+	archiveIndex archiveCache
+}
+
+// PostgresOption 設置 PostgresStore
+type PostgresOption func(*PostgresStore)
+
+// WithSearchConfig 設置全文搜尋的 text search 設定 (例如 simple、german)，預設為 DefaultSearchConfig
+// migration 0010 以這個設定重建 search_vector 欄位；之後再改變設定需要重建欄位，否則 Migrate 返回錯誤
+func WithSearchConfig(config string) PostgresOption {
+	return func(p *PostgresStore) {
+		p.searchConfig = config
+	}
+}
+
+// NewPostgresStore 連線到資料庫並套用還沒套用的 migration
+func NewPostgresStore(dsn string, opts ...PostgresOption) (*PostgresStore, error) {
+	store, err := OpenPostgresStore(dsn, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// 同時啟動的實例會等待持有 migration lock 的實例完成
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if err := store.Migrate(ctx); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
 }
 
-func NewPostgresStore(dsn string) (*PostgresStore, error) {
+// OpenPostgresStore 連線到資料庫但不執行 migration，供 settlectl migrate 使用
+func OpenPostgresStore(dsn string, opts ...PostgresOption) (*PostgresStore, error) {
+	store := &PostgresStore{searchConfig: DefaultSearchConfig}
+	for _, opt := range opts {
+		opt(store)
+	}
+	if !ValidSearchConfig(store.searchConfig) {
+		return nil, fmt.Errorf("invalid text search config %q", store.searchConfig)
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	db, err := pgxpool.New(ctx, dsn)
+	config, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
-		log.Println("Failed initializing connection pool")
+		log.Println("Failed parsing database URL")
 		return nil, err
 	}
+	// 每個查詢都以 span 記錄，handler 的 trace 可以看到 SQL 花費的時間
+	config.ConnConfig.Tracer = newQueryTracer()
 
-	store := &PostgresStore{DB: db}
-	if err := store.migrate(ctx); err != nil {
+	db, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		log.Println("Failed initializing connection pool")
 		return nil, err
 	}
+	if err := db.Ping(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping database: %w", err)
+	}
+
 	log.Println("Connected to PostgresSQL")
+	store.DB = db
 	return store, nil
 }
 
-// Create index based on room_id and timestamp for fetching history message based on room and timestamp
-// So that such query will be much faster:
-// SELECT * FROM messages
-// WHERE room_id = 'food'
-// ORDER BY timestamp DESC
-// LIMIT 50;
-
-func (p *PostgresStore) migrate(ctx context.Context) error {
-	_, err := p.DB.Exec(ctx, `
-	CREATE TABLE IF NOT EXISTS messages (
-		id SERIAL PRIMARY KEY,
-		room_id TEXT NOT NULL,
-		sender_id TEXT NOT NULL,
-		sender TEXT NOT NULL,
-		content TEXT NOT NULL,
-		timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_messages_room_time ON messages (room_id, timestamp);
-
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT PRIMARY KEY,
-		username TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL,
-		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
-		last_active TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_users_last_active ON users (last_active);
-
-	CREATE TABLE IF NOT EXISTS rooms (
-		id TEXT PRIMARY KEY,           -- UUID 
-		roomname TEXT NOT NULL,            -- 顯示用名稱
-		created_by TEXT NOT NULL,      -- 使用者 ID
-		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS room_members (
-		user_id TEXT NOT NULL,
-		room_id TEXT NOT NULL,
-		joined_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
-		PRIMARY KEY (user_id, room_id),
-		FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_rooms_members_room_id ON room_members (room_id);
-
-	CREATE TABLE IF NOT EXISTS user_presence (
-    room_id VARCHAR(36) NOT NULL,
-    user_id VARCHAR(36) NOT NULL,
-    is_online BOOLEAN NOT NULL,
-    last_seen TIMESTAMP NOT NULL,
-    PRIMARY KEY (room_id, user_id)
-	);
-
-	`)
-
-	return err
+// SearchConfig 返回全文搜尋使用的 text search 設定
+func (p *PostgresStore) SearchConfig() string {
+	return p.searchConfig
+}
+
+// Migrate 把 schema 更新到最新的版本，schema 變更在 migrations/ 中以新的版本加入
+func (p *PostgresStore) Migrate(ctx context.Context) error {
+	migrator, err := NewMigrator(p.DB)
+	if err != nil {
+		return err
+	}
+	migrator.SearchConfig = p.searchConfig
+	applied, err := migrator.Up(ctx, 0)
+	if err != nil {
+		return fmt.Errorf("migrate database: %w", err)
+	}
+	if len(applied) > 0 {
+		log.Printf("Applied %d migrations, schema is at version %d", len(applied), applied[len(applied)-1].Version)
+	}
+	return p.checkSearchConfig(ctx)
+}
+
+// checkSearchConfig 確認 search_vector 欄位以目前的設定建立；不一致時查詢的詞幹與索引不相符，
+// 搜尋會漏掉結果，因此拒絕啟動
+func (p *PostgresStore) checkSearchConfig(ctx context.Context) error {
+	var column string
+	var same bool
+	err := p.DB.QueryRow(ctx, `
+		SELECT c.config, c.config::regconfig = $1::regconfig
+		FROM (
+			SELECT substring(pg_get_expr(d.adbin, d.adrelid) FROM '''([^'']+)''::regconfig') AS config
+			FROM pg_attrdef d
+			JOIN pg_attribute a ON a.attrelid = d.adrelid AND a.attnum = d.adnum
+			WHERE d.adrelid = 'messages'::regclass AND a.attname = 'search_vector'
+		) c
+	`, p.searchConfig).Scan(&column, &same)
+	if err != nil {
+		return fmt.Errorf("read the text search config of messages.search_vector: %w", err)
+	}
+	if !same {
+		return fmt.Errorf("messages.search_vector uses text search config %q but SEARCH_CONFIG is %q: set SEARCH_CONFIG=%s or rebuild the column", column, p.searchConfig, column)
+	}
+	return nil
 }
 
 // Close closes the database connection pool
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrDeadLetterNotFound 找不到指定的死信
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter 是 handler 重試後仍然處理失敗的事件，保存原始主題、標頭與 payload
+type DeadLetter struct {
+	ID         int64               `json:"id"`
+	HandlerKey string              `json:"handler"`
+	Subject    string              `json:"subject"`
+	Header     map[string][]string `json:"header,omitempty"`
+	Data       []byte              `json:"data"`
+	Error      string              `json:"error"`
+	Attempts   int                 `json:"attempts"`
+	FailedAt   time.Time           `json:"failed_at"`
+}
+
+// SaveDeadLetter 寫入一筆死信
+func (p *PostgresStore) SaveDeadLetter(ctx context.Context, letter DeadLetter) error {
+	header, err := json.Marshal(letter.Header)
+	if err != nil {
+		return fmt.Errorf("marshal dead letter header: %w", err)
+	}
+	if letter.FailedAt.IsZero() {
+		letter.FailedAt = time.Now()
+	}
+
+	_, err = p.DB.Exec(ctx, `
+		INSERT INTO dead_letters (handler_key, subject, header, data, error, attempts, failed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, letter.HandlerKey, letter.Subject, header, letter.Data, letter.Error, letter.Attempts, letter.FailedAt)
+	return err
+}
+
+// ListDeadLetters 依失敗時間由新到舊列出死信，handlerKey 為空時列出所有 handler 的死信
+func (p *PostgresStore) ListDeadLetters(ctx context.Context, handlerKey string, limit int) ([]DeadLetter, error) {
+	rows, err := p.DB.Query(ctx, `
+		SELECT id, handler_key, subject, header, data, error, attempts, failed_at
+		FROM dead_letters
+		WHERE $1 = '' OR handler_key = $1
+		ORDER BY failed_at DESC
+		LIMIT $2
+	`, handlerKey, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+// GetDeadLetter 取得一筆死信
+func (p *PostgresStore) GetDeadLetter(ctx context.Context, id int64) (*DeadLetter, error) {
+	row := p.DB.QueryRow(ctx, `
+		SELECT id, handler_key, subject, header, data, error, attempts, failed_at
+		FROM dead_letters WHERE id = $1
+	`, id)
+	letter, err := scanDeadLetter(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// DeleteDeadLetter 刪除一筆死信 (丟棄或已經重新發布)
+func (p *PostgresStore) DeleteDeadLetter(ctx context.Context, id int64) error {
+	tag, err := p.DB.Exec(ctx, `DELETE FROM dead_letters WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+func scanDeadLetter(row pgx.Row) (DeadLetter, error) {
+	var letter DeadLetter
+	var header []byte
+	if err := row.Scan(&letter.ID, &letter.HandlerKey, &letter.Subject, &header, &letter.Data, &letter.Error, &letter.Attempts, &letter.FailedAt); err != nil {
+		return DeadLetter{}, err
+	}
+	if len(header) > 0 {
+		if err := json.Unmarshal(header, &letter.Header); err != nil {
+			return DeadLetter{}, fmt.Errorf("unmarshal dead letter header: %w", err)
+		}
+	}
+	return letter, nil
+}
@@ -0,0 +1,759 @@
+// Package memory 提供 storage.Store 的 in-process 實現，資料只存在於記憶體，
+// 讓 handler、Hub 與 HTTP handler 可以不依賴資料庫測試，也可以在開發時以單機模式執行
+package memory
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// Store 以 map 實現 storage.Store，所有操作以同一個鎖保護，行為與 PostgresStore 一致
+type Store struct {
+	mu       sync.Mutex
+	messages []storage.ChatMessage
+	users    map[string]*user
+	rooms    map[string]*storage.Room
+	members  map[string][]membership // roomID -> 依加入順序排列的成員
+	presence map[presenceKey]presence
+
+	deadLetters []storage.DeadLetter
+	outbox      []outboxEntry
+	retention   map[string]storage.RetentionPolicy // roomID -> 設定過的保留規則
+
+	nextMessageID    int64
+	nextDeadLetterID int64
+	nextOutboxID     int64
+
+	// relayMu 讓同時執行的 RelayOutbox 不會發布同一筆事件 (對應 FOR UPDATE SKIP LOCKED)
+	relayMu sync.Mutex
+}
+
+type user struct {
+	storage.User
+	passwordHash string
+	status       storage.UserStatus
+}
+
+type membership struct {
+	userID   string
+	joinedAt time.Time
+}
+
+type presenceKey struct {
+	roomID string
+	userID string
+}
+
+type presence struct {
+	isOnline bool
+	lastSeen time.Time
+}
+
+type outboxEntry struct {
+	storage.OutboxMessage
+	publishedAt *time.Time
+}
+
+var _ storage.Store = (*Store)(nil)
+
+// NewStore 創建一個空的 in-memory store
+func NewStore() *Store {
+	return &Store{
+		users:     make(map[string]*user),
+		rooms:     make(map[string]*storage.Room),
+		members:   make(map[string][]membership),
+		presence:  make(map[presenceKey]presence),
+		retention: make(map[string]storage.RetentionPolicy),
+	}
+}
+
+func (s *Store) Close() {}
+
+func (s *Store) SaveMessage(ctx context.Context, msg storage.ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextMessageID++
+	msg.ID = s.nextMessageID
+	s.saveMessage(msg)
+	return nil
+}
+
+// saveMessage 保存已經分配了 ID 的消息
+func (s *Store) saveMessage(msg storage.ChatMessage) {
+	msg.Timestamp = msg.Timestamp.UTC()
+	if msg.ExpiresAt != nil {
+		expiresAt := msg.ExpiresAt.UTC()
+		msg.ExpiresAt = &expiresAt
+	}
+	s.messages = append(s.messages, msg)
+}
+
+func (s *Store) SaveMessageWithOutbox(ctx context.Context, msg storage.ChatMessage, event storage.MessageEvent) (int64, error) {
+	ids, err := s.SaveMessagesWithOutbox(ctx, []storage.PendingMessage{{Message: msg, Event: event}})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// SaveMessagesWithOutbox 依序保存一批消息，事件 ID 已經存在的消息略過
+// 與 Postgres 相同，整批的 ID 先分配好再產生事件，略過的消息留下空號
+func (s *Store) SaveMessagesWithOutbox(ctx context.Context, batch []storage.PendingMessage) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]storage.ChatMessage, len(batch))
+	events := make([]storage.OutboxMessage, len(batch))
+	for i, pending := range batch {
+		messages[i] = pending.Message
+		messages[i].ID = s.nextMessageID + int64(i) + 1
+		out, err := pending.Event(messages[i])
+		if err != nil {
+			return make([]int64, len(batch)), err
+		}
+		events[i] = out
+	}
+	s.nextMessageID += int64(len(batch))
+
+	saved := make([]int64, len(batch))
+	for i, msg := range messages {
+		if s.insertOutbox(events[i]) {
+			s.saveMessage(msg)
+			saved[i] = msg.ID
+		}
+	}
+	return saved, nil
+}
+
+func (s *Store) GetRecentMessages(ctx context.Context, roomID string, limit int) ([]storage.ChatMessage, error) {
+	return s.recentMessages(roomID, nil, limit), nil
+}
+
+func (s *Store) GetMessagesBefore(ctx context.Context, roomID string, before storage.MessageCursor, limit int) ([]storage.ChatMessage, error) {
+	return s.recentMessages(roomID, &before, limit), nil
+}
+
+// recentMessages 返回最後 limit 條沒有過期的非系統消息，before 不為 nil 時只包含游標之前的消息
+func (s *Store) recentMessages(roomID string, before *storage.MessageCursor, limit int) []storage.ChatMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var messages []storage.ChatMessage
+	for _, msg := range s.messages {
+		if msg.RoomID == roomID && msg.SenderID != "system" && !msg.Expired(now) && (before == nil || before.Includes(msg)) {
+			messages = append(messages, msg)
+		}
+	}
+	sortMessages(messages)
+	if limit >= 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return messages
+}
+
+func (s *Store) GetMessagesByTimeRange(ctx context.Context, roomID string, startTime, endTime time.Time) ([]storage.ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var messages []storage.ChatMessage
+	for _, msg := range s.messages {
+		if msg.RoomID == roomID && !msg.Expired(now) && !msg.Timestamp.Before(startTime) && !msg.Timestamp.After(endTime) {
+			messages = append(messages, msg)
+		}
+	}
+	sortMessages(messages)
+	return messages, nil
+}
+
+// SearchMessages 以子字串搜尋，Rank 是查詢詞出現的次數
+func (s *Store) SearchMessages(ctx context.Context, search storage.MessageSearch) ([]storage.SearchResult, error) {
+	search = search.Normalize()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := []storage.SearchResult{}
+	for _, msg := range s.messages {
+		if search.Matches(msg) {
+			results = append(results, search.SearchResultOf(msg))
+		}
+	}
+	return storage.SortSearchResults(results, search.Limit), nil
+}
+
+// sortMessages 依時間由舊到新排序，時間相同時依 ID (寫入順序)
+func sortMessages(messages []storage.ChatMessage) {
+	slices.SortFunc(messages, func(a, b storage.ChatMessage) int {
+		if c := a.Timestamp.Compare(b.Timestamp); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
+
+func (s *Store) Register(ctx context.Context, username, password string) (string, error) {
+	s.mu.Lock()
+	for _, u := range s.users {
+		if u.UserName == username {
+			s.mu.Unlock()
+			return "", storage.ErrUsernameTaken
+		}
+	}
+	s.mu.Unlock()
+
+	// bcrypt 很慢，不在持有鎖的時候計算
+	hash, err := storage.HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.UserName == username {
+			return "", storage.ErrUsernameTaken
+		}
+	}
+	now := time.Now().UTC()
+	userID := uuid.NewString()
+	s.users[userID] = &user{
+		User:         storage.User{ID: userID, UserName: username, CreatedAt: now, LastActive: now},
+		passwordHash: hash,
+		status:       storage.UserStatus{UserID: userID, Status: storage.UserStatusOnline},
+	}
+	return userID, nil
+}
+
+func (s *Store) Login(ctx context.Context, username, password string) (string, error) {
+	s.mu.Lock()
+	var found *user
+	for _, u := range s.users {
+		if u.UserName == username {
+			found = u
+			break
+		}
+	}
+	var userID, hash string
+	if found != nil {
+		userID, hash = found.ID, found.passwordHash
+	}
+	s.mu.Unlock()
+
+	if found == nil {
+		return "", storage.ErrInvalidCredentials
+	}
+	if err := storage.CheckPassword(hash, password); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func (s *Store) GetUserByID(ctx context.Context, userID string) (*storage.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, storage.ErrUserNotFound
+	}
+	found := u.User
+	return &found, nil
+}
+
+func (s *Store) UpsertUser(ctx context.Context, record storage.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[record.ID]; ok {
+		u.UserName = record.UserName
+		u.LastActive = record.LastActive
+		return nil
+	}
+	for _, u := range s.users {
+		if u.UserName == record.UserName {
+			return storage.ErrUsernameTaken
+		}
+	}
+	s.users[record.ID] = &user{
+		User:   record,
+		status: storage.UserStatus{UserID: record.ID, Status: storage.UserStatusOnline},
+	}
+	return nil
+}
+
+func (s *Store) UpdateLastActive(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.LastActive = time.Now().UTC()
+	}
+	return nil
+}
+
+func (s *Store) UpdatePresence(ctx context.Context, roomID, userID string, isOnline bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.presence[presenceKey{roomID, userID}] = presence{isOnline: isOnline, lastSeen: time.Now().UTC()}
+	return nil
+}
+
+func (s *Store) GetUserStatus(ctx context.Context, userID string) (*storage.UserStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, storage.ErrUserNotFound
+	}
+	st := u.status.Current(time.Now())
+	return &st, nil
+}
+
+func (s *Store) UpdateUserStatus(ctx context.Context, st storage.UserStatus) error {
+	if !storage.IsValidUserStatus(st.Status) {
+		return fmt.Errorf("invalid user status: %q", st.Status)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[st.UserID]
+	if !ok {
+		return fmt.Errorf("%w: %s", storage.ErrUserNotFound, st.UserID)
+	}
+	if st.ExpiresAt != nil {
+		expiresAt := st.ExpiresAt.UTC()
+		st.ExpiresAt = &expiresAt
+	}
+	st.AutoAway = false
+	u.status = st
+	return nil
+}
+
+func (s *Store) CompareAndSetUserStatus(ctx context.Context, userID, from, to string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok || u.status.Status != from || (from == storage.UserStatusAway && !u.status.AutoAway) {
+		return false, nil
+	}
+	u.status.Status, u.status.AutoAway = to, to == storage.UserStatusAway
+	return true, nil
+}
+
+func (s *Store) ClearExpiredStatusText(ctx context.Context) ([]storage.UserStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var statuses []storage.UserStatus
+	for _, u := range s.users {
+		if u.status.ExpiresAt == nil || u.status.ExpiresAt.After(now) {
+			continue
+		}
+		u.status = u.status.Current(now)
+		statuses = append(statuses, storage.UserStatus{UserID: u.ID, Status: u.status.Status})
+	}
+	return statuses, nil
+}
+
+func (s *Store) CreateRoom(ctx context.Context, name, createdBy string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.createRoom(name, createdBy), nil
+}
+
+// createRoom 創建房間，房間名稱已存在時沿用既有的房間
+func (s *Store) createRoom(name, createdBy string) string {
+	for _, room := range s.rooms {
+		if room.RoomName == name {
+			log.Printf("Room already exists: %s", room.ID)
+			return room.ID
+		}
+	}
+	roomID := uuid.NewString()
+	s.rooms[roomID] = &storage.Room{ID: roomID, RoomName: name, CreatedBy: createdBy, CreatedAt: time.Now().UTC()}
+	return roomID
+}
+
+func (s *Store) CreateRoomWithOutbox(ctx context.Context, name, createdBy string, event func(roomID string) (storage.OutboxMessage, error)) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 與交易一樣，產生事件失敗時不保留新創建的房間
+	existed := s.roomByName(name) != nil
+	roomID := s.createRoom(name, createdBy)
+	out, err := event(roomID)
+	if err != nil {
+		if !existed {
+			delete(s.rooms, roomID)
+		}
+		return "", err
+	}
+	s.insertOutbox(out)
+	return roomID, nil
+}
+
+func (s *Store) roomByName(name string) *storage.Room {
+	for _, room := range s.rooms {
+		if room.RoomName == name {
+			return room
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetRoom(ctx context.Context, roomID string) (*storage.Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return nil, storage.ErrRoomNotFound
+	}
+	found := *room
+	return &found, nil
+}
+
+func (s *Store) GetUserRooms(ctx context.Context, userID string) ([]storage.Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type joined struct {
+		room storage.Room
+		at   time.Time
+	}
+	var found []joined
+	for roomID := range s.members {
+		if m, ok := s.membership(roomID, userID); ok {
+			found = append(found, joined{*s.rooms[roomID], m.joinedAt})
+		}
+	}
+	slices.SortStableFunc(found, func(a, b joined) int {
+		return a.at.Compare(b.at)
+	})
+
+	var rooms []storage.Room
+	for _, j := range found {
+		rooms = append(rooms, j.room)
+	}
+	return rooms, nil
+}
+
+func (s *Store) AddUserToRoom(ctx context.Context, userID, roomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[roomID]; !ok {
+		return fmt.Errorf("add user %s to room %s: %w", userID, roomID, storage.ErrRoomNotFound)
+	}
+	if _, ok := s.membership(roomID, userID); !ok {
+		s.members[roomID] = append(s.members[roomID], membership{userID: userID, joinedAt: time.Now().UTC()})
+	}
+	return nil
+}
+
+// RemoveUserFromRoom 與 PostgresStore 相同，只把用戶在房間內的在線狀態設為離線，仍然保留成員資格
+func (s *Store) RemoveUserFromRoom(ctx context.Context, userID, roomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := presenceKey{roomID, userID}
+	if _, ok := s.presence[key]; ok {
+		s.presence[key] = presence{isOnline: false, lastSeen: time.Now().UTC()}
+	}
+	return nil
+}
+
+func (s *Store) IsRoomMember(ctx context.Context, roomID, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.membership(roomID, userID)
+	return ok, nil
+}
+
+func (s *Store) membership(roomID, userID string) (membership, bool) {
+	i := slices.IndexFunc(s.members[roomID], func(m membership) bool {
+		return m.userID == userID
+	})
+	if i < 0 {
+		return membership{}, false
+	}
+	return s.members[roomID][i], true
+}
+
+func (s *Store) GetRoomMembers(ctx context.Context, roomID string) ([]storage.RoomMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := []storage.RoomMember{}
+	for _, m := range s.members[roomID] {
+		u, ok := s.users[m.userID]
+		if !ok {
+			continue
+		}
+		member := storage.RoomMember{UserID: m.userID, Username: u.UserName, JoinedAt: m.joinedAt}
+		if p, ok := s.presence[presenceKey{roomID, m.userID}]; ok {
+			lastSeen := p.lastSeen
+			member.IsOnline, member.LastSeen = p.isOnline, &lastSeen
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (s *Store) SaveDeadLetter(ctx context.Context, letter storage.DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if letter.FailedAt.IsZero() {
+		letter.FailedAt = time.Now()
+	}
+	s.nextDeadLetterID++
+	letter.ID = s.nextDeadLetterID
+	letter.FailedAt = letter.FailedAt.UTC()
+	letter.Data = slices.Clone(letter.Data)
+	s.deadLetters = append(s.deadLetters, letter)
+	return nil
+}
+
+func (s *Store) ListDeadLetters(ctx context.Context, handlerKey string, limit int) ([]storage.DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := []storage.DeadLetter{}
+	for _, letter := range s.deadLetters {
+		if handlerKey == "" || letter.HandlerKey == handlerKey {
+			letters = append(letters, letter)
+		}
+	}
+	slices.SortStableFunc(letters, func(a, b storage.DeadLetter) int {
+		return b.FailedAt.Compare(a.FailedAt)
+	})
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (s *Store) GetDeadLetter(ctx context.Context, id int64) (*storage.DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, letter := range s.deadLetters {
+		if letter.ID == id {
+			return &letter, nil
+		}
+	}
+	return nil, storage.ErrDeadLetterNotFound
+}
+
+func (s *Store) DeleteDeadLetter(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.deadLetters, func(letter storage.DeadLetter) bool {
+		return letter.ID == id
+	})
+	if i < 0 {
+		return storage.ErrDeadLetterNotFound
+	}
+	s.deadLetters = slices.Delete(s.deadLetters, i, i+1)
+	return nil
+}
+
+// insertOutbox 寫入一筆 outbox 資料，同一個事件 ID 已經存在時忽略並返回 false
+func (s *Store) insertOutbox(out storage.OutboxMessage) bool {
+	for _, entry := range s.outbox {
+		if entry.EventID == out.EventID {
+			return false
+		}
+	}
+	s.nextOutboxID++
+	out.ID = s.nextOutboxID
+	out.CreatedAt = time.Now().UTC()
+	out.Data = slices.Clone(out.Data)
+	s.outbox = append(s.outbox, outboxEntry{OutboxMessage: out})
+	return true
+}
+
+func (s *Store) RelayOutbox(ctx context.Context, limit int, publish func(storage.OutboxMessage) error) (int, error) {
+	s.relayMu.Lock()
+	defer s.relayMu.Unlock()
+
+	// publish 可能很慢，不在持有資料鎖的時候呼叫
+	s.mu.Lock()
+	var pending []storage.OutboxMessage
+	for _, entry := range s.outbox {
+		if len(pending) == limit {
+			break
+		}
+		if entry.publishedAt == nil {
+			pending = append(pending, entry.OutboxMessage)
+		}
+	}
+	s.mu.Unlock()
+
+	var published []int64
+	var publishErr error
+	for _, out := range pending {
+		if publishErr = publish(out); publishErr != nil {
+			break
+		}
+		published = append(published, out.ID)
+	}
+
+	s.mu.Lock()
+	now := time.Now().UTC()
+	for i := range s.outbox {
+		if slices.Contains(published, s.outbox[i].ID) {
+			s.outbox[i].publishedAt = &now
+		}
+	}
+	s.mu.Unlock()
+
+	if publishErr != nil {
+		return len(published), fmt.Errorf("publish outbox: %w", publishErr)
+	}
+	return len(published), nil
+}
+
+func (s *Store) DeletePublishedOutbox(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.outbox)
+	s.outbox = slices.DeleteFunc(s.outbox, func(entry outboxEntry) bool {
+		return entry.publishedAt != nil && entry.publishedAt.Before(before)
+	})
+	return int64(n - len(s.outbox)), nil
+}
+
+func (s *Store) GetRetentionPolicy(ctx context.Context, roomID string) (*storage.RetentionPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policy, err := s.retentionPolicy(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// retentionPolicy 返回房間的保留規則，沒有設定過的房間永久保留
+func (s *Store) retentionPolicy(roomID string) (storage.RetentionPolicy, error) {
+	if _, ok := s.rooms[roomID]; !ok {
+		return storage.RetentionPolicy{}, storage.ErrRoomNotFound
+	}
+	policy, ok := s.retention[roomID]
+	if !ok {
+		policy = storage.RetentionPolicy{RoomID: roomID, Mode: storage.RetentionForever}
+	}
+	return policy, nil
+}
+
+// SetRetentionPolicy 設定房間的保留規則，不改變 LegalHold
+func (s *Store) SetRetentionPolicy(ctx context.Context, policy storage.RetentionPolicy) (*storage.RetentionPolicy, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.retentionPolicy(policy.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	policy.LegalHold = current.LegalHold
+	policy.UpdatedAt = time.Now().UTC()
+	s.retention[policy.RoomID] = policy
+	return &policy, nil
+}
+
+func (s *Store) SetLegalHold(ctx context.Context, roomID string, hold bool) (*storage.RetentionPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policy, err := s.retentionPolicy(roomID)
+	if err != nil {
+		return nil, err
+	}
+	policy.LegalHold = hold
+	policy.UpdatedAt = time.Now().UTC()
+	s.retention[roomID] = policy
+	return &policy, nil
+}
+
+// PurgeMessages 刪除過期與超出保留規則的消息，與 PostgresStore 相同，系統消息不計入 keep_last
+func (s *Store) PurgeMessages(ctx context.Context, now time.Time) ([]storage.PurgeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 每個房間刪除時間早於 cutoff 的消息
+	cutoffs := make(map[string]time.Time)
+	for roomID, policy := range s.retention {
+		if policy.LegalHold {
+			continue
+		}
+		switch policy.Mode {
+		case storage.RetentionDays:
+			cutoffs[roomID] = now.AddDate(0, 0, -policy.Days)
+		case storage.RetentionKeepLast:
+			var kept []storage.ChatMessage
+			for _, msg := range s.messages {
+				if msg.RoomID == roomID && msg.SenderID != "system" && !msg.Expired(now) {
+					kept = append(kept, msg)
+				}
+			}
+			sortMessages(kept)
+			if len(kept) >= policy.KeepLast {
+				cutoffs[roomID] = kept[len(kept)-policy.KeepLast].Timestamp
+			}
+		}
+	}
+
+	results := make(map[string]*storage.PurgeResult)
+	messages := s.messages[:0]
+	for _, msg := range s.messages {
+		if s.retention[msg.RoomID].LegalHold {
+			messages = append(messages, msg)
+			continue
+		}
+		cutoff, hasCutoff := cutoffs[msg.RoomID]
+		expired := msg.Expired(now)
+		if !expired && !(hasCutoff && msg.Timestamp.Before(cutoff)) {
+			messages = append(messages, msg)
+			continue
+		}
+
+		r := results[msg.RoomID]
+		if r == nil {
+			r = &storage.PurgeResult{RoomID: msg.RoomID}
+			results[msg.RoomID] = r
+		}
+		if expired {
+			r.ExpiredBefore = &now
+		} else {
+			r.RemovedBefore = &cutoff
+		}
+		r.Deleted++
+	}
+	clear(s.messages[len(messages):])
+	s.messages = messages
+	return storage.SortPurgeResults(results), nil
+}
@@ -3,13 +3,15 @@ package storage
 import (
 	"context"
 	"time"
+
+	"github.com/jackc/pgx/v5"
 )
 
 func (p *PostgresStore) SaveMessage(ctx context.Context, msg ChatMessage) error {
 	_, err := p.DB.Exec(ctx, `
-		INSERT INTO messages (room_id, sender_id, sender, content, timestamp)
-		VALUES ($1, $2, $3, $4, $5)
-	`, msg.RoomID, msg.SenderID, msg.Sender, msg.Content, msg.Timestamp)
+		INSERT INTO messages (room_id, sender_id, sender, content, timestamp, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, msg.RoomID, msg.SenderID, msg.Sender, msg.Content, msg.Timestamp, msg.ExpiresAt)
 	return err
 }
 
@@ -18,58 +20,89 @@ func (p *PostgresStore) GetRecentMessages(ctx context.Context, roomId string, li
 	// 排除 sender_id = 'system' 的消息
 	rows, err := p.DB.Query(ctx, `
 		WITH recent_messages AS (
-			SELECT id, room_id, sender_id, sender, content, timestamp 
+			SELECT id, room_id, sender_id, sender, content, timestamp, expires_at 
 			FROM messages 
 			WHERE room_id = $1 AND sender_id != 'system'
-			ORDER BY timestamp DESC
+			AND (expires_at IS NULL OR expires_at > now())
+			ORDER BY timestamp DESC, id DESC
 			LIMIT $2
 		)
-		SELECT id, room_id, sender_id, sender, content, timestamp 
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at 
 		FROM recent_messages
-		ORDER BY timestamp ASC
+		ORDER BY timestamp ASC, id ASC
 	`, roomId, limit)
 
 	if err != nil {
 		return nil, err
 	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// 房間的消息不足 limit 條時，更早的消息可能已經封存
+	return p.readThroughBefore(ctx, roomId, nil, limit, messages)
+}
+
+// GetMessagesBefore 向上捲動時載入游標之前的消息，資料庫中不足時從封存檔案補足
+// 游標沒有 ID 時 id < 0 不成立，只比較時間
+func (p *PostgresStore) GetMessagesBefore(ctx context.Context, roomID string, before MessageCursor, limit int) ([]ChatMessage, error) {
+	rows, err := p.DB.Query(ctx, `
+		WITH earlier_messages AS (
+			SELECT id, room_id, sender_id, sender, content, timestamp, expires_at
+			FROM messages
+			WHERE room_id = $1 AND sender_id != 'system'
+			AND (timestamp < $2 OR (timestamp = $2 AND id < $3))
+			AND (expires_at IS NULL OR expires_at > now())
+			ORDER BY timestamp DESC, id DESC
+			LIMIT $4
+		)
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at
+		FROM earlier_messages
+		ORDER BY timestamp ASC, id ASC
+	`, roomID, before.Timestamp, before.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return p.readThroughBefore(ctx, roomID, &before, limit, messages)
+}
+
+func scanMessages(rows pgx.Rows) ([]ChatMessage, error) {
 	defer rows.Close()
 
 	var messages []ChatMessage
 	for rows.Next() {
 		var msg ChatMessage
-		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Sender, &msg.Content, &msg.Timestamp); err != nil {
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Sender, &msg.Content, &msg.Timestamp, &msg.ExpiresAt); err != nil {
 			return nil, err
 		}
 		messages = append(messages, msg)
 	}
-
-	return messages, nil
+	return messages, rows.Err()
 }
 
 func (p *PostgresStore) GetMessagesByTimeRange(ctx context.Context, roomID string, startTime, endTime time.Time) ([]ChatMessage, error) {
 	rows, err := p.DB.Query(ctx, `
-		SELECT id, room_id, sender_id, sender, content, timestamp 
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at 
 		FROM messages 
 		WHERE room_id = $1 
 		AND timestamp BETWEEN $2 AND $3
+		AND (expires_at IS NULL OR expires_at > now())
 		ORDER BY timestamp ASC
 	`, roomID, startTime, endTime)
 
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var messages []ChatMessage
-	for rows.Next() {
-		var msg ChatMessage
-		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Sender, &msg.Content, &msg.Timestamp); err != nil {
-			return nil, err
-		}
-		messages = append(messages, msg)
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
 	}
-
-	return messages, nil
+	return p.readThroughRange(ctx, roomID, startTime, endTime, messages)
 }
 
 
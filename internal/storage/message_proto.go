@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ChatMessage 的 Protobuf 欄位編號，見 chat_message.proto
+const (
+	protoFieldRoomID        protowire.Number = 1
+	protoFieldSenderID      protowire.Number = 2
+	protoFieldSender        protowire.Number = 3
+	protoFieldContent       protowire.Number = 4
+	protoFieldTimestamp     protowire.Number = 5
+	protoFieldClientMsgID   protowire.Number = 6
+	protoFieldAck           protowire.Number = 7
+	protoFieldExpiresAt     protowire.Number = 8
+	protoFieldExpiresIn     protowire.Number = 9
+	protoFieldRemovedBefore protowire.Number = 10
+	protoFieldExpiredBefore protowire.Number = 11
+	protoFieldID            protowire.Number = 12
+
+	// google.protobuf.Timestamp
+	protoFieldSeconds protowire.Number = 1
+	protoFieldNanos   protowire.Number = 2
+)
+
+// MarshalProto 把消息編碼為 Protobuf
+func (m ChatMessage) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendProtoString(b, protoFieldRoomID, m.RoomID)
+	b = appendProtoString(b, protoFieldSenderID, m.SenderID)
+	b = appendProtoString(b, protoFieldSender, m.Sender)
+	b = appendProtoString(b, protoFieldContent, m.Content)
+
+	if !m.Timestamp.IsZero() {
+		b = appendProtoTimestamp(b, protoFieldTimestamp, m.Timestamp)
+	}
+	b = appendProtoString(b, protoFieldClientMsgID, m.ClientMsgID)
+	b = appendProtoString(b, protoFieldAck, m.Ack)
+	if m.ExpiresAt != nil {
+		b = appendProtoTimestamp(b, protoFieldExpiresAt, *m.ExpiresAt)
+	}
+	if m.ExpiresIn != 0 {
+		b = protowire.AppendTag(b, protoFieldExpiresIn, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int32(m.ExpiresIn)))
+	}
+	if m.RemovedBefore != nil {
+		b = appendProtoTimestamp(b, protoFieldRemovedBefore, *m.RemovedBefore)
+	}
+	if m.ExpiredBefore != nil {
+		b = appendProtoTimestamp(b, protoFieldExpiredBefore, *m.ExpiredBefore)
+	}
+	if m.ID != 0 {
+		b = protowire.AppendTag(b, protoFieldID, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.ID))
+	}
+	return b, nil
+}
+
+// UnmarshalProto 從 Protobuf 解碼消息，不認得的欄位會被略過
+func (m *ChatMessage) UnmarshalProto(b []byte) error {
+	*m = ChatMessage{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		// expires_in 與 id 是 varint 欄位
+		if (num == protoFieldExpiresIn || num == protoFieldID) && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			if num == protoFieldID {
+				m.ID = int64(v)
+			} else {
+				m.ExpiresIn = int(int32(v))
+			}
+			continue
+		}
+
+		if typ != protowire.BytesType || num < protoFieldRoomID || num > protoFieldExpiredBefore || num == protoFieldExpiresIn {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case protoFieldRoomID:
+			m.RoomID = string(v)
+		case protoFieldSenderID:
+			m.SenderID = string(v)
+		case protoFieldSender:
+			m.Sender = string(v)
+		case protoFieldContent:
+			m.Content = string(v)
+		case protoFieldTimestamp:
+			ts, err := consumeProtoTimestamp(v)
+			if err != nil {
+				return fmt.Errorf("timestamp: %w", err)
+			}
+			m.Timestamp = ts
+		case protoFieldClientMsgID:
+			m.ClientMsgID = string(v)
+		case protoFieldAck:
+			m.Ack = string(v)
+		case protoFieldExpiresAt, protoFieldRemovedBefore, protoFieldExpiredBefore:
+			ts, err := consumeProtoTimestamp(v)
+			if err != nil {
+				return fmt.Errorf("field %d: %w", num, err)
+			}
+			switch num {
+			case protoFieldExpiresAt:
+				m.ExpiresAt = &ts
+			case protoFieldRemovedBefore:
+				m.RemovedBefore = &ts
+			default:
+				m.ExpiredBefore = &ts
+			}
+		}
+	}
+	return nil
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendProtoTimestamp 以 google.protobuf.Timestamp 編碼 t
+func appendProtoTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	var ts []byte
+	if secs := t.Unix(); secs != 0 {
+		ts = protowire.AppendTag(ts, protoFieldSeconds, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(secs))
+	}
+	if nanos := t.Nanosecond(); nanos != 0 {
+		ts = protowire.AppendTag(ts, protoFieldNanos, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(nanos))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, ts)
+}
+
+func consumeProtoTimestamp(b []byte) (time.Time, error) {
+	var secs, nanos int64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.VarintType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return time.Time{}, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case protoFieldSeconds:
+			secs = int64(v)
+		case protoFieldNanos:
+			nanos = int64(int32(v))
+		}
+	}
+	return time.Unix(secs, nanos).UTC(), nil
+}
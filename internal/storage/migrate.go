@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrationFiles 是依版本排序的 schema 變更，每個版本有 NNNN_name.up.sql 與 NNNN_name.down.sql
+// 已經發布的檔案不能再修改，schema 變更要加入新的版本
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey 是 pg_advisory_lock 的鍵，同時啟動的實例只有一個會執行 migration
+const migrationLockKey int64 = 0x5e771ec4a7
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// ErrNoMigrations 沒有可以回滾的 migration
+var ErrNoMigrations = errors.New("no migrations applied")
+
+// Migration 是一個版本的 schema 變更
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// MigrationStatus 是 migration 在資料庫中的狀態
+type MigrationStatus struct {
+	Migration
+	// AppliedAt 套用的時間，還沒套用時為 nil
+	AppliedAt *time.Time
+	// Unknown 資料庫中有這個版本，但這個執行檔沒有 (由較新的版本套用)
+	Unknown bool
+}
+
+// Migrations 返回內嵌的所有 migration，依版本排序
+func Migrations() ([]Migration, error) {
+	return LoadMigrations(migrationFiles)
+}
+
+// LoadMigrations 讀取 fsys 中 migrations/ 目錄下的 migration，依版本排序
+// 其他資料庫後端 (例如 sqlite) 以同樣的檔名格式保存自己的 migration
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, path := range paths {
+		name := path[len("migrations/"):]
+		match := migrationFileName.FindStringSubmatch(name)
+		if match == nil {
+			return nil, fmt.Errorf("migration %s: file name must look like 0001_name.up.sql", name)
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version", name)
+		}
+		sql, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %s needs both an up and a down script", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	return migrations, nil
+}
+
+// Migrator 套用或回滾 migration，每一個 migration 與它在 schema_migrations 的記錄在同一個交易中完成
+type Migrator struct {
+	// SearchConfig 代入 migration 中的 {{search_config}}，是全文搜尋使用的 text search 設定
+	SearchConfig string
+
+	db         *pgxpool.Pool
+	migrations []Migration
+}
+
+// NewMigrator 以內嵌的 migration 創建 Migrator
+func NewMigrator(db *pgxpool.Pool) (*Migrator, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{SearchConfig: DefaultSearchConfig, db: db, migrations: migrations}, nil
+}
+
+// expand 把 migration 中的參數代換為 SQL 字面值
+func (m *Migrator) expand(script string) (string, error) {
+	if !strings.Contains(script, "{{search_config}}") {
+		return script, nil
+	}
+	if !ValidSearchConfig(m.SearchConfig) {
+		return "", fmt.Errorf("invalid text search config %q", m.SearchConfig)
+	}
+	return strings.ReplaceAll(script, "{{search_config}}", "'"+m.SearchConfig+"'"), nil
+}
+
+// Up 依序套用還沒套用的 migration 直到 target (0 代表最新的版本)，返回這次套用的 migration
+func (m *Migrator) Up(ctx context.Context, target int64) ([]Migration, error) {
+	var applied []Migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for version := range versions {
+			if !m.known(version) {
+				log.Printf("Warning: database has migration %d that this binary does not know, it was applied by a newer version", version)
+			}
+		}
+
+		for _, migration := range m.migrations {
+			if target > 0 && migration.Version > target {
+				break
+			}
+			if _, ok := versions[migration.Version]; ok {
+				continue
+			}
+			if err := m.apply(ctx, conn, migration, true); err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down 由最新的版本開始回滾 steps 個已經套用的 migration，返回這次回滾的 migration
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			return ErrNoMigrations
+		}
+		// 比這個執行檔更新的版本沒有 down 腳本，不能跳過它回滾更舊的版本
+		if latest := slices.Max(slices.Collect(maps.Keys(versions))); !m.known(latest) {
+			return fmt.Errorf("latest applied migration %d is unknown to this binary, roll it back with a newer version", latest)
+		}
+
+		for _, migration := range slices.Backward(m.migrations) {
+			if len(reverted) == steps {
+				break
+			}
+			if _, ok := versions[migration.Version]; !ok {
+				continue
+			}
+			if err := m.apply(ctx, conn, migration, false); err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status 返回所有 migration 的狀態，包含資料庫中有但這個執行檔不知道的版本
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return nil, err
+	}
+	versions, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Migration: migration}
+		if record, ok := versions[migration.Version]; ok {
+			status.AppliedAt = &record.appliedAt
+			delete(versions, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for version, record := range versions {
+		statuses = append(statuses, MigrationStatus{
+			Migration: Migration{Version: version, Name: record.name},
+			AppliedAt: &record.appliedAt,
+			Unknown:   true,
+		})
+	}
+	slices.SortFunc(statuses, func(a, b MigrationStatus) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	return statuses, nil
+}
+
+func (m *Migrator) known(version int64) bool {
+	return slices.ContainsFunc(m.migrations, func(migration Migration) bool {
+		return migration.Version == version
+	})
+}
+
+// withLock 在持有 advisory lock 的連線上執行 fn，同時啟動的其他實例會等待直到 migration 完成
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, migrationLockKey).Scan(&locked); err != nil {
+		return fmt.Errorf("try migration lock: %w", err)
+	}
+	if !locked {
+		log.Println("Waiting for another instance to finish migrating the database")
+		if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+			return fmt.Errorf("migration lock: %w", err)
+		}
+	}
+	defer func() {
+		// ctx 可能已經取消，解鎖使用獨立的 context；連線斷開時鎖也會被釋放
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.Exec(unlockCtx, `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			log.Printf("Failed to release migration lock: %v", err)
+		}
+	}()
+
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// apply 在一個交易中執行 migration 的 up (或 down) 腳本並更新 schema_migrations
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, migration Migration, up bool) error {
+	direction, script := "up", migration.Up
+	if !up {
+		direction, script = "down", migration.Down
+	}
+
+	script, err := m.expand(script)
+	if err != nil {
+		return fmt.Errorf("migration %s %s: %w", migration, direction, err)
+	}
+
+	start := time.Now()
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, script); err != nil {
+			return err
+		}
+		if up {
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name)
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("migration %s %s: %w", migration, direction, err)
+	}
+	log.Printf("Migrated %s %s in %s", migration, direction, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func ensureMigrationsTable(ctx context.Context, conn *pgxpool.Conn) error {
+	_, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+type appliedMigration struct {
+	name      string
+	appliedAt time.Time
+}
+
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int64]appliedMigration, error) {
+	rows, err := conn.Query(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[int64]appliedMigration)
+	for rows.Next() {
+		var version int64
+		var record appliedMigration
+		if err := rows.Scan(&version, &record.name, &record.appliedAt); err != nil {
+			return nil, err
+		}
+		versions[version] = record
+	}
+	return versions, rows.Err()
+}
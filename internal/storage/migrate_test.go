@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 版本從 1 開始連續，新的版本接在最後
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Fatalf("migration %d is %s, versions must be contiguous", i, m)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0002_second.up.sql":   {Data: []byte("CREATE TABLE b ();")},
+		"migrations/0002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"migrations/0001_first.up.sql":    {Data: []byte("CREATE TABLE a ();")},
+		"migrations/0001_first.down.sql":  {Data: []byte("DROP TABLE a;")},
+	}
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].String() != "0001_first" || migrations[1].String() != "0002_second" {
+		t.Fatalf("got %v", migrations)
+	}
+	if migrations[1].Up != "CREATE TABLE b ();" || migrations[1].Down != "DROP TABLE b;" {
+		t.Errorf("got scripts %q / %q", migrations[1].Up, migrations[1].Down)
+	}
+
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+		want string
+	}{
+		{"missing down", fstest.MapFS{"migrations/0001_a.up.sql": {}}, "needs both"},
+		{"bad name", fstest.MapFS{"migrations/first.up.sql": {}}, "file name"},
+		{"two names", fstest.MapFS{
+			"migrations/0001_a.up.sql":   {},
+			"migrations/0001_b.down.sql": {},
+		}, "two names"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadMigrations(tt.fsys); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandSearchConfig(t *testing.T) {
+	m := &Migrator{SearchConfig: "simple"}
+	script, err := m.expand("SELECT to_tsvector({{search_config}}, 'a');")
+	if err != nil || script != "SELECT to_tsvector('simple', 'a');" {
+		t.Fatalf("expand = %q, %v", script, err)
+	}
+
+	// 名稱會被代入 SQL，不接受引號等字元
+	m.SearchConfig = "english'); DROP TABLE messages; --"
+	if _, err := m.expand("SELECT to_tsvector({{search_config}}, 'a');"); err == nil {
+		t.Fatal("expand accepted an invalid config name")
+	}
+	// 沒有參數的 migration 不檢查設定
+	if script, err := m.expand("CREATE TABLE a ();"); err != nil || script != "CREATE TABLE a ();" {
+		t.Fatalf("expand = %q, %v", script, err)
+	}
+}
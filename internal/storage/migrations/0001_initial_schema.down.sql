@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS user_presence;
+DROP TABLE IF EXISTS room_members;
+DROP TABLE IF EXISTS rooms;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS messages;
@@ -0,0 +1,7 @@
+-- 用戶全域狀態 (online/away/dnd/invisible) 與自訂狀態文字
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'online';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_text TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_emoji TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_users_status_expires_at ON users (status_expires_at) WHERE status_expires_at IS NOT NULL;
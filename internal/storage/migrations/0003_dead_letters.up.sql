@@ -0,0 +1,13 @@
+-- handler 重試後仍然失敗的事件
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id BIGSERIAL PRIMARY KEY,
+	handler_key TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	header JSONB,
+	data BYTEA NOT NULL,
+	error TEXT NOT NULL,
+	attempts INT NOT NULL,
+	failed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_dead_letters_handler_time ON dead_letters (handler_key, failed_at);
@@ -0,0 +1,5 @@
+-- 超過 36 個字元的 ID 無法轉回 VARCHAR(36)，這時回滾會失敗
+ALTER TABLE user_presence
+	ALTER COLUMN room_id TYPE VARCHAR(36),
+	ALTER COLUMN user_id TYPE VARCHAR(36),
+	ALTER COLUMN last_seen TYPE TIMESTAMP;
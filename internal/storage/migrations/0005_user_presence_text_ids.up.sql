@@ -0,0 +1,6 @@
+-- user_presence 的 ID 與其他資料表一樣使用 TEXT，不再限制 36 個字元；
+-- last_seen 改為 TIMESTAMPTZ，舊的值以資料庫的時區 (寫入時 NOW() 使用的時區) 解讀
+ALTER TABLE user_presence
+	ALTER COLUMN room_id TYPE TEXT,
+	ALTER COLUMN user_id TYPE TEXT,
+	ALTER COLUMN last_seen TYPE TIMESTAMPTZ;
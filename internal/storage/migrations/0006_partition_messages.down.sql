@@ -0,0 +1,25 @@
+-- 回到沒有分區的 messages；已經封存的月份不會搬回資料表，ID 超過 INTEGER 範圍時回滾會失敗
+CREATE TABLE messages_unpartitioned (
+	id SERIAL PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	sender_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	content TEXT NOT NULL,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO messages_unpartitioned (id, room_id, sender_id, sender, content, timestamp)
+SELECT id, room_id, sender_id, sender, content, timestamp
+FROM messages;
+
+SELECT setval(pg_get_serial_sequence('messages_unpartitioned', 'id'), COALESCE((SELECT MAX(id) FROM messages_unpartitioned), 0) + 1, false);
+
+-- 同時刪除所有分區與 BIGSERIAL 的序列
+DROP TABLE messages;
+
+ALTER TABLE messages_unpartitioned RENAME TO messages;
+ALTER TABLE messages RENAME CONSTRAINT messages_unpartitioned_pkey TO messages_pkey;
+ALTER SEQUENCE messages_unpartitioned_id_seq RENAME TO messages_id_seq;
+CREATE INDEX IF NOT EXISTS idx_messages_room_time ON messages (room_id, timestamp);
+
+DROP TABLE IF EXISTS message_archives;
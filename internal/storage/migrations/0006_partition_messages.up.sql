@@ -0,0 +1,57 @@
+-- messages 改為以 timestamp 按月 (UTC) 分區，ID 改為 64 位元
+-- 每個月份一個分區 messages_pYYYYMM，沒有對應分區的消息寫入 messages_default；
+-- 未來月份的分區由 MessageArchiver 預先建立，冷分區封存到本地檔案後記錄在 message_archives
+ALTER TABLE messages RENAME TO messages_unpartitioned;
+ALTER TABLE messages_unpartitioned RENAME CONSTRAINT messages_pkey TO messages_unpartitioned_pkey;
+ALTER INDEX IF EXISTS idx_messages_room_time RENAME TO idx_messages_unpartitioned_room_time;
+ALTER SEQUENCE messages_id_seq RENAME TO messages_unpartitioned_id_seq;
+
+-- 分區表的主鍵必須包含分區鍵
+CREATE TABLE messages (
+	id BIGSERIAL NOT NULL,
+	room_id TEXT NOT NULL,
+	sender_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	content TEXT NOT NULL,
+	timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (id, timestamp)
+) PARTITION BY RANGE (timestamp);
+
+CREATE INDEX idx_messages_room_time ON messages (room_id, timestamp);
+
+CREATE TABLE messages_default PARTITION OF messages DEFAULT;
+
+-- 為既有消息的每個月份與本月建立分區
+DO $$
+DECLARE
+	month TIMESTAMP;
+BEGIN
+	FOR month IN
+		SELECT DISTINCT date_trunc('month', timestamp AT TIME ZONE 'UTC') FROM messages_unpartitioned WHERE timestamp IS NOT NULL
+		UNION
+		SELECT date_trunc('month', now() AT TIME ZONE 'UTC')
+	LOOP
+		EXECUTE format('CREATE TABLE %I PARTITION OF messages FOR VALUES FROM (%L) TO (%L)',
+			'messages_p' || to_char(month, 'YYYYMM'),
+			month AT TIME ZONE 'UTC',
+			(month + interval '1 month') AT TIME ZONE 'UTC');
+	END LOOP;
+END $$;
+
+-- 沒有時間的舊消息放在 1970 年，歸入 messages_default
+INSERT INTO messages (id, room_id, sender_id, sender, content, timestamp)
+SELECT id, room_id, sender_id, sender, content, COALESCE(timestamp, 'epoch')
+FROM messages_unpartitioned;
+
+SELECT setval(pg_get_serial_sequence('messages', 'id'), COALESCE((SELECT MAX(id) FROM messages), 0) + 1, false);
+
+DROP TABLE messages_unpartitioned;
+
+-- 已經封存到本地檔案的月份，path 是該月份封存檔案的目錄
+CREATE TABLE IF NOT EXISTS message_archives (
+	month TIMESTAMPTZ PRIMARY KEY,
+	path TEXT NOT NULL,
+	messages BIGINT NOT NULL,
+	rooms INTEGER NOT NULL,
+	archived_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,4 @@
+-- pg_trgm 可能也被其他資料庫物件使用，不移除
+DROP INDEX IF EXISTS idx_messages_content_trgm;
+DROP INDEX IF EXISTS idx_messages_search;
+ALTER TABLE messages DROP COLUMN IF EXISTS search_vector;
@@ -0,0 +1,10 @@
+-- 消息全文搜尋：英文以 tsvector (english 設定，含詞幹) 比對，
+-- 中文等沒有空白分詞的文字以 pg_trgm 的三字元索引做子字串比對
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- 分區表新增的欄位與索引會套用到所有分區，之後建立的分區以 LIKE ... INCLUDING GENERATED 複製
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+	GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS idx_messages_content_trgm ON messages USING GIN (content gin_trgm_ops);
@@ -0,0 +1,15 @@
+-- 消息保留：每條消息可以有過期時間 (閱後即焚)，每個房間可以設定保留規則
+-- 過期或超出保留規則的消息由 messaging.RetentionSweeper 刪除，法律保全 (legal_hold) 中的房間不刪除任何消息
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_messages_expires_at ON messages (expires_at) WHERE expires_at IS NOT NULL;
+
+-- 沒有記錄的房間永久保留；mode 為 days 時保留最近 days 天，keep_last 時保留最後 keep_last 條
+CREATE TABLE IF NOT EXISTS room_retention (
+	room_id TEXT PRIMARY KEY REFERENCES rooms(id) ON DELETE CASCADE,
+	mode TEXT NOT NULL DEFAULT 'forever' CHECK (mode IN ('forever', 'days', 'keep_last')),
+	days INTEGER NOT NULL DEFAULT 0,
+	keep_last INTEGER NOT NULL DEFAULT 0,
+	legal_hold BOOLEAN NOT NULL DEFAULT false,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+-- 記錄 away 是否由閒置自動設定：用戶之後有活動時，任何一個實例都只恢復自動設定的 away
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_auto_away BOOLEAN NOT NULL DEFAULT false;
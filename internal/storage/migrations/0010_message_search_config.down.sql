@@ -0,0 +1,18 @@
+-- 恢復 0007 的 english 設定
+DO $$
+DECLARE
+	current_config TEXT;
+BEGIN
+	SELECT substring(pg_get_expr(d.adbin, d.adrelid) FROM '''([^'']+)''::regconfig') INTO current_config
+	FROM pg_attrdef d
+	JOIN pg_attribute a ON a.attrelid = d.adrelid AND a.attnum = d.adnum
+	WHERE d.adrelid = 'messages'::regclass AND a.attname = 'search_vector';
+
+	IF current_config IS NULL OR current_config::regconfig != 'english'::regconfig THEN
+		DROP INDEX IF EXISTS idx_messages_search;
+		ALTER TABLE messages DROP COLUMN IF EXISTS search_vector;
+		ALTER TABLE messages ADD COLUMN search_vector tsvector
+			GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+		CREATE INDEX idx_messages_search ON messages USING GIN (search_vector);
+	END IF;
+END $$;
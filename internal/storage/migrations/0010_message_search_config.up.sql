@@ -0,0 +1,19 @@
+-- 以 SEARCH_CONFIG ({{search_config}}) 重建 search_vector；0007 固定使用 english，
+-- 欄位已經是這個設定時 (預設的 english) 不重建，避免改寫所有分區
+DO $$
+DECLARE
+	current_config TEXT;
+BEGIN
+	SELECT substring(pg_get_expr(d.adbin, d.adrelid) FROM '''([^'']+)''::regconfig') INTO current_config
+	FROM pg_attrdef d
+	JOIN pg_attribute a ON a.attrelid = d.adrelid AND a.attnum = d.adnum
+	WHERE d.adrelid = 'messages'::regclass AND a.attname = 'search_vector';
+
+	IF current_config IS NULL OR current_config::regconfig != {{search_config}}::regconfig THEN
+		DROP INDEX IF EXISTS idx_messages_search;
+		ALTER TABLE messages DROP COLUMN IF EXISTS search_vector;
+		ALTER TABLE messages ADD COLUMN search_vector tsvector
+			GENERATED ALWAYS AS (to_tsvector({{search_config}}, content)) STORED;
+		CREATE INDEX idx_messages_search ON messages USING GIN (search_vector);
+	END IF;
+END $$;
@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// OutboxMessage 是等待發布的事件，與業務資料在同一個交易中寫入
+// relay 至少發布一次；EventID 作為去重 ID 寫入消息標頭，重複發布時由 JetStream 或訂閱端去重
+type OutboxMessage struct {
+	ID        int64               `json:"id"`
+	EventID   string              `json:"event_id"`
+	Subject   string              `json:"subject"`
+	Header    map[string][]string `json:"header,omitempty"`
+	Data      []byte              `json:"data"`
+	CreatedAt time.Time           `json:"created_at"`
+}
+
+// SaveMessageWithOutbox 在同一個交易中保存聊天消息與要發布的事件 (例如廣播)
+// 消息 ID 先從序列取得，event 因此可以把 ID 放進廣播；事件 ID 已經在 outbox 中時代表同一條消息
+// 已經保存過，不會再寫入一次，返回 0 (取得的 ID 只是留下空號)
+func (p *PostgresStore) SaveMessageWithOutbox(ctx context.Context, msg ChatMessage, event MessageEvent) (id int64, err error) {
+	err = pgx.BeginFunc(ctx, p.DB, func(tx pgx.Tx) error {
+		ids, err := nextMessageIDs(ctx, tx, 1)
+		if err != nil {
+			return err
+		}
+		msg.ID = ids[0]
+		out, err := event(msg)
+		if err != nil {
+			return err
+		}
+		inserted, err := insertOutbox(ctx, tx, out)
+		if err != nil || !inserted {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO messages (id, room_id, sender_id, sender, content, timestamp, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, msg.ID, msg.RoomID, msg.SenderID, msg.Sender, msg.Content, msg.Timestamp, msg.ExpiresAt); err != nil {
+			return fmt.Errorf("insert message: %w", err)
+		}
+		id = msg.ID
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// SaveMessagesWithOutbox 在同一個交易中保存一批消息與事件：先從序列一次取得整批的消息 ID，
+// 事件以 unnest 一次寫入 outbox，由 RETURNING 得知哪些事件是新的，再以 COPY 依序寫入這些事件的消息
+func (p *PostgresStore) SaveMessagesWithOutbox(ctx context.Context, batch []PendingMessage) ([]int64, error) {
+	saved := make([]int64, len(batch))
+	if len(batch) == 0 {
+		return saved, nil
+	}
+
+	err := pgx.BeginFunc(ctx, p.DB, func(tx pgx.Tx) error {
+		ids, err := nextMessageIDs(ctx, tx, len(batch))
+		if err != nil {
+			return err
+		}
+
+		messages := make([]ChatMessage, len(batch))
+		eventIDs := make([]string, len(batch))
+		subjects := make([]string, len(batch))
+		headers := make([]string, len(batch))
+		data := make([][]byte, len(batch))
+		for i, pending := range batch {
+			messages[i] = pending.Message
+			messages[i].ID = ids[i]
+			out, err := pending.Event(messages[i])
+			if err != nil {
+				return err
+			}
+			header, err := json.Marshal(out.Header)
+			if err != nil {
+				return fmt.Errorf("marshal outbox header: %w", err)
+			}
+			eventIDs[i] = out.EventID
+			subjects[i] = out.Subject
+			headers[i] = string(header)
+			data[i] = out.Data
+		}
+
+		rows, err := tx.Query(ctx, `
+			INSERT INTO outbox (event_id, subject, header, data)
+			SELECT event_id, subject, header::jsonb, data
+			FROM unnest($1::text[], $2::text[], $3::text[], $4::bytea[])
+				WITH ORDINALITY AS pending(event_id, subject, header, data, n)
+			ORDER BY n
+			ON CONFLICT (event_id) DO NOTHING
+			RETURNING event_id
+		`, eventIDs, subjects, headers, data)
+		if err != nil {
+			return fmt.Errorf("insert outbox: %w", err)
+		}
+		inserted, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("insert outbox: %w", err)
+		}
+
+		fresh := make(map[string]bool, len(inserted))
+		for _, id := range inserted {
+			fresh[id] = true
+		}
+		copyRows := make([][]any, 0, len(inserted))
+		for i, msg := range messages {
+			if !fresh[eventIDs[i]] {
+				continue
+			}
+			// 同一批中重複的事件只保存第一條
+			delete(fresh, eventIDs[i])
+			saved[i] = msg.ID
+			copyRows = append(copyRows, []any{msg.ID, msg.RoomID, msg.SenderID, msg.Sender, msg.Content, msg.Timestamp, msg.ExpiresAt})
+		}
+		if len(copyRows) == 0 {
+			return nil
+		}
+
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"messages"},
+			[]string{"id", "room_id", "sender_id", "sender", "content", "timestamp", "expires_at"},
+			pgx.CopyFromRows(copyRows)); err != nil {
+			return fmt.Errorf("copy messages: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return make([]int64, len(batch)), err
+	}
+	return saved, nil
+}
+
+// nextMessageIDs 從 messages.id 的序列取得 n 個遞增的 ID，依序分配給一批消息，保存順序與 ID 順序一致
+func nextMessageIDs(ctx context.Context, tx pgx.Tx, n int) ([]int64, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT nextval(pg_get_serial_sequence('messages', 'id')) FROM generate_series(1, $1)
+	`, n)
+	if err != nil {
+		return nil, fmt.Errorf("allocate message ids: %w", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("allocate message ids: %w", err)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// CreateRoomWithOutbox 創建房間 (房間名稱已存在時沿用既有的房間)，並在同一個交易中寫入 event 返回的事件
+func (p *PostgresStore) CreateRoomWithOutbox(ctx context.Context, name, createdBy string, event func(roomID string) (OutboxMessage, error)) (string, error) {
+	var roomID string
+	err := pgx.BeginFunc(ctx, p.DB, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, `SELECT id FROM rooms WHERE roomname = $1`, name).Scan(&roomID)
+		switch {
+		case err == nil:
+			log.Printf("Room already exists: %s", roomID)
+		case errors.Is(err, pgx.ErrNoRows):
+			roomID = uuid.NewString()
+			log.Printf("Creating room: ID=%s, Name=%s, CreatedBy=%s", roomID, name, createdBy)
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO rooms (id, roomname, created_by, created_at)
+				VALUES ($1, $2, $3, $4)
+			`, roomID, name, createdBy, time.Now().UTC()); err != nil {
+				return fmt.Errorf("insert room: %w", err)
+			}
+		default:
+			return err
+		}
+
+		out, err := event(roomID)
+		if err != nil {
+			return err
+		}
+		_, err = insertOutbox(ctx, tx, out)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error creating room: %v", err)
+		return "", err
+	}
+	return roomID, nil
+}
+
+// insertOutbox 寫入一筆 outbox 資料，同一個事件 ID 已經存在時忽略並返回 false
+func insertOutbox(ctx context.Context, tx pgx.Tx, out OutboxMessage) (bool, error) {
+	header, err := json.Marshal(out.Header)
+	if err != nil {
+		return false, fmt.Errorf("marshal outbox header: %w", err)
+	}
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO outbox (event_id, subject, header, data)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (event_id) DO NOTHING
+	`, out.EventID, out.Subject, header, out.Data)
+	if err != nil {
+		return false, fmt.Errorf("insert outbox: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// RelayOutbox 依寫入順序取出最多 limit 筆未發布的事件交給 publish，成功的標記為已發布
+// 以 FOR UPDATE SKIP LOCKED 鎖定，多個實例同時 relay 時不會拿到同一筆
+// publish 失敗時停止這一批，已經發布的仍然會標記；返回標記的筆數
+func (p *PostgresStore) RelayOutbox(ctx context.Context, limit int, publish func(OutboxMessage) error) (int, error) {
+	published := 0
+	var publishErr error
+	err := pgx.BeginFunc(ctx, p.DB, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			SELECT id, event_id, subject, header, data, created_at
+			FROM outbox
+			WHERE published_at IS NULL
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		`, limit)
+		if err != nil {
+			return err
+		}
+		pending, err := pgx.CollectRows(rows, scanOutbox)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]int64, 0, len(pending))
+		for _, out := range pending {
+			if publishErr = publish(out); publishErr != nil {
+				break
+			}
+			ids = append(ids, out.ID)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE outbox SET published_at = NOW() WHERE id = ANY($1)`, ids); err != nil {
+			return fmt.Errorf("mark outbox published: %w", err)
+		}
+		published = len(ids)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if publishErr != nil {
+		return published, fmt.Errorf("publish outbox: %w", publishErr)
+	}
+	return published, nil
+}
+
+// DeletePublishedOutbox 刪除 before 之前已經發布的事件
+func (p *PostgresStore) DeletePublishedOutbox(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := p.DB.Exec(ctx, `DELETE FROM outbox WHERE published_at IS NOT NULL AND published_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func scanOutbox(row pgx.CollectableRow) (OutboxMessage, error) {
+	var out OutboxMessage
+	var header []byte
+	if err := row.Scan(&out.ID, &out.EventID, &out.Subject, &header, &out.Data, &out.CreatedAt); err != nil {
+		return OutboxMessage{}, err
+	}
+	if len(header) > 0 {
+		if err := json.Unmarshal(header, &out.Header); err != nil {
+			return OutboxMessage{}, fmt.Errorf("unmarshal outbox header: %w", err)
+		}
+	}
+	return out, nil
+}
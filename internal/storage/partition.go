@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// messages 以 timestamp 按月 (UTC) 分區，每個月份是一個 messages_pYYYYMM 分區，
+// 沒有對應分區的消息寫入 messages_default (見 migrations/0006_partition_messages.up.sql)
+const (
+	messagePartitionPrefix  = "messages_p"
+	messagePartitionLayout  = "200601"
+	messageDefaultPartition = "messages_default"
+)
+
+// MessagePartition 是 messages 的一個月份分區，包含 [Month, Month+1 個月) 的消息
+type MessagePartition struct {
+	Name  string    `json:"name"`
+	Month time.Time `json:"month"`
+}
+
+// End 返回分區的上界 (不包含)
+func (p MessagePartition) End() time.Time {
+	return p.Month.AddDate(0, 1, 0)
+}
+
+// monthStart 返回 t 所在月份的第一天 (UTC)
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// partitionName 返回 month 所在月份的分區名稱
+func partitionName(month time.Time) string {
+	return messagePartitionPrefix + monthStart(month).Format(messagePartitionLayout)
+}
+
+// parsePartitionName 解析 messages_pYYYYMM，其他名稱 (例如 messages_default) 返回 false
+func parsePartitionName(name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(name, messagePartitionPrefix)
+	if !ok || len(suffix) != len(messagePartitionLayout) {
+		return time.Time{}, false
+	}
+	month, err := time.Parse(messagePartitionLayout, suffix)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return month, true
+}
+
+// MessagePartitions 返回 messages 目前的月份分區，由舊到新排序
+func (p *PostgresStore) MessagePartitions(ctx context.Context) ([]MessagePartition, error) {
+	rows, err := p.DB.Query(ctx, `
+		SELECT c.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'messages'::regclass
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list message partitions: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("list message partitions: %w", err)
+	}
+
+	var partitions []MessagePartition
+	for _, name := range names {
+		if month, ok := parsePartitionName(name); ok {
+			partitions = append(partitions, MessagePartition{Name: name, Month: month})
+		}
+	}
+	slices.SortFunc(partitions, func(a, b MessagePartition) int {
+		return a.Month.Compare(b.Month)
+	})
+	return partitions, nil
+}
+
+// EnsureMessagePartitions 建立 now 所在月份與之後 ahead 個月份還不存在的分區
+// 已經寫入 messages_default 的同月份消息會搬到新的分區；已經封存的月份不會重新建立
+func (p *PostgresStore) EnsureMessagePartitions(ctx context.Context, now time.Time, ahead int) ([]MessagePartition, error) {
+	existing, err := p.MessagePartitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := p.ArchivedMonths(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var created []MessagePartition
+	start := monthStart(now)
+	for i := 0; i <= ahead; i++ {
+		month := start.AddDate(0, i, 0)
+		exists := slices.ContainsFunc(existing, func(partition MessagePartition) bool {
+			return partition.Month.Equal(month)
+		})
+		if exists || slices.ContainsFunc(archived, month.Equal) {
+			continue
+		}
+
+		partition := MessagePartition{Name: partitionName(month), Month: month}
+		if err := p.createMessagePartition(ctx, partition); err != nil {
+			return created, err
+		}
+		created = append(created, partition)
+	}
+	return created, nil
+}
+
+// createMessagePartition 在一個交易中建立分區：
+// 先以 messages 的結構建立獨立的表，把 messages_default 中屬於這個月份的消息搬進去，再 ATTACH 為分區；
+// 直接 CREATE TABLE ... PARTITION OF 在 messages_default 已經有同月份的消息時會失敗
+func (p *PostgresStore) createMessagePartition(ctx context.Context, partition MessagePartition) error {
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	table := pgx.Identifier{partition.Name}.Sanitize()
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE %s (LIKE messages INCLUDING DEFAULTS INCLUDING CONSTRAINTS INCLUDING GENERATED)`, table)); err != nil {
+		return fmt.Errorf("create partition %s: %w", partition.Name, err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`
+		WITH moved AS (
+			DELETE FROM %s WHERE timestamp >= $1 AND timestamp < $2
+			RETURNING id, room_id, sender_id, sender, content, timestamp, expires_at
+		)
+		INSERT INTO %s (id, room_id, sender_id, sender, content, timestamp, expires_at)
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at FROM moved
+	`, messageDefaultPartition, table), partition.Month, partition.End()); err != nil {
+		return fmt.Errorf("move messages into partition %s: %w", partition.Name, err)
+	}
+	// ATTACH PARTITION 不接受參數，邊界以 UTC 的字面值寫入
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE messages ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')`,
+		table, partition.Month.Format(time.RFC3339), partition.End().Format(time.RFC3339))); err != nil {
+		return fmt.Errorf("attach partition %s: %w", partition.Name, err)
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetRetentionPolicy 獲取房間的保留規則，沒有設定過的房間返回永久保留
+func (p *PostgresStore) GetRetentionPolicy(ctx context.Context, roomID string) (*RetentionPolicy, error) {
+	policy := RetentionPolicy{RoomID: roomID}
+	var updatedAt *time.Time
+	err := p.DB.QueryRow(ctx, `
+		SELECT COALESCE(rr.mode, 'forever'), COALESCE(rr.days, 0), COALESCE(rr.keep_last, 0),
+			COALESCE(rr.legal_hold, false), rr.updated_at
+		FROM rooms r
+		LEFT JOIN room_retention rr ON rr.room_id = r.id
+		WHERE r.id = $1
+	`, roomID).Scan(&policy.Mode, &policy.Days, &policy.KeepLast, &policy.LegalHold, &updatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get retention policy: %w", err)
+	}
+	if updatedAt != nil {
+		policy.UpdatedAt = *updatedAt
+	}
+	return &policy, nil
+}
+
+// SetRetentionPolicy 設定房間的保留規則，不改變 LegalHold
+func (p *PostgresStore) SetRetentionPolicy(ctx context.Context, policy RetentionPolicy) (*RetentionPolicy, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	err := p.DB.QueryRow(ctx, `
+		INSERT INTO room_retention (room_id, mode, days, keep_last, updated_at)
+		SELECT id, $2, $3, $4, $5 FROM rooms WHERE id = $1
+		ON CONFLICT (room_id) DO UPDATE
+			SET mode = EXCLUDED.mode, days = EXCLUDED.days, keep_last = EXCLUDED.keep_last, updated_at = EXCLUDED.updated_at
+		RETURNING legal_hold, updated_at
+	`, policy.RoomID, policy.Mode, policy.Days, policy.KeepLast, time.Now().UTC()).Scan(&policy.LegalHold, &policy.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("set retention policy: %w", err)
+	}
+	return &policy, nil
+}
+
+// SetLegalHold 設定或解除房間的法律保全，不改變保留規則
+func (p *PostgresStore) SetLegalHold(ctx context.Context, roomID string, hold bool) (*RetentionPolicy, error) {
+	policy := RetentionPolicy{RoomID: roomID}
+	err := p.DB.QueryRow(ctx, `
+		INSERT INTO room_retention (room_id, legal_hold, updated_at)
+		SELECT id, $2, $3 FROM rooms WHERE id = $1
+		ON CONFLICT (room_id) DO UPDATE
+			SET legal_hold = EXCLUDED.legal_hold, updated_at = EXCLUDED.updated_at
+		RETURNING mode, days, keep_last, legal_hold, updated_at
+	`, roomID, hold, time.Now().UTC()).Scan(&policy.Mode, &policy.Days, &policy.KeepLast, &policy.LegalHold, &policy.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("set legal hold: %w", err)
+	}
+	return &policy, nil
+}
+
+// PurgeMessages 在一個交易中依序刪除過期的消息、超過保留天數的消息與最後 keep_last 條之前的消息，
+// 之後以 purgeArchives 把保留規則套用到已經封存的月份 (過期的消息在讀取封存時略過，不改寫檔案)
+// 多個實例同時執行時，每條被刪除的消息只會出現在其中一個實例的結果中
+func (p *PostgresStore) PurgeMessages(ctx context.Context, now time.Time) ([]PurgeResult, error) {
+	results := make(map[string]*PurgeResult)
+	result := func(roomID string) *PurgeResult {
+		if results[roomID] == nil {
+			results[roomID] = &PurgeResult{RoomID: roomID}
+		}
+		return results[roomID]
+	}
+
+	err := pgx.BeginFunc(ctx, p.DB, func(tx pgx.Tx) error {
+		// 過期的消息
+		rows, err := tx.Query(ctx, `
+			WITH deleted AS (
+				DELETE FROM messages m
+				WHERE m.expires_at <= $1
+					AND NOT EXISTS (SELECT 1 FROM room_retention rr WHERE rr.room_id = m.room_id AND rr.legal_hold)
+				RETURNING m.room_id
+			)
+			SELECT room_id, count(*) FROM deleted GROUP BY room_id
+		`, now)
+		if err != nil {
+			return fmt.Errorf("purge expired messages: %w", err)
+		}
+		var roomID string
+		var deleted int64
+		if _, err := pgx.ForEachRow(rows, []any{&roomID, &deleted}, func() error {
+			r := result(roomID)
+			r.ExpiredBefore = &now
+			r.Deleted += deleted
+			return nil
+		}); err != nil {
+			return fmt.Errorf("purge expired messages: %w", err)
+		}
+
+		// 超過保留天數與最後 keep_last 條之前的消息，刪除時間早於 cutoff 的消息
+		for name, query := range map[string]string{
+			RetentionDays: `
+				WITH deleted AS (
+					DELETE FROM messages m
+					USING room_retention rr
+					WHERE rr.room_id = m.room_id AND rr.mode = 'days' AND NOT rr.legal_hold
+						AND m.timestamp < $1::timestamptz - make_interval(days => rr.days)
+					RETURNING m.room_id, $1::timestamptz - make_interval(days => rr.days) AS cutoff
+				)
+				SELECT room_id, max(cutoff), count(*) FROM deleted GROUP BY room_id
+			`,
+			// 系統消息不計入 keep_last，但與之前的消息一起刪除
+			RetentionKeepLast: `
+				WITH ranked AS (
+					SELECT m.room_id, m.timestamp, rr.keep_last,
+						row_number() OVER (PARTITION BY m.room_id ORDER BY m.timestamp DESC, m.id DESC) AS n
+					FROM messages m
+					JOIN room_retention rr ON rr.room_id = m.room_id
+					WHERE rr.mode = 'keep_last' AND NOT rr.legal_hold AND m.sender_id != 'system'
+				), cutoffs AS (
+					SELECT room_id, timestamp AS cutoff FROM ranked WHERE n = keep_last
+				), deleted AS (
+					DELETE FROM messages m
+					USING cutoffs c
+					WHERE m.room_id = c.room_id AND m.timestamp < c.cutoff
+					RETURNING m.room_id, c.cutoff
+				)
+				SELECT room_id, max(cutoff), count(*) FROM deleted GROUP BY room_id
+			`,
+		} {
+			rows, err := tx.Query(ctx, query, now)
+			if err != nil {
+				return fmt.Errorf("purge messages by %s: %w", name, err)
+			}
+			var cutoff time.Time
+			if _, err := pgx.ForEachRow(rows, []any{&roomID, &cutoff, &deleted}, func() error {
+				r := result(roomID)
+				if r.RemovedBefore == nil || cutoff.After(*r.RemovedBefore) {
+					removedBefore := cutoff
+					r.RemovedBefore = &removedBefore
+				}
+				r.Deleted += deleted
+				return nil
+			}); err != nil {
+				return fmt.Errorf("purge messages by %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 資料庫中的消息已經刪除，封存檔案的錯誤只記錄，下次清理時重試
+	if err := p.purgeArchives(ctx, now, result); err != nil {
+		log.Printf("Failed to purge archived messages: %v", err)
+	}
+	return SortPurgeResults(results), nil
+}
+
+// archivedRetention 是有保留規則的房間，stored 是資料庫中的非系統消息數量
+type archivedRetention struct {
+	RetentionPolicy
+	stored int64
+}
+
+// purgeArchives 刪除封存檔案中超過保留天數與最後 keep_last 條之前的消息，keep_last 同時計算資料庫中的消息
+// 與封存工作使用同一個 advisory lock，不會與封存或其他實例同時改寫檔案；鎖被佔用時這次略過
+func (p *PostgresStore) purgeArchives(ctx context.Context, now time.Time, result func(roomID string) *PurgeResult) error {
+	archives, err := p.MessageArchives(ctx)
+	if err != nil || len(archives) == 0 {
+		return err
+	}
+
+	conn, err := p.DB.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, archiveLockKey).Scan(&locked); err != nil {
+		return fmt.Errorf("try archive lock: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+	defer func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.Exec(unlockCtx, `SELECT pg_advisory_unlock($1)`, archiveLockKey); err != nil {
+			log.Printf("Failed to release archive lock: %v", err)
+		}
+	}()
+
+	rows, err := conn.Query(ctx, `
+		SELECT rr.room_id, rr.mode, rr.days, rr.keep_last,
+			CASE WHEN rr.mode = 'keep_last' THEN
+				(SELECT count(*) FROM messages m WHERE m.room_id = rr.room_id AND m.sender_id != 'system')
+			ELSE 0 END
+		FROM room_retention rr
+		WHERE rr.mode IN ('days', 'keep_last') AND NOT rr.legal_hold
+	`)
+	if err != nil {
+		return fmt.Errorf("list retention policies: %w", err)
+	}
+	rooms, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (archivedRetention, error) {
+		var r archivedRetention
+		err := row.Scan(&r.RoomID, &r.Mode, &r.Days, &r.KeepLast, &r.stored)
+		return r, err
+	})
+	if err != nil {
+		return fmt.Errorf("list retention policies: %w", err)
+	}
+
+	for _, room := range rooms {
+		// keep_last 在封存檔案中還可以保留的非系統消息數量，由新到舊的月份依序扣除
+		remaining := int64(room.KeepLast) - room.stored
+		for _, a := range slices.Backward(archives) {
+			dir := p.archivePath(a)
+			var cutoff time.Time
+			switch room.Mode {
+			case RetentionDays:
+				cutoff = now.AddDate(0, 0, -room.Days)
+				if !a.Month.Before(cutoff) {
+					continue
+				}
+			case RetentionKeepLast:
+				if remaining <= 0 {
+					cutoff = a.Month.AddDate(0, 1, 0)
+					break
+				}
+				messages, err := readArchiveFile(dir, room.RoomID, func(msg ChatMessage) bool { return msg.SenderID != "system" })
+				if err != nil {
+					log.Printf("Failed to read archived messages of room %s for %s: %v", room.RoomID, a.Month.Format(archiveDirLayout), err)
+					continue
+				}
+				if int64(len(messages)) <= remaining {
+					remaining -= int64(len(messages))
+					continue
+				}
+				cutoff = messages[int64(len(messages))-remaining].Timestamp
+				remaining = 0
+			}
+
+			deleted, removedFile, err := rewriteArchiveFile(dir, room.RoomID, func(msg ChatMessage) bool {
+				return !msg.Timestamp.Before(cutoff)
+			})
+			if err != nil {
+				log.Printf("Failed to purge archived messages of room %s for %s: %v", room.RoomID, a.Month.Format(archiveDirLayout), err)
+				continue
+			}
+			if deleted == 0 {
+				continue
+			}
+			removedRooms := 0
+			if removedFile {
+				removedRooms = 1
+			}
+			if _, err := conn.Exec(ctx, `
+				UPDATE message_archives SET messages = messages - $2, rooms = rooms - $3 WHERE month = $1
+			`, a.Month, deleted, removedRooms); err != nil {
+				return fmt.Errorf("update archive %s: %w", a.Month.Format(archiveDirLayout), err)
+			}
+
+			r := result(room.RoomID)
+			if r.RemovedBefore == nil || cutoff.After(*r.RemovedBefore) {
+				removedBefore := cutoff
+				r.RemovedBefore = &removedBefore
+			}
+			r.Deleted += deleted
+		}
+	}
+	return nil
+}
+
+// archiveRetentionCutoff 返回讀取封存檔案時房間保留規則允許的最早時間，nil 代表不限制
+// 清理工作執行之前，超出保留規則的封存消息也不返回；keep_last 只在資料庫中已經有 keep_last 條消息時
+// 略過所有封存的消息，資料庫中不足的部分由 purgeArchives 修剪
+func (p *PostgresStore) archiveRetentionCutoff(ctx context.Context, roomID string, now time.Time) (*time.Time, error) {
+	policy, err := p.GetRetentionPolicy(ctx, roomID)
+	if errors.Is(err, ErrRoomNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if policy.LegalHold {
+		return nil, nil
+	}
+
+	switch policy.Mode {
+	case RetentionDays:
+		cutoff := now.AddDate(0, 0, -policy.Days)
+		return &cutoff, nil
+	case RetentionKeepLast:
+		var cutoff time.Time
+		err := p.DB.QueryRow(ctx, `
+			SELECT timestamp FROM messages
+			WHERE room_id = $1 AND sender_id != 'system'
+			ORDER BY timestamp DESC, id DESC
+			OFFSET $2 LIMIT 1
+		`, roomID, policy.KeepLast-1).Scan(&cutoff)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get retention cutoff: %w", err)
+		}
+		return &cutoff, nil
+	}
+	return nil, nil
+}
+
+// SortPurgeResults 依房間 ID 排序每個房間的清理結果
+func SortPurgeResults(results map[string]*PurgeResult) []PurgeResult {
+	sorted := make([]PurgeResult, 0, len(results))
+	for _, r := range results {
+		sorted = append(sorted, *r)
+	}
+	slices.SortFunc(sorted, func(a, b PurgeResult) int {
+		return strings.Compare(a.RoomID, b.RoomID)
+	})
+	return sorted
+}
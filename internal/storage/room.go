@@ -2,13 +2,18 @@ package storage
 
 import (
 	"context"
+	"errors"
 	// "fmt"
 	"log"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
+// ErrRoomNotFound 找不到指定的房間
+var ErrRoomNotFound = errors.New("room not found")
+
 func (p *PostgresStore) CreateRoom(ctx context.Context, name, createdBy string) (string, error) {
 
 	// Check if the room exist or not
@@ -84,6 +89,50 @@ func (p *PostgresStore) GetUserRooms(ctx context.Context, userID string) ([]Room
 	return rooms, nil
 }
 
+// GetRoom 獲取房間資訊，房間不存在時返回 ErrRoomNotFound
+func (p *PostgresStore) GetRoom(ctx context.Context, roomID string) (*Room, error) {
+	var room Room
+	err := p.DB.QueryRow(ctx, `
+		SELECT id, roomname, created_by, created_at FROM rooms WHERE id = $1
+	`, roomID).Scan(&room.ID, &room.RoomName, &room.CreatedBy, &room.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// GetRoomMembers 獲取房間成員，按加入時間排序，沒有在線記錄的成員視為離線
+func (p *PostgresStore) GetRoomMembers(ctx context.Context, roomID string) ([]RoomMember, error) {
+	rows, err := p.DB.Query(ctx, `
+		SELECT m.user_id, u.username, m.joined_at, COALESCE(pr.is_online, false), pr.last_seen
+		FROM room_members m
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN user_presence pr ON pr.room_id = m.room_id AND pr.user_id = m.user_id
+		WHERE m.room_id = $1
+		ORDER BY m.joined_at
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (RoomMember, error) {
+		var member RoomMember
+		err := row.Scan(&member.UserID, &member.Username, &member.JoinedAt, &member.IsOnline, &member.LastSeen)
+		return member, err
+	})
+}
+
+// IsRoomMember 用戶是否為房間成員
+func (p *PostgresStore) IsRoomMember(ctx context.Context, roomID, userID string) (bool, error) {
+	var member bool
+	err := p.DB.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id = $1 AND user_id = $2)
+	`, roomID, userID).Scan(&member)
+	return member, err
+}
+
 // RemoveUserFromRoom 從房間中移除用戶
 func (p *PostgresStore) RemoveUserFromRoom(ctx context.Context, userID, roomID string) error {
 	// 從 room_members 表中刪除記錄
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"html"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// DefaultSearchLimit 沒有指定數量時返回的搜尋結果數
+	DefaultSearchLimit = 20
+	// MaxSearchLimit 一次搜尋最多返回的結果數
+	MaxSearchLimit = 100
+
+	// DefaultSearchConfig 沒有以 WithSearchConfig 設置時 messages.search_vector 與搜尋使用的 text search 設定
+	DefaultSearchConfig = "english"
+)
+
+// searchConfigName 限制 text search 設定的名稱 (可以帶 schema)，名稱會被代入 migration 的 SQL
+var searchConfigName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// ValidSearchConfig 判斷 name 是否可以作為 text search 設定的名稱，設定是否存在由資料庫檢查
+func ValidSearchConfig(name string) bool {
+	return searchConfigName.MatchString(name)
+}
+
+// attachmentRegex 判斷消息是否帶有附件：消息目前只有文字，分享檔案與圖片都是貼上連結
+// 同一個表達式也用於 Postgres 的 ~* (不分大小寫)
+const attachmentRegex = `https?://\S+`
+
+var attachmentPattern = regexp.MustCompile(`(?i)` + attachmentRegex)
+
+// MessageSearch 是一次消息搜尋的條件
+type MessageSearch struct {
+	Query string
+	// RoomIDs 搜尋的房間，呼叫端只傳入用戶所屬的房間；為空時沒有任何結果
+	RoomIDs       []string
+	SenderID      string
+	From, To      time.Time // 時間範圍 [From, To)，零值代表不限制
+	HasAttachment bool
+	Limit         int
+}
+
+// SearchResult 是一條符合搜尋的消息
+type SearchResult struct {
+	ChatMessage
+	// Highlight 是可以直接顯示的 HTML：內容已經轉義，符合的部分以 <mark> 標示
+	Highlight string  `json:"highlight"`
+	Rank      float64 `json:"rank"`
+}
+
+// Normalize 去除查詢的空白並把 Limit 限制在 [1, MaxSearchLimit]
+func (s MessageSearch) Normalize() MessageSearch {
+	s.Query = strings.TrimSpace(s.Query)
+	if s.Limit <= 0 {
+		s.Limit = DefaultSearchLimit
+	}
+	s.Limit = min(s.Limit, MaxSearchLimit)
+	return s
+}
+
+// Matches 以子字串 (不分大小寫) 判斷消息是否符合搜尋，供沒有全文索引的後端使用
+func (s MessageSearch) Matches(msg ChatMessage) bool {
+	if msg.SenderID == "system" || msg.Expired(time.Now()) || !slices.Contains(s.RoomIDs, msg.RoomID) {
+		return false
+	}
+	if s.SenderID != "" && msg.SenderID != s.SenderID {
+		return false
+	}
+	if !s.From.IsZero() && msg.Timestamp.Before(s.From) {
+		return false
+	}
+	if !s.To.IsZero() && !msg.Timestamp.Before(s.To) {
+		return false
+	}
+	if s.HasAttachment && !HasAttachment(msg.Content) {
+		return false
+	}
+	// 與 websearch_to_tsquery 相同，所有查詢詞都要出現
+	terms := s.Terms()
+	content := strings.ToLower(msg.Content)
+	for _, term := range terms {
+		if !strings.Contains(content, strings.ToLower(term)) {
+			return false
+		}
+	}
+	return len(terms) > 0
+}
+
+// SearchResultOf 返回 msg 的搜尋結果，Rank 是查詢詞出現的次數
+func (s MessageSearch) SearchResultOf(msg ChatMessage) SearchResult {
+	matches := searchTermsPattern(s.Query).FindAllStringIndex(msg.Content, -1)
+	return SearchResult{ChatMessage: msg, Highlight: markMatches(msg.Content, matches), Rank: float64(len(matches))}
+}
+
+// HasAttachment 判斷消息內容是否帶有附件 (連結)
+func HasAttachment(content string) bool {
+	return attachmentPattern.MatchString(content)
+}
+
+// Terms 返回查詢中的詞，長的在前；供沒有全文索引的後端以子字串比對
+func (s MessageSearch) Terms() []string {
+	return searchTerms(s.Query)
+}
+
+// searchTerms 把查詢拆成詞，去掉 websearch 語法的引號與排除符號
+func searchTerms(query string) []string {
+	var terms []string
+	for _, term := range strings.Fields(query) {
+		term = strings.Trim(term, `"-`)
+		if term != "" && !strings.EqualFold(term, "or") {
+			terms = append(terms, term)
+		}
+	}
+	// 長的詞優先，"hello" 不會被 "hell" 切斷
+	slices.SortFunc(terms, func(a, b string) int {
+		return cmp.Compare(len(b), len(a))
+	})
+	return terms
+}
+
+// searchTermsPattern 符合任何一個查詢詞的正則表達式 (不分大小寫)
+func searchTermsPattern(query string) *regexp.Regexp {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return regexp.MustCompile(`$^`)
+	}
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+}
+
+// Highlight 轉義 content 並以 <mark> 標示查詢詞出現的位置
+func Highlight(content, query string) string {
+	return markMatches(content, searchTermsPattern(query).FindAllStringIndex(content, -1))
+}
+
+func markMatches(content string, matches [][]int) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(html.EscapeString(content[last:m[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(content[m[0]:m[1]]))
+		b.WriteString("</mark>")
+		last = m[1]
+	}
+	b.WriteString(html.EscapeString(content[last:]))
+	return b.String()
+}
+
+// ts_headline 以控制字元標示符合的部分，轉義後再換成 <mark>，消息內容中的 HTML 不會被執行
+const (
+	headlineStart = "\x02"
+	headlineStop  = "\x03"
+)
+
+var headlineOptions = fmt.Sprintf(`StartSel=%s, StopSel=%s, MaxFragments=2, MaxWords=30, MinWords=10, FragmentDelimiter=" … "`, headlineStart, headlineStop)
+
+// headlineHTML 把 ts_headline 的結果轉換成 HTML；沒有標示任何詞時 (例如中文的子字串比對) 自行標示完整內容
+func headlineHTML(headline, content, query string) string {
+	if !strings.Contains(headline, headlineStart) {
+		return Highlight(content, query)
+	}
+	escaped := html.EscapeString(headline)
+	return strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>").Replace(escaped)
+}
+
+// EscapeLike 轉義 LIKE 的萬用字元，以反斜線作為轉義字元 (Postgres 的預設，SQLite 需要 ESCAPE)
+func EscapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SearchMessages 以全文索引 (預設英文詞幹，見 WithSearchConfig) 與三字元索引 (中文等子字串) 搜尋消息，相關度高、時間新的在前
+// 已經封存到檔案的月份不在搜尋範圍內
+func (p *PostgresStore) SearchMessages(ctx context.Context, search MessageSearch) ([]SearchResult, error) {
+	search = search.Normalize()
+	if search.Query == "" || len(search.RoomIDs) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	var from, to *time.Time
+	if !search.From.IsZero() {
+		from = &search.From
+	}
+	if !search.To.IsZero() {
+		to = &search.To
+	}
+
+	rows, err := p.DB.Query(ctx, `
+		WITH q AS (SELECT websearch_to_tsquery($1::regconfig, $2) AS query)
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at,
+			ts_headline($1::regconfig, content, q.query, $3),
+			ts_rank(search_vector, q.query) + similarity(content, $2) AS rank
+		FROM messages, q
+		WHERE room_id = ANY($4)
+			AND sender_id != 'system'
+			AND (expires_at IS NULL OR expires_at > now())
+			AND (search_vector @@ q.query OR content ILIKE '%' || $5 || '%')
+			AND ($6 = '' OR sender_id = $6)
+			AND ($7::timestamptz IS NULL OR timestamp >= $7)
+			AND ($8::timestamptz IS NULL OR timestamp < $8)
+			AND (NOT $9 OR content ~* $10)
+		ORDER BY rank DESC, timestamp DESC
+		LIMIT $11
+	`, p.searchConfig, search.Query, headlineOptions, search.RoomIDs, EscapeLike(search.Query),
+		search.SenderID, from, to, search.HasAttachment, attachmentRegex, search.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("search messages: %w", err)
+	}
+	results, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (SearchResult, error) {
+		var r SearchResult
+		var headline string
+		err := row.Scan(&r.ID, &r.RoomID, &r.SenderID, &r.Sender, &r.Content, &r.Timestamp, &r.ExpiresAt, &headline, &r.Rank)
+		r.Highlight = headlineHTML(headline, r.Content, search.Query)
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("search messages: %w", err)
+	}
+	return results, nil
+}
+
+// SortSearchResults 以 Rank 排序，相同時時間新的在前，並截取前 limit 條；
+// 供沒有全文索引的後端使用
+func SortSearchResults(results []SearchResult, limit int) []SearchResult {
+	slices.SortStableFunc(results, func(a, b SearchResult) int {
+		if c := cmp.Compare(b.Rank, a.Rank); c != 0 {
+			return c
+		}
+		return b.Timestamp.Compare(a.Timestamp)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
@@ -0,0 +1,203 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// SaveDeadLetter 寫入一筆死信
+func (s *Store) SaveDeadLetter(ctx context.Context, letter storage.DeadLetter) error {
+	header, err := json.Marshal(letter.Header)
+	if err != nil {
+		return fmt.Errorf("marshal dead letter header: %w", err)
+	}
+	if letter.FailedAt.IsZero() {
+		letter.FailedAt = now()
+	}
+
+	_, err = s.DB.ExecContext(ctx, `
+		INSERT INTO dead_letters (handler_key, subject, header, data, error, attempts, failed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, letter.HandlerKey, letter.Subject, string(header), letter.Data, letter.Error, letter.Attempts, letter.FailedAt.UTC())
+	return err
+}
+
+// ListDeadLetters 依失敗時間由新到舊列出死信，handlerKey 為空時列出所有 handler 的死信
+func (s *Store) ListDeadLetters(ctx context.Context, handlerKey string, limit int) ([]storage.DeadLetter, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT id, handler_key, subject, header, data, error, attempts, failed_at
+		FROM dead_letters
+		WHERE ?1 = '' OR handler_key = ?1
+		ORDER BY failed_at DESC, id DESC
+		LIMIT ?2
+	`, handlerKey, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []storage.DeadLetter{}
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+// GetDeadLetter 取得一筆死信
+func (s *Store) GetDeadLetter(ctx context.Context, id int64) (*storage.DeadLetter, error) {
+	row := s.DB.QueryRowContext(ctx, `
+		SELECT id, handler_key, subject, header, data, error, attempts, failed_at
+		FROM dead_letters WHERE id = ?
+	`, id)
+	letter, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// DeleteDeadLetter 刪除一筆死信 (丟棄或已經重新發布)
+func (s *Store) DeleteDeadLetter(ctx context.Context, id int64) error {
+	result, err := s.DB.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return storage.ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// scanner 是 *sql.Row 與 *sql.Rows 共同的方法
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDeadLetter(row scanner) (storage.DeadLetter, error) {
+	var letter storage.DeadLetter
+	var header sql.NullString
+	if err := row.Scan(&letter.ID, &letter.HandlerKey, &letter.Subject, &header, &letter.Data, &letter.Error, &letter.Attempts, &letter.FailedAt); err != nil {
+		return storage.DeadLetter{}, err
+	}
+	if header.Valid && header.String != "" {
+		if err := json.Unmarshal([]byte(header.String), &letter.Header); err != nil {
+			return storage.DeadLetter{}, fmt.Errorf("unmarshal dead letter header: %w", err)
+		}
+	}
+	return letter, nil
+}
+
+// insertOutbox 寫入一筆 outbox 資料，同一個事件 ID 已經存在時忽略並返回 false
+func insertOutbox(ctx context.Context, tx *sql.Tx, out storage.OutboxMessage) (bool, error) {
+	header, err := json.Marshal(out.Header)
+	if err != nil {
+		return false, fmt.Errorf("marshal outbox header: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO outbox (event_id, subject, header, data, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (event_id) DO NOTHING
+	`, out.EventID, out.Subject, string(header), out.Data, now())
+	if err != nil {
+		return false, fmt.Errorf("insert outbox: %w", err)
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// RelayOutbox 依寫入順序取出最多 limit 筆未發布的事件交給 publish，成功的標記為已發布
+// 交易一開始就取得寫入鎖，同時 relay 的連線會等待，不會拿到同一筆
+// publish 失敗時停止這一批，已經發布的仍然會標記；返回標記的筆數
+func (s *Store) RelayOutbox(ctx context.Context, limit int, publish func(storage.OutboxMessage) error) (int, error) {
+	published := 0
+	var publishErr error
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		pending, err := pendingOutbox(ctx, tx, limit)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]any, 0, len(pending))
+		for _, out := range pending {
+			if publishErr = publish(out); publishErr != nil {
+				break
+			}
+			ids = append(ids, out.ID)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+		args := append([]any{now()}, ids...)
+		if _, err := tx.ExecContext(ctx, `UPDATE outbox SET published_at = ? WHERE id IN (`+placeholders+`)`, args...); err != nil {
+			return fmt.Errorf("mark outbox published: %w", err)
+		}
+		published = len(ids)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if publishErr != nil {
+		return published, fmt.Errorf("publish outbox: %w", publishErr)
+	}
+	return published, nil
+}
+
+func pendingOutbox(ctx context.Context, tx *sql.Tx, limit int) ([]storage.OutboxMessage, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, event_id, subject, header, data, created_at
+		FROM outbox
+		WHERE published_at IS NULL
+		ORDER BY id
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []storage.OutboxMessage
+	for rows.Next() {
+		var out storage.OutboxMessage
+		var header sql.NullString
+		if err := rows.Scan(&out.ID, &out.EventID, &out.Subject, &header, &out.Data, &out.CreatedAt); err != nil {
+			return nil, err
+		}
+		if header.Valid && header.String != "" {
+			if err := json.Unmarshal([]byte(header.String), &out.Header); err != nil {
+				return nil, fmt.Errorf("unmarshal outbox header: %w", err)
+			}
+		}
+		pending = append(pending, out)
+	}
+	return pending, rows.Err()
+}
+
+// DeletePublishedOutbox 刪除 before 之前已經發布的事件
+func (s *Store) DeletePublishedOutbox(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.DB.ExecContext(ctx, `
+		DELETE FROM outbox WHERE published_at IS NOT NULL AND published_at < ?
+	`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
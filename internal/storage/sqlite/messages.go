@@ -0,0 +1,201 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// execer 是 *sql.DB 與 *sql.Tx 共同的方法，同一段 SQL 可以在交易內外執行
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (s *Store) SaveMessage(ctx context.Context, msg storage.ChatMessage) error {
+	_, err := insertMessage(ctx, s.DB, msg)
+	return err
+}
+
+// insertMessage 寫入一條消息並返回分配的 ID
+func insertMessage(ctx context.Context, db execer, msg storage.ChatMessage) (int64, error) {
+	var expiresAt any
+	if msg.ExpiresAt != nil {
+		expiresAt = msg.ExpiresAt.UTC()
+	}
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO messages (room_id, sender_id, sender, content, timestamp, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, msg.RoomID, msg.SenderID, msg.Sender, msg.Content, msg.Timestamp.UTC(), expiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// SaveMessageWithOutbox 在同一個交易中保存聊天消息與要發布的事件，事件 ID 已經存在時返回 0
+func (s *Store) SaveMessageWithOutbox(ctx context.Context, msg storage.ChatMessage, event storage.MessageEvent) (id int64, err error) {
+	ids, err := s.SaveMessagesWithOutbox(ctx, []storage.PendingMessage{{Message: msg, Event: event}})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// SaveMessagesWithOutbox 在同一個交易中依序保存一批消息，事件 ID 已經存在的消息略過
+// SQLite 只有一個寫入者，批次寫入省下的是每個交易的 fsync
+// 消息先寫入取得 ID，再產生事件；事件重複時刪除剛寫入的消息 (AUTOINCREMENT 不會重用這個 ID)
+func (s *Store) SaveMessagesWithOutbox(ctx context.Context, batch []storage.PendingMessage) ([]int64, error) {
+	saved := make([]int64, len(batch))
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		for i, pending := range batch {
+			msg := pending.Message
+			id, err := insertMessage(ctx, tx, msg)
+			if err != nil {
+				return fmt.Errorf("insert message: %w", err)
+			}
+			msg.ID = id
+			out, err := pending.Event(msg)
+			if err != nil {
+				return err
+			}
+			inserted, err := insertOutbox(ctx, tx, out)
+			if err != nil {
+				return err
+			}
+			if !inserted {
+				if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id = ?`, id); err != nil {
+					return fmt.Errorf("delete duplicate message: %w", err)
+				}
+				continue
+			}
+			saved[i] = id
+		}
+		return nil
+	})
+	if err != nil {
+		return make([]int64, len(batch)), err
+	}
+	return saved, nil
+}
+
+func (s *Store) GetRecentMessages(ctx context.Context, roomID string, limit int) ([]storage.ChatMessage, error) {
+	// 與 Postgres 相同：先選出最近的消息，再由舊到新排序，排除系統消息
+	return s.queryMessages(ctx, `
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at FROM (
+			SELECT id, room_id, sender_id, sender, content, timestamp, expires_at
+			FROM messages
+			WHERE room_id = ? AND sender_id != 'system' AND (expires_at IS NULL OR expires_at > ?)
+			ORDER BY timestamp DESC, id DESC
+			LIMIT ?
+		)
+		ORDER BY timestamp ASC, id ASC
+	`, roomID, now(), limit)
+}
+
+func (s *Store) GetMessagesBefore(ctx context.Context, roomID string, before storage.MessageCursor, limit int) ([]storage.ChatMessage, error) {
+	ts := before.Timestamp.UTC()
+	return s.queryMessages(ctx, `
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at FROM (
+			SELECT id, room_id, sender_id, sender, content, timestamp, expires_at
+			FROM messages
+			WHERE room_id = ? AND sender_id != 'system' AND (timestamp < ? OR (timestamp = ? AND id < ?))
+				AND (expires_at IS NULL OR expires_at > ?)
+			ORDER BY timestamp DESC, id DESC
+			LIMIT ?
+		)
+		ORDER BY timestamp ASC, id ASC
+	`, roomID, ts, ts, before.ID, now(), limit)
+}
+
+func (s *Store) GetMessagesByTimeRange(ctx context.Context, roomID string, startTime, endTime time.Time) ([]storage.ChatMessage, error) {
+	return s.queryMessages(ctx, `
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at
+		FROM messages
+		WHERE room_id = ? AND timestamp BETWEEN ? AND ? AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY timestamp ASC, id ASC
+	`, roomID, startTime.UTC(), endTime.UTC(), now())
+}
+
+// SearchMessages 以 LIKE 子字串比對查詢詞，所有詞都要出現；相關度是查詢詞出現的次數，在 SQL 中排序並截取
+// SQLite 的 LIKE 與 lower() 只對 ASCII 不分大小寫
+func (s *Store) SearchMessages(ctx context.Context, search storage.MessageSearch) ([]storage.SearchResult, error) {
+	search = search.Normalize()
+	results := []storage.SearchResult{}
+	terms := search.Terms()
+	if len(terms) == 0 || len(search.RoomIDs) == 0 {
+		return results, nil
+	}
+
+	// 每個詞出現的次數：去掉這個詞之後內容變短了多少
+	var rank []string
+	var rankArgs []any
+	for _, term := range terms {
+		rank = append(rank, `(length(content) - length(replace(lower(content), ?, ''))) / length(?)`)
+		rankArgs = append(rankArgs, strings.ToLower(term), strings.ToLower(term))
+	}
+	args := make([]any, 0, len(search.RoomIDs)+len(terms)+len(rankArgs)+5)
+	query := `
+		SELECT id, room_id, sender_id, sender, content, timestamp, expires_at
+		FROM messages
+		WHERE room_id IN (` + strings.TrimSuffix(strings.Repeat("?,", len(search.RoomIDs)), ",") + `)
+			AND sender_id != 'system' AND (expires_at IS NULL OR expires_at > ?)`
+	for _, roomID := range search.RoomIDs {
+		args = append(args, roomID)
+	}
+	args = append(args, now())
+	for _, term := range terms {
+		query += ` AND content LIKE ? ESCAPE '\'`
+		args = append(args, "%"+storage.EscapeLike(term)+"%")
+	}
+	if search.SenderID != "" {
+		query += ` AND sender_id = ?`
+		args = append(args, search.SenderID)
+	}
+	if !search.From.IsZero() {
+		query += ` AND timestamp >= ?`
+		args = append(args, search.From.UTC())
+	}
+	if !search.To.IsZero() {
+		query += ` AND timestamp < ?`
+		args = append(args, search.To.UTC())
+	}
+	if search.HasAttachment {
+		// 粗略篩選，確切的判斷在下面以 storage.HasAttachment 完成
+		query += ` AND (content LIKE '%http://%' OR content LIKE '%https://%')`
+	}
+	query += ` ORDER BY ` + strings.Join(rank, " + ") + ` DESC, timestamp DESC LIMIT ?`
+	args = append(append(args, rankArgs...), search.Limit)
+
+	messages, err := s.queryMessages(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		if search.Matches(msg) {
+			results = append(results, search.SearchResultOf(msg))
+		}
+	}
+	return storage.SortSearchResults(results, search.Limit), nil
+}
+
+func (s *Store) queryMessages(ctx context.Context, query string, args ...any) ([]storage.ChatMessage, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []storage.ChatMessage
+	for rows.Next() {
+		var msg storage.ChatMessage
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Sender, &msg.Content, &msg.Timestamp, &msg.ExpiresAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,76 @@
+-- SQLite 的 schema 對應 Postgres migrations 0001-0005 的結果
+-- 時間一律以 UTC 寫入 (_time_format=sqlite)，字串比較與時間順序一致
+
+CREATE TABLE messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	room_id TEXT NOT NULL,
+	sender_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	content TEXT NOT NULL,
+	timestamp TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_messages_room_time ON messages (room_id, timestamp);
+
+CREATE TABLE users (
+	id TEXT PRIMARY KEY,
+	username TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	last_active TIMESTAMP NOT NULL,
+	status TEXT NOT NULL DEFAULT 'online',
+	status_text TEXT NOT NULL DEFAULT '',
+	status_emoji TEXT NOT NULL DEFAULT '',
+	status_expires_at TIMESTAMP
+);
+
+CREATE INDEX idx_users_status_expires_at ON users (status_expires_at) WHERE status_expires_at IS NOT NULL;
+
+CREATE TABLE rooms (
+	id TEXT PRIMARY KEY,
+	roomname TEXT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE room_members (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	joined_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, room_id)
+);
+
+CREATE INDEX idx_rooms_members_room_id ON room_members (room_id);
+
+CREATE TABLE user_presence (
+	room_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	is_online BOOLEAN NOT NULL,
+	last_seen TIMESTAMP NOT NULL,
+	PRIMARY KEY (room_id, user_id)
+);
+
+CREATE TABLE dead_letters (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	handler_key TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	header TEXT,
+	data BLOB NOT NULL,
+	error TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	failed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_dead_letters_handler_time ON dead_letters (handler_key, failed_at);
+
+CREATE TABLE outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id TEXT NOT NULL UNIQUE,
+	subject TEXT NOT NULL,
+	header TEXT,
+	data BLOB NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	published_at TIMESTAMP
+);
+
+CREATE INDEX idx_outbox_pending ON outbox (id) WHERE published_at IS NULL;
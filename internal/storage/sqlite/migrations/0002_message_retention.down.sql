@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS room_retention;
+DROP INDEX IF EXISTS idx_messages_expires_at;
+ALTER TABLE messages DROP COLUMN expires_at;
@@ -0,0 +1,13 @@
+-- 對應 Postgres migration 0008：消息的過期時間與房間的保留規則
+ALTER TABLE messages ADD COLUMN expires_at TIMESTAMP;
+
+CREATE INDEX idx_messages_expires_at ON messages (expires_at) WHERE expires_at IS NOT NULL;
+
+CREATE TABLE room_retention (
+	room_id TEXT PRIMARY KEY REFERENCES rooms(id) ON DELETE CASCADE,
+	mode TEXT NOT NULL DEFAULT 'forever' CHECK (mode IN ('forever', 'days', 'keep_last')),
+	days INTEGER NOT NULL DEFAULT 0,
+	keep_last INTEGER NOT NULL DEFAULT 0,
+	legal_hold BOOLEAN NOT NULL DEFAULT 0,
+	updated_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,2 @@
+-- 對應 Postgres migration 0009：away 是否由閒置自動設定
+ALTER TABLE users ADD COLUMN status_auto_away BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,198 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// GetRetentionPolicy 獲取房間的保留規則，沒有設定過的房間返回永久保留
+func (s *Store) GetRetentionPolicy(ctx context.Context, roomID string) (*storage.RetentionPolicy, error) {
+	policy := storage.RetentionPolicy{RoomID: roomID}
+	var updatedAt sql.NullTime
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT COALESCE(rr.mode, 'forever'), COALESCE(rr.days, 0), COALESCE(rr.keep_last, 0),
+			COALESCE(rr.legal_hold, false), rr.updated_at
+		FROM rooms r
+		LEFT JOIN room_retention rr ON rr.room_id = r.id
+		WHERE r.id = ?
+	`, roomID).Scan(&policy.Mode, &policy.Days, &policy.KeepLast, &policy.LegalHold, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get retention policy: %w", err)
+	}
+	policy.UpdatedAt = updatedAt.Time
+	return &policy, nil
+}
+
+// SetRetentionPolicy 設定房間的保留規則，不改變 LegalHold
+func (s *Store) SetRetentionPolicy(ctx context.Context, policy storage.RetentionPolicy) (*storage.RetentionPolicy, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	err := s.DB.QueryRowContext(ctx, `
+		INSERT INTO room_retention (room_id, mode, days, keep_last, updated_at)
+		SELECT id, ?, ?, ?, ? FROM rooms WHERE id = ?
+		ON CONFLICT (room_id) DO UPDATE
+			SET mode = excluded.mode, days = excluded.days, keep_last = excluded.keep_last, updated_at = excluded.updated_at
+		RETURNING legal_hold, updated_at
+	`, policy.Mode, policy.Days, policy.KeepLast, now(), policy.RoomID).Scan(&policy.LegalHold, &policy.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("set retention policy: %w", err)
+	}
+	return &policy, nil
+}
+
+// SetLegalHold 設定或解除房間的法律保全，不改變保留規則
+func (s *Store) SetLegalHold(ctx context.Context, roomID string, hold bool) (*storage.RetentionPolicy, error) {
+	policy := storage.RetentionPolicy{RoomID: roomID}
+	err := s.DB.QueryRowContext(ctx, `
+		INSERT INTO room_retention (room_id, legal_hold, updated_at)
+		SELECT id, ?, ? FROM rooms WHERE id = ?
+		ON CONFLICT (room_id) DO UPDATE
+			SET legal_hold = excluded.legal_hold, updated_at = excluded.updated_at
+		RETURNING mode, days, keep_last, legal_hold, updated_at
+	`, hold, now(), roomID).Scan(&policy.Mode, &policy.Days, &policy.KeepLast, &policy.LegalHold, &policy.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("set legal hold: %w", err)
+	}
+	return &policy, nil
+}
+
+// PurgeMessages 在一個交易中依序刪除過期的消息、超過保留天數的消息與最後 keep_last 條之前的消息
+// 與 PostgresStore 相同，系統消息不計入 keep_last
+func (s *Store) PurgeMessages(ctx context.Context, now time.Time) ([]storage.PurgeResult, error) {
+	now = now.UTC()
+	results := make(map[string]*storage.PurgeResult)
+	result := func(roomID string) *storage.PurgeResult {
+		if results[roomID] == nil {
+			results[roomID] = &storage.PurgeResult{RoomID: roomID}
+		}
+		return results[roomID]
+	}
+
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		// 過期的消息
+		expired, err := queryCounts(ctx, tx, `
+			SELECT room_id, count(*) FROM messages
+			WHERE expires_at <= ? AND room_id NOT IN (SELECT room_id FROM room_retention WHERE legal_hold)
+			GROUP BY room_id
+		`, now)
+		if err != nil {
+			return fmt.Errorf("count expired messages: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM messages
+			WHERE expires_at <= ? AND room_id NOT IN (SELECT room_id FROM room_retention WHERE legal_hold)
+		`, now); err != nil {
+			return fmt.Errorf("purge expired messages: %w", err)
+		}
+		for roomID, deleted := range expired {
+			r := result(roomID)
+			r.ExpiredBefore = &now
+			r.Deleted += deleted
+		}
+
+		// 超過保留天數與最後 keep_last 條之前的消息，刪除時間早於 cutoff 的消息
+		cutoffs, err := retentionCutoffs(ctx, tx, now)
+		if err != nil {
+			return err
+		}
+		for roomID, cutoff := range cutoffs {
+			res, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE room_id = ? AND timestamp < ?`, roomID, cutoff)
+			if err != nil {
+				return fmt.Errorf("purge messages of room %s: %w", roomID, err)
+			}
+			if deleted, err := res.RowsAffected(); err == nil && deleted > 0 {
+				r := result(roomID)
+				r.RemovedBefore = &cutoff
+				r.Deleted += deleted
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storage.SortPurgeResults(results), nil
+}
+
+// queryCounts 執行返回 (room_id, count) 的查詢
+func queryCounts(ctx context.Context, tx *sql.Tx, query string, args ...any) (map[string]int64, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var roomID string
+		var count int64
+		if err := rows.Scan(&roomID, &count); err != nil {
+			return nil, err
+		}
+		counts[roomID] = count
+	}
+	return counts, rows.Err()
+}
+
+// retentionCutoffs 返回每個有保留規則 (且不在法律保全中) 的房間要刪除的消息的時間上界
+func retentionCutoffs(ctx context.Context, tx *sql.Tx, now time.Time) (map[string]time.Time, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT room_id, mode, days, keep_last FROM room_retention
+		WHERE mode != 'forever' AND NOT legal_hold
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list retention policies: %w", err)
+	}
+	var policies []storage.RetentionPolicy
+	for rows.Next() {
+		var policy storage.RetentionPolicy
+		if err := rows.Scan(&policy.RoomID, &policy.Mode, &policy.Days, &policy.KeepLast); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("list retention policies: %w", err)
+		}
+		policies = append(policies, policy)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list retention policies: %w", err)
+	}
+
+	cutoffs := make(map[string]time.Time)
+	for _, policy := range policies {
+		switch policy.Mode {
+		case storage.RetentionDays:
+			cutoffs[policy.RoomID] = now.AddDate(0, 0, -policy.Days)
+		case storage.RetentionKeepLast:
+			var cutoff time.Time
+			err := tx.QueryRowContext(ctx, `
+				SELECT timestamp FROM messages
+				WHERE room_id = ? AND sender_id != 'system'
+				ORDER BY timestamp DESC, id DESC
+				LIMIT 1 OFFSET ?
+			`, policy.RoomID, policy.KeepLast-1).Scan(&cutoff)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue // 消息還不到 keep_last 條
+			}
+			if err != nil {
+				return nil, fmt.Errorf("find keep_last cutoff of room %s: %w", policy.RoomID, err)
+			}
+			cutoffs[policy.RoomID] = cutoff
+		}
+	}
+	return cutoffs, nil
+}
@@ -0,0 +1,163 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// CreateRoom 創建房間，房間名稱已存在時沿用既有的房間
+func (s *Store) CreateRoom(ctx context.Context, name, createdBy string) (string, error) {
+	var roomID string
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		roomID, err = createRoom(ctx, tx, name, createdBy)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return roomID, nil
+}
+
+// CreateRoomWithOutbox 創建房間 (房間名稱已存在時沿用既有的房間)，並在同一個交易中寫入 event 返回的事件
+func (s *Store) CreateRoomWithOutbox(ctx context.Context, name, createdBy string, event func(roomID string) (storage.OutboxMessage, error)) (string, error) {
+	var roomID string
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if roomID, err = createRoom(ctx, tx, name, createdBy); err != nil {
+			return err
+		}
+		out, err := event(roomID)
+		if err != nil {
+			return err
+		}
+		_, err = insertOutbox(ctx, tx, out)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error creating room: %v", err)
+		return "", err
+	}
+	return roomID, nil
+}
+
+func createRoom(ctx context.Context, tx *sql.Tx, name, createdBy string) (string, error) {
+	var roomID string
+	err := tx.QueryRowContext(ctx, `SELECT id FROM rooms WHERE roomname = ?`, name).Scan(&roomID)
+	if err == nil {
+		log.Printf("Room already exists: %s", roomID)
+		return roomID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	roomID = uuid.NewString()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO rooms (id, roomname, created_by, created_at) VALUES (?, ?, ?, ?)
+	`, roomID, name, createdBy, now()); err != nil {
+		return "", fmt.Errorf("insert room: %w", err)
+	}
+	return roomID, nil
+}
+
+// GetRoom 獲取房間資訊，房間不存在時返回 storage.ErrRoomNotFound
+func (s *Store) GetRoom(ctx context.Context, roomID string) (*storage.Room, error) {
+	var room storage.Room
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT id, roomname, created_by, created_at FROM rooms WHERE id = ?
+	`, roomID).Scan(&room.ID, &room.RoomName, &room.CreatedBy, &room.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (s *Store) GetUserRooms(ctx context.Context, userID string) ([]storage.Room, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT r.id, r.roomname, r.created_by, r.created_at
+		FROM rooms r
+		JOIN room_members m ON r.id = m.room_id
+		WHERE m.user_id = ?
+		ORDER BY m.joined_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []storage.Room
+	for rows.Next() {
+		var room storage.Room
+		if err := rows.Scan(&room.ID, &room.RoomName, &room.CreatedBy, &room.CreatedAt); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *Store) AddUserToRoom(ctx context.Context, userID, roomID string) error {
+	_, err := s.DB.ExecContext(ctx, `
+		INSERT INTO room_members (user_id, room_id, joined_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`, userID, roomID, now())
+	return err
+}
+
+// RemoveUserFromRoom 與 PostgresStore 相同，只把用戶在房間內的在線狀態設為離線，仍然保留成員資格
+func (s *Store) RemoveUserFromRoom(ctx context.Context, userID, roomID string) error {
+	_, err := s.DB.ExecContext(ctx, `
+		UPDATE user_presence SET is_online = false, last_seen = ?
+		WHERE user_id = ? AND room_id = ?
+	`, now(), userID, roomID)
+	if err != nil {
+		log.Printf("Failed to update user presence on room leave: %v", err)
+	}
+	return nil
+}
+
+// IsRoomMember 用戶是否為房間成員
+func (s *Store) IsRoomMember(ctx context.Context, roomID, userID string) (bool, error) {
+	var member bool
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id = ? AND user_id = ?)
+	`, roomID, userID).Scan(&member)
+	return member, err
+}
+
+// GetRoomMembers 獲取房間成員，按加入時間排序，沒有在線記錄的成員視為離線
+func (s *Store) GetRoomMembers(ctx context.Context, roomID string) ([]storage.RoomMember, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT m.user_id, u.username, m.joined_at, COALESCE(pr.is_online, false), pr.last_seen
+		FROM room_members m
+		JOIN users u ON u.id = m.user_id
+		LEFT JOIN user_presence pr ON pr.room_id = m.room_id AND pr.user_id = m.user_id
+		WHERE m.room_id = ?
+		ORDER BY m.joined_at
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []storage.RoomMember{}
+	for rows.Next() {
+		var member storage.RoomMember
+		if err := rows.Scan(&member.UserID, &member.Username, &member.JoinedAt, &member.IsOnline, &member.LastSeen); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
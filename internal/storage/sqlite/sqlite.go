@@ -0,0 +1,133 @@
+// Package sqlite 以 SQLite (modernc.org/sqlite，不需要 cgo) 實現 storage.Store，
+// 適合單機、小規模的自行部署：資料保存在一個檔案中，不需要另外執行 Postgres
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	_ "modernc.org/sqlite"
+)
+
+// migrationFiles 與 Postgres 的 migration 使用同樣的檔名格式，已經套用的版本記錄在 PRAGMA user_version
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// pragmas 每個連線都會套用：WAL 讓讀取不會被寫入阻塞，busy_timeout 讓同時寫入的連線等待而不是失敗
+var pragmas = []string{
+	"foreign_keys(1)",
+	"busy_timeout(5000)",
+	"journal_mode(WAL)",
+	"synchronous(NORMAL)",
+}
+
+// Store 以 SQLite 實現 storage.Store
+type Store struct {
+	DB *sql.DB
+}
+
+var _ storage.Store = (*Store)(nil)
+
+// Open 開啟 (或創建) path 的資料庫檔案並套用還沒套用的 migration
+func Open(path string) (*Store, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite: empty database path")
+	}
+
+	db, err := sql.Open("sqlite", dsn(path))
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{DB: db}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := store.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Printf("Opened SQLite database %s", path)
+	return store, nil
+}
+
+// dsn 在檔案路徑後加上連線參數：交易一開始就取得寫入鎖 (_txlock=immediate)，避免讀取後升級為寫入時發生 SQLITE_BUSY；
+// 時間以 "2006-01-02 15:04:05.999999999-07:00" 格式寫入，UTC 時間的字串順序與時間順序一致
+func dsn(path string) string {
+	params := url.Values{}
+	for _, pragma := range pragmas {
+		params.Add("_pragma", pragma)
+	}
+	params.Set("_txlock", "immediate")
+	params.Set("_time_format", "sqlite")
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + params.Encode()
+}
+
+// Migrate 依序套用版本大於 PRAGMA user_version 的 migration，每個 migration 在一個交易中完成
+func (s *Store) Migrate(ctx context.Context) error {
+	migrations, err := storage.LoadMigrations(migrationFiles)
+	if err != nil {
+		return err
+	}
+
+	var current int64
+	if err := s.DB.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		err := s.withTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+				return err
+			}
+			// PRAGMA 不接受參數，版本是 migration 檔名中的數字
+			_, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, migration.Version))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %s up: %w", migration, err)
+		}
+		log.Printf("Migrated SQLite %s up", migration)
+	}
+	return nil
+}
+
+// withTx 在交易中執行 fn，fn 返回錯誤時回滾
+func (s *Store) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the database
+func (s *Store) Close() {
+	if s.DB != nil {
+		s.DB.Close()
+	}
+}
+
+// now 返回寫入資料庫的時間，一律使用 UTC
+func now() time.Time {
+	return time.Now().UTC()
+}
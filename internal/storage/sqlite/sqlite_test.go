@@ -0,0 +1,51 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/storage/storagetest"
+)
+
+func TestStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		store, err := Open(filepath.Join(t.TempDir(), "settlechat.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(store.Close)
+		return store
+	})
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settlechat.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := store.Register(context.Background(), "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// 重新開啟既有的資料庫不會再套用 migration，資料仍然存在
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var version int64
+	if err := store.DB.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version == 0 {
+		t.Fatal("schema version was not recorded")
+	}
+	if id, err := store.Login(context.Background(), "alice", "secret"); err != nil || id != userID {
+		t.Fatalf("Login after reopening = %q, %v", id, err)
+	}
+}
@@ -0,0 +1,172 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+func (s *Store) Register(ctx context.Context, username, password string) (string, error) {
+	var exists bool
+	if err := s.DB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, username).Scan(&exists); err != nil {
+		return "", err
+	}
+	if exists {
+		return "", storage.ErrUsernameTaken
+	}
+
+	hash, err := storage.HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	userID := uuid.NewString()
+	created := now()
+	_, err = s.DB.ExecContext(ctx, `
+		INSERT INTO users (id, username, password_hash, created_at, last_active)
+		VALUES (?, ?, ?, ?, ?)
+	`, userID, username, hash, created, created)
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func (s *Store) Login(ctx context.Context, username, password string) (string, error) {
+	var userID, hash string
+	err := s.DB.QueryRowContext(ctx, `SELECT id, password_hash FROM users WHERE username = ?`, username).Scan(&userID, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", storage.ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := storage.CheckPassword(hash, password); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func (s *Store) GetUserByID(ctx context.Context, userID string) (*storage.User, error) {
+	var u storage.User
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT id, username, last_active, created_at FROM users WHERE id = ?
+	`, userID).Scan(&u.ID, &u.UserName, &u.LastActive, &u.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *Store) UpsertUser(ctx context.Context, user storage.User) error {
+	_, err := s.DB.ExecContext(ctx, `
+		INSERT INTO users (id, username, password_hash, last_active, created_at)
+		VALUES (?, ?, '', ?, ?)
+		ON CONFLICT (id) DO UPDATE
+		SET username = excluded.username,
+		    last_active = excluded.last_active
+	`, user.ID, user.UserName, user.LastActive.UTC(), user.CreatedAt.UTC())
+	return err
+}
+
+func (s *Store) UpdateLastActive(ctx context.Context, userID string) error {
+	_, err := s.DB.ExecContext(ctx, `UPDATE users SET last_active = ? WHERE id = ?`, now(), userID)
+	return err
+}
+
+func (s *Store) UpdatePresence(ctx context.Context, roomID, userID string, isOnline bool) error {
+	_, err := s.DB.ExecContext(ctx, `
+		INSERT INTO user_presence (room_id, user_id, is_online, last_seen)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (room_id, user_id)
+		DO UPDATE SET is_online = excluded.is_online, last_seen = excluded.last_seen
+	`, roomID, userID, isOnline, now())
+	return err
+}
+
+// GetUserStatus 獲取用戶的全域狀態，過期的自訂狀態文字不會被返回
+func (s *Store) GetUserStatus(ctx context.Context, userID string) (*storage.UserStatus, error) {
+	st := storage.UserStatus{UserID: userID}
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT status, status_text, status_emoji, status_expires_at, status_auto_away FROM users WHERE id = ?
+	`, userID).Scan(&st.Status, &st.Text, &st.Emoji, &st.ExpiresAt, &st.AutoAway)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	st = st.Current(now())
+	return &st, nil
+}
+
+// UpdateUserStatus 更新用戶的全域狀態與自訂狀態文字，手動設定的狀態不是自動離開
+func (s *Store) UpdateUserStatus(ctx context.Context, st storage.UserStatus) error {
+	if !storage.IsValidUserStatus(st.Status) {
+		return fmt.Errorf("invalid user status: %q", st.Status)
+	}
+
+	var expiresAt any
+	if st.ExpiresAt != nil {
+		expiresAt = st.ExpiresAt.UTC()
+	}
+	result, err := s.DB.ExecContext(ctx, `
+		UPDATE users
+		SET status = ?, status_text = ?, status_emoji = ?, status_expires_at = ?, status_auto_away = 0
+		WHERE id = ?
+	`, st.Status, st.Text, st.Emoji, expiresAt, st.UserID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: %s", storage.ErrUserNotFound, st.UserID)
+	}
+	return nil
+}
+
+// CompareAndSetUserStatus 只有在目前狀態為 from 時才更新為 to，返回是否有更新
+// 更新為 away 時記錄為自動離開，from 為 away 時只更新自動設定的 away
+func (s *Store) CompareAndSetUserStatus(ctx context.Context, userID, from, to string) (bool, error) {
+	result, err := s.DB.ExecContext(ctx, `
+		UPDATE users SET status = ?, status_auto_away = ?
+		WHERE id = ? AND status = ? AND (status != 'away' OR status_auto_away)
+	`, to, to == storage.UserStatusAway, userID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ClearExpiredStatusText 清除所有已過期的自訂狀態文字，並返回受影響用戶的最新狀態
+func (s *Store) ClearExpiredStatusText(ctx context.Context) ([]storage.UserStatus, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		UPDATE users
+		SET status_text = '', status_emoji = '', status_expires_at = NULL
+		WHERE status_expires_at IS NOT NULL AND status_expires_at <= ?
+		RETURNING id, status
+	`, now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []storage.UserStatus
+	for rows.Next() {
+		var st storage.UserStatus
+		if err := rows.Scan(&st.UserID, &st.Status); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, rows.Err()
+}
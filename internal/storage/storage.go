@@ -2,18 +2,95 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrUserNotFound 找不到指定的用戶
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUsernameTaken 註冊的用戶名稱已經被使用
+	ErrUsernameTaken = errors.New("username already exists")
+	// ErrInvalidCredentials 用戶名稱或密碼錯誤，不區分是哪一個錯誤
+	ErrInvalidCredentials = errors.New("invalid username or password")
 )
 
 type ChatMessage struct {
-	ID        int       `json:"-"` // 不 expose 給前端
+	ID        int64     `json:"id,omitempty"` // 保存後才有；64 位元，Postgres 為 BIGSERIAL，向上捲動時與時間一起作為游標
 	RoomID    string    `json:"room_id"`
 	SenderID  string    `json:"sender_id"`
 	Sender    string    `json:"sender"`
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
+
+	// ClientMsgID 客戶端為消息產生的 ID，不保存；廣播與 ack 原樣帶回，客戶端以此對應自己送出的消息
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// Ack 只出現在送給發送者的確認中：MessageAckSaved 或 MessageAckFailed
+	Ack string `json:"ack,omitempty"`
+
+	// ExpiresIn 客戶端要求消息在幾秒後消失 (閱後即焚)，不保存；發布時換算成 ExpiresAt
+	ExpiresIn int `json:"expires_in,omitempty"`
+	// ExpiresAt 消息的過期時間，過期後不再出現在歷史與廣播中，並由 RetentionSweeper 刪除
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// RemovedBefore 與 ExpiredBefore 只出現在通知客戶端移除消息的系統消息中：
+	// 刪除了房間內時間早於 RemovedBefore 的消息 (保留規則)，以及過期時間不晚於 ExpiredBefore 的消息
+	RemovedBefore *time.Time `json:"removed_before,omitempty"`
+	ExpiredBefore *time.Time `json:"expired_before,omitempty"`
+}
+
+// MessageCursor 是向上捲動的位置，通常是客戶端目前最舊一條消息的時間與 ID
+// 早於 Timestamp 的消息，以及時間相同但 ID 較小的消息都在游標之前；ID 為 0 時只比較時間
+type MessageCursor struct {
+	Timestamp time.Time
+	ID        int64
+}
+
+// CursorOf 返回消息所在的位置
+func CursorOf(msg ChatMessage) MessageCursor {
+	return MessageCursor{Timestamp: msg.Timestamp, ID: msg.ID}
+}
+
+// Includes 判斷消息是否在游標之前
+func (c MessageCursor) Includes(msg ChatMessage) bool {
+	if msg.Timestamp.Before(c.Timestamp) {
+		return true
+	}
+	return c.ID > 0 && msg.Timestamp.Equal(c.Timestamp) && msg.ID < c.ID
+}
+
+// MaxMessageTTL 閱後即焚消息最長的存在時間
+const MaxMessageTTL = 30 * 24 * time.Hour
+
+// Expired 消息在 now 時是否已經過期
+func (m ChatMessage) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !m.ExpiresAt.After(now)
+}
+
+// WithoutExpired 返回 messages 中在 now 時還沒有過期的消息
+func WithoutExpired(messages []ChatMessage, now time.Time) []ChatMessage {
+	if !slices.ContainsFunc(messages, func(m ChatMessage) bool { return m.Expired(now) }) {
+		return messages
+	}
+	kept := make([]ChatMessage, 0, len(messages))
+	for _, m := range messages {
+		if !m.Expired(now) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
 }
 
+// 送給發送者的消息確認
+const (
+	MessageAckSaved  = "saved"
+	MessageAckFailed = "failed"
+)
+
 type User struct {
 	ID         string    `json:"user_id"`
 	UserName   string    `json:"user_name"`
@@ -21,6 +98,75 @@ type User struct {
 	LastActive time.Time `json:"last_active"`
 }
 
+// 用戶全域狀態
+const (
+	UserStatusOnline    = "online"
+	UserStatusAway      = "away"
+	UserStatusDND       = "dnd"
+	UserStatusInvisible = "invisible"
+	UserStatusOffline   = "offline" // 只用於對外廣播，不會被儲存
+)
+
+// UserStatus 用戶的全域狀態與自訂狀態文字
+type UserStatus struct {
+	UserID    string     `json:"user_id"`
+	Status    string     `json:"status"`
+	Text      string     `json:"status_text,omitempty"`
+	Emoji     string     `json:"status_emoji,omitempty"`
+	ExpiresAt *time.Time `json:"status_expires_at,omitempty"`
+	// AutoAway 狀態是由閒置自動設定的 away，用戶有活動時恢復在線；手動設定的狀態都是 false
+	AutoAway bool `json:"auto_away,omitempty"`
+}
+
+// IsValidUserStatus 檢查狀態是否可以由用戶設定
+func IsValidUserStatus(status string) bool {
+	switch status {
+	case UserStatusOnline, UserStatusAway, UserStatusDND, UserStatusInvisible:
+		return true
+	default:
+		return false
+	}
+}
+
+// Visible 返回其他用戶看到的狀態：隱身的用戶對外顯示為離線
+func (s UserStatus) Visible() UserStatus {
+	if s.Status == UserStatusInvisible {
+		return UserStatus{UserID: s.UserID, Status: UserStatusOffline}
+	}
+	s.AutoAway = false
+	return s
+}
+
+// Current 返回 now 時的狀態：自訂狀態文字過期後不再返回
+func (s UserStatus) Current(now time.Time) UserStatus {
+	if s.ExpiresAt != nil && !s.ExpiresAt.After(now) {
+		s.Text, s.Emoji, s.ExpiresAt = "", "", nil
+	}
+	return s
+}
+
+// IsOnline 對外是否顯示為在線
+func (s UserStatus) IsOnline() bool {
+	return s.Status != UserStatusInvisible && s.Status != UserStatusOffline
+}
+
+// HashPassword 以 bcrypt 產生密碼的 hash，所有後端使用同樣的格式
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost) // what is Cost?
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword 密碼與 hash 不符時返回 ErrInvalidCredentials
+func CheckPassword(hash, password string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
 type Room struct {
 	ID        string    `json:"room_id"`
 	RoomName  string    `json:"room_name"`
@@ -29,20 +175,165 @@ type Room struct {
 }
 
 // Leverage the Go interface for better decoupling, unit-testing
+// 使用資料庫的元件只依賴需要的介面，PostgresStore、memory.Store 與 sqlite.Store 都實現了 Store
+
+// MessageStore 聊天消息，GetRecentMessages 不包含系統消息並由舊到新排序
 type MessageStore interface {
 	SaveMessage(ctx context.Context, msg ChatMessage) error
+	// SaveMessageWithOutbox 在同一個交易中保存消息與 event 返回的事件，返回消息的 ID；
+	// 事件 ID 已經保存過時不寫入，返回 0
+	SaveMessageWithOutbox(ctx context.Context, msg ChatMessage, event MessageEvent) (id int64, err error)
+	// SaveMessagesWithOutbox 在同一個交易中依序保存一批消息與各自的事件，全部成功或全部失敗
+	// ids[i] 為 0 代表 batch[i] 的事件 ID 已經保存過 (包括同一批中較早的一條)
+	SaveMessagesWithOutbox(ctx context.Context, batch []PendingMessage) (ids []int64, err error)
 	GetRecentMessages(ctx context.Context, roomID string, limit int) ([]ChatMessage, error)
+	// GetMessagesBefore 返回游標之前的最後 limit 條非系統消息，由舊到新排序 (時間相同時依 ID)，用於向上捲動載入更早的歷史
+	GetMessagesBefore(ctx context.Context, roomID string, before MessageCursor, limit int) ([]ChatMessage, error)
+	GetMessagesByTimeRange(ctx context.Context, roomID string, startTime, endTime time.Time) ([]ChatMessage, error)
+	// SearchMessages 在 search.RoomIDs 的房間中搜尋非系統消息，相關度高的在前
+	SearchMessages(ctx context.Context, search MessageSearch) ([]SearchResult, error)
+}
+
+// MessageSaver 保存一條聊天消息與它的廣播事件，MessageStore 直接寫入，MessageWriter 批次寫入
+type MessageSaver interface {
+	SaveMessageWithOutbox(ctx context.Context, msg ChatMessage, event MessageEvent) (id int64, err error)
+}
+
+// MessageEvent 返回與消息在同一個交易中寫入 outbox 的事件
+// 呼叫時 msg.ID 已經是分配給消息的 ID，廣播的內容因此可以帶著 ID；
+// 可能被呼叫不只一次 (例如整批寫入失敗後逐條重寫)，每次都要返回同一個事件 ID
+type MessageEvent func(msg ChatMessage) (OutboxMessage, error)
+
+// FixedEvent 返回不依賴消息 ID 的事件
+func FixedEvent(out OutboxMessage) MessageEvent {
+	return func(ChatMessage) (OutboxMessage, error) {
+		return out, nil
+	}
+}
+
+// PendingMessage 是一條等待保存的聊天消息，以及與它在同一個交易中寫入 outbox 的事件
+type PendingMessage struct {
+	Message ChatMessage
+	Event   MessageEvent
 }
 
 type UserStore interface {
 	// Regiser and Login
+	Register(ctx context.Context, username, password string) (string, error)
+	Login(ctx context.Context, username, password string) (string, error)
+	GetUserByID(ctx context.Context, userID string) (*User, error)
 	UpsertUser(ctx context.Context, user User) error // insert or update
 	UpdateLastActive(ctx context.Context, userID string) error
-	GetUser(ctx context.Context, userId string) (*User, error)
+	UpdatePresence(ctx context.Context, roomID, userID string, isOnline bool) error
+
+	GetUserStatus(ctx context.Context, userID string) (*UserStatus, error)
+	UpdateUserStatus(ctx context.Context, st UserStatus) error
+	// CompareAndSetUserStatus 用於自動離開與恢復在線：只有在目前狀態為 from 時才更新為 to，
+	// 更新為 away 時記錄為 AutoAway；from 為 away 時只更新自動設定的 away，手動設定的不受影響
+	CompareAndSetUserStatus(ctx context.Context, userID, from, to string) (bool, error)
+	ClearExpiredStatusText(ctx context.Context) ([]UserStatus, error)
 }
 
 type RoomStore interface {
 	CreateRoom(ctx context.Context, name, createdBy string) (string, error)
+	CreateRoomWithOutbox(ctx context.Context, name, createdBy string, event func(roomID string) (OutboxMessage, error)) (string, error)
+	GetRoom(ctx context.Context, roomID string) (*Room, error)
 	GetUserRooms(ctx context.Context, userID string) ([]Room, error)
 	AddUserToRoom(ctx context.Context, userID, roomID string) error
+	RemoveUserFromRoom(ctx context.Context, userID, roomID string) error
+	IsRoomMember(ctx context.Context, roomID, userID string) (bool, error)
+	GetRoomMembers(ctx context.Context, roomID string) ([]RoomMember, error)
+}
+
+// DeadLetterStore 重試後仍然失敗的事件，找不到時返回 ErrDeadLetterNotFound
+type DeadLetterStore interface {
+	SaveDeadLetter(ctx context.Context, letter DeadLetter) error
+	ListDeadLetters(ctx context.Context, handlerKey string, limit int) ([]DeadLetter, error)
+	GetDeadLetter(ctx context.Context, id int64) (*DeadLetter, error)
+	DeleteDeadLetter(ctx context.Context, id int64) error
+}
+
+// OutboxStore 等待發布的事件，由 messaging.OutboxRelay 發布
+type OutboxStore interface {
+	RelayOutbox(ctx context.Context, limit int, publish func(OutboxMessage) error) (int, error)
+	DeletePublishedOutbox(ctx context.Context, before time.Time) (int64, error)
+}
+
+// 房間的保留規則
+const (
+	RetentionForever  = "forever"
+	RetentionDays     = "days"      // 保留最近 Days 天的消息
+	RetentionKeepLast = "keep_last" // 保留最後 KeepLast 條非系統消息
+)
+
+// RetentionPolicy 房間消息的保留規則，沒有設定的房間永久保留
+// LegalHold 的房間不刪除任何消息，包括保留規則之外與已經過期的消息 (過期的消息仍然不會返回給用戶)
+type RetentionPolicy struct {
+	RoomID    string    `json:"room_id"`
+	Mode      string    `json:"mode"`
+	Days      int       `json:"days,omitempty"`
+	KeepLast  int       `json:"keep_last,omitempty"`
+	LegalHold bool      `json:"legal_hold"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate 檢查規則的參數，Mode 為空時視為永久保留
+func (p *RetentionPolicy) Validate() error {
+	switch p.Mode {
+	case "", RetentionForever:
+		p.Mode, p.Days, p.KeepLast = RetentionForever, 0, 0
+	case RetentionDays:
+		if p.Days <= 0 {
+			return fmt.Errorf("retention days must be positive, got %d", p.Days)
+		}
+		p.KeepLast = 0
+	case RetentionKeepLast:
+		if p.KeepLast <= 0 {
+			return fmt.Errorf("retention keep_last must be positive, got %d", p.KeepLast)
+		}
+		p.Days = 0
+	default:
+		return fmt.Errorf("unknown retention mode %q", p.Mode)
+	}
+	return nil
+}
+
+// PurgeResult 是一個房間在一次清理中被刪除的消息
+type PurgeResult struct {
+	RoomID        string
+	RemovedBefore *time.Time // 保留規則刪除了時間早於此的消息
+	ExpiredBefore *time.Time // 刪除了過期時間不晚於此的消息
+	Deleted       int64
+}
+
+// RetentionStore 房間的保留規則與過期消息的清理，房間不存在時返回 ErrRoomNotFound
+type RetentionStore interface {
+	// GetRetentionPolicy 沒有設定過的房間返回永久保留
+	GetRetentionPolicy(ctx context.Context, roomID string) (*RetentionPolicy, error)
+	// SetRetentionPolicy 設定保留規則，不改變 LegalHold
+	SetRetentionPolicy(ctx context.Context, policy RetentionPolicy) (*RetentionPolicy, error)
+	SetLegalHold(ctx context.Context, roomID string, hold bool) (*RetentionPolicy, error)
+	// PurgeMessages 刪除在 now 時已經過期或超出保留規則的消息，略過法律保全中的房間
+	// 只返回有消息被刪除的房間，依房間 ID 排序
+	PurgeMessages(ctx context.Context, now time.Time) ([]PurgeResult, error)
+}
+
+// Store 是完整的儲存後端
+type Store interface {
+	MessageStore
+	UserStore
+	RoomStore
+	DeadLetterStore
+	OutboxStore
+	RetentionStore
+	Close()
+}
+
+// RoomMember 房間成員與在房間內的在線狀態
+type RoomMember struct {
+	UserID   string     `json:"user_id"`
+	Username string     `json:"username"`
+	JoinedAt time.Time  `json:"joined_at"`
+	IsOnline bool       `json:"is_online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
 }
@@ -0,0 +1,890 @@
+// Package storagetest 是 storage.Store 的共用測試，每一個後端 (Postgres、SQLite、memory) 都要通過同一組測試，
+// 行為才能互相替換
+//
+// 測試使用隨機的用戶名稱、房間名稱與事件 ID，可以在已經有資料的資料庫上執行
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// Run 對 newStore 返回的 store 執行所有測試，每個子測試都會呼叫一次 newStore
+// newStore 負責以 t.Cleanup 關閉或清除 store
+func Run(t *testing.T, newStore func(t *testing.T) storage.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store storage.Store)
+	}{
+		{"Users", testUsers},
+		{"UserStatus", testUserStatus},
+		{"Rooms", testRooms},
+		{"RoomMembers", testRoomMembers},
+		{"Messages", testMessages},
+		{"MessagesBeforeCursor", testMessagesBeforeCursor},
+		{"MessageOutbox", testMessageOutbox},
+		{"MessageBatch", testMessageBatch},
+		{"SearchMessages", testSearchMessages},
+		{"Retention", testRetention},
+		{"RoomOutbox", testRoomOutbox},
+		{"RelayOutbox", testRelayOutbox},
+		{"DeadLetters", testDeadLetters},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+// unique 返回加上隨機後綴的名稱
+func unique(name string) string {
+	return name + "-" + uuid.NewString()[:8]
+}
+
+func register(t *testing.T, store storage.Store, username string) string {
+	t.Helper()
+	userID, err := store.Register(context.Background(), username, "secret")
+	if err != nil {
+		t.Fatalf("Register(%s): %v", username, err)
+	}
+	return userID
+}
+
+func testUsers(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	username := unique("alice")
+	userID := register(t, store, username)
+
+	if _, err := store.Register(ctx, username, "other"); !errors.Is(err, storage.ErrUsernameTaken) {
+		t.Fatalf("second Register error = %v, want ErrUsernameTaken", err)
+	}
+
+	if id, err := store.Login(ctx, username, "secret"); err != nil || id != userID {
+		t.Fatalf("Login = %q, %v; want %q", id, err, userID)
+	}
+	if _, err := store.Login(ctx, username, "wrong"); !errors.Is(err, storage.ErrInvalidCredentials) {
+		t.Fatalf("Login with wrong password error = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := store.Login(ctx, unique("nobody"), "secret"); !errors.Is(err, storage.ErrInvalidCredentials) {
+		t.Fatalf("Login of unknown user error = %v, want ErrInvalidCredentials", err)
+	}
+
+	user, err := store.GetUserByID(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != userID || user.UserName != username || user.CreatedAt.IsZero() {
+		t.Fatalf("GetUserByID = %+v", user)
+	}
+	if _, err := store.GetUserByID(ctx, uuid.NewString()); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("GetUserByID of unknown user error = %v, want ErrUserNotFound", err)
+	}
+
+	// UpsertUser 更新既有用戶的名稱與最後活動時間
+	renamed := unique("alice-renamed")
+	lastActive := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+	if err := store.UpsertUser(ctx, storage.User{ID: userID, UserName: renamed, LastActive: lastActive, CreatedAt: user.CreatedAt}); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = store.GetUserByID(ctx, userID)
+	if user.UserName != renamed || !user.LastActive.Equal(lastActive) {
+		t.Fatalf("after UpsertUser = %+v, want name %s and last active %v", user, renamed, lastActive)
+	}
+
+	if err := store.UpdateLastActive(ctx, userID); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = store.GetUserByID(ctx, userID)
+	if !user.LastActive.After(lastActive) {
+		t.Fatalf("UpdateLastActive did not move last active forward: %v", user.LastActive)
+	}
+}
+
+func testUserStatus(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	userID := register(t, store, unique("bob"))
+
+	status, err := store.GetUserStatus(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != storage.UserStatusOnline || status.Text != "" {
+		t.Fatalf("initial status = %+v, want online", status)
+	}
+	if _, err := store.GetUserStatus(ctx, uuid.NewString()); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("GetUserStatus of unknown user error = %v, want ErrUserNotFound", err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+	want := storage.UserStatus{UserID: userID, Status: storage.UserStatusDND, Text: "focusing", Emoji: "🎧", ExpiresAt: &expiresAt}
+	if err := store.UpdateUserStatus(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = store.GetUserStatus(ctx, userID)
+	if status.Status != want.Status || status.Text != want.Text || status.Emoji != want.Emoji || status.ExpiresAt == nil || !status.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("status = %+v, want %+v", status, want)
+	}
+
+	if err := store.UpdateUserStatus(ctx, storage.UserStatus{UserID: userID, Status: storage.UserStatusOffline}); err == nil {
+		t.Fatal("UpdateUserStatus accepted offline, which users cannot set")
+	}
+	if err := store.UpdateUserStatus(ctx, storage.UserStatus{UserID: uuid.NewString(), Status: storage.UserStatusAway}); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("UpdateUserStatus of unknown user error = %v, want ErrUserNotFound", err)
+	}
+
+	// CompareAndSetUserStatus 只在目前狀態符合時更新
+	if ok, err := store.CompareAndSetUserStatus(ctx, userID, storage.UserStatusOnline, storage.UserStatusAway); err != nil || ok {
+		t.Fatalf("CompareAndSetUserStatus from online = %v, %v; want false", ok, err)
+	}
+	if ok, err := store.CompareAndSetUserStatus(ctx, userID, storage.UserStatusDND, storage.UserStatusAway); err != nil || !ok {
+		t.Fatalf("CompareAndSetUserStatus from dnd = %v, %v; want true", ok, err)
+	}
+	if status, _ = store.GetUserStatus(ctx, userID); !status.AutoAway {
+		t.Fatalf("status after CompareAndSetUserStatus to away = %+v, want auto away", status)
+	}
+	if ok, err := store.CompareAndSetUserStatus(ctx, userID, storage.UserStatusAway, storage.UserStatusOnline); err != nil || !ok {
+		t.Fatalf("CompareAndSetUserStatus from auto away = %v, %v; want true", ok, err)
+	}
+	if status, _ = store.GetUserStatus(ctx, userID); status.Status != storage.UserStatusOnline || status.AutoAway {
+		t.Fatalf("status after restoring = %+v, want online", status)
+	}
+
+	// 手動設定的 away 不會被自動恢復
+	if err := store.UpdateUserStatus(ctx, storage.UserStatus{UserID: userID, Status: storage.UserStatusAway}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.CompareAndSetUserStatus(ctx, userID, storage.UserStatusAway, storage.UserStatusOnline); err != nil || ok {
+		t.Fatalf("CompareAndSetUserStatus from manual away = %v, %v; want false", ok, err)
+	}
+
+	// 過期的狀態文字不再返回，ClearExpiredStatusText 清除後返回受影響的用戶
+	expired := time.Now().Add(-time.Minute).UTC()
+	if err := store.UpdateUserStatus(ctx, storage.UserStatus{UserID: userID, Status: storage.UserStatusAway, Text: "lunch", ExpiresAt: &expired}); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = store.GetUserStatus(ctx, userID)
+	if status.Text != "" || status.ExpiresAt != nil || status.Status != storage.UserStatusAway {
+		t.Fatalf("status with expired text = %+v, want away without text", status)
+	}
+	cleared, err := store.ClearExpiredStatusText(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(cleared, storage.UserStatus{UserID: userID, Status: storage.UserStatusAway}) {
+		t.Fatalf("ClearExpiredStatusText = %+v, want %s", cleared, userID)
+	}
+	cleared, _ = store.ClearExpiredStatusText(ctx)
+	if slices.ContainsFunc(cleared, func(st storage.UserStatus) bool { return st.UserID == userID }) {
+		t.Fatal("ClearExpiredStatusText returned the same user twice")
+	}
+}
+
+func testRooms(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	userID := register(t, store, unique("carol"))
+	name := unique("general")
+
+	roomID, err := store.CreateRoom(ctx, name, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同名的房間沿用既有的房間
+	if again, err := store.CreateRoom(ctx, name, userID); err != nil || again != roomID {
+		t.Fatalf("CreateRoom with existing name = %q, %v; want %q", again, err, roomID)
+	}
+
+	room, err := store.GetRoom(ctx, roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.ID != roomID || room.RoomName != name || room.CreatedBy != userID || room.CreatedAt.IsZero() {
+		t.Fatalf("GetRoom = %+v", room)
+	}
+	if _, err := store.GetRoom(ctx, uuid.NewString()); !errors.Is(err, storage.ErrRoomNotFound) {
+		t.Fatalf("GetRoom of unknown room error = %v, want ErrRoomNotFound", err)
+	}
+
+	if rooms, err := store.GetUserRooms(ctx, userID); err != nil || len(rooms) != 0 {
+		t.Fatalf("GetUserRooms before joining = %+v, %v", rooms, err)
+	}
+	other, _ := store.CreateRoom(ctx, unique("random"), userID)
+	for _, id := range []string{roomID, other, roomID} {
+		if err := store.AddUserToRoom(ctx, userID, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rooms, err := store.GetUserRooms(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, room := range rooms {
+		ids = append(ids, room.ID)
+	}
+	slices.Sort(ids)
+	want := []string{roomID, other}
+	slices.Sort(want)
+	if !slices.Equal(ids, want) {
+		t.Fatalf("GetUserRooms = %v, want %v", ids, want)
+	}
+
+	if err := store.AddUserToRoom(ctx, userID, uuid.NewString()); err == nil {
+		t.Fatal("AddUserToRoom accepted a room that does not exist")
+	}
+}
+
+func testRoomMembers(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	first := register(t, store, unique("dave"))
+	second := register(t, store, unique("erin"))
+	roomID, err := store.CreateRoom(ctx, unique("members"), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if member, err := store.IsRoomMember(ctx, roomID, first); err != nil || member {
+		t.Fatalf("IsRoomMember before joining = %v, %v", member, err)
+	}
+	store.AddUserToRoom(ctx, first, roomID)
+	time.Sleep(5 * time.Millisecond)
+	store.AddUserToRoom(ctx, second, roomID)
+	if member, err := store.IsRoomMember(ctx, roomID, first); err != nil || !member {
+		t.Fatalf("IsRoomMember after joining = %v, %v", member, err)
+	}
+
+	if err := store.UpdatePresence(ctx, roomID, first, true); err != nil {
+		t.Fatal(err)
+	}
+	members, err := store.GetRoomMembers(ctx, roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 按加入時間排序，沒有在線記錄的成員視為離線
+	if len(members) != 2 || members[0].UserID != first || members[1].UserID != second {
+		t.Fatalf("GetRoomMembers = %+v, want %s then %s", members, first, second)
+	}
+	if !members[0].IsOnline || members[0].LastSeen == nil || members[1].IsOnline || members[1].LastSeen != nil {
+		t.Fatalf("presence of members = %+v", members)
+	}
+
+	// 離開房間只把在線狀態設為離線
+	if err := store.RemoveUserFromRoom(ctx, first, roomID); err != nil {
+		t.Fatal(err)
+	}
+	members, _ = store.GetRoomMembers(ctx, roomID)
+	if len(members) != 2 || members[0].IsOnline {
+		t.Fatalf("GetRoomMembers after leaving = %+v, want %s offline", members, first)
+	}
+
+	if members, err := store.GetRoomMembers(ctx, uuid.NewString()); err != nil || members == nil || len(members) != 0 {
+		t.Fatalf("GetRoomMembers of unknown room = %#v, %v; want an empty list", members, err)
+	}
+}
+
+func chatMessage(roomID, senderID string, at time.Time, content string) storage.ChatMessage {
+	return storage.ChatMessage{RoomID: roomID, SenderID: senderID, Sender: senderID, Content: content, Timestamp: at}
+}
+
+func contents(messages []storage.ChatMessage) []string {
+	var out []string
+	for _, msg := range messages {
+		out = append(out, msg.Content)
+	}
+	return out
+}
+
+func testMessages(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	roomID := unique("room")
+	base := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+
+	// 以不同的順序寫入，讀取時依消息時間排序
+	for _, i := range []int{2, 0, 3, 1} {
+		if err := store.SaveMessage(ctx, chatMessage(roomID, "u1", base.Add(time.Duration(i)*time.Second), fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.SaveMessage(ctx, chatMessage(roomID, "system", base.Add(10*time.Second), "system"))
+	store.SaveMessage(ctx, chatMessage(unique("other"), "u1", base, "other room"))
+
+	recent, err := store.GetRecentMessages(ctx, roomID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(contents(recent), []string{"1", "2", "3"}) {
+		t.Fatalf("GetRecentMessages = %v, want the 3 latest non-system messages oldest first", contents(recent))
+	}
+	if recent[0].ID == 0 || recent[0].RoomID != roomID || !recent[0].Timestamp.Equal(base.Add(time.Second)) {
+		t.Fatalf("message = %+v", recent[0])
+	}
+
+	// 時間範圍包含兩端，也包含系統消息
+	inRange, err := store.GetMessagesByTimeRange(ctx, roomID, base.Add(time.Second), base.Add(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(contents(inRange), []string{"1", "2", "3", "system"}) {
+		t.Fatalf("GetMessagesByTimeRange = %v", contents(inRange))
+	}
+
+	// 向上捲動：早於第 3 秒 (不包含) 的最後兩條
+	before, err := store.GetMessagesBefore(ctx, roomID, storage.MessageCursor{Timestamp: base.Add(3 * time.Second)}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(contents(before), []string{"1", "2"}) {
+		t.Fatalf("GetMessagesBefore = %v, want [1 2]", contents(before))
+	}
+	if before, err := store.GetMessagesBefore(ctx, roomID, storage.MessageCursor{Timestamp: base}, 10); err != nil || len(before) != 0 {
+		t.Fatalf("GetMessagesBefore the first message = %v, %v", contents(before), err)
+	}
+
+	if empty, err := store.GetRecentMessages(ctx, unique("empty"), 10); err != nil || len(empty) != 0 {
+		t.Fatalf("GetRecentMessages of empty room = %v, %v", empty, err)
+	}
+}
+
+// testMessagesBeforeCursor 多條消息的時間相同時，以 (時間, ID) 分頁不會略過或重複任何一條
+func testMessagesBeforeCursor(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	roomID := unique("room")
+	base := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		at := base
+		if i == 4 {
+			at = base.Add(time.Second)
+		}
+		if err := store.SaveMessage(ctx, chatMessage(roomID, "u1", at, fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recent, err := store.GetRecentMessages(ctx, roomID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(contents(recent), []string{"3", "4"}) {
+		t.Fatalf("GetRecentMessages = %v, want [3 4]", contents(recent))
+	}
+
+	// 從最舊的一條往前翻頁，每頁 2 條
+	var pages []string
+	cursor := storage.CursorOf(recent[0])
+	for range 5 {
+		page, err := store.GetMessagesBefore(ctx, roomID, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages = append(contents(page), pages...)
+		cursor = storage.CursorOf(page[0])
+	}
+	if !slices.Equal(pages, []string{"0", "1", "2"}) {
+		t.Fatalf("pages before %v = %v, want [0 1 2]", contents(recent), pages)
+	}
+
+	// 沒有 ID 的游標只比較時間，與游標同一時間的消息都不包含
+	page, err := store.GetMessagesBefore(ctx, roomID, storage.MessageCursor{Timestamp: base.Add(time.Second)}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(contents(page), []string{"0", "1", "2", "3"}) {
+		t.Fatalf("GetMessagesBefore without ID = %v, want [0 1 2 3]", contents(page))
+	}
+}
+
+func testMessageOutbox(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	roomID := unique("room")
+	msg := chatMessage(roomID, "u1", time.Now().UTC(), "hello")
+	eventID := uuid.NewString()
+
+	// event 收到的消息已經帶著保存時的 ID，廣播因此可以包含 ID
+	var eventMsgID int64
+	event := func(saved storage.ChatMessage) (storage.OutboxMessage, error) {
+		eventMsgID = saved.ID
+		return storage.OutboxMessage{EventID: eventID, Subject: "chat.broadcast", Data: []byte(fmt.Sprint(saved.ID))}, nil
+	}
+
+	// 同一個事件 ID 只保存一次，重複投遞的消息不會寫入兩次
+	id, err := store.SaveMessageWithOutbox(ctx, msg, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == 0 || eventMsgID != id {
+		t.Fatalf("SaveMessageWithOutbox id = %d, event saw %d", id, eventMsgID)
+	}
+	if again, err := store.SaveMessageWithOutbox(ctx, msg, event); err != nil || again != 0 {
+		t.Fatalf("second SaveMessageWithOutbox = %d, %v, want 0", again, err)
+	}
+	recent, _ := store.GetRecentMessages(ctx, roomID, 10)
+	if len(recent) != 1 {
+		t.Fatalf("room has %d messages, want 1", len(recent))
+	}
+	if recent[0].ID != id {
+		t.Fatalf("stored message id = %d, want %d", recent[0].ID, id)
+	}
+}
+
+func testMessageBatch(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	roomID := unique("room")
+	at := time.Now().UTC().Truncate(time.Millisecond)
+
+	pending := func(eventID, content string, offset time.Duration) storage.PendingMessage {
+		return storage.PendingMessage{
+			Message: chatMessage(roomID, "u1", at.Add(offset), content),
+			Event:   storage.FixedEvent(storage.OutboxMessage{EventID: eventID, Subject: "chat.broadcast", Data: []byte(content)}),
+		}
+	}
+
+	if ids, err := store.SaveMessagesWithOutbox(ctx, nil); err != nil || len(ids) != 0 {
+		t.Fatalf("empty batch: ids = %v, err = %v", ids, err)
+	}
+
+	// 已經保存過的事件與同一批中重複的事件都不會再寫入
+	first, second, third := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	if _, err := store.SaveMessageWithOutbox(ctx, pending(first, "one", 0).Message, pending(first, "one", 0).Event); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := store.SaveMessagesWithOutbox(ctx, []storage.PendingMessage{
+		pending(first, "one again", time.Millisecond),
+		pending(second, "two", 2*time.Millisecond),
+		pending(third, "three", 3*time.Millisecond),
+		pending(second, "two again", 4*time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids[0] != 0 || ids[1] == 0 || ids[2] <= ids[1] || ids[3] != 0 {
+		t.Fatalf("ids = %v, want [0 id id+n 0]", ids)
+	}
+
+	recent, err := store.GetRecentMessages(ctx, roomID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contents(recent), []string{"one", "two", "three"}; !slices.Equal(got, want) {
+		t.Fatalf("messages = %v, want %v", got, want)
+	}
+	if recent[1].ID != ids[1] || recent[2].ID != ids[2] {
+		t.Fatalf("stored ids = [%d %d], want %v", recent[1].ID, recent[2].ID, ids[1:3])
+	}
+}
+
+func testSearchMessages(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	roomID, otherRoom := unique("room"), unique("other")
+	base := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+
+	for _, msg := range []storage.ChatMessage{
+		chatMessage(roomID, "u1", base, "Hello world"),
+		chatMessage(roomID, "u2", base.Add(time.Minute), "大家好朋友們 hello"),
+		chatMessage(roomID, "u1", base.Add(2*time.Minute), "見面吧 https://example.com/photo.png"),
+		chatMessage(roomID, "u1", base.Add(3*time.Minute), "<b>bold</b> hello"),
+		chatMessage(roomID, "system", base.Add(4*time.Minute), "hello system"),
+		chatMessage(otherRoom, "u1", base, "hello from another room"),
+	} {
+		if err := store.SaveMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(s storage.MessageSearch) []storage.SearchResult {
+		t.Helper()
+		if s.RoomIDs == nil {
+			s.RoomIDs = []string{roomID}
+		}
+		results, err := store.SearchMessages(ctx, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	found := func(results []storage.SearchResult) []string {
+		var out []string
+		for _, r := range results {
+			out = append(out, r.Content)
+		}
+		slices.Sort(out)
+		return out
+	}
+
+	// 只搜尋指定的房間，不包含系統消息；內容中的 HTML 被轉義
+	results := search(storage.MessageSearch{Query: "hello"})
+	if got, want := found(results), []string{"<b>bold</b> hello", "Hello world", "大家好朋友們 hello"}; !slices.Equal(got, want) {
+		t.Fatalf("search hello = %q, want %q", got, want)
+	}
+	for _, r := range results {
+		if !strings.Contains(r.Highlight, "<mark>") || strings.Contains(r.Highlight, "<b>") {
+			t.Errorf("highlight of %q = %q", r.Content, r.Highlight)
+		}
+	}
+
+	// 中文沒有空白分詞，以子字串比對
+	results = search(storage.MessageSearch{Query: "好朋"})
+	if len(results) != 1 || !strings.Contains(results[0].Highlight, "<mark>好朋</mark>") {
+		t.Fatalf("search 好朋 = %+v", results)
+	}
+
+	if got := found(search(storage.MessageSearch{Query: "hello", SenderID: "u2"})); !slices.Equal(got, []string{"大家好朋友們 hello"}) {
+		t.Errorf("search by sender = %q", got)
+	}
+	if got := found(search(storage.MessageSearch{Query: "hello", From: base.Add(30 * time.Second), To: base.Add(3 * time.Minute)})); !slices.Equal(got, []string{"大家好朋友們 hello"}) {
+		t.Errorf("search by time range = %q", got)
+	}
+	if got := found(search(storage.MessageSearch{Query: "見面", HasAttachment: true})); len(got) != 1 {
+		t.Errorf("search with attachment = %q", got)
+	}
+	if got := search(storage.MessageSearch{Query: "hello", HasAttachment: true}); len(got) != 0 {
+		t.Errorf("search hello with attachment = %+v", got)
+	}
+	if got := search(storage.MessageSearch{Query: "hello", Limit: 1}); len(got) != 1 {
+		t.Errorf("search with limit 1 returned %d results", len(got))
+	}
+	if got := search(storage.MessageSearch{Query: "hello", RoomIDs: []string{}}); len(got) != 0 {
+		t.Errorf("search without rooms = %+v", got)
+	}
+
+	// 截取之前先依相關度排序：較舊但符合較多次的消息在前；LIKE 的萬用字元只是一般字元
+	rankRoom := unique("rank")
+	for i, content := range []string{"hello hello hello", "50% off", "500 off", "hello"} {
+		store.SaveMessage(ctx, chatMessage(rankRoom, "u1", base.Add(time.Duration(i)*time.Minute), content))
+	}
+	if got := search(storage.MessageSearch{Query: "hello", RoomIDs: []string{rankRoom}, Limit: 1}); len(got) != 1 || got[0].Content != "hello hello hello" {
+		t.Errorf("best match with limit 1 = %+v", got)
+	}
+	if got := found(search(storage.MessageSearch{Query: "50%", RoomIDs: []string{rankRoom}})); !slices.Equal(got, []string{"50% off"}) {
+		t.Errorf("search 50%% = %q", got)
+	}
+}
+
+func testRetention(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	userID := register(t, store, unique("frank"))
+	newRoom := func(name string) string {
+		t.Helper()
+		roomID, err := store.CreateRoom(ctx, unique(name), userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return roomID
+	}
+	keepRoom, daysRoom, ttlRoom, holdRoom := newRoom("keep"), newRoom("days"), newRoom("ttl"), newRoom("hold")
+
+	// 沒有設定過的房間永久保留
+	if policy, err := store.GetRetentionPolicy(ctx, ttlRoom); err != nil || policy.Mode != storage.RetentionForever || policy.LegalHold {
+		t.Fatalf("GetRetentionPolicy default = %+v, %v", policy, err)
+	}
+	if _, err := store.GetRetentionPolicy(ctx, uuid.NewString()); !errors.Is(err, storage.ErrRoomNotFound) {
+		t.Fatalf("GetRetentionPolicy of unknown room error = %v, want ErrRoomNotFound", err)
+	}
+	if _, err := store.SetRetentionPolicy(ctx, storage.RetentionPolicy{RoomID: uuid.NewString(), Mode: storage.RetentionDays, Days: 1}); !errors.Is(err, storage.ErrRoomNotFound) {
+		t.Fatalf("SetRetentionPolicy of unknown room error = %v, want ErrRoomNotFound", err)
+	}
+	if _, err := store.SetRetentionPolicy(ctx, storage.RetentionPolicy{RoomID: keepRoom, Mode: storage.RetentionKeepLast}); err == nil {
+		t.Fatal("SetRetentionPolicy accepted keep_last 0")
+	}
+
+	for _, policy := range []storage.RetentionPolicy{
+		{RoomID: keepRoom, Mode: storage.RetentionKeepLast, KeepLast: 2},
+		{RoomID: daysRoom, Mode: storage.RetentionDays, Days: 1},
+		{RoomID: holdRoom, Mode: storage.RetentionKeepLast, KeepLast: 1},
+	} {
+		if _, err := store.SetRetentionPolicy(ctx, policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.SetLegalHold(ctx, holdRoom, true); err != nil {
+		t.Fatal(err)
+	}
+	// 修改保留規則不會解除法律保全
+	policy, err := store.SetRetentionPolicy(ctx, storage.RetentionPolicy{RoomID: holdRoom, Mode: storage.RetentionKeepLast, KeepLast: 1})
+	if err != nil || !policy.LegalHold || policy.KeepLast != 1 || policy.UpdatedAt.IsZero() {
+		t.Fatalf("SetRetentionPolicy of room on legal hold = %+v, %v", policy, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	base := now.Add(-time.Hour)
+	expired, later := now.Add(-time.Minute), now.Add(time.Hour)
+	expiring := func(msg storage.ChatMessage, at time.Time) storage.ChatMessage {
+		msg.ExpiresAt = &at
+		return msg
+	}
+	for _, msg := range []storage.ChatMessage{
+		chatMessage(keepRoom, "u1", base, "k0"),
+		chatMessage(keepRoom, "u1", base.Add(time.Second), "k1"),
+		chatMessage(keepRoom, "system", base.Add(1500*time.Millisecond), "joined"),
+		chatMessage(keepRoom, "u1", base.Add(2*time.Second), "k2"),
+		chatMessage(keepRoom, "u1", base.Add(3*time.Second), "k3"),
+		chatMessage(daysRoom, "u1", now.AddDate(0, 0, -3), "old"),
+		chatMessage(daysRoom, "u1", base, "new"),
+		expiring(chatMessage(ttlRoom, "u1", base, "burnt"), expired),
+		expiring(chatMessage(ttlRoom, "u1", base.Add(time.Second), "burning"), later),
+		chatMessage(ttlRoom, "u1", base.Add(2*time.Second), "kept"),
+		chatMessage(holdRoom, "u1", base, "h0"),
+		expiring(chatMessage(holdRoom, "u1", base.Add(time.Second), "h1"), expired),
+		chatMessage(holdRoom, "u1", base.Add(2*time.Second), "h2"),
+	} {
+		if err := store.SaveMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 過期的消息在清理之前就不再返回
+	recent, err := store.GetRecentMessages(ctx, ttlRoom, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(contents(recent), []string{"burning", "kept"}) {
+		t.Fatalf("GetRecentMessages with an expired message = %v", contents(recent))
+	}
+	if recent[0].ExpiresAt == nil || !recent[0].ExpiresAt.Equal(later) {
+		t.Fatalf("ExpiresAt = %v, want %v", recent[0].ExpiresAt, later)
+	}
+
+	results, err := store.PurgeMessages(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged := make(map[string]storage.PurgeResult)
+	for _, r := range results {
+		purged[r.RoomID] = r
+	}
+	if r := purged[keepRoom]; r.Deleted != 3 || r.RemovedBefore == nil || !r.RemovedBefore.Equal(base.Add(2*time.Second)) || r.ExpiredBefore != nil {
+		t.Errorf("purge of keep_last room = %+v, want 3 messages before %v", r, base.Add(2*time.Second))
+	}
+	if r := purged[daysRoom]; r.Deleted != 1 || r.RemovedBefore == nil || r.RemovedBefore.After(now.Add(-23*time.Hour)) {
+		t.Errorf("purge of days room = %+v, want 1 message before a day ago", r)
+	}
+	if r := purged[ttlRoom]; r.Deleted != 1 || r.ExpiredBefore == nil || !r.ExpiredBefore.Equal(now) || r.RemovedBefore != nil {
+		t.Errorf("purge of ttl room = %+v, want 1 expired message", r)
+	}
+	if r, ok := purged[holdRoom]; ok {
+		t.Errorf("purged a room on legal hold: %+v", r)
+	}
+
+	for roomID, want := range map[string][]string{
+		keepRoom: {"k2", "k3"},
+		daysRoom: {"new"},
+		ttlRoom:  {"burning", "kept"},
+		holdRoom: {"h0", "h2"},
+	} {
+		messages, err := store.GetMessagesByTimeRange(ctx, roomID, now.AddDate(0, 0, -7), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(contents(messages), want) {
+			t.Errorf("messages after purge = %v, want %v", contents(messages), want)
+		}
+	}
+
+	// 往前翻頁也不會讀到保留規則之外的消息 (Postgres 會讀取封存的月份)
+	var paged []string
+	cursor := storage.MessageCursor{Timestamp: now}
+	for range 10 {
+		page, err := store.GetMessagesBefore(ctx, keepRoom, cursor, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		paged = append(contents(page), paged...)
+		cursor = storage.CursorOf(page[0])
+	}
+	if !slices.Equal(paged, []string{"k2", "k3"}) {
+		t.Errorf("paged history after purge = %v, want [k2 k3]", paged)
+	}
+
+	// 解除法律保全之後才清理
+	if _, err := store.SetLegalHold(ctx, holdRoom, false); err != nil {
+		t.Fatal(err)
+	}
+	results, err = store.PurgeMessages(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || !slices.ContainsFunc(results, func(r storage.PurgeResult) bool { return r.RoomID == holdRoom && r.Deleted == 2 }) {
+		t.Fatalf("purge after lifting legal hold = %+v, want 2 messages of %s", results, holdRoom)
+	}
+	for _, r := range results {
+		if r.RoomID == keepRoom || r.RoomID == daysRoom || r.RoomID == ttlRoom {
+			t.Errorf("purged %+v again", r)
+		}
+	}
+}
+
+func testRoomOutbox(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	name := unique("outbox-room")
+
+	// 產生事件失敗時不創建房間
+	if _, err := store.CreateRoomWithOutbox(ctx, name, "u1", func(roomID string) (storage.OutboxMessage, error) {
+		return storage.OutboxMessage{}, errors.New("encode failed")
+	}); err == nil {
+		t.Fatal("CreateRoomWithOutbox ignored the event error")
+	}
+
+	eventID := uuid.NewString()
+	var eventRoom string
+	roomID, err := store.CreateRoomWithOutbox(ctx, name, "u1", func(roomID string) (storage.OutboxMessage, error) {
+		eventRoom = roomID
+		return storage.OutboxMessage{EventID: eventID, Subject: "room.created", Data: []byte(roomID)}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roomID != eventRoom {
+		t.Fatalf("event got room %q, created %q", eventRoom, roomID)
+	}
+	if again, _ := store.CreateRoom(ctx, name, "u1"); again != roomID {
+		t.Fatalf("room created with outbox was not found by name: %q != %q", again, roomID)
+	}
+
+	if !relayed(t, store, eventID) {
+		t.Fatal("room event was not in the outbox")
+	}
+}
+
+// relayed 發布所有待發布的事件，返回其中是否有 eventID
+func relayed(t *testing.T, store storage.Store, eventID string) bool {
+	t.Helper()
+	found := false
+	for {
+		n, err := store.RelayOutbox(context.Background(), 100, func(out storage.OutboxMessage) error {
+			if out.EventID == eventID {
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return found
+		}
+	}
+}
+
+func testRelayOutbox(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	relayed(t, store, "")
+
+	var eventIDs []string
+	for i := range 3 {
+		out := storage.OutboxMessage{
+			EventID: uuid.NewString(),
+			Subject: "chat.broadcast",
+			Header:  map[string][]string{"Msg-Id": {fmt.Sprint(i)}},
+			Data:    []byte(fmt.Sprint(i)),
+		}
+		if _, err := store.SaveMessageWithOutbox(ctx, chatMessage(unique("room"), "u1", time.Now(), "m"), storage.FixedEvent(out)); err != nil {
+			t.Fatal(err)
+		}
+		eventIDs = append(eventIDs, out.EventID)
+	}
+
+	// publish 失敗時停止這一批，之前發布的仍然標記為已發布
+	var got []storage.OutboxMessage
+	n, err := store.RelayOutbox(ctx, 10, func(out storage.OutboxMessage) error {
+		if len(got) == 2 {
+			return errors.New("broker down")
+		}
+		got = append(got, out)
+		return nil
+	})
+	if err == nil || n != 2 {
+		t.Fatalf("RelayOutbox = %d, %v; want 2 and the publish error", n, err)
+	}
+	if got[0].EventID != eventIDs[0] || got[1].EventID != eventIDs[1] {
+		t.Fatalf("relayed %s, %s; want events in insertion order", got[0].EventID, got[1].EventID)
+	}
+	if string(got[1].Data) != "1" || got[1].Subject != "chat.broadcast" || got[1].Header["Msg-Id"][0] != "1" {
+		t.Fatalf("relayed event = %+v", got[1])
+	}
+
+	// 剩下的事件在下一次 relay 發布，已發布的不會再發布
+	var rest []string
+	if _, err := store.RelayOutbox(ctx, 10, func(out storage.OutboxMessage) error {
+		rest = append(rest, out.EventID)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rest, eventIDs[2:]) {
+		t.Fatalf("second relay = %v, want %v", rest, eventIDs[2:])
+	}
+
+	deleted, err := store.DeletePublishedOutbox(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted < 3 {
+		t.Fatalf("DeletePublishedOutbox deleted %d, want at least 3", deleted)
+	}
+}
+
+func testDeadLetters(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	handlerKey := unique("message.chat")
+	base := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+
+	for i := range 3 {
+		letter := storage.DeadLetter{
+			HandlerKey: handlerKey,
+			Subject:    "prod.chat.room-1.message",
+			Header:     map[string][]string{"Msg-Id": {fmt.Sprint(i)}},
+			Data:       []byte(fmt.Sprint(i)),
+			Error:      "boom",
+			Attempts:   3,
+			FailedAt:   base.Add(time.Duration(i) * time.Second),
+		}
+		if err := store.SaveDeadLetter(ctx, letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.SaveDeadLetter(ctx, storage.DeadLetter{HandlerKey: unique("other"), Subject: "x", Data: []byte("x"), Error: "boom"})
+
+	// 依失敗時間由新到舊
+	letters, err := store.ListDeadLetters(ctx, handlerKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 || string(letters[0].Data) != "2" || string(letters[1].Data) != "1" {
+		t.Fatalf("ListDeadLetters = %+v, want the 2 latest", letters)
+	}
+	if all, _ := store.ListDeadLetters(ctx, "", 1000); len(all) < 4 {
+		t.Fatalf("ListDeadLetters of all handlers returned %d, want at least 4", len(all))
+	}
+
+	letter, err := store.GetDeadLetter(ctx, letters[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if letter.HandlerKey != handlerKey || letter.Attempts != 3 || letter.Error != "boom" ||
+		letter.Header["Msg-Id"][0] != "2" || !letter.FailedAt.Equal(base.Add(2*time.Second)) {
+		t.Fatalf("GetDeadLetter = %+v", letter)
+	}
+
+	if err := store.DeleteDeadLetter(ctx, letter.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetDeadLetter(ctx, letter.ID); !errors.Is(err, storage.ErrDeadLetterNotFound) {
+		t.Fatalf("GetDeadLetter after delete error = %v, want ErrDeadLetterNotFound", err)
+	}
+	if err := store.DeleteDeadLetter(ctx, letter.ID); !errors.Is(err, storage.ErrDeadLetterNotFound) {
+		t.Fatalf("second DeleteDeadLetter error = %v, want ErrDeadLetterNotFound", err)
+	}
+}
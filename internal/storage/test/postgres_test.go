@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/storage/storagetest"
 	"github.com/joho/godotenv"
 )
 
@@ -29,6 +32,13 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// TestConformance 與 SQLite、memory 後端執行同一組測試，資料庫中既有的資料不影響結果
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		return store
+	})
+}
+
 func TestUpsertUser(t *testing.T) {
 	user := storage.User{
 		ID:         "test_user_1",
@@ -88,9 +98,334 @@ func TestSaveAndQueryMessages(t *testing.T) {
 
 }
 
+func TestUserStatus(t *testing.T) {
+	ctx := context.Background()
+	user := storage.User{
+		ID:         "test_user_status",
+		UserName:   "TestStatusUser",
+		LastActive: time.Now().UTC(),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := store.UpsertUser(ctx, user); err != nil {
+		t.Fatalf("UpsertUser Failed: %v", err)
+	}
+
+	t.Run("custom status round trip", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Hour).UTC()
+		want := storage.UserStatus{
+			UserID:    user.ID,
+			Status:    storage.UserStatusDND,
+			Text:      "In a meeting",
+			Emoji:     "📅",
+			ExpiresAt: &expiresAt,
+		}
+		if err := store.UpdateUserStatus(ctx, want); err != nil {
+			t.Fatalf("UpdateUserStatus failed: %v", err)
+		}
+
+		got, err := store.GetUserStatus(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("GetUserStatus failed: %v", err)
+		}
+		assertCorrectMessage(t, got.Status, want.Status)
+		assertCorrectMessage(t, got.Text, want.Text)
+		assertCorrectMessage(t, got.Emoji, want.Emoji)
+	})
+
+	t.Run("expired status text is hidden", func(t *testing.T) {
+		expiresAt := time.Now().Add(-time.Minute).UTC()
+		err := store.UpdateUserStatus(ctx, storage.UserStatus{
+			UserID:    user.ID,
+			Status:    storage.UserStatusOnline,
+			Text:      "Lunch",
+			ExpiresAt: &expiresAt,
+		})
+		if err != nil {
+			t.Fatalf("UpdateUserStatus failed: %v", err)
+		}
+
+		got, err := store.GetUserStatus(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("GetUserStatus failed: %v", err)
+		}
+		assertCorrectMessage(t, got.Text, "")
+	})
+
+	t.Run("auto away only from online", func(t *testing.T) {
+		changed, err := store.CompareAndSetUserStatus(ctx, user.ID, storage.UserStatusOnline, storage.UserStatusAway)
+		if err != nil || !changed {
+			t.Fatalf("expected online -> away, changed=%v err=%v", changed, err)
+		}
+
+		changed, err = store.CompareAndSetUserStatus(ctx, user.ID, storage.UserStatusOnline, storage.UserStatusAway)
+		if err != nil || changed {
+			t.Fatalf("expected no change when already away, changed=%v err=%v", changed, err)
+		}
+	})
+}
+
 func assertCorrectMessage(t testing.TB, got, want string) {
 	t.Helper()
 	if got != want {
 		t.Errorf("got %q want %q", got, want)
 	}
 }
+
+func TestSaveMessageWithOutboxIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	roomID := "outbox_room_" + time.Now().Format("150405.000000")
+	msg := storage.ChatMessage{RoomID: roomID, SenderID: "test_user_1", Sender: "TestUser", Content: "outbox", Timestamp: time.Now().UTC()}
+	out := storage.OutboxMessage{EventID: roomID + ".broadcast", Subject: "settlechat.message.broadcast." + roomID, Data: []byte(`{}`)}
+
+	// 同一個事件處理兩次只保存一次
+	for i := 0; i < 2; i++ {
+		id, err := store.SaveMessageWithOutbox(ctx, msg, storage.FixedEvent(out))
+		if err != nil {
+			t.Fatalf("SaveMessageWithOutbox failed: %v", err)
+		}
+		if saved := id != 0; saved != (i == 0) {
+			t.Errorf("attempt %d saved = %v, want %v", i+1, saved, i == 0)
+		}
+	}
+	msgs, err := store.GetRecentMessages(ctx, roomID, 10)
+	if err != nil {
+		t.Fatalf("GetRecentMessages failed: %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Errorf("got %d messages, want 1", len(msgs))
+	}
+
+	var relayed []string
+	for {
+		n, err := store.RelayOutbox(ctx, 100, func(o storage.OutboxMessage) error {
+			relayed = append(relayed, o.EventID)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("RelayOutbox failed: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	found := 0
+	for _, id := range relayed {
+		if id == out.EventID {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("outbox event relayed %d times, want 1", found)
+	}
+}
+
+func TestMigrationsAreApplied(t *testing.T) {
+	ctx := context.Background()
+	migrator, err := storage.NewMigrator(store.DB)
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+
+	// NewPostgresStore 已經套用所有 migration，再套用一次不會有任何改變
+	applied, err := migrator.Up(ctx, 0)
+	if err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("applied %d migrations again", len(applied))
+	}
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			t.Errorf("migration %s not applied", status.Migration)
+		}
+	}
+}
+
+// TestArchivePartition 封存一個過去的月份後，歷史查詢從封存檔案讀取
+// 每次執行使用不同的月份，已經封存的月份不會重新建立分區
+func TestArchivePartition(t *testing.T) {
+	ctx := context.Background()
+	store.ArchiveDir = t.TempDir()
+	defer func() { store.ArchiveDir = "" }()
+
+	month := time.Date(1900, time.Month(1+time.Now().UnixNano()%(12*100)), 1, 0, 0, 0, 0, time.UTC)
+	roomID := fmt.Sprintf("archive-room-%d", time.Now().UnixNano())
+	for i, content := range []string{"first", "second"} {
+		msg := storage.ChatMessage{RoomID: roomID, SenderID: "test_user_1", Sender: "TestUser", Content: content, Timestamp: month.Add(time.Duration(i+1) * time.Hour)}
+		if err := store.SaveMessage(ctx, msg); err != nil {
+			t.Fatalf("SaveMessage failed: %v", err)
+		}
+	}
+
+	archive := archiveMonth(t, month)
+	if archive.Messages < 2 {
+		t.Errorf("archived %d messages, want at least 2", archive.Messages)
+	}
+
+	// 分區已經刪除，消息從封存檔案讀取
+	before, err := store.GetMessagesBefore(ctx, roomID, storage.MessageCursor{Timestamp: month.AddDate(0, 1, 0)}, 10)
+	if err != nil {
+		t.Fatalf("GetMessagesBefore failed: %v", err)
+	}
+	if len(before) != 2 || before[0].Content != "first" || before[1].Content != "second" || before[0].ID == 0 {
+		t.Fatalf("GetMessagesBefore returned %+v", before)
+	}
+	inRange, err := store.GetMessagesByTimeRange(ctx, roomID, month, month.Add(90*time.Minute))
+	if err != nil {
+		t.Fatalf("GetMessagesByTimeRange failed: %v", err)
+	}
+	if len(inRange) != 1 || inRange[0].Content != "first" {
+		t.Fatalf("GetMessagesByTimeRange returned %+v", inRange)
+	}
+
+	// 已經封存的月份不會重新建立
+	if created, err := store.EnsureMessagePartitions(ctx, month, 0); err != nil || len(created) != 0 {
+		t.Fatalf("EnsureMessagePartitions after archiving = %+v, %v", created, err)
+	}
+}
+
+// archiveMonth 為 month 建立分區並封存，month 中的消息之前寫入 messages_default
+func archiveMonth(t *testing.T, month time.Time) *storage.MessageArchive {
+	t.Helper()
+	ctx := context.Background()
+
+	// 沒有這個月份的分區，消息寫入 messages_default；建立分區時搬過去
+	created, err := store.EnsureMessagePartitions(ctx, month, 0)
+	if err != nil {
+		t.Fatalf("EnsureMessagePartitions failed: %v", err)
+	}
+	if len(created) != 1 || !created[0].Month.Equal(month) {
+		t.Fatalf("created partitions %+v, want %s", created, month.Format("2006-01"))
+	}
+	var partition storage.MessagePartition
+	partitions, err := store.MessagePartitions(ctx)
+	if err != nil {
+		t.Fatalf("MessagePartitions failed: %v", err)
+	}
+	for _, p := range partitions {
+		if p.Month.Equal(month) {
+			partition = p
+		}
+	}
+	if partition.Name == "" {
+		t.Fatalf("partition for %s not listed in %+v", month.Format("2006-01"), partitions)
+	}
+
+	archive, err := store.ArchivePartition(ctx, partition)
+	if err != nil {
+		t.Fatalf("ArchivePartition failed: %v", err)
+	}
+	return archive
+}
+
+// TestArchiveRetention 保留規則也刪除已經封存的消息，清理之前讀取封存時就略過超出規則的消息
+func TestArchiveRetention(t *testing.T) {
+	ctx := context.Background()
+	store.ArchiveDir = t.TempDir()
+	defer func() { store.ArchiveDir = "" }()
+
+	// 與 TestArchivePartition 使用不同的年份，兩個測試不會封存同一個月份
+	month := time.Date(1800, time.Month(1+time.Now().UnixNano()%(12*100)), 1, 0, 0, 0, 0, time.UTC)
+	userID, err := store.Register(ctx, fmt.Sprintf("retention-%d", time.Now().UnixNano()), "secret")
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	keepRoom, err := store.CreateRoom(ctx, fmt.Sprintf("archive-keep-%d", time.Now().UnixNano()), userID)
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	daysRoom, err := store.CreateRoom(ctx, fmt.Sprintf("archive-days-%d", time.Now().UnixNano()), userID)
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	for _, roomID := range []string{keepRoom, daysRoom} {
+		for i, content := range []string{"a0", "a1", "a2"} {
+			msg := storage.ChatMessage{RoomID: roomID, SenderID: userID, Sender: "TestUser", Content: content, Timestamp: month.Add(time.Duration(i+1) * time.Hour)}
+			if err := store.SaveMessage(ctx, msg); err != nil {
+				t.Fatalf("SaveMessage failed: %v", err)
+			}
+		}
+	}
+	archiveMonth(t, month)
+
+	history := func(roomID string) []string {
+		t.Helper()
+		messages, err := store.GetMessagesBefore(ctx, roomID, storage.MessageCursor{Timestamp: month.AddDate(0, 1, 0)}, 10)
+		if err != nil {
+			t.Fatalf("GetMessagesBefore failed: %v", err)
+		}
+		var contents []string
+		for _, msg := range messages {
+			contents = append(contents, msg.Content)
+		}
+		return contents
+	}
+
+	if _, err := store.SetRetentionPolicy(ctx, storage.RetentionPolicy{RoomID: keepRoom, Mode: storage.RetentionKeepLast, KeepLast: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetRetentionPolicy(ctx, storage.RetentionPolicy{RoomID: daysRoom, Mode: storage.RetentionDays, Days: 365}); err != nil {
+		t.Fatal(err)
+	}
+	if got := history(daysRoom); len(got) != 0 {
+		t.Fatalf("history of days room before purge = %v, want none", got)
+	}
+
+	results, err := store.PurgeMessages(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("PurgeMessages failed: %v", err)
+	}
+	purged := make(map[string]storage.PurgeResult)
+	for _, r := range results {
+		purged[r.RoomID] = r
+	}
+	if r := purged[keepRoom]; r.Deleted != 1 || r.RemovedBefore == nil || !r.RemovedBefore.Equal(month.Add(2*time.Hour)) {
+		t.Errorf("purge of keep_last room = %+v, want 1 archived message", r)
+	}
+	if r := purged[daysRoom]; r.Deleted != 3 || r.RemovedBefore == nil {
+		t.Errorf("purge of days room = %+v, want 3 archived messages", r)
+	}
+	if got := history(keepRoom); len(got) != 2 || got[0] != "a1" || got[1] != "a2" {
+		t.Errorf("history of keep_last room after purge = %v, want [a1 a2]", got)
+	}
+
+	// 封存檔案已經改寫，解除規則之後刪除的消息也不會回來
+	for _, roomID := range []string{keepRoom, daysRoom} {
+		if _, err := store.SetRetentionPolicy(ctx, storage.RetentionPolicy{RoomID: roomID, Mode: storage.RetentionForever}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := history(keepRoom); len(got) != 2 {
+		t.Errorf("history of keep_last room = %v, want [a1 a2]", got)
+	}
+	if got := history(daysRoom); len(got) != 0 {
+		t.Errorf("history of days room = %v, want none", got)
+	}
+	if results, err := store.PurgeMessages(ctx, time.Now()); err != nil || slices.ContainsFunc(results, func(r storage.PurgeResult) bool {
+		return r.RoomID == keepRoom || r.RoomID == daysRoom
+	}) {
+		t.Errorf("second purge = %+v, %v", results, err)
+	}
+}
+
+// search_vector 以 english 建立，以不同的設定啟動時 Migrate 拒絕，而不是讓搜尋靜靜地漏掉結果
+func TestMigrateRejectsSearchConfigMismatch(t *testing.T) {
+	other, err := storage.OpenPostgresStore(os.Getenv("DATABASE_URL"), storage.WithSearchConfig("simple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	ctx := context.Background()
+	if err := other.Migrate(ctx); err == nil || !strings.Contains(err.Error(), "SEARCH_CONFIG") {
+		t.Fatalf("Migrate with a different search config: err = %v", err)
+	}
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate with the column's search config: %v", err)
+	}
+}
@@ -3,11 +3,12 @@ package storage
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v5"
 )
 
 func (p *PostgresStore) Register(ctx context.Context, username, password string) (string, error) {
@@ -20,10 +21,10 @@ func (p *PostgresStore) Register(ctx context.Context, username, password string)
 	}
 
 	if exists {
-		return "", errors.New("username already exists")
+		return "", ErrUsernameTaken
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost) // what is Cost?
+	hash, err := HashPassword(password)
 	if err != nil {
 		log.Println("Hashing Failed")
 		return "", err
@@ -33,7 +34,7 @@ func (p *PostgresStore) Register(ctx context.Context, username, password string)
 	_, err = p.DB.Exec(ctx, `
 		INSERT INTO users(id, username, password_hash, created_at)
 		VALUES ($1, $2, $3, $4)
-	`, userID, username, string(hash), time.Now().UTC())
+	`, userID, username, hash, time.Now().UTC())
 
 	if err != nil {
 		log.Println("Inserting Failed")
@@ -49,12 +50,12 @@ func (p *PostgresStore) Login(ctx context.Context, username, password string) (s
 	err := p.DB.QueryRow(ctx, `SELECT id, password_hash FROM users WHERE username=$1`, username).Scan(&userID, &hash)
 	if err != nil {
 		log.Printf("Login failed for user %s: %v", username, err)
-		return "", errors.New("invalid username or password")
+		return "", ErrInvalidCredentials
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+	if err := CheckPassword(hash, password); err != nil {
 		log.Println("Wrong Password!")
-		return "", errors.New("invalid password")
+		return "", err
 	}
 
 	return userID, nil
@@ -65,6 +66,9 @@ func (p *PostgresStore) GetUserByID(ctx context.Context, userID string) (*User,
 	row := p.DB.QueryRow(ctx, `SELECT id, username, last_active, created_at FROM users WHERE id=$1`, userID)
 	var u User
 	if err := row.Scan(&u.ID, &u.UserName, &u.LastActive, &u.CreatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
 		return nil, err
 	}
 	return &u, nil
@@ -100,3 +104,80 @@ func (p *PostgresStore) UpdatePresence(ctx context.Context, roomID, userID strin
     `, roomID, userID, isOnline)
 	return err
 }
+
+// GetUserStatus 獲取用戶的全域狀態，過期的自訂狀態文字不會被返回
+func (p *PostgresStore) GetUserStatus(ctx context.Context, userID string) (*UserStatus, error) {
+	st := UserStatus{UserID: userID}
+	err := p.DB.QueryRow(ctx, `
+		SELECT status, status_text, status_emoji, status_expires_at, status_auto_away
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&st.Status, &st.Text, &st.Emoji, &st.ExpiresAt, &st.AutoAway)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	st = st.Current(time.Now())
+	return &st, nil
+}
+
+// UpdateUserStatus 更新用戶的全域狀態與自訂狀態文字，手動設定的狀態不是自動離開
+func (p *PostgresStore) UpdateUserStatus(ctx context.Context, st UserStatus) error {
+	if !IsValidUserStatus(st.Status) {
+		return fmt.Errorf("invalid user status: %q", st.Status)
+	}
+
+	tag, err := p.DB.Exec(ctx, `
+		UPDATE users
+		SET status = $2, status_text = $3, status_emoji = $4, status_expires_at = $5, status_auto_away = false
+		WHERE id = $1
+	`, st.UserID, st.Status, st.Text, st.Emoji, st.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, st.UserID)
+	}
+	return nil
+}
+
+// CompareAndSetUserStatus 只有在目前狀態為 from 時才更新為 to，用於自動離開/恢復在線
+// 更新為 away 時記錄為自動離開，from 為 away 時只更新自動設定的 away；返回是否有更新
+func (p *PostgresStore) CompareAndSetUserStatus(ctx context.Context, userID, from, to string) (bool, error) {
+	tag, err := p.DB.Exec(ctx, `
+		UPDATE users
+		SET status = $3, status_auto_away = ($3 = 'away')
+		WHERE id = $1 AND status = $2 AND (status != 'away' OR status_auto_away)
+	`, userID, from, to)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ClearExpiredStatusText 清除所有已過期的自訂狀態文字，並返回受影響用戶的最新狀態
+func (p *PostgresStore) ClearExpiredStatusText(ctx context.Context) ([]UserStatus, error) {
+	rows, err := p.DB.Query(ctx, `
+		UPDATE users
+		SET status_text = '', status_emoji = '', status_expires_at = NULL
+		WHERE status_expires_at IS NOT NULL AND status_expires_at <= NOW()
+		RETURNING id, status
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []UserStatus
+	for rows.Next() {
+		var st UserStatus
+		if err := rows.Scan(&st.UserID, &st.Status); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, rows.Err()
+}
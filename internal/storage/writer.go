@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWriterClosed MessageWriter 已經關閉，不再接受新的消息
+var ErrWriterClosed = errors.New("message writer closed")
+
+// WriterConfig 設置 MessageWriter 的批次大小與等待時間
+type WriterConfig struct {
+	// MaxBatch 一批最多寫入的消息數，湊滿時立即寫入
+	MaxBatch int
+	// FlushInterval 一批的第一條消息最多等待多久，時間到了不論湊到幾條都寫入；
+	// 不大於 0 時不等待，只把寫入上一批期間排隊的消息湊成一批 (group commit)
+	// 同一個房間一次只有一條消息在等待寫入，大於 0 時每條消息至少等待一個 interval，
+	// 單一房間每秒最多只能保存 1/FlushInterval 條消息
+	FlushInterval time.Duration
+	// QueueSize 等待寫入的消息上限，佇列滿時 SaveMessageWithOutbox 等待
+	QueueSize int
+	// FlushTimeout 寫入一批的時間上限
+	FlushTimeout time.Duration
+}
+
+// DefaultWriterConfig 返回預設的批次設定：不等待，一批最多 100 條排隊中的消息
+// 寫入一批期間排隊的消息自然湊成下一批，負載越高批次越大，而低負載時不增加延遲
+func DefaultWriterConfig() WriterConfig {
+	return WriterConfig{
+		MaxBatch:      100,
+		FlushInterval: 0,
+		QueueSize:     1000,
+		FlushTimeout:  5 * time.Second,
+	}
+}
+
+// WriterStats 是 MessageWriter 的寫入統計
+type WriterStats struct {
+	Batches   int64   `json:"batches"`
+	Messages  int64   `json:"messages"`  // 寫入成功的消息，包括重複而略過的
+	Failed    int64   `json:"failed"`    // 寫入失敗並回報給呼叫端的消息
+	Fallbacks int64   `json:"fallbacks"` // 整批失敗後改為逐條寫入的批次
+	Queued    int     `json:"queued"`
+	AvgBatch  float64 `json:"avg_batch"`
+}
+
+// MessageWriter 把聊天消息排隊後批次寫入 MessageStore (Postgres 以 COPY 寫入)
+// SaveMessageWithOutbox 等到消息所在的一批寫入後才返回結果，呼叫端以此確認 (ack) 消息已經保存；
+// 只有一個 goroutine 依排隊順序寫入，同一個房間的消息依序處理時 (見 nats.Subscriber)，保存順序不變
+type MessageWriter struct {
+	store  MessageStore
+	config WriterConfig
+	queue  chan *pendingWrite
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	batches   atomic.Int64
+	messages  atomic.Int64
+	failed    atomic.Int64
+	fallbacks atomic.Int64
+}
+
+var _ MessageSaver = (*MessageWriter)(nil)
+
+// pendingWrite 是排隊中的一條消息，寫入的結果送到 result
+type pendingWrite struct {
+	PendingMessage
+	result chan writeResult
+}
+
+type writeResult struct {
+	id  int64
+	err error
+}
+
+// NewMessageWriter 創建 MessageWriter 並開始寫入，不再使用時呼叫 Close
+func NewMessageWriter(store MessageStore, config WriterConfig) *MessageWriter {
+	defaults := DefaultWriterConfig()
+	if config.MaxBatch <= 0 {
+		config.MaxBatch = defaults.MaxBatch
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaults.QueueSize
+	}
+	if config.FlushTimeout <= 0 {
+		config.FlushTimeout = defaults.FlushTimeout
+	}
+
+	w := &MessageWriter{
+		store:  store,
+		config: config,
+		queue:  make(chan *pendingWrite, config.QueueSize),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// SaveMessageWithOutbox 把消息排入下一批，等待寫入完成後返回與 MessageStore 相同的結果
+// ctx 在排隊或等待期間結束時返回錯誤，但已經排入的消息仍然會寫入；
+// 重新投遞的同一個事件以事件 ID 去重，不會保存兩次
+func (w *MessageWriter) SaveMessageWithOutbox(ctx context.Context, msg ChatMessage, event MessageEvent) (int64, error) {
+	p := &pendingWrite{
+		PendingMessage: PendingMessage{Message: msg, Event: event},
+		result:         make(chan writeResult, 1),
+	}
+
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return 0, ErrWriterClosed
+	}
+	select {
+	case w.queue <- p:
+	case <-ctx.Done():
+		w.mu.RUnlock()
+		return 0, fmt.Errorf("queue message write: %w", ctx.Err())
+	}
+	w.mu.RUnlock()
+
+	select {
+	case r := <-p.result:
+		return r.id, r.err
+	case <-ctx.Done():
+		return 0, fmt.Errorf("wait for message write: %w", ctx.Err())
+	}
+}
+
+func (w *MessageWriter) run() {
+	defer close(w.done)
+
+	batch := make([]*pendingWrite, 0, w.config.MaxBatch)
+	for {
+		first, ok := <-w.queue
+		if !ok {
+			return
+		}
+		batch = append(batch[:0], first)
+		batch = w.collect(batch)
+		w.flush(batch)
+	}
+}
+
+// collect 把排隊中的消息加入 batch，直到湊滿、FlushInterval 到期或佇列關閉
+func (w *MessageWriter) collect(batch []*pendingWrite) []*pendingWrite {
+	if w.config.FlushInterval <= 0 {
+		for len(batch) < w.config.MaxBatch {
+			select {
+			case p, ok := <-w.queue:
+				if !ok {
+					return batch
+				}
+				batch = append(batch, p)
+			default:
+				return batch
+			}
+		}
+		return batch
+	}
+
+	timer := time.NewTimer(w.config.FlushInterval)
+	defer timer.Stop()
+	for len(batch) < w.config.MaxBatch {
+		select {
+		case p, ok := <-w.queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, p)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// flush 在一個交易中寫入整批消息；整批失敗時逐條重新寫入，
+// 一條消息的問題 (例如內容不合法) 不會讓同一批其他房間的消息一起失敗
+func (w *MessageWriter) flush(batch []*pendingWrite) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.FlushTimeout)
+	defer cancel()
+
+	pending := make([]PendingMessage, len(batch))
+	for i, p := range batch {
+		pending[i] = p.PendingMessage
+	}
+
+	w.batches.Add(1)
+	ids, err := w.store.SaveMessagesWithOutbox(ctx, pending)
+	if err == nil {
+		w.messages.Add(int64(len(batch)))
+		for i, p := range batch {
+			p.result <- writeResult{id: ids[i]}
+		}
+		return
+	}
+
+	log.Printf("Failed to write batch of %d messages, writing them one by one: %v", len(batch), err)
+	w.fallbacks.Add(1)
+
+	ctx, cancel = context.WithTimeout(context.Background(), w.config.FlushTimeout)
+	defer cancel()
+	for _, p := range batch {
+		id, err := w.store.SaveMessageWithOutbox(ctx, p.Message, p.Event)
+		if err != nil {
+			w.failed.Add(1)
+			err = fmt.Errorf("save message: %w", err)
+		} else {
+			w.messages.Add(1)
+		}
+		p.result <- writeResult{id: id, err: err}
+	}
+}
+
+// Stats 返回目前的寫入統計
+func (w *MessageWriter) Stats() WriterStats {
+	stats := WriterStats{
+		Batches:   w.batches.Load(),
+		Messages:  w.messages.Load(),
+		Failed:    w.failed.Load(),
+		Fallbacks: w.fallbacks.Load(),
+		Queued:    len(w.queue),
+	}
+	if stats.Batches > 0 {
+		stats.AvgBatch = float64(stats.Messages+stats.Failed) / float64(stats.Batches)
+	}
+	return stats
+}
+
+// Close 停止接受新的消息，寫入所有已經排隊的消息後返回
+func (w *MessageWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
@@ -0,0 +1,160 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+	"github.com/ianwu0915/SettleChat/internal/storage/memory"
+)
+
+// rejectingStore 整批寫入時失敗，逐條寫入時只拒絕內容為 "bad" 的消息
+type rejectingStore struct {
+	*memory.Store
+}
+
+func (s rejectingStore) SaveMessagesWithOutbox(ctx context.Context, batch []storage.PendingMessage) ([]int64, error) {
+	return nil, errors.New("batch rejected")
+}
+
+func (s rejectingStore) SaveMessageWithOutbox(ctx context.Context, msg storage.ChatMessage, event storage.MessageEvent) (int64, error) {
+	if msg.Content == "bad" {
+		return 0, errors.New("bad message")
+	}
+	return s.Store.SaveMessageWithOutbox(ctx, msg, event)
+}
+
+func pending(roomID, eventID, content string) (storage.ChatMessage, storage.MessageEvent) {
+	return storage.ChatMessage{RoomID: roomID, SenderID: "u1", Content: content, Timestamp: time.Now()},
+		storage.FixedEvent(storage.OutboxMessage{EventID: eventID, Subject: "broadcast", Data: []byte(content)})
+}
+
+func TestMessageWriterBatchesConcurrentWrites(t *testing.T) {
+	store := memory.NewStore()
+	writer := storage.NewMessageWriter(store, storage.WriterConfig{MaxBatch: 10, FlushInterval: 20 * time.Millisecond})
+	defer writer.Close()
+
+	// 10 個房間同時送出，各自依序等待 ack，就像 Subscriber 的每個房間一次只處理一條
+	const rooms, perRoom = 10, 5
+	var wg sync.WaitGroup
+	for r := 0; r < rooms; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			roomID := fmt.Sprintf("room-%d", r)
+			for i := 0; i < perRoom; i++ {
+				eventID := fmt.Sprintf("%s-%d", roomID, i)
+				msg, event := pending(roomID, eventID, fmt.Sprint(i))
+				if id, err := writer.SaveMessageWithOutbox(context.Background(), msg, event); err != nil || id == 0 {
+					t.Errorf("save %s: id = %d, err = %v", eventID, id, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := writer.Stats()
+	if stats.Messages != rooms*perRoom {
+		t.Fatalf("wrote %d messages, want %d", stats.Messages, rooms*perRoom)
+	}
+	if stats.Batches >= rooms*perRoom {
+		t.Fatalf("%d messages took %d batches, writes were not batched", stats.Messages, stats.Batches)
+	}
+
+	for r := 0; r < rooms; r++ {
+		recent, _ := store.GetRecentMessages(context.Background(), fmt.Sprintf("room-%d", r), 10)
+		var got []string
+		for _, msg := range recent {
+			got = append(got, msg.Content)
+		}
+		if want := []string{"0", "1", "2", "3", "4"}; !slices.Equal(got, want) {
+			t.Fatalf("room-%d messages = %v, want %v", r, got, want)
+		}
+	}
+}
+
+func TestMessageWriterAcksDuplicates(t *testing.T) {
+	writer := storage.NewMessageWriter(memory.NewStore(), storage.WriterConfig{})
+	defer writer.Close()
+
+	msg, event := pending("room-1", "event-1", "hello")
+	for i, want := range []bool{true, false} {
+		id, err := writer.SaveMessageWithOutbox(context.Background(), msg, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved := id != 0; saved != want {
+			t.Fatalf("call %d saved = %v, want %v", i+1, saved, want)
+		}
+	}
+}
+
+func TestMessageWriterIsolatesFailedMessages(t *testing.T) {
+	store := rejectingStore{memory.NewStore()}
+	writer := storage.NewMessageWriter(store, storage.WriterConfig{MaxBatch: 3, FlushInterval: time.Second})
+	defer writer.Close()
+
+	// 三條消息湊成一批，整批失敗後逐條寫入，只有 "bad" 回報失敗
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, content := range []string{"good", "bad", "fine"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg, event := pending("room-1", content, content)
+			_, err := writer.SaveMessageWithOutbox(context.Background(), msg, event)
+			mu.Lock()
+			errs[content] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if errs["good"] != nil || errs["fine"] != nil {
+		t.Fatalf("good messages failed: %v", errs)
+	}
+	if errs["bad"] == nil {
+		t.Fatal("bad message was acked")
+	}
+	if stats := writer.Stats(); stats.Fallbacks != 1 || stats.Failed != 1 || stats.Messages != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestMessageWriterClose(t *testing.T) {
+	store := memory.NewStore()
+	writer := storage.NewMessageWriter(store, storage.WriterConfig{FlushInterval: time.Hour})
+
+	// 排隊中的消息在關閉時寫入
+	result := make(chan error, 1)
+	go func() {
+		msg, event := pending("room-1", "event-1", "queued")
+		_, err := writer.SaveMessageWithOutbox(context.Background(), msg, event)
+		result <- err
+	}()
+	// 等待消息排入，FlushInterval 很長，關閉之前不會寫入
+	time.Sleep(50 * time.Millisecond)
+	if stats := writer.Stats(); stats.Batches != 0 {
+		t.Fatalf("message written before close: %+v", stats)
+	}
+	writer.Close()
+
+	if err := <-result; err != nil {
+		t.Fatalf("queued message: %v", err)
+	}
+	if recent, _ := store.GetRecentMessages(context.Background(), "room-1", 10); len(recent) != 1 {
+		t.Fatalf("room has %d messages after close, want 1", len(recent))
+	}
+
+	msg, event := pending("room-1", "event-2", "late")
+	if _, err := writer.SaveMessageWithOutbox(context.Background(), msg, event); !errors.Is(err, storage.ErrWriterClosed) {
+		t.Fatalf("save after close: err = %v, want ErrWriterClosed", err)
+	}
+}
@@ -0,0 +1,99 @@
+package tracing
+
+import (
+	"context"
+	"net/textproto"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// headerCarrier 讓 propagator 讀寫消息標頭 (traceparent, tracestate, baggage)
+// NATS 標頭與 HTTP 一樣以 canonical 形式保存 key
+type headerCarrier types.Header
+
+func (c headerCarrier) Get(key string) string {
+	return types.Header(c).Get(textproto.CanonicalMIMEHeaderKey(key))
+}
+
+func (c headerCarrier) Set(key, value string) {
+	types.Header(c).Set(textproto.CanonicalMIMEHeaderKey(key), value)
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Inject 把 ctx 的 trace context 寫入消息標頭
+func Inject(ctx context.Context, header types.Header) {
+	if header == nil {
+		return
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(header))
+}
+
+// Extract 從消息標頭讀取上游的 trace context
+func Extract(ctx context.Context, header types.Header) context.Context {
+	if header == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier(header))
+}
+
+// StartPublish 為發布的消息建立 producer span，並把這個 span 寫入消息標頭讓訂閱端接上同一個 trace
+// eventType 為空時 (例如 outbox 只知道主題) 以主題命名 span；呼叫者在發布後以 End 結束 span
+func StartPublish(ctx context.Context, msg *types.Message, eventType string) (context.Context, trace.Span) {
+	name := eventType
+	if name == "" {
+		name = msg.Subject
+	}
+	ctx, span := Start(ctx, "publish "+name,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(messageAttributes(msg, eventType)...),
+	)
+	Inject(ctx, msg.Header)
+	return ctx, span
+}
+
+// StartRequest 為 request-reply 的查詢建立 client span，並把這個 span 寫入消息標頭
+func StartRequest(ctx context.Context, msg *types.Message, eventType string) (context.Context, trace.Span) {
+	ctx, span := Start(ctx, "request "+eventType,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(messageAttributes(msg, eventType)...),
+	)
+	Inject(ctx, msg.Header)
+	return ctx, span
+}
+
+// StartConsume 以消息標頭中的 trace context 為父 span，為 handler 建立 consumer span
+func StartConsume(ctx context.Context, msg *types.Message, handlerKey string) (context.Context, trace.Span) {
+	attrs := append(messageAttributes(msg, ""), attribute.String("settlechat.handler", handlerKey))
+	if msg.Attempt > 0 {
+		attrs = append(attrs, attribute.Int("messaging.delivery.attempt", msg.Attempt))
+	}
+	return Start(Extract(ctx, msg.Header), "handle "+handlerKey,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+func messageAttributes(msg *types.Message, eventType string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.system", "nats"),
+		attribute.String("messaging.destination.name", msg.Subject),
+		attribute.Int("messaging.message.body.size", len(msg.Data)),
+	}
+	if id := msg.Header.Get(types.HeaderMsgID); id != "" {
+		attrs = append(attrs, attribute.String("messaging.message.id", id))
+	}
+	if eventType != "" {
+		attrs = append(attrs, attribute.String("settlechat.event_type", eventType))
+	}
+	return attrs
+}
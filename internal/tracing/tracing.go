@@ -0,0 +1,124 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName 是 SettleChat 建立的 span 的 instrumentation scope
+const instrumentationName = "github.com/ianwu0915/SettleChat"
+
+// 支援的 exporter
+const (
+	ExporterNone   = "none"   // 不輸出 span，但仍然在消息標頭之間傳遞 trace context
+	ExporterStdout = "stdout" // 以縮排的 JSON 輸出到標準輸出
+	ExporterFile   = "file"   // 每個 span 一行 JSON，附加到 Config.File
+)
+
+// Config 設置 span 的輸出方式
+type Config struct {
+	// Exporter 為 none、stdout 或 file，空字串視為 none
+	Exporter string
+	// File Exporter 為 file 時寫入的檔案
+	File string
+	// ServiceName 寫入每個 span 的 service.name
+	ServiceName string
+	// SampleRatio 取樣新 trace 的比例 (0, 1]，0 視為全部取樣；已經被取樣的上游 trace 一律取樣
+	SampleRatio float64
+}
+
+// Shutdown 送出還在緩衝的 span 並關閉 exporter
+type Shutdown func(ctx context.Context) error
+
+// Setup 設置全域的 TracerProvider 與 W3C trace context propagator
+// Exporter 為 none 時 span 不會被記錄，但 trace context 仍然會透過 NATS 標頭傳遞給其他實例
+func Setup(cfg Config) (Shutdown, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var (
+		writer io.Writer
+		file   *os.File
+		opts   []stdouttrace.Option
+	)
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		writer = os.Stdout
+		opts = append(opts, stdouttrace.WithPrettyPrint())
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, errors.New("trace exporter file requires a file path")
+		}
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("open trace file: %w", err)
+		}
+		writer, file = f, f
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (want none, stdout or file)", cfg.Exporter)
+	}
+
+	exporter, err := stdouttrace.New(append(opts, stdouttrace.WithWriter(writer))...)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, fmt.Errorf("create trace exporter: %w", err)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "settlechat"
+	}
+	ratio := cfg.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	}, nil
+}
+
+// Tracer 返回 SettleChat 的 tracer，Setup 之前建立的 span 也會在 Setup 之後生效
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start 以 SettleChat 的 tracer 建立 span
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// End 記錄 err 並結束 span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ianwu0915/SettleChat/internal/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func setupRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return recorder
+}
+
+func TestPublishConsumeSharesTrace(t *testing.T) {
+	recorder := setupRecorder(t)
+
+	ctx, root := Start(context.Background(), "receive chat message")
+	msg := types.NewMessage("settlechat.message.chat.room1", []byte(`{}`))
+	msg.Header.Set(types.HeaderMsgID, "event-1")
+	_, publish := StartPublish(ctx, msg, types.EventTypeNewMessage)
+	End(publish, nil)
+	root.End()
+
+	if msg.Header.Get("Traceparent") == "" {
+		t.Fatalf("traceparent header not injected: %v", msg.Header)
+	}
+
+	// 訂閱端只拿得到消息標頭
+	received := &types.Message{Subject: msg.Subject, Header: msg.Header, Data: msg.Data, Attempt: 1}
+	consumeCtx, consume := StartConsume(context.Background(), received, "message.chat")
+	End(consume, nil)
+
+	consumed := trace.SpanContextFromContext(consumeCtx)
+	if consumed.TraceID() != root.SpanContext().TraceID() {
+		t.Fatalf("consumer trace = %s, want %s", consumed.TraceID(), root.SpanContext().TraceID())
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(spans))
+	}
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		byName[span.Name()] = span
+	}
+	publishSpan := byName["publish "+types.EventTypeNewMessage]
+	consumeSpan := byName["handle message.chat"]
+	if publishSpan == nil || consumeSpan == nil {
+		t.Fatalf("missing publish or consume span: %v", byName)
+	}
+	if consumeSpan.Parent().SpanID() != publishSpan.SpanContext().SpanID() {
+		t.Errorf("consumer parent = %s, want publish span %s", consumeSpan.Parent().SpanID(), publishSpan.SpanContext().SpanID())
+	}
+	if consumeSpan.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("consumer span kind = %s", consumeSpan.SpanKind())
+	}
+}
+
+func TestExtractWithoutHeader(t *testing.T) {
+	setupRecorder(t)
+
+	msg := &types.Message{Subject: "settlechat.message.chat.room1"}
+	ctx, span := StartConsume(context.Background(), msg, "message.chat")
+	defer span.End()
+
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("message without trace headers should start a new trace")
+	}
+	if span.(sdktrace.ReadOnlySpan).Parent().IsValid() {
+		t.Error("message without trace headers should not have a parent span")
+	}
+}
+
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	if _, err := Setup(Config{Exporter: "zipkin"}); err == nil {
+		t.Fatal("expected error for unknown exporter")
+	}
+	if _, err := Setup(Config{Exporter: ExporterFile}); err == nil {
+		t.Fatal("expected error for file exporter without a path")
+	}
+}
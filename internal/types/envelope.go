@@ -0,0 +1,54 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Envelope 是事件總線上所有事件共用的外層結構
+// Payload 的結構由 Type 與 Version 決定，登記在 EventRegistry
+type Envelope struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	RoomID    string    `json:"room_id"`
+	Actor     string    `json:"actor,omitempty"` // 觸發事件的用戶，系統產生的事件為空
+	Payload   any       `json:"payload"`
+}
+
+// NewEnvelope 以事件類型目前的版本創建一個事件
+func NewEnvelope(eventType, roomID, actor string, payload any) Envelope {
+	version, _ := Events.CurrentVersion(eventType)
+	return Envelope{
+		ID:        uuid.NewString(),
+		Type:      eventType,
+		Version:   version,
+		Timestamp: time.Now(),
+		RoomID:    roomID,
+		Actor:     actor,
+		Payload:   payload,
+	}
+}
+
+// GetType 實現 Event 介面
+func (e Envelope) GetType() string {
+	return e.Type
+}
+
+// GetTimestamp 實現 Event 介面
+func (e Envelope) GetTimestamp() time.Time {
+	return e.Timestamp
+}
+
+// envelopeHeader 是 Envelope 除了 Payload 之外的欄位
+// 解碼時先讀出類型與版本，再決定 payload 的結構
+type envelopeHeader struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	RoomID    string    `json:"room_id"`
+	Actor     string    `json:"actor,omitempty"`
+}
@@ -1,11 +1,19 @@
 package types
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/ianwu0915/SettleChat/internal/storage"
 )
 
+// ConnectionMessage 連接與斷開連接事件的 payload，事件類型區分兩者
+type ConnectionMessage struct {
+	RoomID   string `json:"room_id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
 // UserJoinedMessage 用戶加入消息
 type UserJoinedMessage struct {
 	RoomID   string    `json:"room_id"`
@@ -22,12 +30,17 @@ type UserLeftMessage struct {
 	LeftAt   time.Time `json:"left_at"`
 }
 
-// PresenceMessage 在線狀態消息
+// PresenceMessage 在線狀態消息 (user.presence v2)
+// 只有 IsOnline 的 v1 消息解碼時會補上 Status
 type PresenceMessage struct {
-	RoomID   string `json:"room_id"`
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
-	IsOnline bool   `json:"is_online"`
+	RoomID          string     `json:"room_id"`
+	UserID          string     `json:"user_id"`
+	Username        string     `json:"username"`
+	IsOnline        bool       `json:"is_online"`
+	Status          string     `json:"status,omitempty"`
+	StatusText      string     `json:"status_text,omitempty"`
+	StatusEmoji     string     `json:"status_emoji,omitempty"`
+	StatusExpiresAt *time.Time `json:"status_expires_at,omitempty"`
 }
 
 // SystemMessage 系統消息
@@ -37,11 +50,26 @@ type SystemMessage struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 
-// HistoryRequest 歷史消息請求
+// MessageAck 聊天消息保存的結果，只推送給發送者
+// 保存失敗時一定會推送；保存成功時只在消息帶有 ClientMsgID 時推送
+type MessageAck struct {
+	RoomID      string    `json:"room_id"`
+	UserID      string    `json:"user_id"`
+	EventID     string    `json:"event_id"`
+	ClientMsgID string    `json:"client_msg_id,omitempty"`
+	Status      string    `json:"status"` // storage.MessageAckSaved 或 storage.MessageAckFailed
+	Error       string    `json:"error,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// HistoryRequest 歷史消息請求，Before 不為空時返回早於 Before 的消息 (向上捲動)
+// BeforeID 是客戶端最舊一條消息的 ID，與 Before 時間相同的消息中只返回 ID 較小的；為 0 時只比較時間
 type HistoryRequest struct {
-	RoomID string `json:"room_id"`
-	UserID string `json:"user_id"`
-	Limit  int    `json:"limit"`
+	RoomID   string     `json:"room_id"`
+	UserID   string     `json:"user_id"`
+	Limit    int        `json:"limit"`
+	Before   *time.Time `json:"before,omitempty"`
+	BeforeID int64      `json:"before_id,omitempty"`
 }
 
 // HistoryResponse 歷史消息響應
@@ -50,6 +78,47 @@ type HistoryResponse struct {
 	Messages []storage.ChatMessage `json:"messages"`
 }
 
+// RoomMembersRequest 房間成員查詢
+type RoomMembersRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// RoomMembersResponse 房間成員查詢的響應
+type RoomMembersResponse struct {
+	RoomID  string               `json:"room_id"`
+	Members []storage.RoomMember `json:"members"`
+}
+
+// RoomStateRequest 房間狀態查詢
+type RoomStateRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// RoomState 房間狀態查詢的響應
+type RoomState struct {
+	Room          storage.Room `json:"room"`
+	MemberCount   int          `json:"member_count"`
+	OnlineCount   int          `json:"online_count"`
+	LastMessageAt *time.Time   `json:"last_message_at,omitempty"`
+}
+
+// 查詢錯誤代碼
+const (
+	QueryErrorBadRequest = "bad_request"
+	QueryErrorNotFound   = "not_found"
+	QueryErrorInternal   = "internal"
+)
+
+// QueryError 響應端無法完成查詢時回覆的錯誤，請求端以 errors.As 取得
+type QueryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query failed (%s): %s", e.Code, e.Message)
+}
+
 type AICommand struct {
 	
 }
@@ -0,0 +1,153 @@
+package types
+
+import (
+	"fmt"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// Events 是所有事件類型與 payload 結構的登記表
+// 新增事件類型或修改 payload 時在這裡登記新版本，並為舊版本提供 upcaster
+var Events = NewEventRegistry()
+
+func init() {
+	Events.Register(EventSchema{
+		Type: EventTypeConnect, Version: 1,
+		Description: "客戶端連上某個實例",
+		New:         func() any { return &ConnectionMessage{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeDisconnect, Version: 1,
+		Description: "客戶端斷開連線",
+		New:         func() any { return &ConnectionMessage{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeUserJoined, Version: 1,
+		Description: "用戶加入房間",
+		New:         func() any { return &UserJoinedMessage{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeUserLeft, Version: 1,
+		Description: "用戶離開房間",
+		New:         func() any { return &UserLeftMessage{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeUserPresence, Version: 1,
+		Description: "用戶在線狀態，只有 is_online",
+		New:         func() any { return &presenceMessageV1{} },
+		Upcast:      upcastPresenceV1,
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeUserPresence, Version: 2,
+		Description: "用戶在線狀態，帶有自訂狀態與文字",
+		New:         func() any { return &PresenceMessage{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeNewMessage, Version: 1,
+		Description: "客戶端送出的新消息，等待保存與廣播",
+		New:         func() any { return &storage.ChatMessage{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeBroadcastMsg, Version: 1,
+		Description: "已保存的消息，推送給房間內的客戶端",
+		New:         func() any { return &storage.ChatMessage{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeMessageAck, Version: 1,
+		Description: "消息保存成功或失敗，推送給發送者",
+		New:         func() any { return &MessageAck{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeHistoryRequest, Version: 1,
+		Description: "客戶端加入房間時查詢最近的消息",
+		New:         func() any { return &HistoryRequest{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeHistoryResponse, Version: 1,
+		Description: "最近的消息，回覆到請求的 inbox 主題",
+		New:         func() any { return &HistoryResponse{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeRoomMembersRequest, Version: 1,
+		Description: "查詢房間成員",
+		New:         func() any { return &RoomMembersRequest{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeRoomMembersResponse, Version: 1,
+		Description: "房間成員與各自的在線狀態",
+		New:         func() any { return &RoomMembersResponse{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeRoomStateRequest, Version: 1,
+		Description: "查詢房間狀態",
+		New:         func() any { return &RoomStateRequest{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeRoomStateResponse, Version: 1,
+		Description: "房間資訊、成員數與最後一條消息的時間",
+		New:         func() any { return &RoomState{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeQueryError, Version: 1,
+		Description: "查詢失敗時代替響應回覆的錯誤",
+		New:         func() any { return &QueryError{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeSystemMessage, Version: 1,
+		Description: "系統產生的房間通知，例如加入與離開",
+		New:         func() any { return &SystemMessage{} },
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeNewAICommand, Version: 0,
+		Description: "舊格式的 AI 命令，消息放在 Message 欄位",
+		New:         func() any { return &legacyAICommand{} },
+		Upcast:      upcastLegacyAICommand,
+	})
+	Events.Register(EventSchema{
+		Type: EventTypeNewAICommand, Version: 1,
+		Description: "以 / 開頭交給 AI 處理的消息",
+		New:         func() any { return &storage.ChatMessage{} },
+	})
+}
+
+// presenceMessageV1 是加入自訂狀態之前的在線狀態
+type presenceMessageV1 struct {
+	RoomID   string `json:"room_id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	IsOnline bool   `json:"is_online"`
+}
+
+func upcastPresenceV1(payload any) (any, error) {
+	old, ok := payload.(*presenceMessageV1)
+	if !ok {
+		return nil, fmt.Errorf("unexpected presence v1 payload %T", payload)
+	}
+	status := storage.UserStatusOnline
+	if !old.IsOnline {
+		status = storage.UserStatusOffline
+	}
+	return &PresenceMessage{
+		RoomID:   old.RoomID,
+		UserID:   old.UserID,
+		Username: old.Username,
+		IsOnline: old.IsOnline,
+		Status:   status,
+	}, nil
+}
+
+// legacyAICommand 是 Envelope 之前的 AI 命令事件，消息欄位沒有 json 標籤
+type legacyAICommand struct {
+	Message *storage.ChatMessage `json:"Message"`
+}
+
+func upcastLegacyAICommand(payload any) (any, error) {
+	old, ok := payload.(*legacyAICommand)
+	if !ok {
+		return nil, fmt.Errorf("unexpected legacy ai command payload %T", payload)
+	}
+	if old.Message == nil {
+		return nil, fmt.Errorf("legacy ai command without message")
+	}
+	return old.Message, nil
+}
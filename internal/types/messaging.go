@@ -1,24 +1,91 @@
 package types
 
-import (
-	"github.com/nats-io/nats.go"
-)
-
 // MessageHandler 定義消息處理器接口
 type MessageHandler interface {
-	Handle(msg *nats.Msg) error
+	Handle(msg *Message) error
+}
+
+// HandlerFunc 讓普通函數實現 MessageHandler
+type HandlerFunc func(msg *Message) error
+
+func (f HandlerFunc) Handle(msg *Message) error {
+	return f(msg)
+}
+
+// Middleware 包裝 handler，加上恢復、日誌、指標等共同的處理
+// handlerKey 是被包裝的 handler，例如 "message.chat"
+type Middleware func(handlerKey string, next MessageHandler) MessageHandler
+
+// Chain 依序以 middlewares 包裝 handler，第一個 middleware 在最外層
+func Chain(handlerKey string, handler MessageHandler, middlewares ...Middleware) MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handlerKey, handler)
+	}
+	return handler
+}
+
+// DeliveryMode 決定多個伺服器實例同時運行時，handler 如何接收事件
+type DeliveryMode int
+
+const (
+	// DeliveryFanout 投遞型 handler：每個實例都會收到，例如推送消息給本地的 WebSocket 客戶端
+	DeliveryFanout DeliveryMode = iota
+
+	// DeliveryWork 工作型 handler：同一事件只由其中一個實例處理 (NATS queue group)，例如儲存消息
+	DeliveryWork
+
+	// DeliveryDurable 持久型 handler：啟用 JetStream 時以 durable consumer 消費，失敗會重新投遞，
+	// 實例停機期間的事件也不會遺失；沒有啟用 JetStream 時等同 DeliveryWork
+	DeliveryDurable
+)
+
+func (m DeliveryMode) String() string {
+	switch m {
+	case DeliveryWork:
+		return "work"
+	case DeliveryDurable:
+		return "durable"
+	case DeliveryFanout:
+		return "fanout"
+	default:
+		return "unknown"
+	}
+}
+
+// Topic 是解析後的主題
+type Topic struct {
+	Category string // 例如 "message"
+	Action   string // 例如 "chat"、"history"
+	RoomID   string
+}
+
+// HandlerKey 返回對應 handler 的 key，例如 "query.history"
+func (t Topic) HandlerKey() string {
+	return t.Category + "." + t.Action
 }
 
 // TopicFormatter 定義主題格式化接口
 type TopicFormatter interface {
+	// ParseTopic 把主題解析回類別、動作與房間，是各個 Get*Topic 的反函數
+	ParseTopic(topic string) (Topic, error)
+	// FormatTopic 是 ParseTopic 的反函數
+	FormatTopic(topic Topic) string
+	// GetWildcardTopic 返回匹配某類別與動作在所有房間的萬用主題
+	GetWildcardTopic(category, action string) string
+	// Namespace 返回主題的命名空間 (環境與租戶)，例如 "prod.acme"；預設命名空間為空字串
+	// 同一個命名空間的實例共用 queue group 與 durable consumer
+	Namespace() string
+
 	GetMessageTopic(roomID string) string
 	GetPresenceTopic(roomID string) string
-	GetHistoryRequestTopic(roomID string) string
-	GetHistoryResponseTopic(roomID, userID string) string
+	GetHistoryQueryTopic(roomID string) string
+	GetRoomMembersQueryTopic(roomID string) string
+	GetRoomStateQueryTopic(roomID string) string
 	GetSystemMessageTopic(roomID string) string
 	GetUserJoinedTopic(roomID string) string
 	GetUserLeftTopic(roomID string) string
 	GetBroadcastTopic(roomID string) string
+	GetMessageAckTopic(roomID string) string
 	GetConnectionTopic(roomID string) string
 	GetAICommandTopic(roomID string) string
 }
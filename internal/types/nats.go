@@ -3,5 +3,7 @@ package types
 // NATSPublisher 定義 NATS 發布接口
 type NATSPublisher interface {
 	Publish(topic string, data []byte) error
+	// PublishMsg 發布帶有標頭的消息，例如 Content-Type 與去重 ID
+	PublishMsg(msg *Message) error
 	GetTopics() TopicFormatter
 }
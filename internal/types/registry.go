@@ -0,0 +1,218 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ianwu0915/SettleChat/internal/codec"
+)
+
+var (
+	// ErrUnknownEventType 事件類型沒有登記在 registry
+	ErrUnknownEventType = errors.New("unknown event type")
+
+	// ErrUnsupportedVersion 事件版本比本實例認得的版本新，或缺少升級到目前版本的 upcaster
+	ErrUnsupportedVersion = errors.New("unsupported event version")
+)
+
+// EventSchema 描述一種事件在某個版本的 payload 結構
+type EventSchema struct {
+	Type        string
+	Version     int
+	Description string
+
+	// New 返回一個指向空 payload 的指標，解碼時使用
+	New func() any
+
+	// Upcast 把這個版本的 payload 轉換成下一個版本的 payload (都是指標)
+	// 目前版本為 nil
+	Upcast func(payload any) (any, error)
+}
+
+// SchemaField 是 payload 的一個欄位
+type SchemaField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Fields 根據 json 標籤列出 payload 的欄位
+func (s EventSchema) Fields() []SchemaField {
+	t := reflect.TypeOf(s.New())
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []SchemaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, SchemaField{Name: name, Type: f.Type.String()})
+	}
+	return fields
+}
+
+// EventRegistry 記錄每種事件類型各個版本的 payload 結構
+// 舊版本的事件 (例如 JetStream 中保存的、或滾動更新時舊實例發布的) 解碼後會依序 upcast 到目前版本
+type EventRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]map[int]EventSchema
+	current map[string]int
+}
+
+// NewEventRegistry 創建一個空的 registry
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{
+		schemas: make(map[string]map[int]EventSchema),
+		current: make(map[string]int),
+	}
+}
+
+// Register 登記一個版本的 payload 結構，版本最高的即為目前版本
+// 版本 0 保留給沒有 Envelope 的舊格式消息 (payload 欄位直接在最外層)
+func (r *EventRegistry) Register(schema EventSchema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions, ok := r.schemas[schema.Type]
+	if !ok {
+		versions = make(map[int]EventSchema)
+		r.schemas[schema.Type] = versions
+	}
+	if _, exists := versions[schema.Version]; exists {
+		panic(fmt.Sprintf("event schema %s v%d registered twice", schema.Type, schema.Version))
+	}
+	versions[schema.Version] = schema
+	if schema.Version > r.current[schema.Type] {
+		r.current[schema.Type] = schema.Version
+	}
+}
+
+// CurrentVersion 返回事件類型目前的版本
+func (r *EventRegistry) CurrentVersion(eventType string) (int, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	version, ok := r.current[eventType]
+	return version, ok
+}
+
+// Schemas 返回所有登記的結構，依類型與版本排序
+func (r *EventRegistry) Schemas() []EventSchema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var schemas []EventSchema
+	for _, versions := range r.schemas {
+		for _, schema := range versions {
+			schemas = append(schemas, schema)
+		}
+	}
+	sort.Slice(schemas, func(i, j int) bool {
+		if schemas[i].Type != schemas[j].Type {
+			return schemas[i].Type < schemas[j].Type
+		}
+		return schemas[i].Version < schemas[j].Version
+	})
+	return schemas
+}
+
+// Decode 解碼一個事件，返回的 Envelope.Payload 是目前版本 payload 結構的指標
+// 沒有 Envelope 的舊格式消息如果也沒有 type 欄位，以 fallbackType 當作事件類型
+func (r *EventRegistry) Decode(c codec.Codec, data []byte, fallbackType string) (*Envelope, error) {
+	var header envelopeHeader
+	if err := c.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("decode event envelope: %w", err)
+	}
+	if header.Type == "" {
+		header.Type = fallbackType
+	}
+
+	r.mu.RLock()
+	versions := r.schemas[header.Type]
+	current := r.current[header.Type]
+	r.mu.RUnlock()
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEventType, header.Type)
+	}
+	if header.Version > current {
+		return nil, fmt.Errorf("%w: %s v%d (current v%d)", ErrUnsupportedVersion, header.Type, header.Version, current)
+	}
+
+	version := header.Version
+	var payload any
+	if version == 0 {
+		// 舊格式: 整個消息就是 payload，沒有登記版本 0 時當作最早的版本
+		schema, ok := versions[0]
+		if !ok {
+			schema = oldestSchema(versions)
+		}
+		version = schema.Version
+		payload = schema.New()
+		if err := c.Unmarshal(data, payload); err != nil {
+			return nil, fmt.Errorf("decode legacy %s payload: %w", header.Type, err)
+		}
+	} else {
+		schema, ok := versions[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s v%d", ErrUnsupportedVersion, header.Type, version)
+		}
+		payload = schema.New()
+		wrapper := struct {
+			Payload any `json:"payload"`
+		}{Payload: payload}
+		if err := c.Unmarshal(data, &wrapper); err != nil {
+			return nil, fmt.Errorf("decode %s v%d payload: %w", header.Type, version, err)
+		}
+	}
+
+	// 依序升級到目前版本
+	for ; version < current; version++ {
+		schema, ok := versions[version]
+		if !ok || schema.Upcast == nil {
+			return nil, fmt.Errorf("%w: no upcaster for %s v%d", ErrUnsupportedVersion, header.Type, version)
+		}
+		upcast, err := schema.Upcast(payload)
+		if err != nil {
+			return nil, fmt.Errorf("upcast %s v%d: %w", header.Type, version, err)
+		}
+		payload = upcast
+	}
+
+	return &Envelope{
+		ID:        header.ID,
+		Type:      header.Type,
+		Version:   current,
+		Timestamp: header.Timestamp,
+		RoomID:    header.RoomID,
+		Actor:     header.Actor,
+		Payload:   payload,
+	}, nil
+}
+
+func oldestSchema(versions map[int]EventSchema) EventSchema {
+	var oldest EventSchema
+	first := true
+	for version, schema := range versions {
+		if first || version < oldest.Version {
+			oldest = schema
+			first = false
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,102 @@
+package types
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ianwu0915/SettleChat/internal/codec"
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+func TestDecodeUpcastsOldVersions(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		fallbackType string
+		wantType     string
+		check        func(t *testing.T, payload any)
+	}{
+		{
+			name:     "presence v1 envelope gets a status",
+			data:     `{"id":"e1","type":"user.presence","version":1,"room_id":"room-1","payload":{"room_id":"room-1","user_id":"u1","is_online":false}}`,
+			wantType: EventTypeUserPresence,
+			check: func(t *testing.T, payload any) {
+				presence := payload.(*PresenceMessage)
+				if presence.Status != storage.UserStatusOffline || presence.UserID != "u1" {
+					t.Errorf("got %+v", presence)
+				}
+			},
+		},
+		{
+			name:     "legacy flat event with type",
+			data:     `{"type":"connection.disconnect","timestamp":"2025-06-01T12:00:00Z","room_id":"room-1","user_id":"u1","username":"Alice"}`,
+			wantType: EventTypeDisconnect,
+			check: func(t *testing.T, payload any) {
+				if conn := payload.(*ConnectionMessage); conn.Username != "Alice" {
+					t.Errorf("got %+v", conn)
+				}
+			},
+		},
+		{
+			name:         "legacy bare payload uses fallback type",
+			data:         `{"room_id":"room-1","sender_id":"u1","sender":"Alice","content":"hi"}`,
+			fallbackType: EventTypeNewMessage,
+			wantType:     EventTypeNewMessage,
+			check: func(t *testing.T, payload any) {
+				if msg := payload.(*storage.ChatMessage); msg.Content != "hi" {
+					t.Errorf("got %+v", msg)
+				}
+			},
+		},
+		{
+			name:     "legacy ai command",
+			data:     `{"type":"ai.command","Message":{"room_id":"room-1","sender_id":"u1","content":"/summary"}}`,
+			wantType: EventTypeNewAICommand,
+			check: func(t *testing.T, payload any) {
+				if msg := payload.(*storage.ChatMessage); msg.Content != "/summary" {
+					t.Errorf("got %+v", msg)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := Events.Decode(codec.JSON, []byte(tt.data), tt.fallbackType)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if event.Type != tt.wantType {
+				t.Errorf("got type %q want %q", event.Type, tt.wantType)
+			}
+			if current, _ := Events.CurrentVersion(tt.wantType); event.Version != current {
+				t.Errorf("got version %d want %d", event.Version, current)
+			}
+			tt.check(t, event.Payload)
+		})
+	}
+}
+
+func TestDecodeRejectsUnknownEvents(t *testing.T) {
+	_, err := Events.Decode(codec.JSON, []byte(`{"type":"room.renamed","version":1,"payload":{}}`), "")
+	if !errors.Is(err, ErrUnknownEventType) {
+		t.Errorf("got %v want ErrUnknownEventType", err)
+	}
+
+	_, err = Events.Decode(codec.JSON, []byte(`{"type":"user.joined","version":99,"payload":{}}`), "")
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("got %v want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestEverySchemaHasUpcastPath(t *testing.T) {
+	for _, schema := range Events.Schemas() {
+		current, _ := Events.CurrentVersion(schema.Type)
+		if schema.Version < current && schema.Upcast == nil {
+			t.Errorf("%s v%d has no upcaster to v%d", schema.Type, schema.Version, schema.Version+1)
+		}
+		if len(schema.Fields()) == 0 {
+			t.Errorf("%s v%d has no fields", schema.Type, schema.Version)
+		}
+	}
+}
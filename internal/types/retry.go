@@ -0,0 +1,54 @@
+package types
+
+import (
+	"context"
+	"time"
+
+	"github.com/ianwu0915/SettleChat/internal/storage"
+)
+
+// RetryPolicy 決定 handler 失敗時重試的次數與間隔
+type RetryPolicy struct {
+	// MaxAttempts 包含第一次處理在內的最多處理次數，小於 1 時視為 1
+	MaxAttempts int
+
+	// InitialBackoff 第一次重試前的等待時間，之後每次加倍
+	InitialBackoff time.Duration
+
+	// MaxBackoff 等待時間的上限
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy 返回預設的重試策略：最多處理 4 次，等待 100ms、200ms、400ms
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+	}
+}
+
+// Backoff 返回第 attempt 次處理失敗後，下一次重試前的等待時間
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// Attempts 返回最多處理次數
+func (p RetryPolicy) Attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// DeadLetterSink 保存重試後仍然失敗的事件，之後可以由管理員檢查、重新發布或丟棄
+type DeadLetterSink interface {
+	SaveDeadLetter(ctx context.Context, letter storage.DeadLetter) error
+}
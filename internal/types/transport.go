@@ -0,0 +1,124 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoResponders Request 的主題沒有任何訂閱者
+	ErrNoResponders = errors.New("no responders available for request")
+
+	// ErrPermanent handler 返回包裝了 ErrPermanent 的錯誤時，消息不會被重新投遞
+	ErrPermanent = errors.New("permanent failure")
+)
+
+// HeaderMsgID 是消息的去重 ID (事件的 Envelope.ID)
+// JetStream 在 duplicate window 內會丟棄相同 ID 的消息，Subscriber 也會略過已經處理成功的 ID
+const HeaderMsgID = "Nats-Msg-Id"
+
+// Header 是消息的標頭，例如 payload 的 Content-Type
+type Header map[string][]string
+
+// Get 返回 key 的第一個值
+func (h Header) Get(key string) string {
+	if values := h[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Set 設置 key 的值，覆蓋原有的值
+func (h Header) Set(key, value string) {
+	h[key] = []string{value}
+}
+
+// Message 是與傳輸層無關的消息，handler 只依賴這個結構
+type Message struct {
+	Subject string
+	Reply   string // Request 的回覆主題，一般消息為空
+	Header  Header
+	Data    []byte
+
+	// Attempt 第幾次投遞這條消息，從 1 開始；傳輸層不追蹤投遞次數時為 0
+	Attempt int
+	// MaxAttempts 最多處理幾次，由 Subscriber 依 handler 的重試策略設置；不知道時為 0
+	MaxAttempts int
+
+	ctx context.Context
+}
+
+// Context 返回處理這條消息的 context，middleware 以此傳遞期限與取消
+// 沒有設置時返回 context.Background()
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// WithContext 返回帶有 ctx 的淺拷貝，原本的消息不變
+func (m *Message) WithContext(ctx context.Context) *Message {
+	copied := *m
+	copied.ctx = ctx
+	return &copied
+}
+
+// LastAttempt 這次處理失敗後是否不會再重試 (之後寫入死信)
+func (m *Message) LastAttempt() bool {
+	return m.MaxAttempts > 0 && m.Attempt >= m.MaxAttempts
+}
+
+// NewMessage 創建一個帶有空標頭的消息
+func NewMessage(subject string, data []byte) *Message {
+	return &Message{Subject: subject, Header: Header{}, Data: data}
+}
+
+// Subscription 是一個訂閱
+type Subscription interface {
+	Subject() string
+	Unsubscribe() error
+}
+
+// Transport 定義事件傳輸層 (NATS 或單機的 in-memory)
+// 同一個訂閱的回調依序執行，不同訂閱之間並發執行
+type Transport interface {
+	Publish(msg *Message) error
+	Subscribe(subject string, handler func(*Message)) (Subscription, error)
+	// QueueSubscribe 同一個 queue 內的訂閱者中，每條消息只會交給其中一個
+	QueueSubscribe(subject, queue string, handler func(*Message)) (Subscription, error)
+	// Request 發布消息並等待第一個回覆，沒有訂閱者時返回 ErrNoResponders
+	Request(ctx context.Context, msg *Message) (*Message, error)
+}
+
+// DurableTransport 是可以持久保存事件的傳輸層 (JetStream)
+type DurableTransport interface {
+	Transport
+
+	// Durable 是否已經啟用持久化
+	Durable() bool
+	// ConsumeDurable 以具名的持久 consumer 消費主題，同名 consumer 在多個實例之間分攤消息，
+	// 停機期間的事件在重新啟動後補上。handler 處理完成後以結果呼叫 ack (可以在其他 goroutine 非同步呼叫)，
+	// 錯誤時重新投遞
+	ConsumeDurable(durable, subject string, handler func(msg *Message, ack func(error))) (Subscription, error)
+	// Replay 依序讀出主題在 since 之後保存的消息
+	Replay(ctx context.Context, subject string, since time.Time, fn func(*Message) error) error
+}
+
+// SubjectMatches 判斷主題是否符合含有 * 或 > 的 pattern
+func SubjectMatches(pattern, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}